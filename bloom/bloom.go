@@ -0,0 +1,111 @@
+package bloom
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// Filter Bloom filter over strings, the words changed since the last
+// Delta are tracked so the filter can be shipped incrementally
+type Filter struct {
+	k     int
+	words []uint64
+	dirty map[int]bool // word index -> changed since the last Delta
+}
+
+// New filter sized for n keys at the false positive rate p
+func New(n int, p float64) *Filter {
+	if n <= 0 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := int(math.Round(m / float64(n) * math.Ln2))
+	return FromWords(max(k, 1), make([]uint64, int(math.Ceil(m/64))))
+}
+
+// FromWords filter received from another node
+func FromWords(k int, words []uint64) *Filter {
+	return &Filter{k: k, words: words, dirty: make(map[int]bool)}
+}
+
+// K hash functions
+func (f *Filter) K() int {
+	return f.k
+}
+
+// Words the bit array, shared with the filter
+func (f *Filter) Words() []uint64 {
+	return f.words
+}
+
+// Bits size of the bit array
+func (f *Filter) Bits() uint64 {
+	return uint64(len(f.words)) * 64
+}
+
+// locations double hashing, h1 + i*h2
+func (f *Filter) locations(key string) []uint64 {
+	ha, hb := fnv.New64a(), fnv.New64()
+	_, _ = ha.Write([]byte(key))
+	_, _ = hb.Write([]byte(key))
+	h1, h2 := ha.Sum64(), hb.Sum64()|1
+	locs := make([]uint64, f.k)
+	for i := range locs {
+		locs[i] = (h1 + uint64(i)*h2) % f.Bits()
+	}
+	return locs
+}
+
+// Add the key, marking the changed words
+func (f *Filter) Add(key string) {
+	for _, loc := range f.locations(key) {
+		w, bit := int(loc/64), uint64(1)<<(loc%64)
+		if f.words[w]&bit == 0 {
+			f.words[w] |= bit
+			f.dirty[w] = true
+		}
+	}
+}
+
+// Test whether the key may have been added, never false for an added key
+func (f *Filter) Test(key string) bool {
+	if len(f.words) == 0 {
+		return false
+	}
+	for _, loc := range f.locations(key) {
+		if f.words[loc/64]&(uint64(1)<<(loc%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Delta the words changed since the last call, nil when unchanged
+func (f *Filter) Delta() map[int]uint64 {
+	if len(f.dirty) == 0 {
+		return nil
+	}
+	delta := make(map[int]uint64, len(f.dirty))
+	for w := range f.dirty {
+		delta[w] = f.words[w]
+	}
+	f.dirty = make(map[int]bool)
+	return delta
+}
+
+// Apply the delta of the remote filter
+func (f *Filter) Apply(delta map[int]uint64) {
+	for w, bits := range delta {
+		if w >= 0 && w < len(f.words) {
+			f.words[w] |= bits
+		}
+	}
+}
+
+// FalsePositiveRate expected with n keys added
+func (f *Filter) FalsePositiveRate(n int) float64 {
+	return math.Pow(1-math.Exp(-float64(f.k)*float64(n)/float64(f.Bits())), float64(f.k))
+}
@@ -0,0 +1,45 @@
+package bloom
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	f := New(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		f.Add(fmt.Sprintf("key-%d", i))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.True(t, f.Test(fmt.Sprintf("key-%d", i)))
+	}
+	fp := 0
+	for i := 0; i < 10000; i++ {
+		if f.Test(fmt.Sprintf("other-%d", i)) {
+			fp++
+		}
+	}
+	assert.Less(t, float64(fp)/10000, 0.02)
+	assert.InDelta(t, 0.01, f.FalsePositiveRate(1000), 0.002)
+}
+
+func TestFilter_Delta(t *testing.T) {
+	f := New(100, 0.01)
+	f.Add("a")
+	remote := FromWords(f.K(), append([]uint64(nil), f.Words()...))
+	assert.NotEmpty(t, f.Delta())
+	assert.Nil(t, f.Delta())
+
+	// only the changed words are shipped
+	f.Add("b")
+	delta := f.Delta()
+	assert.LessOrEqual(t, len(delta), f.K())
+	assert.False(t, remote.Test("b"))
+	remote.Apply(delta)
+	assert.True(t, remote.Test("a"))
+	assert.True(t, remote.Test("b"))
+	assert.Equal(t, f.Words(), remote.Words())
+
+	assert.False(t, FromWords(3, nil).Test("a"))
+}
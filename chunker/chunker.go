@@ -0,0 +1,128 @@
+package chunker
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math/bits"
+)
+
+const (
+	DefaultMinSize = 2 << 10
+	DefaultAvgSize = 8 << 10
+	DefaultMaxSize = 64 << 10
+	// normalization level, the mask before the average size has this many
+	// more bits & the one after as many less, chunk sizes gather around Avg
+	normalization = 2
+)
+
+// Config chunk size bounds, zero fields take the defaults
+type Config struct {
+	Min int
+	Avg int
+	Max int
+}
+
+// gear random value of every byte, fixed so every node cuts alike
+var gear [256]uint64
+
+func init() {
+	// splitmix64
+	x := uint64(0x2545f4914f6cdd1d)
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+func (c Config) withDefaults() Config {
+	if c.Min <= 0 {
+		c.Min = DefaultMinSize
+	}
+	if c.Avg <= 0 {
+		c.Avg = DefaultAvgSize
+	}
+	if c.Max <= 0 {
+		c.Max = DefaultMaxSize
+	}
+	c.Avg = max(c.Avg, c.Min)
+	c.Max = max(c.Max, c.Avg)
+	return c
+}
+
+// masks of the gear hash before & after the average size
+func (c Config) masks() (uint64, uint64) {
+	b := bits.Len(uint(c.Avg)) - 1
+	small := uint64(1)<<min(b+normalization, 63) - 1
+	large := uint64(1)<<max(b-normalization, 1) - 1
+	// spread the bits over the high part of the hash
+	return small << (64 - min(b+normalization, 63)), large << (64 - max(b-normalization, 1))
+}
+
+// Cut length of the first chunk of data (FastCDC), data holding fewer than
+// Max bytes is the tail of the stream
+func (c Config) Cut(data []byte) int {
+	c = c.withDefaults()
+	n := len(data)
+	if n <= c.Min {
+		return n
+	}
+	n = min(n, c.Max)
+	normal := min(c.Avg, n)
+	maskS, maskL := c.masks()
+
+	var fp uint64
+	i := c.Min
+	for ; i < normal; i++ {
+		fp = fp<<1 + gear[data[i]]
+		if fp&maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = fp<<1 + gear[data[i]]
+		if fp&maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// Split the data into content-defined chunks, sharing its memory
+func (c Config) Split(data []byte) [][]byte {
+	var chunks [][]byte
+	for len(data) > 0 {
+		n := c.Cut(data)
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
+
+// Chunker cut a stream into content-defined chunks
+type Chunker struct {
+	cfg Config
+	r   *bufio.Reader
+}
+
+func New(r io.Reader, cfg Config) *Chunker {
+	cfg = cfg.withDefaults()
+	return &Chunker{cfg: cfg, r: bufio.NewReaderSize(r, cfg.Max)}
+}
+
+// Next chunk of the stream, owned by the caller, io.EOF at the end
+func (c *Chunker) Next() ([]byte, error) {
+	buf, err := c.r.Peek(c.cfg.Max)
+	if len(buf) == 0 {
+		return nil, err
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	chunk := make([]byte, c.cfg.Cut(buf))
+	_, err = io.ReadFull(c.r, chunk)
+	return chunk, err
+}
@@ -0,0 +1,88 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(n int, seed int64) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func TestSplit(t *testing.T) {
+	cfg := Config{}.withDefaults()
+	data := randomBytes(1<<20, 1)
+	chunks := cfg.Split(data)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("chunks do not rebuild the data")
+	}
+	for i, c := range chunks {
+		if len(c) > cfg.Max || (len(c) < cfg.Min && i != len(chunks)-1) {
+			t.Errorf("chunk %d sized %d out of [%d, %d]", i, len(c), cfg.Min, cfg.Max)
+		}
+	}
+	avg := len(data) / len(chunks)
+	if avg < cfg.Avg/2 || avg > cfg.Avg*2 {
+		t.Errorf("average chunk %d far from %d", avg, cfg.Avg)
+	}
+
+	// the stream chunker cuts alike
+	var streamed [][]byte
+	c := New(bytes.NewReader(data), Config{})
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		streamed = append(streamed, chunk)
+	}
+	if len(streamed) != len(chunks) {
+		t.Fatalf("stream cut %d chunks, want %d", len(streamed), len(chunks))
+	}
+	for i := range chunks {
+		if !bytes.Equal(streamed[i], chunks[i]) {
+			t.Fatalf("chunk %d differs", i)
+		}
+	}
+}
+
+func TestSplit_Edit(t *testing.T) {
+	data := randomBytes(1<<20, 2)
+	edited := append(append(append([]byte(nil), data[:1000]...), []byte("inserted bytes")...), data[1000:]...)
+
+	hashes := func(chunks [][]byte) map[[32]byte]bool {
+		m := make(map[[32]byte]bool)
+		for _, c := range chunks {
+			m[sha256.Sum256(c)] = true
+		}
+		return m
+	}
+	before, after := hashes(Config{}.Split(data)), hashes(Config{}.Split(edited))
+	shared := 0
+	for h := range after {
+		if before[h] {
+			shared++
+		}
+	}
+	// only the chunks around the edit change
+	if len(after)-shared > 3 {
+		t.Errorf("%d of %d chunks changed after a small insert", len(after)-shared, len(after))
+	}
+}
+
+func TestCut_Small(t *testing.T) {
+	if n := (Config{}).Cut([]byte("tiny")); n != 4 {
+		t.Errorf("small data is a single chunk, got %d", n)
+	}
+	if chunks := (Config{}).Split(nil); len(chunks) != 0 {
+		t.Errorf("no chunk for empty data, got %d", len(chunks))
+	}
+}
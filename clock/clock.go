@@ -0,0 +1,132 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Ordering result of comparing two vector clocks
+type Ordering int
+
+const (
+	Equal      Ordering = iota
+	Before              // happened before the other
+	After               // happened after the other
+	Concurrent          // neither saw the other
+)
+
+func (o Ordering) String() string {
+	switch o {
+	case Before:
+		return "before"
+	case After:
+		return "after"
+	case Concurrent:
+		return "concurrent"
+	}
+	return "equal"
+}
+
+// VClock vector clock, node ID -> latest timestamp of the node seen,
+// the timestamps come from the node's HLC so they only grow
+type VClock map[string]int64
+
+// Copy deep copy
+func (vc VClock) Copy() VClock {
+	c := make(VClock, len(vc))
+	for node, ts := range vc {
+		c[node] = ts
+	}
+	return c
+}
+
+// Merge the element-wise maximum of both clocks
+func (vc VClock) Merge(other VClock) VClock {
+	m := vc.Copy()
+	for node, ts := range other {
+		if ts > m[node] {
+			m[node] = ts
+		}
+	}
+	return m
+}
+
+// Compare the causal order of vc against other
+func (vc VClock) Compare(other VClock) Ordering {
+	var less, greater bool
+	for node, ts := range vc {
+		if ts > other[node] {
+			greater = true
+		} else if ts < other[node] {
+			less = true
+		}
+	}
+	for node, ts := range other {
+		if _, ok := vc[node]; !ok && ts > 0 {
+			less = true
+		}
+	}
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	}
+	return Equal
+}
+
+// Descends vc had seen every event of other
+func (vc VClock) Descends(other VClock) bool {
+	o := vc.Compare(other)
+	return o == After || o == Equal
+}
+
+// Max the largest timestamp of the clock
+func (vc VClock) Max() int64 {
+	var m int64
+	for _, ts := range vc {
+		m = max(m, ts)
+	}
+	return m
+}
+
+// Nodes sorted node IDs of the clock
+func (vc VClock) Nodes() []string {
+	nodes := make([]string, 0, len(vc))
+	for node := range vc {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// HLC hybrid logical clock packed into unix nanoseconds, it follows the
+// wall clock but never goes backwards and stays ahead of every
+// timestamp observed from other nodes
+type HLC struct {
+	mu   sync.Mutex
+	last int64
+	now  func() time.Time
+}
+
+func NewHLC() *HLC {
+	return &HLC{now: time.Now}
+}
+
+// Now next timestamp, strictly greater than any issued or observed before
+func (c *HLC) Now() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last = max(c.now().UnixNano(), c.last+1)
+	return c.last
+}
+
+// Observe a remote timestamp, the next ones are issued after it
+func (c *HLC) Observe(ts int64) {
+	c.mu.Lock()
+	c.last = max(c.last, ts)
+	c.mu.Unlock()
+}
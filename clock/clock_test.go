@@ -0,0 +1,35 @@
+package clock
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestVClock_Compare(t *testing.T) {
+	a := VClock{"n1": 1}
+	b := a.Merge(VClock{"n2": 1})
+	c := VClock{"n1": 1, "n3": 1}
+
+	assert.Equal(t, Equal, a.Compare(a.Copy()))
+	assert.Equal(t, Before, a.Compare(b))
+	assert.Equal(t, After, b.Compare(a))
+	assert.Equal(t, Concurrent, b.Compare(c))
+	assert.Equal(t, After, a.Compare(nil))
+	assert.True(t, b.Merge(c).Descends(b))
+	assert.True(t, b.Merge(c).Descends(c))
+	assert.Equal(t, []string{"n1", "n2", "n3"}, b.Merge(c).Nodes())
+}
+
+func TestHLC(t *testing.T) {
+	frozen := time.Unix(100, 0)
+	c := &HLC{now: func() time.Time { return frozen }}
+
+	// the wall clock does not move, timestamps still grow
+	first := c.Now()
+	assert.Equal(t, first+1, c.Now())
+
+	// a remote clock ahead pushes the local one
+	c.Observe(first + 1000)
+	assert.Equal(t, first+1001, c.Now())
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/server"
+	"github.com/roylic/go-distributed-file-storage/storage"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// runCommand dispatch the sub-commands of the fs binary
+func runCommand(args []string) error {
+	switch {
+	case len(args) >= 2 && args[0] == "index" && args[1] == "rebuild":
+		return indexRebuild(args[2:])
+	case len(args) >= 2 && args[0] == "node" && args[1] == "drain":
+		return nodeDrain(args[2:])
+	case len(args) >= 2 && args[0] == "node" && args[1] == "undrain":
+		return nodeUndrain(args[2:])
+	}
+	return fmt.Errorf("unknown command %v, usage:\n"+
+		"  fs index rebuild -root <storage root>\n"+
+		"  fs node drain -admin <admin addr> <node id>\n"+
+		"  fs node undrain -admin <admin addr> <node id>", args)
+}
+
+// indexRebuild rebuild the metadata index from the sidecars on disk
+func indexRebuild(args []string) error {
+	fs := flag.NewFlagSet("index rebuild", flag.ContinueOnError)
+	root := fs.String("root", storage.DefaultRoot, "storage root of the node")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	// a running node appends to & compacts the same index
+	store, err := storage.OpenStore(storage.StorageOpt{
+		Root:              *root,
+		PathTransformFunc: storage.CASPathTransformFunc,
+	})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	n, err := store.RebuildIndex()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("index rebuilt under %s, %d objects indexed\n", *root, n)
+	return nil
+}
+
+// nodeDrain ask the node (by its listen address) to drain, through the
+// admin API of any node, then wait until it can be shut down
+func nodeDrain(args []string) error {
+	fs := flag.NewFlagSet("node drain", flag.ContinueOnError)
+	admin := fs.String("admin", "localhost:8999", "admin API address of a node in the cluster")
+	wait := fs.Bool("wait", true, "wait until the node is drained")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: fs node drain -admin <admin addr> <node id>")
+	}
+	node := fs.Arg(0)
+	endpoint := fmt.Sprintf("http://%s/nodes/%s/drain", *admin, url.PathEscape(node))
+
+	status, err := drainRequest(http.MethodPost, endpoint)
+	if err != nil {
+		return err
+	}
+	for *wait && status.State != server.NodeDrained {
+		fmt.Printf("node %s %s, confirmed %d/%d objects\n",
+			node, status.State, status.Confirmed, status.Objects)
+		time.Sleep(time.Second)
+		if status, err = drainRequest(http.MethodGet, endpoint); err != nil {
+			return err
+		}
+	}
+	if status.State == server.NodeDrained {
+		fmt.Printf("node %s is drained and can be shut down safely\n", node)
+	}
+	return nil
+}
+
+// nodeUndrain put a leaving or drained node back in service, through the
+// admin API of any node
+func nodeUndrain(args []string) error {
+	fs := flag.NewFlagSet("node undrain", flag.ContinueOnError)
+	admin := fs.String("admin", "localhost:8999", "admin API address of a node in the cluster")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: fs node undrain -admin <admin addr> <node id>")
+	}
+	node := fs.Arg(0)
+	endpoint := fmt.Sprintf("http://%s/nodes/%s/drain", *admin, url.PathEscape(node))
+	if _, err := drainRequest(http.MethodDelete, endpoint); err != nil {
+		return err
+	}
+	fmt.Printf("node %s is back in service\n", node)
+	return nil
+}
+
+// drainRequest call the drain endpoint of the admin API
+func drainRequest(method string, endpoint string) (*server.DrainStatus, error) {
+	req, err := http.NewRequest(method, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var msg [512]byte
+		n, _ := resp.Body.Read(msg[:])
+		return nil, fmt.Errorf("%s %s: %s", method, endpoint, msg[:n])
+	}
+	status := new(server.DrainStatus)
+	return status, json.NewDecoder(resp.Body).Decode(status)
+}
@@ -73,6 +73,54 @@ func CopyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 		cipherBlock.BlockSize(), src, dst)
 }
 
+// newCTRAt CTR stream positioned at the byte offset of the stream started
+// with the IV, the counter block is advanced instead of generating the
+// keystream of the skipped bytes
+func newCTRAt(block cipher.Block, iv []byte, offset int64) cipher.Stream {
+	counter := make([]byte, len(iv))
+	copy(counter, iv)
+	// counter += offset / blockSize (big endian)
+	carry := uint64(offset) / uint64(block.BlockSize())
+	for i := len(counter) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(counter[i]) + carry&0xff
+		counter[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	stream := cipher.NewCTR(block, counter)
+	if skip := int(offset % int64(block.BlockSize())); skip > 0 {
+		pad := make([]byte, skip)
+		stream.XORKeyStream(pad, pad)
+	}
+	return stream
+}
+
+// CopyEncryptAt encrypt src as the bytes at the offset of the stream
+// started with the IV, the IV is not written
+func CopyEncryptAt(key []byte, iv []byte, offset int64, src io.Reader, dst io.Writer) (int, error) {
+	cipherBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return 0, err
+	}
+	return copyStream(newCTRAt(cipherBlock, iv, offset), 0, src, dst)
+}
+
+// CopyDecryptAt decrypt src, the bytes at the offset of the stream started
+// with the IV. CTR is symmetric
+func CopyDecryptAt(key []byte, iv []byte, offset int64, src io.Reader, dst io.Writer) (int, error) {
+	return CopyEncryptAt(key, iv, offset, src, dst)
+}
+
+// DecryptRange decrypt length bytes at the offset of the plain content
+// from the output of CopyEncrypt, reading only the IV & the range
+func DecryptRange(key []byte, src io.ReaderAt, offset int64, length int64, dst io.Writer) (int, error) {
+	iv := make([]byte, aes.BlockSize)
+	if _, err := src.ReadAt(iv, 0); err != nil {
+		return 0, err
+	}
+	r := io.NewSectionReader(src, int64(len(iv))+offset, length)
+	return CopyDecryptAt(key, iv, offset, r, dst)
+}
+
 func copyStream(stream cipher.Stream, blockSize int, src io.Reader, dst io.Writer) (int, error) {
 	var (
 		buf = make([]byte, 32*1024)
@@ -38,3 +38,50 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 	}
 
 }
+
+func TestDecryptRange(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef-"), 1000)
+	key := NewAesKey()
+	enc := new(bytes.Buffer)
+	if _, err := CopyEncrypt(key, bytes.NewReader(payload), enc); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range [][2]int64{{0, 10}, {5, 100}, {16, 16}, {1000, 4000}, {int64(len(payload)) - 3, 3}} {
+		out := new(bytes.Buffer)
+		if _, err := DecryptRange(key, bytes.NewReader(enc.Bytes()), r[0], r[1], out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), payload[r[0]:r[0]+r[1]]) {
+			t.Errorf("range %v decrypted wrong", r)
+		}
+	}
+
+	// a range encrypted at its offset decrypts with the stream of the object
+	iv := enc.Bytes()[:16]
+	part := new(bytes.Buffer)
+	if _, err := CopyEncryptAt(key, iv, 777, bytes.NewReader(payload[777:900]), part); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(part.Bytes(), enc.Bytes()[16+777:16+900]) {
+		t.Error("range encrypted at its offset differs from the object stream")
+	}
+}
+
+func TestCTRCounterCarry(t *testing.T) {
+	key := NewAesKey()
+	iv := bytes.Repeat([]byte{0xff}, 16)
+	iv[0] = 0
+	payload := bytes.Repeat([]byte("x"), 4096)
+	enc := new(bytes.Buffer)
+	if _, err := CopyEncryptAt(key, iv, 0, bytes.NewReader(payload), enc); err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	if _, err := CopyDecryptAt(key, iv, 3000, bytes.NewReader(enc.Bytes()[3000:]), out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), payload[3000:]) {
+		t.Error("counter carry across bytes")
+	}
+}
@@ -0,0 +1,150 @@
+package dag
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DefaultFanout links per node of the DAG
+const DefaultFanout = 64
+
+// codecs, a raw block is a chunk of the content, a node links the blocks
+// below it
+const (
+	CodecRaw = "raw"
+	CodecDAG = "dag"
+)
+
+// ErrHashMismatch the block is not the one addressed by the CID
+var ErrHashMismatch = errors.New("block does not match its CID")
+
+// CID content identifier of a block, "<codec>:<sha256 hex>"
+type CID string
+
+// NewCID address the block of the codec
+func NewCID(codec string, block []byte) CID {
+	sum := sha256.Sum256(block)
+	return CID(codec + ":" + hex.EncodeToString(sum[:]))
+}
+
+// Parse check the format of the CID
+func Parse(s string) (CID, error) {
+	codec, hash, ok := strings.Cut(s, ":")
+	if !ok || (codec != CodecRaw && codec != CodecDAG) {
+		return "", fmt.Errorf("invalid CID (%s)", s)
+	}
+	if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid CID (%s)", s)
+	}
+	return CID(s), nil
+}
+
+// Codec of the block
+func (c CID) Codec() string {
+	codec, _, _ := strings.Cut(string(c), ":")
+	return codec
+}
+
+// Hash sha256 hex of the block
+func (c CID) Hash() string {
+	_, hash, _ := strings.Cut(string(c), ":")
+	return hash
+}
+
+func (c CID) String() string {
+	return string(c)
+}
+
+// Verify the block is the one addressed by the CID
+func (c CID) Verify(block []byte) error {
+	if NewCID(c.Codec(), block) != c {
+		return fmt.Errorf("%w: %s", ErrHashMismatch, c)
+	}
+	return nil
+}
+
+// Link child of a node, Size is the content below it
+type Link struct {
+	CID  CID
+	Size int64
+}
+
+// Node inner block of the DAG, its children in content order
+type Node struct {
+	Links []Link
+}
+
+// Size of the content below the node
+func (n Node) Size() int64 {
+	var size int64
+	for _, l := range n.Links {
+		size += l.Size
+	}
+	return size
+}
+
+// Encode the node as its block, the CID is taken over these bytes
+func (n Node) Encode() []byte {
+	b, _ := json.Marshal(n)
+	return b
+}
+
+// Decode a block of the dag codec, verified against the CID
+func Decode(c CID, block []byte) (Node, error) {
+	var n Node
+	if c.Codec() != CodecDAG {
+		return n, fmt.Errorf("(%s) is not a node", c)
+	}
+	if err := c.Verify(block); err != nil {
+		return n, err
+	}
+	return n, json.Unmarshal(block, &n)
+}
+
+// Build the DAG over the chunks of the content: the chunks are the raw
+// leaves, grouped by fanout into nodes until a single root is left. The
+// root of a single chunk is the chunk itself. The blocks of the inner
+// nodes are returned, the leaves are the chunks
+func Build(chunks [][]byte, fanout int) (CID, map[CID][]byte) {
+	leaves := make([]Link, len(chunks))
+	for i, c := range chunks {
+		leaves[i] = LeafLink(c)
+	}
+	return BuildLinks(leaves, fanout)
+}
+
+// LeafLink link of the raw leaf of the chunk
+func LeafLink(chunk []byte) Link {
+	return Link{CID: NewCID(CodecRaw, chunk), Size: int64(len(chunk))}
+}
+
+// BuildLinks same as Build over the links of the leaves, the chunks are
+// not needed anymore
+func BuildLinks(leaves []Link, fanout int) (CID, map[CID][]byte) {
+	if fanout < 2 {
+		fanout = DefaultFanout
+	}
+	nodes := make(map[CID][]byte)
+	level := leaves
+	if len(level) == 1 {
+		return level[0].CID, nodes
+	}
+	for {
+		var next []Link
+		for i := 0; i < len(level) || i == 0; i += fanout {
+			n := Node{Links: level[i:min(i+fanout, len(level))]}
+			block := n.Encode()
+			c := NewCID(CodecDAG, block)
+			nodes[c] = block
+			next = append(next, Link{CID: c, Size: n.Size()})
+		}
+		if len(next) == 1 {
+			return next[0].CID, nodes
+		}
+		level = next
+	}
+}
@@ -0,0 +1,92 @@
+package dag
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// walk the DAG in content order, as a reader fetching its blocks would
+func walk(t *testing.T, c CID, nodes map[CID][]byte, chunks map[CID][]byte, out *bytes.Buffer) {
+	if c.Codec() == CodecRaw {
+		block := chunks[c]
+		if err := c.Verify(block); err != nil {
+			t.Fatal(err)
+		}
+		out.Write(block)
+		return
+	}
+	n, err := Decode(c, nodes[c])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range n.Links {
+		walk(t, l.CID, nodes, chunks, out)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	var (
+		chunks  [][]byte
+		content []byte
+		leaves  = make(map[CID][]byte)
+	)
+	for i := 0; i < 100; i++ {
+		c := bytes.Repeat([]byte{byte(i)}, 100+i)
+		chunks = append(chunks, c)
+		content = append(content, c...)
+		leaves[NewCID(CodecRaw, c)] = c
+	}
+	root, nodes := Build(chunks, 8)
+	if root.Codec() != CodecDAG {
+		t.Fatalf("root of several chunks is a node, got %s", root)
+	}
+	// 100 leaves, 13 nodes, 2 nodes, root
+	if len(nodes) != 16 {
+		t.Errorf("want 16 nodes, got %d", len(nodes))
+	}
+	out := new(bytes.Buffer)
+	walk(t, root, nodes, leaves, out)
+	if !bytes.Equal(out.Bytes(), content) {
+		t.Error("walk does not rebuild the content")
+	}
+
+	// same content, same CID
+	if again, _ := Build(chunks, 8); again != root {
+		t.Error("CID is not deterministic")
+	}
+	// any change changes the root
+	chunks[50] = []byte("changed")
+	if changed, _ := Build(chunks, 8); changed == root {
+		t.Error("changed content kept the CID")
+	}
+}
+
+func TestBuild_Small(t *testing.T) {
+	root, nodes := Build([][]byte{[]byte("tiny")}, 0)
+	if root != NewCID(CodecRaw, []byte("tiny")) || len(nodes) != 0 {
+		t.Errorf("single chunk is its own root, got %s & %d nodes", root, len(nodes))
+	}
+	root, nodes = Build(nil, 0)
+	if root.Codec() != CodecDAG || len(nodes) != 1 {
+		t.Errorf("empty content is an empty node, got %s", root)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	c := NewCID(CodecRaw, []byte("block"))
+	if err := c.Verify([]byte("block")); err != nil {
+		t.Error(err)
+	}
+	if err := c.Verify([]byte("tampered")); !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("want ErrHashMismatch, got %v", err)
+	}
+	if _, err := Parse(string(c)); err != nil {
+		t.Error(err)
+	}
+	for _, s := range []string{"", "raw:zz", "foo:" + c.Hash(), c.Hash()} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("(%s) parsed", s)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package dht
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Kind of a request
+type Kind int
+
+const (
+	KindPing           Kind = iota
+	KindFindNode            // the contacts closest to Target
+	KindFindValue           // the providers of Target, or the closest contacts
+	KindAddProvider         // the sender holds Target
+	KindRemoveProvider      // the sender no longer holds Target
+)
+
+// Request sent to a node, answered by a Response
+type Request struct {
+	Kind   Kind
+	From   string // listen address of the sender, added to the routing table
+	Target ID
+}
+
+// Response contacts & providers are listen addresses
+type Response struct {
+	Contacts  []string
+	Providers []string
+}
+
+// Transport deliver the request to the node & wait for its response
+type Transport interface {
+	Call(to string, req Request) (Response, error)
+}
+
+const (
+	DefaultK               = 20 // bucket size, also the nodes storing a provider record
+	DefaultAlpha           = 3  // parallel requests of a lookup
+	DefaultProviderTTL     = 24 * time.Hour
+	DefaultRefreshInterval = time.Hour
+)
+
+// Config of the DHT, zero values take the defaults
+type Config struct {
+	K               int
+	Alpha           int
+	ProviderTTL     time.Duration // provider records not announced again are dropped
+	RefreshInterval time.Duration // the neighbourhood of self is looked up again
+}
+
+// DHT Kademlia overlay: the nodes closest by XOR distance to a key keep
+// the provider records of the key, lookups go iteratively to closer
+// nodes, about log(n) hops
+type DHT struct {
+	self      Contact
+	cfg       Config
+	transport Transport
+	table     *RoutingTable
+
+	mu        sync.Mutex
+	providers map[ID]map[string]time.Time // key -> provider -> expires at
+
+	quitCh   chan struct{}
+	stopOnce sync.Once
+}
+
+func New(addr string, transport Transport, cfg Config) *DHT {
+	if cfg.K <= 0 {
+		cfg.K = DefaultK
+	}
+	if cfg.Alpha <= 0 {
+		cfg.Alpha = DefaultAlpha
+	}
+	if cfg.ProviderTTL <= 0 {
+		cfg.ProviderTTL = DefaultProviderTTL
+	}
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = DefaultRefreshInterval
+	}
+	self := NewContact(addr)
+	return &DHT{
+		self:      self,
+		cfg:       cfg,
+		transport: transport,
+		table:     NewRoutingTable(self.ID, cfg.K),
+		providers: make(map[ID]map[string]time.Time),
+		quitCh:    make(chan struct{}),
+	}
+}
+
+func (d *DHT) Self() Contact {
+	return d.self
+}
+
+// Len contacts in the routing table
+func (d *DHT) Len() int {
+	return d.table.Len()
+}
+
+func (d *DHT) Start() {
+	go d.loop()
+}
+
+func (d *DHT) Stop() {
+	d.stopOnce.Do(func() { close(d.quitCh) })
+}
+
+// loop drop the expired provider records & refresh the neighbourhood
+func (d *DHT) loop() {
+	ticker := time.NewTicker(d.cfg.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.quitCh:
+			return
+		}
+		d.expire()
+		d.FindNode(d.self.ID)
+	}
+}
+
+// Bootstrap add the seeds, then look up self so the nodes close to
+// self learn about it & fill the routing table
+func (d *DHT) Bootstrap(seeds ...string) {
+	for _, addr := range seeds {
+		d.AddContact(addr)
+	}
+	d.FindNode(d.self.ID)
+}
+
+// AddContact a node was seen, when its bucket is full the least recently
+// seen contact is pinged and evicted only if it does not answer
+func (d *DHT) AddContact(addr string) {
+	if len(addr) == 0 || addr == d.self.Addr {
+		return
+	}
+	c := NewContact(addr)
+	oldest, full := d.table.Update(c)
+	if !full {
+		return
+	}
+	go func() {
+		if _, err := d.transport.Call(oldest.Addr, Request{Kind: KindPing, From: d.self.Addr}); err != nil {
+			d.table.Replace(oldest, c)
+			return
+		}
+		d.table.Update(oldest)
+	}()
+}
+
+// RemoveContact the node is gone, its provider records with it
+func (d *DHT) RemoveContact(addr string) {
+	d.table.Remove(HashID(addr))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key := range d.providers {
+		d.dropProvider(key, addr)
+	}
+}
+
+// Handle answer a request of another node, it never waits on the network
+func (d *DHT) Handle(req Request) Response {
+	d.AddContact(req.From)
+	switch req.Kind {
+	case KindFindNode:
+		return Response{Contacts: d.closest(req.Target)}
+	case KindFindValue:
+		return Response{Contacts: d.closest(req.Target), Providers: d.Providers(req.Target)}
+	case KindAddProvider:
+		d.addProvider(req.Target, req.From)
+	case KindRemoveProvider:
+		d.removeProvider(req.Target, req.From)
+	}
+	return Response{}
+}
+
+// closest addresses of the K contacts closest to the target
+func (d *DHT) closest(target ID) []string {
+	var addrs []string
+	for _, c := range d.table.Closest(target, d.cfg.K) {
+		addrs = append(addrs, c.Addr)
+	}
+	return addrs
+}
+
+// FindNode iterative lookup of the K nodes closest to the target
+func (d *DHT) FindNode(target ID) []Contact {
+	closest, _ := d.lookup(target, KindFindNode)
+	return closest
+}
+
+// FindProviders the nodes holding the key, the local records first,
+// then an iterative lookup stopping at the first node knowing providers
+func (d *DHT) FindProviders(key ID) []string {
+	if providers := d.Providers(key); len(providers) > 0 {
+		return providers
+	}
+	_, providers := d.lookup(key, KindFindValue)
+	return providers
+}
+
+// Provide announce self as a provider of the key to the K closest nodes
+func (d *DHT) Provide(key ID) error {
+	d.addProvider(key, d.self.Addr)
+	closest := d.FindNode(key)
+	if len(closest) == 0 {
+		return nil
+	}
+	errs := make(chan error, len(closest))
+	for _, c := range closest {
+		go func(c Contact) {
+			_, err := d.transport.Call(c.Addr, Request{Kind: KindAddProvider, From: d.self.Addr, Target: key})
+			errs <- err
+		}(c)
+	}
+	var lastErr error
+	stored := 0
+	for range closest {
+		if err := <-errs; err != nil {
+			lastErr = err
+			continue
+		}
+		stored++
+	}
+	if stored == 0 {
+		return fmt.Errorf("provider record of %s not stored: %w", key, lastErr)
+	}
+	return nil
+}
+
+// Unprovide withdraw self as a provider of the key from the K closest
+// nodes, the nodes not reached drop the record when it expires
+func (d *DHT) Unprovide(key ID) error {
+	d.removeProvider(key, d.self.Addr)
+	closest := d.FindNode(key)
+	errs := make(chan error, len(closest))
+	for _, c := range closest {
+		go func(c Contact) {
+			_, err := d.transport.Call(c.Addr, Request{Kind: KindRemoveProvider, From: d.self.Addr, Target: key})
+			errs <- err
+		}(c)
+	}
+	var lastErr error
+	for range closest {
+		if err := <-errs; err != nil {
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return fmt.Errorf("provider record of %s not withdrawn everywhere: %w", key, lastErr)
+	}
+	return nil
+}
+
+// Providers the local records of the key, not expired
+func (d *DHT) Providers(key ID) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var addrs []string
+	for addr, expires := range d.providers[key] {
+		if time.Now().Before(expires) {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (d *DHT) addProvider(key ID, addr string) {
+	if len(addr) == 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.providers[key] == nil {
+		d.providers[key] = make(map[string]time.Time)
+	}
+	d.providers[key][addr] = time.Now().Add(d.cfg.ProviderTTL)
+}
+
+func (d *DHT) removeProvider(key ID, addr string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dropProvider(key, addr)
+}
+
+// dropProvider caller holds the lock
+func (d *DHT) dropProvider(key ID, addr string) {
+	delete(d.providers[key], addr)
+	if len(d.providers[key]) == 0 {
+		delete(d.providers, key)
+	}
+}
+
+// expire drop the provider records not announced again
+func (d *DHT) expire() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	for key, providers := range d.providers {
+		for addr, expires := range providers {
+			if now.After(expires) {
+				delete(providers, addr)
+			}
+		}
+		if len(providers) == 0 {
+			delete(d.providers, key)
+		}
+	}
+}
+
+// lookup query Alpha of the K closest nodes not queried yet, in rounds,
+// until the K closest answering nodes were all queried. FIND_VALUE stops
+// at the first round returning providers
+func (d *DHT) lookup(target ID, kind Kind) (closest []Contact, providers []string) {
+	shortlist := d.table.Closest(target, d.cfg.K)
+	seen := map[string]bool{d.self.Addr: true}
+	for _, c := range shortlist {
+		seen[c.Addr] = true
+	}
+	queried := make(map[string]bool)
+	failed := make(map[string]bool)
+	found := make(map[string]bool)
+
+	type answer struct {
+		c    Contact
+		resp Response
+		err  error
+	}
+	for {
+		// the next Alpha among the K closest still answering
+		var batch []Contact
+		n := 0
+		for _, c := range shortlist {
+			if failed[c.Addr] {
+				continue
+			}
+			if n++; n > d.cfg.K {
+				break
+			}
+			if !queried[c.Addr] {
+				batch = append(batch, c)
+				if len(batch) == d.cfg.Alpha {
+					break
+				}
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		answers := make(chan answer, len(batch))
+		for _, c := range batch {
+			queried[c.Addr] = true
+			go func(c Contact) {
+				resp, err := d.transport.Call(c.Addr, Request{Kind: kind, From: d.self.Addr, Target: target})
+				answers <- answer{c: c, resp: resp, err: err}
+			}(c)
+		}
+		for range batch {
+			a := <-answers
+			if a.err != nil {
+				failed[a.c.Addr] = true
+				d.table.Remove(a.c.ID)
+				continue
+			}
+			d.AddContact(a.c.Addr)
+			for _, addr := range a.resp.Providers {
+				if !found[addr] {
+					found[addr] = true
+					providers = append(providers, addr)
+				}
+			}
+			for _, addr := range a.resp.Contacts {
+				if !seen[addr] {
+					seen[addr] = true
+					shortlist = append(shortlist, NewContact(addr))
+				}
+			}
+		}
+		if kind == KindFindValue && len(providers) > 0 {
+			break
+		}
+		sortByDistance(shortlist, target)
+	}
+
+	for _, c := range shortlist {
+		if queried[c.Addr] && !failed[c.Addr] {
+			closest = append(closest, c)
+			if len(closest) == d.cfg.K {
+				break
+			}
+		}
+	}
+	sort.Strings(providers)
+	return closest, providers
+}
@@ -0,0 +1,171 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// simNetwork in memory transport counting the requests
+type simNetwork struct {
+	mu    sync.Mutex
+	nodes map[string]*DHT
+	down  map[string]bool
+	calls atomic.Int64
+}
+
+func newSimNetwork() *simNetwork {
+	return &simNetwork{nodes: make(map[string]*DHT), down: make(map[string]bool)}
+}
+
+func (n *simNetwork) Call(to string, req Request) (Response, error) {
+	n.calls.Add(1)
+	n.mu.Lock()
+	dst, ok := n.nodes[to]
+	down := n.down[to]
+	n.mu.Unlock()
+	if !ok || down {
+		return Response{}, errors.New(to + " unreachable")
+	}
+	return dst.Handle(req), nil
+}
+
+func (n *simNetwork) add(addr string, cfg Config) *DHT {
+	d := New(addr, n, cfg)
+	n.mu.Lock()
+	n.nodes[addr] = d
+	n.mu.Unlock()
+	return d
+}
+
+func TestID(t *testing.T) {
+	a := HashID("a")
+	assert.Equal(t, ID{}, a.Xor(a))
+	assert.Equal(t, IDLength*8, ID{}.prefixLen())
+	assert.Equal(t, 7, ID{1}.prefixLen())
+	assert.Equal(t, 8+3, ID{0, 0x10}.prefixLen())
+	assert.True(t, ID{0, 1}.Less(ID{1}))
+}
+
+func TestRoutingTable(t *testing.T) {
+	self := ID{}
+	table := NewRoutingTable(self, 2)
+	// the same bucket: first bit set
+	c1 := Contact{ID: ID{0x80, 1}, Addr: "c1"}
+	c2 := Contact{ID: ID{0x80, 2}, Addr: "c2"}
+	c3 := Contact{ID: ID{0x80, 3}, Addr: "c3"}
+	table.Update(c1)
+	table.Update(c2)
+	oldest, full := table.Update(c3)
+	assert.True(t, full)
+	assert.Equal(t, c1, oldest)
+
+	// seen again, c2 becomes the oldest
+	table.Update(c1)
+	oldest, _ = table.Update(c3)
+	assert.Equal(t, c2, oldest)
+	table.Replace(c2, c3)
+	assert.Equal(t, []Contact{c1, c3}, table.Closest(ID{0x80}, 5))
+
+	near := Contact{ID: ID{1}, Addr: "near"}
+	table.Update(near)
+	assert.Equal(t, []Contact{near}, table.Closest(self, 1))
+	assert.Equal(t, 3, table.Len())
+}
+
+func TestDHT_LookupOverlay(t *testing.T) {
+	// small buckets, the nodes know a fraction of the overlay
+	cfg := Config{K: 4, Alpha: 2}
+	net := newSimNetwork()
+	var nodes []*DHT
+	for i := 0; i < 200; i++ {
+		d := net.add(fmt.Sprintf("node-%d", i), cfg)
+		if i > 0 {
+			d.Bootstrap(nodes[rand.Intn(len(nodes))].Self().Addr)
+		}
+		nodes = append(nodes, d)
+	}
+	for _, d := range nodes {
+		assert.Less(t, d.Len(), len(nodes)/2)
+	}
+
+	key := HashID("some-object")
+	provider := nodes[rand.Intn(len(nodes))]
+	assert.Nil(t, provider.Provide(key))
+
+	for i := 0; i < 20; i++ {
+		d := nodes[rand.Intn(len(nodes))]
+		if d == provider {
+			continue
+		}
+		net.calls.Store(0)
+		assert.Equal(t, []string{provider.Self().Addr}, d.FindProviders(key))
+		assert.Less(t, net.calls.Load(), int64(40), "lookup should take a few hops")
+	}
+
+	// FIND_NODE converges on the closest node of the overlay
+	var closest Contact
+	for i, d := range nodes {
+		if i == 0 || d.Self().ID.Xor(key).Less(closest.ID.Xor(key)) {
+			closest = d.Self()
+		}
+	}
+	found := nodes[0].FindNode(key)
+	if assert.NotEmpty(t, found) {
+		assert.Equal(t, closest, found[0])
+	}
+}
+
+func TestDHT_FailedContacts(t *testing.T) {
+	net := newSimNetwork()
+	a := net.add("a", Config{})
+	b := net.add("b", Config{})
+	c := net.add("c", Config{})
+	b.Bootstrap("a")
+	c.Bootstrap("a")
+	assert.Equal(t, 2, a.Len())
+	assert.Equal(t, 2, c.Len())
+
+	// the dead node is dropped by the lookups
+	net.mu.Lock()
+	net.down["b"] = true
+	net.mu.Unlock()
+	key := HashID("k")
+	assert.Nil(t, c.Provide(key))
+	assert.Equal(t, 1, c.Len())
+	assert.Equal(t, []string{"c"}, a.FindProviders(key))
+
+	// records expire
+	a.cfg.ProviderTTL = -1
+	a.addProvider(key, "c")
+	a.expire()
+	assert.Empty(t, a.Providers(key))
+}
+
+func TestDHT_WithdrawProviders(t *testing.T) {
+	net := newSimNetwork()
+	a := net.add("a", Config{})
+	b := net.add("b", Config{})
+	c := net.add("c", Config{})
+	b.Bootstrap("a")
+	c.Bootstrap("a")
+
+	key := HashID("k")
+	assert.Nil(t, b.Provide(key))
+	assert.Nil(t, c.Provide(key))
+	assert.Equal(t, []string{"b", "c"}, a.Providers(key))
+
+	// the holder deleted the object
+	assert.Nil(t, c.Unprovide(key))
+	assert.Equal(t, []string{"b"}, a.Providers(key))
+	assert.Equal(t, []string{"b"}, c.Providers(key))
+
+	// the node is dead, its contact & records are dropped
+	a.RemoveContact("b")
+	assert.Empty(t, a.Providers(key))
+	assert.Equal(t, 1, a.Len())
+}
@@ -0,0 +1,163 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"math/bits"
+	"sort"
+	"sync"
+)
+
+// IDLength bytes of the node & key IDs
+const IDLength = sha1.Size
+
+// ID position in the keyspace, nodes & keys share the same space
+type ID [IDLength]byte
+
+// HashID place the node address or the key in the keyspace
+func HashID(s string) ID {
+	return sha1.Sum([]byte(s))
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Xor distance between the two IDs
+func (id ID) Xor(o ID) ID {
+	var d ID
+	for i := range id {
+		d[i] = id[i] ^ o[i]
+	}
+	return d
+}
+
+// Less compare the IDs as big endian numbers
+func (id ID) Less(o ID) bool {
+	return bytes.Compare(id[:], o[:]) < 0
+}
+
+// prefixLen leading zero bits, IDLength*8 for the zero ID
+func (id ID) prefixLen() int {
+	for i, b := range id {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return IDLength * 8
+}
+
+// Contact a node of the overlay, identified by its listen address
+type Contact struct {
+	ID   ID
+	Addr string
+}
+
+func NewContact(addr string) Contact {
+	return Contact{ID: HashID(addr), Addr: addr}
+}
+
+// sortByDistance closest to the target first
+func sortByDistance(contacts []Contact, target ID) {
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i].ID.Xor(target).Less(contacts[j].ID.Xor(target))
+	})
+}
+
+// RoutingTable k-buckets, bucket i holds the contacts sharing i leading
+// bits with self, least recently seen first
+type RoutingTable struct {
+	self ID
+	k    int
+
+	mu      sync.Mutex
+	buckets [IDLength * 8][]Contact
+}
+
+func NewRoutingTable(self ID, k int) *RoutingTable {
+	return &RoutingTable{self: self, k: k}
+}
+
+// bucketIndex -1 for self
+func (t *RoutingTable) bucketIndex(id ID) int {
+	n := t.self.Xor(id).prefixLen()
+	if n == IDLength*8 {
+		return -1
+	}
+	return n
+}
+
+// Update move the contact to the tail of its bucket, when the bucket
+// is full the contact is not added & the least recently seen is returned,
+// to be evicted if it does not answer
+func (t *RoutingTable) Update(c Contact) (oldest Contact, full bool) {
+	i := t.bucketIndex(c.ID)
+	if i < 0 {
+		return Contact{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bucket := t.buckets[i]
+	for j, cur := range bucket {
+		if cur.ID == c.ID {
+			bucket = append(bucket[:j], bucket[j+1:]...)
+			t.buckets[i] = append(bucket, c)
+			return Contact{}, false
+		}
+	}
+	if len(bucket) >= t.k {
+		return bucket[0], true
+	}
+	t.buckets[i] = append(bucket, c)
+	return Contact{}, false
+}
+
+// Replace evict the old contact for the new one
+func (t *RoutingTable) Replace(old, c Contact) {
+	t.Remove(old.ID)
+	t.Update(c)
+}
+
+// Remove drop the contact, it stopped answering
+func (t *RoutingTable) Remove(id ID) {
+	i := t.bucketIndex(id)
+	if i < 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bucket := t.buckets[i]
+	for j, cur := range bucket {
+		if cur.ID == id {
+			t.buckets[i] = append(bucket[:j], bucket[j+1:]...)
+			return
+		}
+	}
+}
+
+// Closest the n known contacts closest to the target
+func (t *RoutingTable) Closest(target ID, n int) []Contact {
+	t.mu.Lock()
+	var all []Contact
+	for _, bucket := range t.buckets {
+		all = append(all, bucket...)
+	}
+	t.mu.Unlock()
+	sortByDistance(all, target)
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// Len contacts in the table
+func (t *RoutingTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, bucket := range t.buckets {
+		n += len(bucket)
+	}
+	return n
+}
@@ -0,0 +1,162 @@
+package erasure
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrTooFewShards = errors.New("too few shards to reconstruct")
+	ErrShardSize    = errors.New("shards of different sizes")
+)
+
+// Encoder Reed-Solomon code of k data shards & m parity shards, the data
+// shards are the content itself & any k shards rebuild it
+type Encoder struct {
+	k, m   int
+	matrix matrix // (k+m) x k, identity on top
+}
+
+// New code of k data & m parity shards, k+m at most 256
+func New(k, m int) (*Encoder, error) {
+	if k < 1 || m < 0 || k+m > 256 {
+		return nil, fmt.Errorf("invalid code of %d data & %d parity shards", k, m)
+	}
+	v := vandermonde(k+m, k)
+	top, ok := v[:k].invert()
+	if !ok {
+		return nil, errors.New("singular vandermonde matrix")
+	}
+	return &Encoder{k: k, m: m, matrix: v.mul(top)}, nil
+}
+
+// DataShards k
+func (e *Encoder) DataShards() int {
+	return e.k
+}
+
+// ParityShards m
+func (e *Encoder) ParityShards() int {
+	return e.m
+}
+
+// Split the content into k data shards, the last one zero padded, followed
+// by m empty parity shards to fill with Encode
+func (e *Encoder) Split(data []byte) [][]byte {
+	size := int(e.ShardSize(int64(len(data))))
+	buf := make([]byte, size*(e.k+e.m))
+	copy(buf, data)
+	shards := make([][]byte, e.k+e.m)
+	for i := range shards {
+		shards[i] = buf[i*size : (i+1)*size : (i+1)*size]
+	}
+	return shards
+}
+
+// ShardSize bytes of every shard of content of the size, as Split cuts it
+func (e *Encoder) ShardSize(size int64) int64 {
+	return max((size+int64(e.k)-1)/int64(e.k), 1)
+}
+
+// Encode compute the parity shards from the data shards
+func (e *Encoder) Encode(shards [][]byte) error {
+	if len(shards) != e.k+e.m {
+		return fmt.Errorf("want %d shards, got %d", e.k+e.m, len(shards))
+	}
+	size, err := shardSize(shards)
+	if err != nil {
+		return err
+	}
+	for i := e.k; i < e.k+e.m; i++ {
+		if len(shards[i]) != size {
+			shards[i] = make([]byte, size)
+		}
+		clear(shards[i])
+		for j := 0; j < e.k; j++ {
+			mulAdd(shards[i], e.matrix[i][j], shards[j])
+		}
+	}
+	return nil
+}
+
+// Reconstruct the missing shards (nil entries) from any k present ones
+func (e *Encoder) Reconstruct(shards [][]byte) error {
+	if len(shards) != e.k+e.m {
+		return fmt.Errorf("want %d shards, got %d", e.k+e.m, len(shards))
+	}
+	size, err := shardSize(shards)
+	if err != nil {
+		return err
+	}
+	// the rows of k present shards
+	var rows []int
+	for i, s := range shards {
+		if s != nil && len(rows) < e.k {
+			rows = append(rows, i)
+		}
+	}
+	if len(rows) < e.k {
+		return fmt.Errorf("%w: %d of %d", ErrTooFewShards, len(rows), e.k)
+	}
+	sub := newMatrix(e.k, e.k)
+	for i, r := range rows {
+		copy(sub[i], e.matrix[r])
+	}
+	decode, ok := sub.invert()
+	if !ok {
+		return errors.New("singular decoding matrix")
+	}
+	// missing data shards first, the parity is encoded from them
+	for i := 0; i < e.k; i++ {
+		if shards[i] != nil {
+			continue
+		}
+		shards[i] = make([]byte, size)
+		for j, r := range rows {
+			mulAdd(shards[i], decode[i][j], shards[r])
+		}
+	}
+	for i := e.k; i < e.k+e.m; i++ {
+		if shards[i] != nil {
+			continue
+		}
+		shards[i] = make([]byte, size)
+		for j := 0; j < e.k; j++ {
+			mulAdd(shards[i], e.matrix[i][j], shards[j])
+		}
+	}
+	return nil
+}
+
+// Join the content of the data shards, cut to its size
+func (e *Encoder) Join(shards [][]byte, size int) ([]byte, error) {
+	data := make([]byte, 0, size)
+	for i := 0; i < e.k && len(data) < size; i++ {
+		if shards[i] == nil {
+			return nil, fmt.Errorf("%w: data shard %d missing", ErrTooFewShards, i)
+		}
+		data = append(data, shards[i]...)
+	}
+	if len(data) < size {
+		return nil, fmt.Errorf("shards hold %d bytes, want %d", len(data), size)
+	}
+	return data[:size], nil
+}
+
+// shardSize of the present shards, all the same
+func shardSize(shards [][]byte) (int, error) {
+	size := -1
+	for _, s := range shards {
+		if s == nil {
+			continue
+		}
+		if size >= 0 && len(s) != size {
+			return 0, ErrShardSize
+		}
+		size = len(s)
+	}
+	if size <= 0 {
+		return 0, ErrTooFewShards
+	}
+	return size, nil
+}
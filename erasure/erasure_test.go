@@ -0,0 +1,91 @@
+package erasure
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestGF(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if gfMul(byte(a), gfInv(byte(a))) != 1 {
+			t.Fatalf("%d * inverse != 1", a)
+		}
+	}
+	if gfMul(3, 7) != 9 {
+		t.Errorf("3 * 7 = %d, want 9", gfMul(3, 7))
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	enc, err := New(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	shards := enc.Split(data)
+	if err := enc.Encode(shards); err != nil {
+		t.Fatal(err)
+	}
+	// systematic, the data shards are the content
+	if !bytes.Equal(bytes.Join(shards[:4], nil)[:len(data)], data) {
+		t.Fatal("data shards differ from the content")
+	}
+
+	// every choice of 2 lost shards
+	for a := 0; a < 6; a++ {
+		for b := a + 1; b < 6; b++ {
+			lost := make([][]byte, len(shards))
+			for i := range shards {
+				if i != a && i != b {
+					lost[i] = append([]byte(nil), shards[i]...)
+				}
+			}
+			if err := enc.Reconstruct(lost); err != nil {
+				t.Fatalf("lost %d & %d: %s", a, b, err)
+			}
+			for i := range shards {
+				if !bytes.Equal(lost[i], shards[i]) {
+					t.Fatalf("lost %d & %d: shard %d rebuilt wrong", a, b, i)
+				}
+			}
+			out, err := enc.Join(lost, len(data))
+			if err != nil || !bytes.Equal(out, data) {
+				t.Fatalf("lost %d & %d: joined content differs (%v)", a, b, err)
+			}
+		}
+	}
+
+	// one more is too many
+	lost := make([][]byte, len(shards))
+	copy(lost, shards[:3])
+	if err := enc.Reconstruct(lost); !errors.Is(err, ErrTooFewShards) {
+		t.Errorf("want ErrTooFewShards, got %v", err)
+	}
+}
+
+func TestEncoder_Small(t *testing.T) {
+	enc, _ := New(3, 2)
+	for _, data := range [][]byte{nil, []byte("a"), []byte("abcd")} {
+		shards := enc.Split(data)
+		if n := enc.ShardSize(int64(len(data))); int64(len(shards[0])) != n {
+			t.Errorf("%q: shards of %d bytes, ShardSize %d", data, len(shards[0]), n)
+		}
+		if err := enc.Encode(shards); err != nil {
+			t.Fatal(err)
+		}
+		shards[0], shards[1] = nil, nil
+		if err := enc.Reconstruct(shards); err != nil {
+			t.Fatal(err)
+		}
+		out, err := enc.Join(shards, len(data))
+		if err != nil || !bytes.Equal(out, data) {
+			t.Errorf("%q: got %q (%v)", data, out, err)
+		}
+	}
+	if _, err := New(0, 2); err == nil {
+		t.Error("code without data shards")
+	}
+}
@@ -0,0 +1,137 @@
+package erasure
+
+// arithmetic over GF(2^8), reduced by x^8+x^4+x^3+x^2+1 (0x11d)
+const polynomial = 0x11d
+
+var (
+	expTable [512]byte // doubled, so exp[log a + log b] needs no modulo
+	logTable [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= polynomial
+		}
+	}
+	for i := 255; i < len(expTable); i++ {
+		expTable[i] = expTable[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+func gfInv(a byte) byte {
+	if a == 0 {
+		panic("erasure: inverse of zero")
+	}
+	return expTable[255-int(logTable[a])]
+}
+
+func gfExp(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])*n)%255]
+}
+
+// mulAdd dst ^= c * src
+func mulAdd(dst []byte, c byte, src []byte) {
+	if c == 0 {
+		return
+	}
+	lc := int(logTable[c])
+	for i, v := range src {
+		if v != 0 {
+			dst[i] ^= expTable[lc+int(logTable[v])]
+		}
+	}
+}
+
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for i := range m {
+		m[i] = make([]byte, cols)
+	}
+	return m
+}
+
+// vandermonde rows of successive powers of distinct points, any square
+// selection of its rows is invertible
+func vandermonde(rows, cols int) matrix {
+	m := newMatrix(rows, cols)
+	for i := range m {
+		for j := range m[i] {
+			m[i][j] = gfExp(byte(i), j)
+		}
+	}
+	return m
+}
+
+func (m matrix) mul(o matrix) matrix {
+	out := newMatrix(len(m), len(o[0]))
+	for i := range m {
+		for j := range o[0] {
+			var v byte
+			for k := range o {
+				v ^= gfMul(m[i][k], o[k][j])
+			}
+			out[i][j] = v
+		}
+	}
+	return out
+}
+
+// invert the square matrix by Gauss-Jordan elimination
+func (m matrix) invert() (matrix, bool) {
+	n := len(m)
+	work := newMatrix(n, 2*n)
+	for i := range m {
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for r := col; r < n; r++ {
+			if work[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, false
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		inv := gfInv(work[col][col])
+		for j := range work[col] {
+			work[col][j] = gfMul(work[col][j], inv)
+		}
+		for r := 0; r < n; r++ {
+			if r != col && work[r][col] != 0 {
+				c := work[r][col]
+				for j := range work[r] {
+					work[r][j] ^= gfMul(c, work[col][j])
+				}
+			}
+		}
+	}
+	out := newMatrix(n, n)
+	for i := range out {
+		copy(out[i], work[i][n:])
+	}
+	return out, true
+}
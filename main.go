@@ -9,6 +9,7 @@ import (
 	"github.com/roylic/go-distributed-file-storage/storage"
 	"io"
 	"log"
+	"os"
 	"time"
 )
 
@@ -32,17 +33,26 @@ func makeServer(encKey []byte, listenAddr string, nodes ...string) *server.FileS
 	// 3. construct server
 	s := server.NewFileServer(fileServerOpts)
 	transport.OnPeer = s.OnPeer
+	transport.OnPeerClose = s.OnPeerClose
 	return s
 }
 
 func main() {
 
+	// sub-commands, e.g. `fs index rebuild -root :3999_network`
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// multi-server setting up
 	sharedKey := crypto.NewAesKey()
 
 	s1 := makeServer(sharedKey, ":3999", "")
 	s2 := makeServer(sharedKey, ":4999", ":3999")
-	s3 := makeServer(sharedKey, ":5999", ":3999", ":4999")
+	s3 := makeServer(sharedKey, ":5999", ":3999") // finds :4999 by peer exchange
 
 	servers := []*server.FileServer{s1, s2, s3}
 
@@ -78,7 +88,7 @@ func main() {
 		time.Sleep(5 * time.Millisecond)
 
 		// delete
-		if err := s3.Storage.Delete(s3.ID, key); err != nil {
+		if err := s3.Storage.Delete(s3.ID, crypto.HashKey(key)); err != nil {
 			log.Fatal(err)
 		}
 		time.Sleep(2 * time.Millisecond)
@@ -0,0 +1,507 @@
+package membership
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State of a member as seen by this node
+type State int
+
+const (
+	StateAlive State = iota
+	StateSuspect
+	StateDead
+)
+
+func (s State) String() string {
+	switch s {
+	case StateSuspect:
+		return "suspect"
+	case StateDead:
+		return "dead"
+	}
+	return "alive"
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Member a node of the cluster, identified by its listen address
+type Member struct {
+	ID          string
+	State       State
+	Incarnation uint64 // bumped by the member itself to refute a suspicion
+	Since       time.Time
+
+	deadline time.Time // suspect -> dead
+}
+
+// Update gossiped about a member, piggybacked on every message
+type Update struct {
+	ID          string
+	State       State
+	Incarnation uint64
+}
+
+// Kind of a protocol message
+type Kind int
+
+const (
+	KindPing    Kind = iota
+	KindAck          // answer of a ping, Seq of the ping
+	KindPingReq      // ask the receiver to ping Target on our behalf
+	KindSync         // push the whole member list, answered by KindSyncReply
+	KindSyncReply
+)
+
+// Message exchanged between the members, carried by the Transport
+type Message struct {
+	Kind    Kind
+	From    string
+	Target  string // KindPingReq only
+	Seq     uint64
+	Updates []Update
+}
+
+// Transport deliver a message to the member, best effort, a lost
+// message is a missing ack
+type Transport interface {
+	Send(to string, msg Message) error
+}
+
+const (
+	DefaultProbeInterval    = time.Second
+	DefaultProbeTimeout     = 300 * time.Millisecond
+	DefaultIndirectChecks   = 3
+	DefaultSuspicionTimeout = 5 * time.Second
+	DefaultRetransmitMult   = 3
+	DefaultMaxPiggyback     = 8
+	DefaultSyncInterval     = 30 * time.Second
+)
+
+// Config of the protocol, zero values take the defaults
+type Config struct {
+	ProbeInterval    time.Duration // one member probed per interval
+	ProbeTimeout     time.Duration // waiting for the direct ack
+	IndirectChecks   int           // members asked to ping when the direct ping fails
+	SuspicionTimeout time.Duration // suspect members not refuting are declared dead
+	RetransmitMult   int           // an update is gossiped RetransmitMult*log10(n+1) times
+	MaxPiggyback     int           // updates carried per message
+	SyncInterval     time.Duration // full member list exchanged with a random member
+	OnChange         func(Member)  // called on every state change of another member
+}
+
+// relay an indirect probe forwarded for another member
+type relay struct {
+	requester string
+	seq       uint64
+	expires   time.Time
+}
+
+// broadcast an update waiting to be piggybacked
+type broadcast struct {
+	update    Update
+	transmits int
+}
+
+// Memberlist SWIM membership: every interval a member is probed directly,
+// then through IndirectChecks other members, before being suspected.
+// A suspect member refutes by bumping its incarnation, otherwise it is
+// declared dead after SuspicionTimeout. State changes spread by
+// piggybacking on the probe messages
+type Memberlist struct {
+	self      string
+	cfg       Config
+	transport Transport
+
+	mu          sync.Mutex
+	incarnation uint64
+	members     map[string]*Member
+	order       []string // probe order, shuffled every round
+	next        int
+	seq         uint64
+	acks        map[uint64]chan struct{}
+	relays      map[uint64]relay
+	queue       []*broadcast
+
+	quitCh   chan struct{}
+	stopOnce sync.Once
+}
+
+func New(self string, transport Transport, cfg Config) *Memberlist {
+	if cfg.ProbeInterval <= 0 {
+		cfg.ProbeInterval = DefaultProbeInterval
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = DefaultProbeTimeout
+	}
+	if cfg.IndirectChecks <= 0 {
+		cfg.IndirectChecks = DefaultIndirectChecks
+	}
+	if cfg.SuspicionTimeout <= 0 {
+		cfg.SuspicionTimeout = DefaultSuspicionTimeout
+	}
+	if cfg.RetransmitMult <= 0 {
+		cfg.RetransmitMult = DefaultRetransmitMult
+	}
+	if cfg.MaxPiggyback <= 0 {
+		cfg.MaxPiggyback = DefaultMaxPiggyback
+	}
+	if cfg.SyncInterval <= 0 {
+		cfg.SyncInterval = DefaultSyncInterval
+	}
+	m := &Memberlist{
+		self:      self,
+		cfg:       cfg,
+		transport: transport,
+		members:   make(map[string]*Member),
+		acks:      make(map[uint64]chan struct{}),
+		relays:    make(map[uint64]relay),
+		quitCh:    make(chan struct{}),
+	}
+	m.members[self] = &Member{ID: self, State: StateAlive, Since: time.Now()}
+	return m
+}
+
+// Self ID of this member
+func (m *Memberlist) Self() string {
+	return m.self
+}
+
+// Start probing in the background
+func (m *Memberlist) Start() {
+	go m.loop()
+}
+
+// Stop probing
+func (m *Memberlist) Stop() {
+	m.stopOnce.Do(func() { close(m.quitCh) })
+}
+
+// Join add a member known to be alive, e.g. a node just connected, and
+// exchange the member lists with it. A member known as suspect or dead
+// learns its state that way, and refutes with a higher incarnation
+func (m *Memberlist) Join(id string) {
+	m.mu.Lock()
+	changed := m.apply(Update{ID: id, State: StateAlive})
+	m.mu.Unlock()
+	m.notify(changed)
+	m.sync(id, KindSync)
+}
+
+// sync send the whole member list
+func (m *Memberlist) sync(to string, kind Kind) {
+	m.mu.Lock()
+	state := make([]Update, 0, len(m.members))
+	for _, mb := range m.members {
+		state = append(state, Update{ID: mb.ID, State: mb.State, Incarnation: mb.Incarnation})
+	}
+	m.mu.Unlock()
+	m.send(to, Message{Kind: kind}, state...)
+}
+
+// Members snapshot of every member including this one, sorted by ID
+func (m *Memberlist) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := make([]Member, 0, len(m.members))
+	for _, mb := range m.members {
+		members = append(members, *mb)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members
+}
+
+// StateOf the member, false when unknown
+func (m *Memberlist) StateOf(id string) (State, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mb, ok := m.members[id]
+	if !ok {
+		return StateDead, false
+	}
+	return mb.State, true
+}
+
+// Handle a message received from the transport, never blocks
+func (m *Memberlist) Handle(msg Message) {
+	m.mu.Lock()
+	var changed []Member
+	for _, u := range msg.Updates {
+		changed = append(changed, m.apply(u)...)
+	}
+	// hearing from an unknown member, it is alive
+	changed = append(changed, m.apply(Update{ID: msg.From, State: StateAlive})...)
+	// tell a member we think is down, so it can refute
+	var extra []Update
+	if mb, ok := m.members[msg.From]; ok && mb.State != StateAlive {
+		extra = append(extra, Update{ID: mb.ID, State: mb.State, Incarnation: mb.Incarnation})
+	}
+	m.mu.Unlock()
+	m.notify(changed)
+
+	switch msg.Kind {
+	case KindSync:
+		m.sync(msg.From, KindSyncReply)
+	case KindPing:
+		m.send(msg.From, Message{Kind: KindAck, Seq: msg.Seq}, extra...)
+	case KindPingReq:
+		m.mu.Lock()
+		m.seq++
+		seq := m.seq
+		m.relays[seq] = relay{requester: msg.From, seq: msg.Seq, expires: time.Now().Add(m.cfg.ProbeInterval)}
+		m.mu.Unlock()
+		m.send(msg.Target, Message{Kind: KindPing, Seq: seq}, extra...)
+	case KindAck:
+		m.mu.Lock()
+		ch, waiting := m.acks[msg.Seq]
+		r, relayed := m.relays[msg.Seq]
+		delete(m.relays, msg.Seq)
+		m.mu.Unlock()
+		if waiting {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+		if relayed {
+			m.send(r.requester, Message{Kind: KindAck, Seq: r.seq})
+		}
+	}
+}
+
+// loop one probe per interval, a full sync per SyncInterval
+func (m *Memberlist) loop() {
+	ticker := time.NewTicker(m.cfg.ProbeInterval)
+	defer ticker.Stop()
+	lastSync := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.quitCh:
+			return
+		}
+		m.expire()
+		if time.Since(lastSync) >= m.cfg.SyncInterval {
+			lastSync = time.Now()
+			if peers := m.randomMembers(1, ""); len(peers) > 0 {
+				m.sync(peers[0], KindSync)
+			}
+		}
+		m.probe()
+	}
+}
+
+// probe the next member, directly then indirectly, suspect it when
+// no ack arrives within the interval
+func (m *Memberlist) probe() {
+	target := m.nextTarget()
+	if len(target) == 0 {
+		return
+	}
+	m.mu.Lock()
+	m.seq++
+	seq := m.seq
+	ack := make(chan struct{}, 1)
+	m.acks[seq] = ack
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.acks, seq)
+		m.mu.Unlock()
+	}()
+
+	m.send(target, Message{Kind: KindPing, Seq: seq})
+	select {
+	case <-ack:
+		return
+	case <-time.After(m.cfg.ProbeTimeout):
+	case <-m.quitCh:
+		return
+	}
+
+	for _, helper := range m.randomMembers(m.cfg.IndirectChecks, target) {
+		m.send(helper, Message{Kind: KindPingReq, Target: target, Seq: seq})
+	}
+	wait := max(m.cfg.ProbeInterval-m.cfg.ProbeTimeout, m.cfg.ProbeTimeout)
+	select {
+	case <-ack:
+		return
+	case <-time.After(wait):
+	case <-m.quitCh:
+		return
+	}
+
+	m.mu.Lock()
+	var changed []Member
+	if mb, ok := m.members[target]; ok && mb.State == StateAlive {
+		changed = m.apply(Update{ID: target, State: StateSuspect, Incarnation: mb.Incarnation})
+	}
+	m.mu.Unlock()
+	m.notify(changed)
+}
+
+// expire declare the suspects past their deadline dead, drop old relays
+func (m *Memberlist) expire() {
+	now := time.Now()
+	m.mu.Lock()
+	var changed []Member
+	for _, mb := range m.members {
+		if mb.State == StateSuspect && now.After(mb.deadline) {
+			changed = append(changed, m.apply(Update{ID: mb.ID, State: StateDead, Incarnation: mb.Incarnation})...)
+		}
+	}
+	for seq, r := range m.relays {
+		if now.After(r.expires) {
+			delete(m.relays, seq)
+		}
+	}
+	m.mu.Unlock()
+	m.notify(changed)
+}
+
+// nextTarget round robin over the shuffled members not known dead
+func (m *Memberlist) nextTarget() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for tries := 0; tries <= len(m.order); tries++ {
+		if m.next >= len(m.order) {
+			m.order = m.order[:0]
+			for id, mb := range m.members {
+				if id != m.self && mb.State != StateDead {
+					m.order = append(m.order, id)
+				}
+			}
+			rand.Shuffle(len(m.order), func(i, j int) { m.order[i], m.order[j] = m.order[j], m.order[i] })
+			m.next = 0
+			if len(m.order) == 0 {
+				return ""
+			}
+		}
+		id := m.order[m.next]
+		m.next++
+		if mb, ok := m.members[id]; ok && mb.State != StateDead {
+			return id
+		}
+	}
+	return ""
+}
+
+// randomMembers at most n alive members, other than self & the excluded one
+func (m *Memberlist) randomMembers(n int, exclude string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ids []string
+	for id, mb := range m.members {
+		if id != m.self && id != exclude && mb.State == StateAlive {
+			ids = append(ids, id)
+		}
+	}
+	rand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+	return ids
+}
+
+// send the message with the pending updates piggybacked, losses are ignored
+func (m *Memberlist) send(to string, msg Message, extra ...Update) {
+	msg.From = m.self
+	m.mu.Lock()
+	msg.Updates = append(extra, m.piggyback()...)
+	m.mu.Unlock()
+	_ = m.transport.Send(to, msg)
+}
+
+// piggyback pick the least transmitted updates, caller holds the lock
+func (m *Memberlist) piggyback() []Update {
+	sort.SliceStable(m.queue, func(i, j int) bool { return m.queue[i].transmits < m.queue[j].transmits })
+	limit := m.cfg.RetransmitMult * int(math.Ceil(math.Log10(float64(len(m.members)+1))))
+	var updates []Update
+	kept := m.queue[:0]
+	for i, b := range m.queue {
+		if i < m.cfg.MaxPiggyback {
+			updates = append(updates, b.update)
+			b.transmits++
+		}
+		if b.transmits < max(limit, 1) {
+			kept = append(kept, b)
+		}
+	}
+	m.queue = kept
+	return updates
+}
+
+// enqueue gossip the update, replacing an older one about the same member
+func (m *Memberlist) enqueue(u Update) {
+	for _, b := range m.queue {
+		if b.update.ID == u.ID {
+			b.update, b.transmits = u, 0
+			return
+		}
+	}
+	m.queue = append(m.queue, &broadcast{update: u})
+}
+
+// apply the update when it overrides the known state, caller holds the
+// lock, return the changed member
+func (m *Memberlist) apply(u Update) []Member {
+	if len(u.ID) == 0 {
+		return nil
+	}
+	if u.ID == m.self {
+		// refute, the others will prefer the higher incarnation
+		if u.State != StateAlive && u.Incarnation >= m.incarnation {
+			m.incarnation = u.Incarnation + 1
+			m.members[m.self].Incarnation = m.incarnation
+			m.enqueue(Update{ID: m.self, State: StateAlive, Incarnation: m.incarnation})
+		}
+		return nil
+	}
+
+	mb, ok := m.members[u.ID]
+	if !ok {
+		if u.State == StateDead {
+			return nil
+		}
+		mb = &Member{ID: u.ID}
+		m.members[u.ID] = mb
+	} else {
+		switch u.State {
+		case StateAlive:
+			if u.Incarnation <= mb.Incarnation {
+				return nil
+			}
+		case StateSuspect:
+			if u.Incarnation < mb.Incarnation || (u.Incarnation == mb.Incarnation && mb.State != StateAlive) {
+				return nil
+			}
+		case StateDead:
+			if u.Incarnation < mb.Incarnation || mb.State == StateDead {
+				return nil
+			}
+		}
+	}
+
+	mb.State, mb.Incarnation, mb.Since = u.State, u.Incarnation, time.Now()
+	if u.State == StateSuspect {
+		mb.deadline = mb.Since.Add(m.cfg.SuspicionTimeout)
+	}
+	m.enqueue(u)
+	return []Member{*mb}
+}
+
+// notify the changes, outside the lock
+func (m *Memberlist) notify(changed []Member) {
+	if m.cfg.OnChange == nil {
+		return
+	}
+	for _, mb := range changed {
+		m.cfg.OnChange(mb)
+	}
+}
@@ -0,0 +1,183 @@
+package membership
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// simNetwork in memory transport, links can be cut in one or both directions
+type simNetwork struct {
+	mu      sync.Mutex
+	members map[string]*Memberlist
+	cut     map[[2]string]bool // from, to
+}
+
+func newSimNetwork() *simNetwork {
+	return &simNetwork{members: make(map[string]*Memberlist), cut: make(map[[2]string]bool)}
+}
+
+// simTransport the view of the network of a single member
+type simTransport struct {
+	net  *simNetwork
+	from string
+}
+
+func (t simTransport) Send(to string, msg Message) error {
+	t.net.mu.Lock()
+	dst, ok := t.net.members[to]
+	cut := t.net.cut[[2]string{t.from, to}]
+	t.net.mu.Unlock()
+	if !ok || cut {
+		return fmt.Errorf("%s unreachable", to)
+	}
+	go dst.Handle(msg)
+	return nil
+}
+
+// add a member knowing the seed
+func (n *simNetwork) add(id string, seed string, cfg Config) *Memberlist {
+	m := New(id, simTransport{net: n, from: id}, cfg)
+	n.mu.Lock()
+	n.members[id] = m
+	n.mu.Unlock()
+	if len(seed) > 0 {
+		m.Join(seed)
+	}
+	m.Start()
+	return m
+}
+
+// isolate cut every link to & from the member
+func (n *simNetwork) isolate(id string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for other := range n.members {
+		n.cut[[2]string{id, other}] = true
+		n.cut[[2]string{other, id}] = true
+	}
+}
+
+func (n *simNetwork) heal() {
+	n.mu.Lock()
+	n.cut = make(map[[2]string]bool)
+	n.mu.Unlock()
+}
+
+var fastConfig = Config{
+	ProbeInterval:    20 * time.Millisecond,
+	ProbeTimeout:     5 * time.Millisecond,
+	SuspicionTimeout: 100 * time.Millisecond,
+}
+
+// stateOf the member as seen by every other member
+func stateOf(members []*Memberlist, id string) map[State]int {
+	states := make(map[State]int)
+	for _, m := range members {
+		if m.Self() == id {
+			continue
+		}
+		state, _ := m.StateOf(id)
+		states[state]++
+	}
+	return states
+}
+
+func TestMemberlist_FailureDetection(t *testing.T) {
+	net := newSimNetwork()
+	var members []*Memberlist
+	for i := 0; i < 5; i++ {
+		members = append(members, net.add(fmt.Sprintf("n%d", i), "n0", fastConfig))
+	}
+	defer func() {
+		for _, m := range members {
+			m.Stop()
+		}
+	}()
+
+	// everybody learns everybody through the seed
+	assert.Eventually(t, func() bool {
+		for _, m := range members {
+			if len(m.Members()) != 5 {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// a crashed member is suspected, then declared dead by all
+	net.isolate("n4")
+	assert.Eventually(t, func() bool {
+		return stateOf(members, "n4")[StateDead] == 4
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestMemberlist_IndirectProbe(t *testing.T) {
+	net := newSimNetwork()
+	var changes []Member
+	var mu sync.Mutex
+	cfg := fastConfig
+	cfg.OnChange = func(mb Member) {
+		mu.Lock()
+		changes = append(changes, mb)
+		mu.Unlock()
+	}
+	a := net.add("a", "", cfg)
+	b := net.add("b", "a", fastConfig)
+	c := net.add("c", "a", fastConfig)
+	defer a.Stop()
+	defer b.Stop()
+	defer c.Stop()
+	b.Join("c")
+	c.Join("b")
+
+	// a can not reach b directly, but through c
+	net.mu.Lock()
+	net.cut[[2]string{"a", "b"}] = true
+	net.mu.Unlock()
+	time.Sleep(500 * time.Millisecond)
+
+	state, _ := a.StateOf("b")
+	assert.Equal(t, StateAlive, state)
+	mu.Lock()
+	defer mu.Unlock()
+	for _, mb := range changes {
+		assert.NotEqual(t, StateDead, mb.State, "%+v", mb)
+	}
+}
+
+func TestMemberlist_Refute(t *testing.T) {
+	net := newSimNetwork()
+	a := net.add("a", "", fastConfig)
+	b := net.add("b", "a", fastConfig)
+	defer a.Stop()
+	defer b.Stop()
+	assert.Eventually(t, func() bool { return len(a.Members()) == 2 }, time.Second, 10*time.Millisecond)
+
+	// a false suspicion is refuted with a higher incarnation
+	a.Handle(Message{Kind: KindAck, From: "b", Updates: []Update{{ID: "b", State: StateSuspect}}})
+	assert.Eventually(t, func() bool {
+		state, _ := a.StateOf("b")
+		for _, mb := range a.Members() {
+			if mb.ID == "b" {
+				return state == StateAlive && mb.Incarnation > 0
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+
+	// a dead member coming back refutes too
+	net.isolate("b")
+	assert.Eventually(t, func() bool {
+		state, _ := a.StateOf("b")
+		return state == StateDead
+	}, 2*time.Second, 10*time.Millisecond)
+	net.heal()
+	a.Join("b") // reconnected
+	assert.Eventually(t, func() bool {
+		state, _ := a.StateOf("b")
+		return state == StateAlive
+	}, 2*time.Second, 10*time.Millisecond)
+}
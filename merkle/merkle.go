@@ -0,0 +1,232 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash"
+	"sort"
+	"sync"
+)
+
+const (
+	DefaultArity = 16 // children per inner node
+	DefaultDepth = 2  // DefaultArity^DefaultDepth = 256 leaves
+)
+
+// Entry single item of the set, Digest summarises its version
+type Entry struct {
+	Key    string
+	Digest []byte
+}
+
+// Tree fixed shape Merkle tree, entries are bucketed into the leaves by
+// the hash of their key, so two trees over the same key space line up
+// level by level and can be compared top-down. Entries are put & removed
+// in place, the hashes of the leaves changed are computed on the next read
+type Tree struct {
+	arity int
+	depth int
+
+	mu      sync.Mutex
+	levels  [][][]byte          // levels[0] is the root, levels[depth] the leaves
+	buckets []map[string][]byte // key -> digest, of every leaf
+	dirty   map[int]bool        // leaves changed since their hash
+}
+
+// Build the tree over the entries
+func Build(entries []Entry, arity int, depth int) *Tree {
+	if arity < 2 {
+		arity = DefaultArity
+	}
+	if depth < 1 {
+		depth = DefaultDepth
+	}
+	t := &Tree{arity: arity, depth: depth, dirty: make(map[int]bool)}
+	leaves := t.width(depth)
+	t.buckets = make([]map[string][]byte, leaves)
+	t.levels = make([][][]byte, depth+1)
+	for l := range t.levels {
+		t.levels[l] = make([][]byte, t.width(l))
+	}
+	for i := range t.buckets {
+		t.buckets[i] = make(map[string][]byte)
+		t.dirty[i] = true
+	}
+	for _, e := range entries {
+		t.buckets[t.BucketOf(e.Key)][e.Key] = e.Digest
+	}
+	t.mu.Lock()
+	t.refresh()
+	t.mu.Unlock()
+	return t
+}
+
+// Put add the entry, or replace the one of the same key
+func (t *Tree) Put(e Entry) {
+	i := t.BucketOf(e.Key)
+	t.mu.Lock()
+	t.buckets[i][e.Key] = e.Digest
+	t.dirty[i] = true
+	t.mu.Unlock()
+}
+
+// Remove drop the entry of the key
+func (t *Tree) Remove(key string) {
+	i := t.BucketOf(key)
+	t.mu.Lock()
+	if _, ok := t.buckets[i][key]; ok {
+		delete(t.buckets[i], key)
+		t.dirty[i] = true
+	}
+	t.mu.Unlock()
+}
+
+// refresh hash the dirty leaves & their ancestors, called with the lock
+func (t *Tree) refresh() {
+	if len(t.dirty) == 0 {
+		return
+	}
+	// leaves hash the sorted entries
+	parents := make(map[int]bool)
+	for i := range t.dirty {
+		h := sha1.New()
+		for _, e := range t.sorted(i) {
+			writeLen(h, []byte(e.Key))
+			writeLen(h, e.Digest)
+		}
+		t.levels[t.depth][i] = h.Sum(nil)
+		parents[i/t.arity] = true
+	}
+	t.dirty = make(map[int]bool)
+
+	// inner nodes hash their children
+	for l := t.depth - 1; l >= 0; l-- {
+		next := make(map[int]bool)
+		for i := range parents {
+			h := sha1.New()
+			for _, child := range t.levels[l+1][i*t.arity : (i+1)*t.arity] {
+				h.Write(child)
+			}
+			t.levels[l][i] = h.Sum(nil)
+			next[i/t.arity] = true
+		}
+		parents = next
+	}
+}
+
+// sorted entries of the leaf, called with the lock
+func (t *Tree) sorted(leaf int) []Entry {
+	bucket := make([]Entry, 0, len(t.buckets[leaf]))
+	for key, digest := range t.buckets[leaf] {
+		bucket = append(bucket, Entry{Key: key, Digest: digest})
+	}
+	sort.Slice(bucket, func(a, b int) bool { return bucket[a].Key < bucket[b].Key })
+	return bucket
+}
+
+// writeLen length prefixed, so concatenations can not collide
+func writeLen(h hash.Hash, b []byte) {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(b)))
+	h.Write(size[:])
+	h.Write(b)
+}
+
+// width nodes on the level
+func (t *Tree) width(level int) int {
+	n := 1
+	for i := 0; i < level; i++ {
+		n *= t.arity
+	}
+	return n
+}
+
+func (t *Tree) Arity() int { return t.arity }
+
+func (t *Tree) Depth() int { return t.depth }
+
+// Root hash of the whole set
+func (t *Tree) Root() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refresh()
+	return t.levels[0][0]
+}
+
+// BucketOf the leaf an entry key falls into
+func (t *Tree) BucketOf(key string) int {
+	sum := sha1.Sum([]byte(key))
+	return int(binary.BigEndian.Uint32(sum[:4]) % uint32(t.width(t.depth)))
+}
+
+// Hashes of the nodes on the level, nil for an index out of range
+func (t *Tree) Hashes(level int, indexes []int) [][]byte {
+	hashes := make([][]byte, len(indexes))
+	if level < 0 || level > t.depth {
+		return hashes
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refresh()
+	for i, idx := range indexes {
+		if idx >= 0 && idx < len(t.levels[level]) {
+			hashes[i] = t.levels[level][idx]
+		}
+	}
+	return hashes
+}
+
+// Children indexes of the nodes on the next level
+func (t *Tree) Children(indexes []int) []int {
+	children := make([]int, 0, len(indexes)*t.arity)
+	for _, idx := range indexes {
+		for c := 0; c < t.arity; c++ {
+			children = append(children, idx*t.arity+c)
+		}
+	}
+	return children
+}
+
+// Diff the indexes whose local hash differs from the remote one
+func (t *Tree) Diff(level int, indexes []int, remote [][]byte) []int {
+	var diff []int
+	local := t.Hashes(level, indexes)
+	for i, idx := range indexes {
+		if i >= len(remote) || !bytes.Equal(local[i], remote[i]) {
+			diff = append(diff, idx)
+		}
+	}
+	return diff
+}
+
+// Bucket entries of the leaf, sorted by key
+func (t *Tree) Bucket(leaf int) []Entry {
+	if leaf < 0 || leaf >= len(t.buckets) {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sorted(leaf)
+}
+
+// DiffEntries keys present on one side only, or with different digests
+func DiffEntries(local []Entry, remote []Entry) []string {
+	digests := make(map[string][]byte, len(local))
+	for _, e := range local {
+		digests[e.Key] = e.Digest
+	}
+	var keys []string
+	for _, e := range remote {
+		d, ok := digests[e.Key]
+		if !ok || !bytes.Equal(d, e.Digest) {
+			keys = append(keys, e.Key)
+		}
+		delete(digests, e.Key)
+	}
+	for key := range digests {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
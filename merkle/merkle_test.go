@@ -0,0 +1,68 @@
+package merkle
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func entries(n int, version string) []Entry {
+	var es []Entry
+	for i := 0; i < n; i++ {
+		es = append(es, Entry{Key: fmt.Sprintf("key_%d", i), Digest: []byte(version)})
+	}
+	return es
+}
+
+func TestTree_Same(t *testing.T) {
+	a := Build(entries(1000, "v1"), DefaultArity, DefaultDepth)
+	b := Build(entries(1000, "v1"), DefaultArity, DefaultDepth)
+	assert.Equal(t, a.Root(), b.Root())
+	assert.Empty(t, a.Diff(0, []int{0}, b.Hashes(0, []int{0})))
+}
+
+func TestTree_DiffTopDown(t *testing.T) {
+	local := entries(1000, "v1")
+	remote := entries(1000, "v1")
+	remote[42].Digest = []byte("v2")                          // stale
+	remote = append(remote, Entry{Key: "extra", Digest: nil}) // missing locally
+	local = local[1:]                                         // key_0 missing remotely
+
+	a := Build(local, DefaultArity, DefaultDepth)
+	b := Build(remote, DefaultArity, DefaultDepth)
+
+	// walk down only the differing nodes
+	level, indexes := 0, []int{0}
+	for level < a.Depth() {
+		indexes = a.Diff(level, indexes, b.Hashes(level, indexes))
+		indexes = a.Children(indexes)
+		level++
+	}
+	leaves := a.Diff(level, indexes, b.Hashes(level, indexes))
+	assert.LessOrEqual(t, len(leaves), 3)
+
+	var keys []string
+	for _, leaf := range leaves {
+		keys = append(keys, DiffEntries(a.Bucket(leaf), b.Bucket(leaf))...)
+	}
+	assert.ElementsMatch(t, []string{"key_0", "key_42", "extra"}, keys)
+}
+
+func TestTree_PutRemove(t *testing.T) {
+	tree := Build(entries(1000, "v1"), DefaultArity, DefaultDepth)
+	tree.Put(Entry{Key: "key_42", Digest: []byte("v2")})
+	tree.Put(Entry{Key: "extra", Digest: []byte("v1")})
+	tree.Remove("key_0")
+	tree.Remove("unknown")
+
+	want := entries(1000, "v1")[1:]
+	want[41].Digest = []byte("v2")
+	want = append(want, Entry{Key: "extra", Digest: []byte("v1")})
+	assert.Equal(t, Build(want, DefaultArity, DefaultDepth).Root(), tree.Root())
+
+	// back to the first set
+	tree.Put(Entry{Key: "key_0", Digest: []byte("v1")})
+	tree.Put(Entry{Key: "key_42", Digest: []byte("v1")})
+	tree.Remove("extra")
+	assert.Equal(t, Build(entries(1000, "v1"), DefaultArity, DefaultDepth).Root(), tree.Root())
+}
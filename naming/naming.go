@@ -0,0 +1,228 @@
+package naming
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/storage"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyFile the owner key of the node, kept beside the records
+const KeyFile = "owner.key"
+
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrExpired          = errors.New("record expired")
+	ErrStale            = errors.New("record not newer than the one held")
+	ErrNotFound         = errors.New("name not found")
+)
+
+// Record points the name of the owner at a content ID or a version, only
+// the owner's key signs it, a higher Seq replaces the previous record
+type Record struct {
+	Owner     ed25519.PublicKey
+	Name      string
+	Target    string // CID, or key@versionID
+	Seq       uint64
+	Expires   time.Time
+	Signature []byte
+}
+
+// payload signed, every field but the signature
+func (r *Record) payload() []byte {
+	var b bytes.Buffer
+	b.WriteString("fs-name-record/1\n")
+	b.WriteString(hex.EncodeToString(r.Owner))
+	b.WriteByte('\n')
+	b.WriteString(strconv.Quote(r.Name))
+	b.WriteByte('\n')
+	b.WriteString(strconv.Quote(r.Target))
+	b.WriteByte('\n')
+	b.WriteString(strconv.FormatUint(r.Seq, 10))
+	b.WriteByte('\n')
+	b.WriteString(strconv.FormatInt(r.Expires.UnixNano(), 10))
+	return b.Bytes()
+}
+
+// Sign the record with the owner's private key, setting Owner
+func (r *Record) Sign(priv ed25519.PrivateKey) {
+	r.Owner = priv.Public().(ed25519.PublicKey)
+	r.Signature = ed25519.Sign(priv, r.payload())
+}
+
+// Verify the signature of the owner & the expiry
+func (r *Record) Verify(now time.Time) error {
+	if len(r.Owner) != ed25519.PublicKeySize || !ed25519.Verify(r.Owner, r.payload(), r.Signature) {
+		return fmt.Errorf("%w: %s of %s", ErrInvalidSignature, r.Name, r.OwnerID())
+	}
+	if !now.Before(r.Expires) {
+		return fmt.Errorf("%w: %s of %s", ErrExpired, r.Name, r.OwnerID())
+	}
+	return nil
+}
+
+// OwnerID hex of the owner's public key
+func (r *Record) OwnerID() string {
+	return hex.EncodeToString(r.Owner)
+}
+
+// Key the records of the same name of the same owner share it
+func (r *Record) Key() string {
+	return Key(r.Owner, r.Name)
+}
+
+func Key(owner ed25519.PublicKey, name string) string {
+	sum := sha256.Sum256(append(append([]byte(nil), owner...), name...))
+	return hex.EncodeToString(sum[:])
+}
+
+// Newer the record replaces the other, equal sequences settle on the
+// signature so every node keeps the same one
+func (r *Record) Newer(other *Record) bool {
+	if r.Seq != other.Seq {
+		return r.Seq > other.Seq
+	}
+	return bytes.Compare(r.Signature, other.Signature) > 0
+}
+
+// LoadKey the owner key kept in the directory, generated & saved on first
+// use, so the names published stay updatable after a restart
+func LoadKey(dir string) (ed25519.PrivateKey, error) {
+	path := filepath.Join(dir, KeyFile)
+	b, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid owner key %s", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := storage.WriteFileAtomic(path, []byte(hex.EncodeToString(key.Seed())), 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Registry the valid records known, one per name, persisted in a directory
+type Registry struct {
+	dir string
+
+	mu      sync.Mutex
+	records map[string]*Record
+}
+
+// NewRegistry load the records kept in the directory, the invalid &
+// expired ones are dropped
+func NewRegistry(dir string) (*Registry, error) {
+	r := &Registry{dir: dir, records: make(map[string]*Record)}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return r, err
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if e.IsDir() || e.Name() == KeyFile {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		rec := new(Record)
+		if json.Unmarshal(b, rec) != nil || rec.Verify(now) != nil {
+			_ = os.Remove(filepath.Join(dir, e.Name()))
+			continue
+		}
+		r.records[rec.Key()] = rec
+	}
+	return r, nil
+}
+
+// Put keep the record when valid & newer than the one held
+func (r *Registry) Put(rec *Record) error {
+	if err := rec.Verify(time.Now()); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cur, ok := r.records[rec.Key()]; ok && !rec.Newer(cur) {
+		return fmt.Errorf("%w: %s seq %d, held %d", ErrStale, rec.Name, rec.Seq, cur.Seq)
+	}
+	if err := r.persist(rec); err != nil {
+		return err
+	}
+	r.records[rec.Key()] = rec
+	return nil
+}
+
+func (r *Registry) persist(rec *Record) error {
+	if len(r.dir) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomic(filepath.Join(r.dir, rec.Key()), b, 0o644)
+}
+
+// Get the record of the name, unexpired
+func (r *Registry) Get(owner ed25519.PublicKey, name string) (*Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.records[Key(owner, name)]
+	if !ok || !time.Now().Before(rec.Expires) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return rec, nil
+}
+
+// Records every record held
+func (r *Registry) Records() []*Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	records := make([]*Record, 0, len(r.records))
+	for _, rec := range r.records {
+		records = append(records, rec)
+	}
+	return records
+}
+
+// Expire drop the expired records
+func (r *Registry) Expire(now time.Time) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for key, rec := range r.records {
+		if now.Before(rec.Expires) {
+			continue
+		}
+		delete(r.records, key)
+		if len(r.dir) > 0 {
+			_ = os.Remove(filepath.Join(r.dir, key))
+		}
+		n++
+	}
+	return n
+}
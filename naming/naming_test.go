@@ -0,0 +1,134 @@
+package naming
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newKey(t *testing.T) ed25519.PrivateKey {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+func signed(priv ed25519.PrivateKey, name string, target string, seq uint64, ttl time.Duration) *Record {
+	r := &Record{Name: name, Target: target, Seq: seq, Expires: time.Now().Add(ttl)}
+	r.Sign(priv)
+	return r
+}
+
+func TestRecord_Verify(t *testing.T) {
+	owner, other := newKey(t), newKey(t)
+	r := signed(owner, "site", "dag:aa", 1, time.Hour)
+	if err := r.Verify(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// any field changed breaks the signature
+	forged := *r
+	forged.Target = "dag:bb"
+	if err := forged.Verify(time.Now()); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("forged target: want ErrInvalidSignature, got %v", err)
+	}
+	forged = *r
+	forged.Seq = 100
+	if err := forged.Verify(time.Now()); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("forged seq: want ErrInvalidSignature, got %v", err)
+	}
+	// signed by another key for the owner
+	forged = *signed(other, "site", "dag:bb", 2, time.Hour)
+	forged.Owner = r.Owner
+	if err := forged.Verify(time.Now()); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("other signer: want ErrInvalidSignature, got %v", err)
+	}
+
+	if err := r.Verify(time.Now().Add(2 * time.Hour)); !errors.Is(err, ErrExpired) {
+		t.Errorf("want ErrExpired, got %v", err)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	dir := t.TempDir()
+	reg, err := NewRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := newKey(t)
+	pub := owner.Public().(ed25519.PublicKey)
+
+	if err := reg.Put(signed(owner, "site", "dag:v1", 1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Put(signed(owner, "site", "dag:v3", 3, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// an older update arriving late is refused
+	if err := reg.Put(signed(owner, "site", "dag:v2", 2, time.Hour)); !errors.Is(err, ErrStale) {
+		t.Errorf("want ErrStale, got %v", err)
+	}
+	forged := *signed(owner, "site", "dag:v3", 4, time.Hour)
+	forged.Target = "dag:evil"
+	if err := reg.Put(&forged); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("want ErrInvalidSignature, got %v", err)
+	}
+	rec, err := reg.Get(pub, "site")
+	if err != nil || rec.Target != "dag:v3" {
+		t.Fatalf("want dag:v3, got %+v %v", rec, err)
+	}
+
+	// kept across restarts
+	reg, err = NewRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := reg.Get(pub, "site"); err != nil || rec.Seq != 3 {
+		t.Errorf("reloaded: %+v %v", rec, err)
+	}
+
+	if err := reg.Put(signed(owner, "short", "dag:x", 1, 10*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if n := reg.Expire(time.Now().Add(time.Second)); n != 1 {
+		t.Errorf("want 1 expired, got %d", n)
+	}
+	if _, err := reg.Get(pub, "short"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("want ErrNotFound, got %v", err)
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	dir := t.TempDir()
+	key, err := LoadKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, KeyFile))
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("key file %v %v", info, err)
+	}
+	// the same owner after a restart, the key file is not a record
+	reg, err := NewRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Put(signed(key, "site", "dag:v1", 1, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	again, err := LoadKey(dir)
+	if err != nil || !key.Equal(again) {
+		t.Errorf("reloaded another key: %v", err)
+	}
+	if _, err := NewRegistry(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, KeyFile)); err != nil {
+		t.Errorf("key file dropped by the registry: %v", err)
+	}
+}
@@ -1,11 +1,21 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
-	"log"
 )
 
+// DefaultMaxMessageSize the largest message frame accepted, bigger content
+// goes over a stream
+const DefaultMaxMessageSize = 64 << 20
+
+// ErrMessageTooLarge the length prefix is above the limit, the connection
+// can't be trusted to stay in sync & is closed
+var ErrMessageTooLarge = errors.New("message too large")
+
 type Decoder interface {
 	Decoder(io.Reader, *RPC) error
 }
@@ -16,7 +26,9 @@ func (d GoDecoder) Decoder(r io.Reader, rpc *RPC) error {
 	return gob.NewDecoder(r).Decode(rpc)
 }
 
-type DefaultDecoder struct{}
+type DefaultDecoder struct {
+	MaxMessageSize uint32 // DefaultMaxMessageSize when 0
+}
 
 // Decoder 根据第一个bytes确认是stream类型还是message类型
 func (d DefaultDecoder) Decoder(r io.Reader, rpc *RPC) error {
@@ -24,8 +36,7 @@ func (d DefaultDecoder) Decoder(r io.Reader, rpc *RPC) error {
 	// determine the type by 1st byte
 	peekBuf := make([]byte, 1)
 	if _, err := r.Read(peekBuf); err != nil {
-		log.Fatalf("Decoding error: %+v, returning nil", err)
-		return nil
+		return err
 	}
 
 	// if it's stream -> finished (no need to decode)
@@ -35,13 +46,33 @@ func (d DefaultDecoder) Decoder(r io.Reader, rpc *RPC) error {
 		return nil
 	}
 
-	// if it's message -> read and copy to buffer (as payload, need to decode)
-	buf := make([]byte, 1024)
-	n, err := r.Read(buf)
-	if err != nil {
+	// if it's message -> read the length prefix, then the whole payload
+	// (metadata & tags could be larger than a single read)
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
 		return err
 	}
-	// copy from buffer
-	rpc.Payload = buf[:n]
+	limit := d.MaxMessageSize
+	if limit == 0 {
+		limit = DefaultMaxMessageSize
+	}
+	if size > limit {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrMessageTooLarge, size, limit)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	rpc.Payload = buf
 	return nil
 }
+
+// EncodeMessage frame the payload as [INCOMING_MESSAGE][uint32 length][payload],
+// the counterpart of DefaultDecoder
+func EncodeMessage(payload []byte) []byte {
+	buf := make([]byte, 5+len(payload))
+	buf[0] = INCOMING_MESSAGE
+	binary.LittleEndian.PutUint32(buf[1:5], uint32(len(payload)))
+	copy(buf[5:], payload)
+	return buf
+}
@@ -2,11 +2,16 @@ package p2p
 
 import (
 	"errors"
+	"io"
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
+// ErrStreamTimeout no stream came from the peer in time
+var ErrStreamTimeout = errors.New("timeout waiting for the stream")
+
 // TCPPeer 代表一个通过TCP连接的远程node
 type TCPPeer struct {
 	// is the underline connection with the peer, tcp connection
@@ -16,6 +21,8 @@ type TCPPeer struct {
 	outbound bool
 	// for same conn read blocking
 	wg *sync.WaitGroup
+	// a stream started, the read loop is paused till CloseStream
+	streams chan struct{}
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
@@ -23,6 +30,7 @@ func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 		Conn:     conn,
 		outbound: outbound,
 		wg:       &sync.WaitGroup{},
+		streams:  make(chan struct{}, 1),
 	}
 }
 
@@ -32,6 +40,17 @@ func (p *TCPPeer) Send(bytes []byte) error {
 	return err
 }
 
+// WaitStream block until the read loop consumed the stream byte & paused,
+// the stream is then read from the peer & ended by CloseStream
+func (p *TCPPeer) WaitStream(timeout time.Duration) error {
+	select {
+	case <-p.streams:
+		return nil
+	case <-time.After(timeout):
+		return ErrStreamTimeout
+	}
+}
+
 // CloseStream -> calling wg.Done()
 func (p *TCPPeer) CloseStream() {
 	p.wg.Done()
@@ -42,6 +61,7 @@ type TCPTransportOpt struct {
 	HandshakeFunc HandshakeFunc
 	Decoder       Decoder
 	OnPeer        func(Peer) error
+	OnPeerClose   func(Peer) // called when a connected peer is dropped
 }
 
 type TCPTransport struct {
@@ -136,15 +156,20 @@ func (t *TCPTransport) startAcceptLoop() {
 // 3) decode the incoming msg to RPC and put into channel (in loop)
 func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 	// 该handleConn方法内所有异常导致return前都会执行conn.Close()
-	var err error
+	var (
+		err       error
+		connected bool
+	)
+	// 针对新连接, 创建Peer
+	peer := NewTCPPeer(conn, outbound)
 	defer func() {
 		log.Printf("dropping peer connection:%s\n", err)
 		conn.Close()
+		if connected && t.OnPeerClose != nil {
+			t.OnPeerClose(peer)
+		}
 	}()
 
-	// 针对新连接, 创建Peer
-	peer := NewTCPPeer(conn, outbound)
-
 	// 尝试握手
 	if err = t.HandshakeFunc(peer); err != nil {
 		return
@@ -156,6 +181,7 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 			return
 		}
 	}
+	connected = true
 
 	// ReadLoop 循环读取 (如果不加入wg, 这里的loop会出现异常)
 	// 可以将其理解为需要将当个Conn的单个事情处理完, 才能再处理同一个Conn的下一件事
@@ -168,9 +194,15 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 		// 使用decoder进行处理
 		err = t.Decoder.Decoder(conn, &rpc)
 		if err != nil {
-			if errors.Is(err, net.ErrClosed) {
+			var opErr *net.OpError
+			if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) ||
+				errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &opErr) {
 				// 连接异常停止调用
 				return
+			} else if errors.Is(err, ErrMessageTooLarge) {
+				// the rest of the frame is still on the wire, drop the connection
+				log.Printf(" server[%s] >>> receive TCP error: %s\n", t.ListenAddr, err)
+				return
 			} else {
 				// 解码异常让其继续
 				log.Printf(" server[%s] >>> receive TCP error: %s\n", t.ListenAddr, err)
@@ -183,6 +215,7 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 		// only for stream, add wait group stuff -> 对于Stream我们要持续获取
 		if rpc.Stream {
 			peer.wg.Add(1)
+			peer.streams <- struct{}{}
 			log.Printf("server[%s] >>> Waiting till readed stream is done\n", t.ListenAddr)
 			peer.wg.Wait()
 			log.Printf("server[%s] <<< stream done continuing the loop\n", t.ListenAddr)
@@ -1,6 +1,7 @@
 package p2p
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -21,3 +22,16 @@ func Test_TCPTransport(t *testing.T) {
 	// check accept return no error
 	assert.Nil(t, tr.ListenAndAccept())
 }
+
+func Test_DefaultDecoderMaxMessageSize(t *testing.T) {
+	d := DefaultDecoder{MaxMessageSize: 8}
+
+	rpc := RPC{}
+	assert.Nil(t, d.Decoder(bytes.NewReader(EncodeMessage([]byte("hello"))), &rpc))
+	assert.Equal(t, []byte("hello"), rpc.Payload)
+
+	// the length prefix alone is rejected, nothing allocated for the payload
+	frame := EncodeMessage([]byte("too large payload"))
+	err := d.Decoder(bytes.NewReader(frame[:5]), &RPC{})
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+}
@@ -1,11 +1,15 @@
 package p2p
 
-import "net"
+import (
+	"net"
+	"time"
+)
 
 // Peer is an interface that represents the remote node
 type Peer interface {
 	net.Conn
 	Send([]byte) error
+	WaitStream(timeout time.Duration) error
 	CloseStream()
 }
 
@@ -0,0 +1,211 @@
+package rsync
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	MinBlockSize = 512
+	MaxBlockSize = 64 << 10
+)
+
+var ErrInvalidDelta = errors.New("invalid delta")
+
+// Block checksums of a block of the receiver's copy
+type Block struct {
+	Weak   uint32   // rolling checksum
+	Strong [32]byte // sha256, confirms a weak match
+}
+
+// Signature of the receiver's copy, every block BlockSize bytes but the last
+type Signature struct {
+	BlockSize int
+	Size      int64
+	Blocks    []Block
+}
+
+type OpKind uint8
+
+const (
+	OpCopy    OpKind = iota // Count blocks of the receiver's copy from Block
+	OpLiteral               // the bytes of Data
+)
+
+// Op instruction of a delta, applied in order they rebuild the new content
+type Op struct {
+	Kind  OpKind
+	Block int
+	Count int
+	Data  []byte
+}
+
+// BlockSize about the square root of the size, the delta of a small
+// change stays small & the signature short
+func BlockSize(size int64) int {
+	bs := int(math.Sqrt(float64(size)))
+	bs = (bs + 63) &^ 63
+	return min(max(bs, MinBlockSize), MaxBlockSize)
+}
+
+// weak rolling checksum of the window, a in the low half & b in the high
+type rolling struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRolling(p []byte) rolling {
+	r := rolling{n: uint32(len(p))}
+	for i, c := range p {
+		r.a += uint32(c)
+		r.b += uint32(len(p)-i) * uint32(c)
+	}
+	return r
+}
+
+// roll the window a byte forward, out leaves & in enters
+func (r *rolling) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r rolling) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+// Sign the checksums of every block of the content
+func Sign(data []byte, blockSize int) *Signature {
+	if blockSize <= 0 {
+		blockSize = BlockSize(int64(len(data)))
+	}
+	sig := &Signature{BlockSize: blockSize, Size: int64(len(data))}
+	for off := 0; off < len(data); off += blockSize {
+		p := data[off:min(off+blockSize, len(data))]
+		sig.Blocks = append(sig.Blocks, Block{Weak: newRolling(p).sum(), Strong: sha256.Sum256(p)})
+	}
+	return sig
+}
+
+// blockLen of the i-th block of the signature
+func (sig *Signature) blockLen(i int) int {
+	if i == len(sig.Blocks)-1 {
+		return int(sig.Size) - i*sig.BlockSize
+	}
+	return sig.BlockSize
+}
+
+// Delta the instructions rebuilding data from the copy the signature
+// describes: the blocks found anywhere in data are copied, the rest is sent
+func Delta(sig *Signature, data []byte) []Op {
+	var (
+		ops     []Op
+		literal int // start of the bytes not matched yet
+	)
+	emit := func(block int, end int) {
+		if literal < end {
+			ops = append(ops, Op{Kind: OpLiteral, Data: data[literal:end]})
+		}
+		if n := len(ops); n > 0 && ops[n-1].Kind == OpCopy && ops[n-1].Block+ops[n-1].Count == block {
+			ops[n-1].Count++
+		} else {
+			ops = append(ops, Op{Kind: OpCopy, Block: block, Count: 1})
+		}
+	}
+
+	bs := sig.BlockSize
+	index := make(map[uint32][]int)
+	for i, b := range sig.Blocks {
+		if sig.blockLen(i) == bs {
+			index[b.Weak] = append(index[b.Weak], i)
+		}
+	}
+	// a weak match is confirmed by the strong checksum
+	match := func(p []byte, weak uint32, candidates []int) int {
+		var strong *[32]byte
+		for _, i := range candidates {
+			if sig.Blocks[i].Weak != weak {
+				continue
+			}
+			if strong == nil {
+				sum := sha256.Sum256(p)
+				strong = &sum
+			}
+			if *strong == sig.Blocks[i].Strong {
+				return i
+			}
+		}
+		return -1
+	}
+
+	pos := 0
+	if bs > 0 && len(index) > 0 && len(data) >= bs {
+		r := newRolling(data[:bs])
+		for {
+			if i := match(data[pos:pos+bs], r.sum(), index[r.sum()]); i >= 0 {
+				emit(i, pos)
+				pos += bs
+				literal = pos
+				if pos+bs > len(data) {
+					break
+				}
+				r = newRolling(data[pos : pos+bs])
+				continue
+			}
+			if pos+bs >= len(data) {
+				break
+			}
+			r.roll(data[pos], data[pos+bs])
+			pos++
+		}
+	}
+
+	// the short last block can only match the end of the content
+	if last := len(sig.Blocks) - 1; last >= 0 && sig.blockLen(last) < bs {
+		tail := len(data) - sig.blockLen(last)
+		if tail >= literal {
+			p := data[tail:]
+			if match(p, newRolling(p).sum(), []int{last}) == last {
+				emit(last, tail)
+				literal = len(data)
+			}
+		}
+	}
+	if literal < len(data) {
+		ops = append(ops, Op{Kind: OpLiteral, Data: data[literal:]})
+	}
+	return ops
+}
+
+// Apply the delta to the copy it was computed against
+func Apply(base []byte, blockSize int, ops []Op) ([]byte, error) {
+	var out []byte
+	for _, op := range ops {
+		switch op.Kind {
+		case OpLiteral:
+			out = append(out, op.Data...)
+		case OpCopy:
+			start := int64(op.Block) * int64(blockSize)
+			end := start + int64(op.Count)*int64(blockSize)
+			if op.Block < 0 || op.Count <= 0 || blockSize <= 0 || start >= int64(len(base)) {
+				return nil, fmt.Errorf("%w: copy of %d blocks from %d", ErrInvalidDelta, op.Count, op.Block)
+			}
+			out = append(out, base[start:min(end, int64(len(base)))]...)
+		default:
+			return nil, fmt.Errorf("%w: op kind %d", ErrInvalidDelta, op.Kind)
+		}
+	}
+	return out, nil
+}
+
+// Literals bytes of the delta sent as data
+func Literals(ops []Op) int64 {
+	var n int64
+	for _, op := range ops {
+		if op.Kind == OpLiteral {
+			n += int64(len(op.Data))
+		}
+	}
+	return n
+}
@@ -0,0 +1,65 @@
+package rsync
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestRolling(t *testing.T) {
+	data := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(data)
+	r := newRolling(data[:512])
+	for i := 1; i+512 <= len(data); i++ {
+		r.roll(data[i-1], data[i+511])
+		if r.sum() != newRolling(data[i:i+512]).sum() {
+			t.Fatalf("rolled checksum at %d differs", i)
+		}
+	}
+}
+
+func TestDelta(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	base := make([]byte, 200<<10+123)
+	rng.Read(base)
+	bs := BlockSize(int64(len(base)))
+
+	edit := func(f func([]byte) []byte) []byte {
+		return f(append([]byte(nil), base...))
+	}
+	cases := map[string][]byte{
+		"same":     base,
+		"inserted": edit(func(b []byte) []byte { return append(b[:5000], append([]byte("inserted bytes"), b[5000:]...)...) }),
+		"changed":  edit(func(b []byte) []byte { copy(b[100<<10:], "changed"); return b }),
+		"cut":      edit(func(b []byte) []byte { return append(b[:7000], b[9000:]...) }),
+		"appended": edit(func(b []byte) []byte { return append(b, "tail"...) }),
+		"empty":    {},
+	}
+	sig := Sign(base, bs)
+	for name, data := range cases {
+		ops := Delta(sig, data)
+		out, err := Apply(base, bs, ops)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Fatalf("%s: applied delta differs", name)
+		}
+		if name != "empty" && Literals(ops) > int64(3*bs) {
+			t.Errorf("%s: %d literal bytes for a small edit", name, Literals(ops))
+		}
+	}
+	if n := Literals(Delta(sig, base)); n != 0 {
+		t.Errorf("unchanged content sends %d bytes", n)
+	}
+
+	// nothing in common, all literal
+	other := make([]byte, 10<<10)
+	rng.Read(other)
+	if n := Literals(Delta(sig, other)); n != int64(len(other)) {
+		t.Errorf("unrelated content: %d literal bytes, want %d", n, len(other))
+	}
+	if _, err := Apply(base, bs, []Op{{Kind: OpCopy, Block: len(sig.Blocks) + 1, Count: 1}}); err == nil {
+		t.Error("copy beyond the base accepted")
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+)
+
+// startAdmin serve the http admin API on AdminAddr
+func (s *FileServer) startAdmin() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /rebalance", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Rebalancer.Status())
+	})
+	mux.HandleFunc("POST /rebalance/pause", func(w http.ResponseWriter, r *http.Request) {
+		s.Rebalancer.Pause()
+		writeJSON(w, s.Rebalancer.Status())
+	})
+	mux.HandleFunc("POST /rebalance/resume", func(w http.ResponseWriter, r *http.Request) {
+		s.Rebalancer.Resume()
+		writeJSON(w, s.Rebalancer.Status())
+	})
+
+	mux.HandleFunc("GET /nodes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.NodeStates())
+	})
+	mux.HandleFunc("POST /nodes/{id}/drain", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Drain(r.PathValue("id")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, s.drainStatusOf(r.PathValue("id")))
+	})
+	mux.HandleFunc("GET /nodes/{id}/drain", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.drainStatusOf(r.PathValue("id")))
+	})
+	mux.HandleFunc("DELETE /nodes/{id}/drain", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Undrain(r.PathValue("id")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, s.drainStatusOf(r.PathValue("id")))
+	})
+
+	mux.HandleFunc("GET /peers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.PeerExchange.Known())
+	})
+	mux.HandleFunc("GET /members", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Membership.Members())
+	})
+
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = s.Metrics.WriteTo(w)
+	})
+
+	ln, err := net.Listen("tcp", s.AdminAddr)
+	if err != nil {
+		return err
+	}
+	s.admin = &http.Server{Handler: mux}
+	go func() {
+		if err := s.admin.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("server[%s] admin API stopped: %s\n", s.Transport.Addr(), err)
+		}
+	}()
+	log.Printf("server[%s] admin API listening on %s\n", s.Transport.Addr(), s.AdminAddr)
+	return nil
+}
+
+// writeJSON reply the value as json
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// drainStatusOf full progress of this node, only the state of the others
+func (s *FileServer) drainStatusOf(node string) DrainStatus {
+	if node == s.Transport.Addr() {
+		return s.Drainer.Status()
+	}
+	state, ok := s.NodeStates()[node]
+	if !ok {
+		state = "unknown"
+	}
+	return DrainStatus{Node: node, State: state}
+}
@@ -0,0 +1,522 @@
+package server
+
+import (
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/merkle"
+	"github.com/roylic/go-distributed-file-storage/storage"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultAntiEntropyInterval time between two sync rounds with a random peer
+const DefaultAntiEntropyInterval = 30 * time.Second
+
+// SyncEntry (ownerID, hashedKey, version/checksum) of an object or a tombstone
+type SyncEntry struct {
+	ID       string
+	Key      string
+	Version  int64
+	Checksum string
+	Deleted  bool
+}
+
+// merkleKey entry key of the tree
+func (e SyncEntry) merkleKey() string {
+	return e.ID + "/" + e.Key
+}
+
+// digest summarise the version of the entry
+func (e SyncEntry) digest() []byte {
+	return []byte(fmt.Sprintf("%d/%s/%t", e.Version, e.Checksum, e.Deleted))
+}
+
+// newerThan decide which side wins, the checksum breaks the tie
+func (e SyncEntry) newerThan(o SyncEntry) bool {
+	if e.Version != o.Version {
+		return e.Version > o.Version
+	}
+	if e.Deleted != o.Deleted {
+		return e.Deleted
+	}
+	return e.Checksum > o.Checksum
+}
+
+// SyncResult outcome of one anti-entropy round
+type SyncResult struct {
+	Peer      string
+	Divergent int // keys differing between the two nodes
+	Repaired  int
+	Failed    int
+}
+
+// AntiEntropy pairs this node with a random peer periodically,
+// comparing Merkle trees and streaming missing or stale objects. The
+// trees follow the writes & deletes reported by the storage, the store is
+// walked again only when the placement changed
+type AntiEntropy struct {
+	s *FileServer
+
+	buildLock sync.Mutex // a single walk at a time
+	mu        sync.Mutex
+	entries   map[string]SyncEntry    // merkle key -> local entry shared with a peer
+	shards    map[string]SyncEntry    // merkle key -> local shard, repaired from its stripe
+	trees     map[string]*merkle.Tree // peer -> tree over the keys shared with it
+	ring      string                  // placement the trees follow, empty until walked
+	building  bool
+	pending   []SyncEntry // changed during the walk, ID & Key only
+	lastGC    time.Time
+}
+
+func NewAntiEntropy(s *FileServer) *AntiEntropy {
+	a := &AntiEntropy{
+		s:       s,
+		entries: make(map[string]SyncEntry),
+		shards:  make(map[string]SyncEntry),
+		trees:   make(map[string]*merkle.Tree),
+	}
+	s.Storage.Watch(a.changed)
+	return a
+}
+
+// loop sync with a random peer every interval
+func (a *AntiEntropy) loop() {
+	interval := a.s.AntiEntropyInterval
+	if interval <= 0 {
+		interval = DefaultAntiEntropyInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.s.quitCh:
+			return
+		}
+		// batched writes reach the disk at least once a round
+		if err := a.s.Storage.Flush(); err != nil {
+			log.Printf("[%s] flush the storage failed: %s\n", a.s.Transport.Addr(), err)
+		}
+		if n, err := a.s.Storage.PurgeTombstones(time.Now().Add(-storage.DefaultTombstoneTTL)); err == nil {
+			a.s.Metrics.Add(MetricTombstonesPurged, int64(n))
+		}
+		_, _ = a.s.Storage.PurgePartials(time.Now().Add(-storage.DefaultPartialTTL))
+		// collecting the blocks walks the store, once per grace period
+		if time.Since(a.lastGC) >= storage.DefaultBlockGrace {
+			a.lastGC = time.Now()
+			if _, err := a.s.Storage.PurgeBlocks(time.Now().Add(-storage.DefaultBlockGrace)); err != nil {
+				log.Printf("[%s] purge the DAG blocks failed: %s\n", a.s.Transport.Addr(), err)
+			}
+		}
+		a.s.expireUploads(time.Now())
+		a.s.Names.Expire(time.Now())
+		a.s.repairStripes()
+		var peers []string
+		for _, node := range a.s.Placement.Nodes() {
+			if _, ok := a.s.nodePeer(node); ok && a.s.alive(node) {
+				peers = append(peers, node)
+			}
+		}
+		if len(peers) == 0 {
+			continue
+		}
+		peer := peers[rand.Intn(len(peers))]
+		if res, err := a.SyncWith(peer); err != nil {
+			log.Printf("[%s] anti-entropy with %s failed: %s\n", a.s.Transport.Addr(), peer, err)
+		} else if res.Divergent > 0 {
+			log.Printf("[%s] anti-entropy with %s: %+v\n", a.s.Transport.Addr(), peer, res)
+		}
+	}
+}
+
+// ringOf identify the placement, the keys shared with a peer follow it
+func (a *AntiEntropy) ringOf() string {
+	nodes := append([]string(nil), a.s.Placement.Nodes()...)
+	sort.Strings(nodes)
+	return fmt.Sprintf("%d/%s", a.s.ReplicationFactor, strings.Join(nodes, ","))
+}
+
+// sharedWith the peers holding the key with this node, none when this
+// node is not one of its replicas
+func (a *AntiEntropy) sharedWith(key string) []string {
+	self := a.s.Transport.Addr()
+	targets := a.s.Placement.Locate(key, a.s.ReplicationFactor)
+	if !contains(targets, self) {
+		return nil
+	}
+	peers := make([]string, 0, len(targets))
+	for _, node := range targets {
+		if node != self {
+			peers = append(peers, node)
+		}
+	}
+	return peers
+}
+
+// localEntry the entry of the object or of its tombstone, false when
+// neither is held
+func (s *FileServer) localEntry(id string, key string) (e SyncEntry, shard bool, ok bool) {
+	if s.Storage.Has(id, key) {
+		meta, err := s.Storage.Stat(id, key)
+		if err != nil {
+			return e, false, false
+		}
+		return SyncEntry{ID: id, Key: key, Version: meta.Version, Checksum: meta.Checksum}, isShard(meta), true
+	}
+	if version, deleted := s.Storage.TombstoneOf(id, key); deleted {
+		return SyncEntry{ID: id, Key: key, Version: version, Deleted: true}, false, true
+	}
+	return e, false, false
+}
+
+// changed follow a write or delete reported by the storage
+func (a *AntiEntropy) changed(id string, key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case a.building:
+		a.pending = append(a.pending, SyncEntry{ID: id, Key: key})
+	case len(a.ring) > 0:
+		a.refresh(id, key)
+	}
+}
+
+// refresh the entry of the key from the storage, called with the lock
+func (a *AntiEntropy) refresh(id string, key string) {
+	a.drop(SyncEntry{ID: id, Key: key}.merkleKey())
+	if e, shard, ok := a.s.localEntry(id, key); ok {
+		a.add(e, shard)
+	}
+}
+
+// add the entry to the trees of the peers sharing it, called with the lock
+func (a *AntiEntropy) add(e SyncEntry, shard bool) {
+	key := e.merkleKey()
+	if shard {
+		a.shards[key] = e
+		return
+	}
+	peers := a.sharedWith(e.Key)
+	if len(peers) == 0 {
+		return
+	}
+	a.entries[key] = e
+	for _, peer := range peers {
+		a.treeOf(peer).Put(merkle.Entry{Key: key, Digest: e.digest()})
+	}
+}
+
+// drop the entry from the trees, called with the lock
+func (a *AntiEntropy) drop(key string) {
+	delete(a.shards, key)
+	e, ok := a.entries[key]
+	if !ok {
+		return
+	}
+	delete(a.entries, key)
+	for _, peer := range a.sharedWith(e.Key) {
+		if t, ok := a.trees[peer]; ok {
+			t.Remove(key)
+		}
+	}
+}
+
+// treeOf the tree of the peer, called with the lock
+func (a *AntiEntropy) treeOf(peer string) *merkle.Tree {
+	t, ok := a.trees[peer]
+	if !ok {
+		t = merkle.Build(nil, merkle.DefaultArity, merkle.DefaultDepth)
+		a.trees[peer] = t
+	}
+	return t
+}
+
+// ensure the trees follow the current placement, walking the store when
+// they do not
+func (a *AntiEntropy) ensure() error {
+	ring := a.ringOf()
+	a.mu.Lock()
+	built := a.ring == ring
+	a.mu.Unlock()
+	if built {
+		return nil
+	}
+	a.buildLock.Lock()
+	defer a.buildLock.Unlock()
+	a.mu.Lock()
+	built = a.ring == ring
+	a.mu.Unlock()
+	if built {
+		return nil
+	}
+	return a.build(ring)
+}
+
+// build the trees from a walk of the objects & tombstones, the changes
+// during the walk are applied on top
+func (a *AntiEntropy) build(ring string) error {
+	a.mu.Lock()
+	a.building, a.pending = true, nil
+	a.mu.Unlock()
+
+	type walked struct {
+		e     SyncEntry
+		shard bool
+	}
+	var found []walked
+	err := a.s.Storage.Walk(func(id string, meta *storage.Metadata) error {
+		found = append(found, walked{SyncEntry{ID: id, Key: meta.Key, Version: meta.Version, Checksum: meta.Checksum}, isShard(meta)})
+		return nil
+	})
+	if err == nil {
+		err = a.s.Storage.WalkTombstones(func(id string, key string, version int64) error {
+			found = append(found, walked{e: SyncEntry{ID: id, Key: key, Version: version, Deleted: true}})
+			return nil
+		})
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.building = false
+	pending := a.pending
+	a.pending = nil
+	if err != nil {
+		return err
+	}
+	a.entries = make(map[string]SyncEntry)
+	a.shards = make(map[string]SyncEntry)
+	a.trees = make(map[string]*merkle.Tree)
+	for _, w := range found {
+		a.add(w.e, w.shard)
+	}
+	a.ring = ring
+	for _, e := range pending {
+		a.refresh(e.ID, e.Key)
+	}
+	return nil
+}
+
+// treeFor the tree over the keys this node shares with the peer
+func (a *AntiEntropy) treeFor(peer string) (*merkle.Tree, error) {
+	if err := a.ensure(); err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.treeOf(peer), nil
+}
+
+// entry the local entry of the merkle key
+func (a *AntiEntropy) entry(key string) (SyncEntry, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, ok := a.entries[key]
+	return e, ok
+}
+
+// localShards the shards held by this node
+func (a *AntiEntropy) localShards() ([]SyncEntry, error) {
+	if err := a.ensure(); err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	shards := make([]SyncEntry, 0, len(a.shards))
+	for _, e := range a.shards {
+		shards = append(shards, e)
+	}
+	return shards, nil
+}
+
+// SyncWith run one round with the peer: walk down the differing
+// nodes of the trees, then compare the entries of the differing leaves
+func (a *AntiEntropy) SyncWith(peer string) (SyncResult, error) {
+	res := SyncResult{Peer: peer}
+	local, err := a.treeFor(peer)
+	if err != nil {
+		return res, err
+	}
+	a.s.Metrics.Add(MetricAntiEntropyRounds, 1)
+
+	level, indexes := 0, []int{0}
+	for {
+		remote, err := a.s.requestMerkleHashes(peer, level, indexes)
+		if err != nil {
+			a.s.Metrics.Add(MetricAntiEntropyFailures, 1)
+			return res, err
+		}
+		indexes = local.Diff(level, indexes, remote)
+		if len(indexes) == 0 || level == local.Depth() {
+			break
+		}
+		indexes = local.Children(indexes)
+		level++
+	}
+	if len(indexes) == 0 {
+		a.s.Metrics.Set(MetricAntiEntropyLastDiff, 0)
+		return res, nil
+	}
+
+	remoteEntries, err := a.s.requestMerkleBuckets(peer, indexes)
+	if err != nil {
+		a.s.Metrics.Add(MetricAntiEntropyFailures, 1)
+		return res, err
+	}
+	remote := make(map[string]SyncEntry, len(remoteEntries))
+	var remoteLeaves []merkle.Entry
+	for _, e := range remoteEntries {
+		remote[e.merkleKey()] = e
+		remoteLeaves = append(remoteLeaves, merkle.Entry{Key: e.merkleKey(), Digest: e.digest()})
+	}
+	var localLeaves []merkle.Entry
+	for _, leaf := range indexes {
+		localLeaves = append(localLeaves, local.Bucket(leaf)...)
+	}
+
+	var pulls []SyncEntry
+	for _, key := range merkle.DiffEntries(localLeaves, remoteLeaves) {
+		res.Divergent++
+		l, hasLocal := a.entry(key)
+		r, hasRemote := remote[key]
+		switch {
+		case hasLocal && (!hasRemote || l.newerThan(r)):
+			// local wins, push to the peer
+			if err := a.s.pushEntry(peer, l); err != nil {
+				log.Printf("[%s] repair (%s) on %s failed: %s\n", a.s.Transport.Addr(), key, peer, err)
+				res.Failed++
+				continue
+			}
+			res.Repaired++
+		case r.Deleted:
+			if err := a.s.deleteObject(r.ID, r.Key, r.Version); err != nil {
+				res.Failed++
+				continue
+			}
+			res.Repaired++
+		default:
+			pulls = append(pulls, r)
+		}
+	}
+	// remote wins, the peer pushes to us in the background
+	if len(pulls) > 0 {
+		if err := a.s.requestRepairPush(peer, pulls); err != nil {
+			res.Failed += len(pulls)
+		} else {
+			res.Repaired += len(pulls)
+		}
+	}
+
+	a.s.Metrics.Add(MetricAntiEntropyDivergent, int64(res.Divergent))
+	a.s.Metrics.Add(MetricAntiEntropyRepaired, int64(res.Repaired))
+	a.s.Metrics.Add(MetricAntiEntropyRepairErrs, int64(res.Failed))
+	a.s.Metrics.Set(MetricAntiEntropyLastDiff, int64(res.Divergent))
+	return res, nil
+}
+
+// pushEntry make the peer converge on the local entry
+func (s *FileServer) pushEntry(peer string, e SyncEntry) error {
+	if e.Deleted {
+		p, ok := s.nodePeer(peer)
+		if !ok {
+			return fmt.Errorf("node %s is not connected", peer)
+		}
+		return s.send(p, &Message{Payload: MessageDeleteFile{ID: e.ID, Key: e.Key, Version: e.Version}})
+	}
+	meta, err := s.Storage.Stat(e.ID, e.Key)
+	if err != nil {
+		return err
+	}
+	_, err = s.copyTo(peer, localObject{id: e.ID, meta: meta}, 0)
+	return err
+}
+
+// requestMerkleHashes hashes of the peer's tree nodes
+func (s *FileServer) requestMerkleHashes(peer string, level int, indexes []int) ([][]byte, error) {
+	resp, err := s.request(peer, func(reqID string) any {
+		return MessageMerkleRequest{RequestID: reqID, Node: s.Transport.Addr(), Level: level, Indexes: indexes}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(MessageMerkleResponse).Hashes, nil
+}
+
+// requestMerkleBuckets entries of the peer's leaves
+func (s *FileServer) requestMerkleBuckets(peer string, leaves []int) ([]SyncEntry, error) {
+	resp, err := s.request(peer, func(reqID string) any {
+		return MessageMerkleBuckets{RequestID: reqID, Node: s.Transport.Addr(), Leaves: leaves}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(MessageMerkleBucketsResponse).Entries, nil
+}
+
+// requestRepairPush ask the peer to push its newer entries to us
+func (s *FileServer) requestRepairPush(peer string, entries []SyncEntry) error {
+	p, ok := s.nodePeer(peer)
+	if !ok {
+		return fmt.Errorf("node %s is not connected", peer)
+	}
+	return s.send(p, &Message{Payload: MessageRepairPush{Node: s.Transport.Addr(), Entries: entries}})
+}
+
+// handleMessageMerkleRequest answer off the loop the hashes of the tree
+// shared with the requester
+func (s *FileServer) handleMessageMerkleRequest(from string, msg MessageMerkleRequest) error {
+	go func() {
+		t, err := s.AntiEntropy.treeFor(msg.Node)
+		if err != nil {
+			log.Printf("[%s] merkle tree for %s failed: %s\n", s.Transport.Addr(), msg.Node, err)
+			return
+		}
+		resp := MessageMerkleResponse{RequestID: msg.RequestID, Hashes: t.Hashes(msg.Level, msg.Indexes)}
+		if err := s.reply(from, &Message{Payload: resp}); err != nil {
+			log.Printf("[%s] reply merkle hashes to %s failed: %s\n", s.Transport.Addr(), msg.Node, err)
+		}
+	}()
+	return nil
+}
+
+// handleMessageMerkleBuckets answer off the loop the entries of the leaves
+func (s *FileServer) handleMessageMerkleBuckets(from string, msg MessageMerkleBuckets) error {
+	go func() {
+		t, err := s.AntiEntropy.treeFor(msg.Node)
+		if err != nil {
+			log.Printf("[%s] merkle tree for %s failed: %s\n", s.Transport.Addr(), msg.Node, err)
+			return
+		}
+		resp := MessageMerkleBucketsResponse{RequestID: msg.RequestID}
+		for _, leaf := range msg.Leaves {
+			for _, e := range t.Bucket(leaf) {
+				if entry, ok := s.AntiEntropy.entry(e.Key); ok {
+					resp.Entries = append(resp.Entries, entry)
+				}
+			}
+		}
+		if err := s.reply(from, &Message{Payload: resp}); err != nil {
+			log.Printf("[%s] reply merkle buckets to %s failed: %s\n", s.Transport.Addr(), msg.Node, err)
+		}
+	}()
+	return nil
+}
+
+// handleMessageRepairPush push the entries in the background,
+// the loop must not wait for the acks
+func (s *FileServer) handleMessageRepairPush(from string, msg MessageRepairPush) error {
+	go func() {
+		for _, e := range msg.Entries {
+			meta, err := s.Storage.Stat(e.ID, e.Key)
+			if err != nil || meta.Version != e.Version {
+				continue // changed since the round
+			}
+			if err := s.pushEntry(msg.Node, e); err != nil {
+				log.Printf("[%s] repair push (%s) to %s failed: %s\n", s.Transport.Addr(), e.Key, msg.Node, err)
+			}
+		}
+	}()
+	return nil
+}
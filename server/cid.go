@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/chunker"
+	"github.com/roylic/go-distributed-file-storage/crypto"
+	"github.com/roylic/go-distributed-file-storage/dag"
+	"github.com/roylic/go-distributed-file-storage/dht"
+	"github.com/roylic/go-distributed-file-storage/storage"
+	"io"
+	"log"
+)
+
+// cidProviderKey the holders of the content announce it under its CID
+func cidProviderKey(c dag.CID) dht.ID {
+	return dht.HashID("cid/" + c.String())
+}
+
+// buildDAG the Merkle DAG over the chunks of the content, cut like the
+// storage cuts deduplicated objects. The content is streamed, only the
+// links of the leaves are kept
+func (s *FileServer) buildDAG(r io.Reader) (dag.CID, map[dag.CID][]byte, error) {
+	var (
+		leaves []dag.Link
+		c      = chunker.New(r, s.Storage.ChunkConfig)
+	)
+	for {
+		chunk, err := c.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		leaves = append(leaves, dag.LeafLink(chunk))
+	}
+	root, nodes := dag.BuildLinks(leaves, dag.DefaultFanout)
+	return root, nodes, nil
+}
+
+// indexCID keep the nodes of the DAG of the object written, so its blocks
+// are served, and announce the content
+func (s *FileServer) indexCID(id string, meta storage.Metadata) error {
+	_, r, err := s.Storage.Read(id, meta.Key)
+	if err != nil {
+		return err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+	root, nodes, err := s.buildDAG(r)
+	if err != nil {
+		return err
+	}
+	if root.String() != meta.CID {
+		return fmt.Errorf("content of (%s) is %s, not %s", meta.Key, root, meta.CID)
+	}
+	for c, block := range nodes {
+		if err := s.Storage.PutBlock(c, block); err != nil {
+			return err
+		}
+	}
+	if err := s.Storage.AddCID(root, id, meta.Key); err != nil {
+		return err
+	}
+	go func() {
+		if err := s.DHT.Provide(cidProviderKey(root)); err != nil {
+			log.Printf("[%s] announce (%s) failed: %s\n", s.Transport.Addr(), root, err)
+		}
+	}()
+	return nil
+}
+
+// GetByCID read the content of the CID, whatever key it was stored under.
+// Streamed block by block, from the local copy first then the network,
+// every block is checked against its CID before it is used, so any peer
+// may serve it. Closing the reader stops the download
+func (s *FileServer) GetByCID(cid string) (io.ReadCloser, error) {
+	root, err := dag.Parse(cid)
+	if err != nil {
+		return nil, err
+	}
+	f := &cidFetch{s: s, root: root}
+	f.id, f.key, f.held = s.Storage.LookupCID(root)
+	block, err := f.block(root, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(f.walkBlock(root, block, 0, pw))
+	}()
+	return pr, nil
+}
+
+// cidCandidates the providers of the content, then the connected nodes
+func (s *FileServer) cidCandidates(root dag.CID) []string {
+	self := s.Transport.Addr()
+	seen := map[string]bool{self: true}
+	var nodes []string
+	for _, node := range s.DHT.FindProviders(cidProviderKey(root)) {
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	s.peerLock.Lock()
+	for node := range s.nodes {
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	s.peerLock.Unlock()
+	return nodes
+}
+
+// cidFetch walk of the DAG, the local blocks first, then the node which
+// served the last block
+type cidFetch struct {
+	s    *FileServer
+	root dag.CID
+
+	id, key string // local object holding the content
+	held    bool
+
+	nodes []string // asked for the blocks missing locally, found on first need
+	found bool
+	last  int
+}
+
+// walk fetch the block & the ones below it, writing the content in order
+func (f *cidFetch) walk(c dag.CID, offset int64, size int64, w io.Writer) error {
+	block, err := f.block(c, offset, size)
+	if err != nil {
+		return err
+	}
+	return f.walkBlock(c, block, offset, w)
+}
+
+// walkBlock write the content of the block already fetched
+func (f *cidFetch) walkBlock(c dag.CID, block []byte, offset int64, w io.Writer) error {
+	if c.Codec() == dag.CodecRaw {
+		_, err := w.Write(block)
+		return err
+	}
+	n, err := dag.Decode(c, block)
+	if err != nil {
+		return err
+	}
+	for _, l := range n.Links {
+		if err := f.walk(l.CID, offset, l.Size, w); err != nil {
+			return err
+		}
+		offset += l.Size
+	}
+	return nil
+}
+
+// block the local one when it is as addressed, otherwise from the first
+// node serving it as addressed
+func (f *cidFetch) block(c dag.CID, offset int64, size int64) ([]byte, error) {
+	block, err := f.local(c, offset, size)
+	if err == nil {
+		if err = checkBlock(c, block, size); err == nil {
+			return block, nil
+		}
+		log.Printf("server[%s] local block %s: %s\n", f.s.Transport.Addr(), c, err)
+	}
+
+	if !f.found {
+		if f.nodes == nil {
+			f.nodes = f.s.cidCandidates(f.root)
+		}
+		f.found = true
+	}
+	for i := range f.nodes {
+		node := f.nodes[(f.last+i)%len(f.nodes)]
+		block, err := f.s.getBlock(node, f.root, c, offset, size)
+		if err == nil {
+			err = checkBlock(c, block, size)
+		}
+		if err != nil {
+			log.Printf("server[%s] block %s from %s: %s\n", f.s.Transport.Addr(), c, node, err)
+			continue
+		}
+		f.last = (f.last + i) % len(f.nodes)
+		return block, nil
+	}
+	return nil, fmt.Errorf("server[%s] %w: %s of %s", f.s.Transport.Addr(), storage.ErrBlockNotFound, c, f.root)
+}
+
+// local the block from the block store, or the leaf read from the local
+// object holding the content
+func (f *cidFetch) local(c dag.CID, offset int64, size int64) ([]byte, error) {
+	if block, err := f.s.Storage.GetBlock(c); err == nil {
+		return block, nil
+	}
+	if !f.held || c.Codec() != dag.CodecRaw {
+		return nil, storage.ErrBlockNotFound
+	}
+	return f.s.readLeaf(f.id, f.key, offset, size)
+}
+
+// checkBlock the block hashes to its CID, a leaf has the size of its link
+func checkBlock(c dag.CID, block []byte, size int64) error {
+	if err := c.Verify(block); err != nil {
+		return err
+	}
+	if size > 0 && c.Codec() == dag.CodecRaw && int64(len(block)) != size {
+		return fmt.Errorf("block %s sized %d, want %d", c, len(block), size)
+	}
+	return nil
+}
+
+func (s *FileServer) getBlock(node string, root dag.CID, c dag.CID, offset int64, size int64) ([]byte, error) {
+	resp, err := s.request(node, func(reqID string) any {
+		return MessageGetBlock{RequestID: reqID, Root: root.String(), CID: c.String(), Offset: offset, Size: size}
+	})
+	if err != nil {
+		return nil, err
+	}
+	v := resp.(MessageGetBlockResponse)
+	if len(v.Err) > 0 {
+		return nil, fmt.Errorf("%s", v.Err)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := crypto.CopyDecrypt(s.EncKey, bytes.NewReader(v.Data), buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// handleMessageGetBlock serve the block from the block store, or the
+// object holding the content of the root
+func (s *FileServer) handleMessageGetBlock(from string, msg MessageGetBlock) error {
+	resp := MessageGetBlockResponse{RequestID: msg.RequestID}
+	block, err := s.readBlock(msg)
+	if err == nil {
+		buf := new(bytes.Buffer)
+		if _, err = crypto.CopyEncrypt(s.EncKey, bytes.NewReader(block), buf); err == nil {
+			resp.Data = buf.Bytes()
+		}
+	}
+	if err != nil {
+		resp.Err = err.Error()
+	}
+	return s.reply(from, &Message{Payload: resp})
+}
+
+func (s *FileServer) readBlock(msg MessageGetBlock) ([]byte, error) {
+	c, err := dag.Parse(msg.CID)
+	if err != nil {
+		return nil, err
+	}
+	if block, err := s.Storage.GetBlock(c); err == nil {
+		return block, nil
+	}
+	id, key, ok := s.Storage.LookupCID(dag.CID(msg.Root))
+	if !ok || c.Codec() != dag.CodecRaw {
+		return nil, fmt.Errorf("[%s] %w: %s", s.Transport.Addr(), storage.ErrBlockNotFound, c)
+	}
+	return s.readLeaf(id, key, msg.Offset, msg.Size)
+}
+
+// readLeaf the leaf at offset of the object holding the content
+func (s *FileServer) readLeaf(id string, key string, offset int64, size int64) ([]byte, error) {
+	_, r, err := s.Storage.ReadRange(id, key, offset, size)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"github.com/roylic/go-distributed-file-storage/clock"
+	"github.com/roylic/go-distributed-file-storage/crypto"
+	"github.com/roylic/go-distributed-file-storage/storage"
+	"io"
+	"log"
+)
+
+// ConflictStrategy what a replica does with two concurrent writes of an object
+type ConflictStrategy string
+
+const (
+	ConflictLastWriterWins ConflictStrategy = "lww"      // the newest version wins, the other is dropped
+	ConflictKeepSiblings   ConflictStrategy = "siblings" // the newest version is served, the other kept as sibling
+	ConflictCustom         ConflictStrategy = "custom"   // ConflictResolver merges both
+)
+
+// errSuperseded the replica kept another version than the one written,
+// after comparing the clocks or resolving a conflict
+var errSuperseded = errors.New("write superseded")
+
+// Sibling one side of a conflict
+type Sibling struct {
+	Meta *storage.Metadata
+	Data []byte
+}
+
+// ConflictResolver merge two concurrent versions into the content kept,
+// it must be deterministic, every replica resolves the conflict by itself
+type ConflictResolver func(local Sibling, remote Sibling) ([]byte, error)
+
+// Siblings concurrent versions of the file kept next to the served one,
+// a later Store from this node supersedes them
+func (s *FileServer) Siblings(key string) ([]storage.Metadata, error) {
+	return s.Storage.Siblings(s.ID, crypto.HashKey(key))
+}
+
+// writeClock causality of a new write, it follows the local copy &
+// its siblings, so the write supersedes every version seen here
+func (s *FileServer) writeClock(id string, hashedKey string) clock.VClock {
+	vc := clock.VClock{}
+	if s.Storage.Has(id, hashedKey) {
+		if cur, err := s.Storage.Stat(id, hashedKey); err == nil {
+			vc = vc.Merge(cur.Clock)
+		}
+	}
+	if siblings, err := s.Storage.Siblings(id, hashedKey); err == nil {
+		for _, sib := range siblings {
+			vc = vc.Merge(sib.Clock)
+		}
+	}
+	return vc
+}
+
+// applyWrite write a replica of the object, comparing its clock with the
+// local copy: stale writes are dropped, concurrent ones go to the strategy,
+// errSuperseded when the write is not the version served afterwards
+func (s *FileServer) applyWrite(id string, meta storage.Metadata, data []byte) error {
+	return s.applyWriteFrom(id, meta, bytes.NewReader(data))
+}
+
+// applyWriteFrom same as applyWrite, the content read from r. Only a
+// conflict reads it into memory
+func (s *FileServer) applyWriteFrom(id string, meta storage.Metadata, r io.Reader) error {
+	s.Clock.Observe(meta.Clock.Max())
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	cur, order := s.localOrder(id, meta)
+	switch order {
+	case clock.Before:
+		log.Printf("[%s] dropping stale write of (%s) from %s\n", s.Transport.Addr(), meta.Key, meta.Node)
+		return errSuperseded
+	case clock.Concurrent:
+		s.Metrics.Add(MetricConflicts, 1)
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return s.resolveConflict(id, cur, meta, data)
+	}
+	return s.writeObject(id, meta, r)
+}
+
+// applyCommit same as applyWrite for a verified partial transfer, which
+// becomes the object in place. Only a conflict reads it into memory
+func (s *FileServer) applyCommit(id string, meta storage.Metadata, p *storage.PartialTransfer) error {
+	s.Clock.Observe(meta.Clock.Max())
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	cur, order := s.localOrder(id, meta)
+	switch order {
+	case clock.Before:
+		log.Printf("[%s] dropping stale write of (%s) from %s\n", s.Transport.Addr(), meta.Key, meta.Node)
+		_ = p.Remove()
+		return errSuperseded
+	case clock.Concurrent:
+		s.Metrics.Add(MetricConflicts, 1)
+		data, err := p.Bytes()
+		if rmErr := p.Remove(); err == nil {
+			err = rmErr
+		}
+		if err != nil {
+			return err
+		}
+		return s.resolveConflict(id, cur, meta, data)
+	}
+	if err := p.CommitWrite(meta); err != nil {
+		_ = p.Remove()
+		return err
+	}
+	return s.wroteObject(id, meta)
+}
+
+// applyTags edit the tags of the local copy as a write of version with the
+// clock vc, errSuperseded when the copy already follows the edit or a newer
+// concurrent write wins
+func (s *FileServer) applyTags(id string, hashedKey string, set map[string]string, remove []string, version int64, vc clock.VClock) (*storage.Metadata, error) {
+	s.Clock.Observe(version)
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	cur, err := s.Storage.Stat(id, hashedKey)
+	if err != nil {
+		return nil, err
+	}
+	switch vc.Compare(cur.Clock) {
+	case clock.Before, clock.Equal:
+		return cur, errSuperseded
+	case clock.Concurrent:
+		if cur.Version > version {
+			return cur, errSuperseded
+		}
+	}
+	return s.Storage.UpdateTags(id, hashedKey, set, remove, version, cur.Clock.Merge(vc))
+}
+
+// localOrder the local copy & how the write compares to it, After when
+// there is none
+func (s *FileServer) localOrder(id string, meta storage.Metadata) (*storage.Metadata, clock.Ordering) {
+	if !s.Storage.Has(id, meta.Key) {
+		return nil, clock.After
+	}
+	cur, err := s.Storage.Stat(id, meta.Key)
+	if err != nil {
+		return nil, clock.After
+	}
+	return cur, meta.Clock.Compare(cur.Clock)
+}
+
+// writeObject write the content & drop the siblings it supersedes
+func (s *FileServer) writeObject(id string, meta storage.Metadata, r io.Reader) error {
+	if _, err := s.Storage.WriteWithMeta(id, meta.Key, r, meta); err != nil {
+		return err
+	}
+	return s.wroteObject(id, meta)
+}
+
+// wroteObject the object was written: drop the siblings it supersedes,
+// then hold, announce & index it
+func (s *FileServer) wroteObject(id string, meta storage.Metadata) error {
+	if _, err := s.Storage.ClearSiblings(id, meta.Key, meta.Clock); err != nil {
+		return err
+	}
+	s.Holdings.Add(id, meta.Key)
+	s.provide(id, meta.Key)
+	if len(meta.CID) > 0 {
+		if err := s.indexCID(id, meta); err != nil {
+			log.Printf("[%s] index the CID of (%s) failed: %s\n", s.Transport.Addr(), meta.Key, err)
+		}
+	}
+	return nil
+}
+
+// deleteObject write the tombstone & stop announcing the object once
+// the copy is gone, a newer copy stays announced
+func (s *FileServer) deleteObject(id string, hashedKey string, version int64) error {
+	held := s.Storage.Has(id, hashedKey)
+	if err := s.Storage.Tombstone(id, hashedKey, version); err != nil {
+		return err
+	}
+	if held && !s.Storage.Has(id, hashedKey) {
+		s.unprovide(id, hashedKey)
+	}
+	return nil
+}
+
+// resolveConflict settle two concurrent writes according to the strategy
+func (s *FileServer) resolveConflict(id string, cur *storage.Metadata, meta storage.Metadata, data []byte) error {
+	log.Printf("[%s] concurrent writes of (%s) by %s and %s, resolving with %s\n",
+		s.Transport.Addr(), meta.Key, cur.Node, meta.Node, s.ConflictStrategy)
+	remote := SyncEntry{Version: meta.Version, Checksum: meta.Checksum}
+	local := SyncEntry{Version: cur.Version, Checksum: cur.Checksum}
+	remoteWins := remote.newerThan(local)
+	merged := cur.Clock.Merge(meta.Clock)
+
+	switch s.ConflictStrategy {
+	case ConflictKeepSiblings:
+		// clocks are not merged, the sibling stays unseen until a later write
+		if !remoteWins {
+			if err := s.Storage.AddSibling(id, meta.Key, bytes.NewReader(data), meta); err != nil {
+				return err
+			}
+			return errSuperseded
+		}
+		localData, err := s.readLocal(id, cur.Key)
+		if err != nil {
+			return err
+		}
+		if err := s.Storage.AddSibling(id, cur.Key, bytes.NewReader(localData), *cur); err != nil {
+			return err
+		}
+		_, err = s.Storage.WriteWithMeta(id, meta.Key, bytes.NewReader(data), meta)
+		return err
+
+	case ConflictCustom:
+		if s.ConflictResolver == nil {
+			break
+		}
+		localData, err := s.readLocal(id, cur.Key)
+		if err != nil {
+			return err
+		}
+		out, err := s.ConflictResolver(Sibling{Meta: cur, Data: localData}, Sibling{Meta: &meta, Data: data})
+		if err != nil {
+			log.Printf("[%s] resolver failed on (%s), falling back to lww: %s\n", s.Transport.Addr(), meta.Key, err)
+			break
+		}
+		// same result on every replica: the winner's fields, both clocks
+		resolved := meta.Clone()
+		if !remoteWins {
+			resolved = cur.Clone()
+		}
+		resolved.Clock = merged
+		resolved.Version = max(cur.Version, meta.Version) + 1
+		resolved.VersionID = ""
+		if err := s.writeObject(id, resolved, bytes.NewReader(out)); err != nil {
+			return err
+		}
+		return errSuperseded
+	}
+
+	// last writer wins, the winner carries both clocks
+	if !remoteWins {
+		cur.Clock = merged
+		if err := s.Storage.WriteMeta(id, cur.Key, cur); err != nil {
+			return err
+		}
+		return errSuperseded
+	}
+	meta.Clock = merged
+	return s.writeObject(id, meta, bytes.NewReader(data))
+}
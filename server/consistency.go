@@ -0,0 +1,44 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Consistency how many replicas must answer a Store, Get or Delete
+type Consistency string
+
+const (
+	ConsistencyOne    Consistency = "ONE"
+	ConsistencyQuorum Consistency = "QUORUM"
+	ConsistencyAll    Consistency = "ALL"
+)
+
+// ErrConsistency not enough replicas answered for the level
+var ErrConsistency = errors.New("consistency level not met")
+
+// ParseConsistency case-insensitive, empty means ONE
+func ParseConsistency(level string) (Consistency, error) {
+	switch c := Consistency(strings.ToUpper(strings.TrimSpace(level))); c {
+	case "":
+		return ConsistencyOne, nil
+	case ConsistencyOne, ConsistencyQuorum, ConsistencyAll:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown consistency level %q", level)
+}
+
+// required answers out of n replicas, the zero value behaves as ONE
+func (c Consistency) required(n int) int {
+	if n == 0 {
+		return 0
+	}
+	switch c {
+	case ConsistencyQuorum:
+		return n/2 + 1
+	case ConsistencyAll:
+		return n
+	}
+	return 1
+}
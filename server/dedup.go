@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/crypto"
+	"github.com/roylic/go-distributed-file-storage/storage"
+)
+
+// replicateChunks cut the content like the storage does, ask the replica
+// which chunks it holds & send the others only
+func (s *FileServer) replicateChunks(node string, id string, meta *storage.Metadata, data []byte) error {
+	chunks, m := s.Storage.SplitChunks(data)
+	hashes := make([]string, len(m))
+	for i, ref := range m {
+		hashes[i] = ref.Hash
+	}
+	resp, err := s.request(node, func(reqID string) any {
+		return MessageChunkHave{RequestID: reqID, Hashes: hashes}
+	})
+	if err != nil {
+		return err
+	}
+	have := resp.(MessageChunkHaveResponse).Have
+	if len(have) != len(m) {
+		return fmt.Errorf("node %s answered %d chunks of %d", node, len(have), len(m))
+	}
+
+	missing := make(map[string][]byte)
+	for i, ref := range m {
+		if have[i] {
+			s.Metrics.Add(MetricChunksSkipped, 1)
+			continue
+		}
+		if _, ok := missing[ref.Hash]; ok {
+			continue
+		}
+		buf := new(bytes.Buffer)
+		if _, err := crypto.CopyEncrypt(s.EncKey, bytes.NewReader(chunks[i]), buf); err != nil {
+			return err
+		}
+		missing[ref.Hash] = buf.Bytes()
+		s.Metrics.Add(MetricChunksSent, 1)
+	}
+	resp, err = s.request(node, func(reqID string) any {
+		return MessageStoreChunks{RequestID: reqID, ID: id, Key: meta.Key, Meta: meta, Chunks: m, Data: missing}
+	})
+	if err != nil {
+		return err
+	}
+	return checkStoreAck(node, meta, resp.(MessageStoreAck))
+}
+
+// handleMessageChunkHave answer the chunks held in the local chunk store
+func (s *FileServer) handleMessageChunkHave(from string, msg MessageChunkHave) error {
+	resp := MessageChunkHaveResponse{RequestID: msg.RequestID, Have: make([]bool, len(msg.Hashes))}
+	for i, hash := range msg.Hashes {
+		resp.Have[i] = s.Storage.HasChunk(hash)
+	}
+	return s.reply(from, &Message{Payload: resp})
+}
+
+// handleMessageStoreChunks rebuild the content from the chunks received &
+// the local ones, then store it like a streamed replica
+func (s *FileServer) handleMessageStoreChunks(from string, msg MessageStoreChunks) error {
+	peer, ok := s.peerOf(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found in Mapping, end handleMessage logic", from)
+	}
+	ack := MessageStoreFile{ID: msg.ID, Key: msg.Key, RequestID: msg.RequestID}
+	if s.Drainer.Leaving() {
+		return s.ackStore(peer, ack, fmt.Errorf("[%s] node is leaving, refusing (%s)", s.Transport.Addr(), msg.Key))
+	}
+	data, err := s.assembleChunks(msg)
+	if err == nil {
+		err = s.storeReplica(msg.ID, msg.Key, msg.Meta, data)
+	}
+	return s.ackStore(peer, ack, err)
+}
+
+func (s *FileServer) assembleChunks(msg MessageStoreChunks) ([]byte, error) {
+	var data bytes.Buffer
+	for _, ref := range msg.Chunks {
+		var chunk []byte
+		if enc, ok := msg.Data[ref.Hash]; ok {
+			buf := new(bytes.Buffer)
+			if _, err := crypto.CopyDecrypt(s.EncKey, bytes.NewReader(enc), buf); err != nil {
+				return nil, err
+			}
+			chunk = buf.Bytes()
+		} else {
+			var err error
+			if chunk, err = s.Storage.ReadChunk(ref.Hash); err != nil {
+				return nil, err
+			}
+		}
+		if storage.ChunkHash(chunk) != ref.Hash {
+			return nil, fmt.Errorf("chunk %s of (%s): %w", ref.Hash, msg.Key, storage.ErrChecksumMismatch)
+		}
+		data.Write(chunk)
+	}
+	return data.Bytes(), nil
+}
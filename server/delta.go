@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/crypto"
+	"github.com/roylic/go-distributed-file-storage/rsync"
+	"github.com/roylic/go-distributed-file-storage/storage"
+)
+
+// DefaultDeltaThreshold updates of replicas from this size send the changed bytes only
+const DefaultDeltaThreshold = 64 << 10
+
+var (
+	// errNoBase the replica holds no copy to apply a delta to
+	errNoBase = errors.New("no copy to apply the delta to")
+	// errDeltaTooBig most of the content changed, sent whole instead
+	errDeltaTooBig = errors.New("delta not worth sending")
+)
+
+func (s *FileServer) deltaThreshold() int64 {
+	if s.DeltaThreshold != 0 {
+		return s.DeltaThreshold
+	}
+	return DefaultDeltaThreshold
+}
+
+// holdsEarlier the node holds an earlier version of the object, a delta
+// may then be worth signing its copy
+func (s *FileServer) holdsEarlier(node string, id string, meta *storage.Metadata) bool {
+	entry, has, err := s.entryOn(node, id, meta.Key)
+	return err == nil && has && entry.Version < meta.Version && entry.Checksum != meta.Checksum
+}
+
+// replicateDelta sign the replica's copy, then send the blocks it misses
+// only, the rest copied from its copy
+func (s *FileServer) replicateDelta(node string, id string, meta *storage.Metadata, data []byte) error {
+	resp, err := s.request(node, func(reqID string) any {
+		return MessageDeltaSignature{RequestID: reqID, ID: id, Key: meta.Key}
+	})
+	if err != nil {
+		return err
+	}
+	sig := resp.(MessageDeltaSignatureResponse)
+	if sig.Signature == nil {
+		return errNoBase
+	}
+
+	ops := rsync.Delta(sig.Signature, data)
+	literals := rsync.Literals(ops)
+	if literals > meta.Size/2 {
+		return fmt.Errorf("%w: %d of %d bytes changed", errDeltaTooBig, literals, meta.Size)
+	}
+	sent := make([]rsync.Op, len(ops))
+	for i, op := range ops {
+		sent[i] = op
+		if op.Kind != rsync.OpLiteral {
+			continue
+		}
+		buf := new(bytes.Buffer)
+		if _, err := crypto.CopyEncrypt(s.EncKey, bytes.NewReader(op.Data), buf); err != nil {
+			return err
+		}
+		sent[i].Data = buf.Bytes()
+	}
+	resp, err = s.request(node, func(reqID string) any {
+		return MessageStoreDelta{
+			RequestID: reqID,
+			ID:        id,
+			Key:       meta.Key,
+			Meta:      meta,
+			Base:      sig.Checksum,
+			BlockSize: sig.Signature.BlockSize,
+			Ops:       sent,
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err := checkStoreAck(node, meta, resp.(MessageStoreAck)); err != nil {
+		return err
+	}
+	s.Metrics.Add(MetricDeltaLiteralBytes, literals)
+	s.Metrics.Add(MetricDeltaMatchedBytes, meta.Size-literals)
+	return nil
+}
+
+// handleMessageDeltaSignature answer the checksums of the local copy
+func (s *FileServer) handleMessageDeltaSignature(from string, msg MessageDeltaSignature) error {
+	resp := MessageDeltaSignatureResponse{RequestID: msg.RequestID}
+	if s.Storage.Has(msg.ID, msg.Key) {
+		if data, err := s.readLocal(msg.ID, msg.Key); err == nil {
+			sum := sha256.Sum256(data)
+			resp.Checksum = hex.EncodeToString(sum[:])
+			resp.Signature = rsync.Sign(data, rsync.BlockSize(int64(len(data))))
+		}
+	}
+	return s.reply(from, &Message{Payload: resp})
+}
+
+// handleMessageStoreDelta rebuild the content from the local copy & the
+// delta, then store it like a streamed replica
+func (s *FileServer) handleMessageStoreDelta(from string, msg MessageStoreDelta) error {
+	peer, ok := s.peerOf(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found in Mapping, end handleMessage logic", from)
+	}
+	ack := MessageStoreFile{ID: msg.ID, Key: msg.Key, RequestID: msg.RequestID}
+	if s.Drainer.Leaving() {
+		return s.ackStore(peer, ack, fmt.Errorf("[%s] node is leaving, refusing (%s)", s.Transport.Addr(), msg.Key))
+	}
+	data, err := s.applyDelta(msg)
+	if err == nil {
+		err = s.storeReplica(msg.ID, msg.Key, msg.Meta, data)
+	}
+	return s.ackStore(peer, ack, err)
+}
+
+func (s *FileServer) applyDelta(msg MessageStoreDelta) ([]byte, error) {
+	base, err := s.readLocal(msg.ID, msg.Key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(base)
+	if hex.EncodeToString(sum[:]) != msg.Base {
+		return nil, fmt.Errorf("copy of (%s) changed since it was signed", msg.Key)
+	}
+	ops := make([]rsync.Op, len(msg.Ops))
+	for i, op := range msg.Ops {
+		ops[i] = op
+		if op.Kind != rsync.OpLiteral {
+			continue
+		}
+		buf := new(bytes.Buffer)
+		if _, err := crypto.CopyDecrypt(s.EncKey, bytes.NewReader(op.Data), buf); err != nil {
+			return nil, err
+		}
+		ops[i].Data = buf.Bytes()
+	}
+	data, err := rsync.Apply(base, msg.BlockSize, ops)
+	if err != nil {
+		return nil, err
+	}
+	sum = sha256.Sum256(data)
+	if msg.Meta == nil || hex.EncodeToString(sum[:]) != msg.Meta.Checksum {
+		return nil, fmt.Errorf("(%s) rebuilt from the delta: %w", msg.Key, storage.ErrChecksumMismatch)
+	}
+	return data, nil
+}
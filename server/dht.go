@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/dag"
+	"github.com/roylic/go-distributed-file-storage/dht"
+	"github.com/roylic/go-distributed-file-storage/p2p"
+	"github.com/roylic/go-distributed-file-storage/storage"
+	"log"
+	"time"
+)
+
+// DefaultProvideInterval time between two announcements of the local
+// objects, shorter than the provider records TTL
+const DefaultProvideInterval = 12 * time.Hour
+
+// dhtTransport carry the DHT requests, dialing the nodes not connected
+type dhtTransport struct {
+	s *FileServer
+}
+
+func (t dhtTransport) Call(to string, req dht.Request) (dht.Response, error) {
+	if _, err := t.s.connect(to); err != nil {
+		return dht.Response{}, err
+	}
+	resp, err := t.s.request(to, func(reqID string) any {
+		return MessageDHTRequest{RequestID: reqID, Req: req}
+	})
+	if err != nil {
+		return dht.Response{}, err
+	}
+	return resp.(MessageDHTResponse).Resp, nil
+}
+
+// providerKey position of the object in the DHT keyspace
+func providerKey(id string, hashedKey string) dht.ID {
+	return dht.HashID(id + "/" + hashedKey)
+}
+
+// provide announce this node holds the object, in the background
+func (s *FileServer) provide(id string, hashedKey string) {
+	go func() {
+		if err := s.DHT.Provide(providerKey(id, hashedKey)); err != nil {
+			log.Printf("[%s] announce (%s) failed: %s\n", s.Transport.Addr(), hashedKey, err)
+		}
+	}()
+}
+
+// unprovide withdraw the provider record of a deleted object, in the background
+func (s *FileServer) unprovide(id string, hashedKey string) {
+	go func() {
+		if err := s.DHT.Unprovide(providerKey(id, hashedKey)); err != nil {
+			log.Printf("[%s] withdraw (%s) failed: %s\n", s.Transport.Addr(), hashedKey, err)
+		}
+	}()
+}
+
+// providersOf the holders of the object found through the DHT
+func (s *FileServer) providersOf(id string, hashedKey string) []string {
+	return s.DHT.FindProviders(providerKey(id, hashedKey))
+}
+
+// connect the node, dialing it when not connected yet, until its hello
+func (s *FileServer) connect(node string) (p2p.Peer, error) {
+	if peer, ok := s.nodePeer(node); ok {
+		return peer, nil
+	}
+	if node == s.Transport.Addr() {
+		return nil, fmt.Errorf("can not connect to self")
+	}
+	s.peerLock.Lock()
+	connected := len(s.peers)
+	s.peerLock.Unlock()
+	if s.MaxPeers > 0 && connected >= s.MaxPeers {
+		return nil, ErrPeerLimit
+	}
+
+	s.PeerExchange.dialed(node)
+	if err := s.Transport.Dial(node); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(DefaultRequestTimeout)
+	for time.Now().Before(deadline) {
+		if peer, ok := s.nodePeer(node); ok {
+			return peer, nil
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-s.quitCh:
+			return nil, fmt.Errorf("server stopped")
+		}
+	}
+	return nil, fmt.Errorf("node %s did not say hello after %s", node, DefaultRequestTimeout)
+}
+
+// provideLoop announce every local object again before the records expire
+func (s *FileServer) provideLoop() {
+	ticker := time.NewTicker(DefaultProvideInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.quitCh:
+			return
+		}
+		err := s.Storage.Walk(func(id string, meta *storage.Metadata) error {
+			if err := s.DHT.Provide(providerKey(id, meta.Key)); err != nil {
+				log.Printf("[%s] announce (%s) failed: %s\n", s.Transport.Addr(), meta.Key, err)
+			}
+			if len(meta.CID) > 0 {
+				if err := s.DHT.Provide(cidProviderKey(dag.CID(meta.CID))); err != nil {
+					log.Printf("[%s] announce (%s) failed: %s\n", s.Transport.Addr(), meta.CID, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("[%s] announce the local objects failed: %s\n", s.Transport.Addr(), err)
+		}
+	}
+}
+
+// handleMessageDHTRequest answer from the routing table & provider records
+func (s *FileServer) handleMessageDHTRequest(from string, msg MessageDHTRequest) error {
+	resp := s.DHT.Handle(msg.Req)
+	return s.reply(from, &Message{Payload: MessageDHTResponse{RequestID: msg.RequestID, Resp: resp}})
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/storage"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	drainStateFile    = "_drain.json" // under StorageRoot, survive restarts
+	DefaultDrainRetry = 2 * time.Second
+	NodeActive        = "active"
+	NodeLeaving       = "leaving"
+	NodeDrained       = "drained" // every object replicated elsewhere, safe to shut down
+)
+
+// DrainStatus progress of draining this node
+type DrainStatus struct {
+	Node       string
+	State      string
+	Passes     int
+	Objects    int // objects held locally in the last pass
+	Confirmed  int // objects confirmed on all their new replicas
+	Pending    int // objects still missing a replica
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// Drainer copy every local object to the other nodes until the
+// replication targets are met, local copies are never deleted
+type Drainer struct {
+	s *FileServer
+
+	mu      sync.Mutex
+	status  DrainStatus
+	running bool
+}
+
+func NewDrainer(s *FileServer) *Drainer {
+	return &Drainer{
+		s:      s,
+		status: DrainStatus{Node: s.Transport.Addr(), State: NodeActive},
+	}
+}
+
+// Status snapshot of the progress
+func (d *Drainer) Status() DrainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status
+}
+
+// Leaving this node is being drained or already drained
+func (d *Drainer) Leaving() bool {
+	return d.Status().State != NodeActive
+}
+
+// statePath persisted drain state
+func (d *Drainer) statePath() string {
+	return filepath.Join(d.s.Storage.Root, drainStateFile)
+}
+
+// load restore the persisted state, called before the server starts
+func (d *Drainer) load() error {
+	b, err := os.ReadFile(d.statePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return json.Unmarshal(b, &d.status)
+}
+
+// save persist the state, caller holds the lock
+func (d *Drainer) save() error {
+	b, err := json.Marshal(d.status)
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomic(d.statePath(), b, 0o644)
+}
+
+// Start mark the node as leaving & run the drain in the background,
+// calling it again on a leaving node only resumes the drain
+func (d *Drainer) Start() error {
+	d.mu.Lock()
+	if d.status.State == NodeActive {
+		d.status.State = NodeLeaving
+		d.status.StartedAt = time.Now()
+		if err := d.save(); err != nil {
+			d.mu.Unlock()
+			return err
+		}
+	}
+	if d.running || d.status.State == NodeDrained {
+		d.mu.Unlock()
+		return nil
+	}
+	d.running = true
+	d.mu.Unlock()
+
+	// stop accepting new writes, the other nodes do the same
+	d.s.Placement.Remove(d.s.Transport.Addr())
+	if err := d.s.announceState(NodeLeaving); err != nil {
+		log.Printf("[%s] announce leaving failed: %s\n", d.s.Transport.Addr(), err)
+	}
+	go d.loop()
+	return nil
+}
+
+// Cancel put the leaving or drained node back in service, its local
+// copies are still there, the rebalancer moves what no longer belongs
+func (d *Drainer) Cancel() error {
+	d.mu.Lock()
+	if d.status.State == NodeActive {
+		d.mu.Unlock()
+		return nil
+	}
+	d.status = DrainStatus{Node: d.s.Transport.Addr(), State: NodeActive}
+	err := d.save()
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	d.s.Placement.Add(d.s.Transport.Addr())
+	if err := d.s.announceState(NodeActive); err != nil {
+		log.Printf("[%s] announce active failed: %s\n", d.s.Transport.Addr(), err)
+	}
+	d.s.Rebalancer.Trigger()
+	return nil
+}
+
+// loop run passes until every object is replicated elsewhere
+func (d *Drainer) loop() {
+	defer func() {
+		d.mu.Lock()
+		d.running = false
+		d.mu.Unlock()
+	}()
+	for {
+		if !d.Leaving() {
+			return // cancelled
+		}
+		if d.pass() {
+			d.mu.Lock()
+			if d.status.State != NodeLeaving {
+				d.mu.Unlock()
+				return
+			}
+			d.status.State = NodeDrained
+			d.status.FinishedAt = time.Now()
+			err := d.save()
+			d.mu.Unlock()
+			if err != nil {
+				log.Printf("[%s] persist drain state failed: %s\n", d.s.Transport.Addr(), err)
+			}
+			_ = d.s.announceState(NodeDrained)
+			log.Printf("[%s] drained, the node can be shut down safely\n", d.s.Transport.Addr())
+			return
+		}
+		select {
+		case <-time.After(DefaultDrainRetry):
+		case <-d.s.quitCh:
+			return
+		}
+	}
+}
+
+// pass copy the local objects to their targets, true when all confirmed
+func (d *Drainer) pass() bool {
+	var objects []localObject
+	err := d.s.Storage.Walk(func(id string, meta *storage.Metadata) error {
+		objects = append(objects, localObject{id: id, meta: meta})
+		return nil
+	})
+	if err != nil {
+		log.Printf("[%s] drain scanning failed: %s\n", d.s.Transport.Addr(), err)
+		return false
+	}
+
+	confirmed := 0
+	for _, obj := range objects {
+		targets := d.s.placeOf(obj.id, obj.meta)
+		if _, err := d.s.copyToTargets(obj, targets, 0); err == nil {
+			confirmed++
+		}
+	}
+	d.mu.Lock()
+	d.status.Passes++
+	d.status.Objects = len(objects)
+	d.status.Confirmed = confirmed
+	d.status.Pending = len(objects) - confirmed
+	d.mu.Unlock()
+	return confirmed == len(objects)
+}
+
+// copyToTargets make sure every target of the placement holds the object,
+// streamed from the disk at most rate bytes per second (0 unlimited),
+// return the bytes sent, an object without any target is never confirmed
+func (s *FileServer) copyToTargets(obj localObject, targets []string, rate int64) (int64, error) {
+	if len(targets) == 0 {
+		return 0, fmt.Errorf("no node to hold (%s)", obj.meta.Key)
+	}
+	var sent int64
+	for _, node := range targets {
+		if node == s.Transport.Addr() {
+			continue
+		}
+		has, err := s.hasOnNode(node, obj.id, obj.meta.Key, obj.meta.Checksum)
+		if err != nil {
+			return sent, err
+		}
+		if has {
+			continue
+		}
+		n, err := s.copyTo(node, obj, rate)
+		if err != nil {
+			return sent, err
+		}
+		sent += n
+	}
+	return sent, nil
+}
+
+// copyTo stream the local copy of the object to the node
+func (s *FileServer) copyTo(node string, obj localObject, rate int64) (int64, error) {
+	size, r, err := s.Storage.Read(obj.id, obj.meta.Key)
+	if err != nil {
+		return 0, err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		return 0, fmt.Errorf("(%s) is not seekable", obj.meta.Key)
+	}
+	if size != obj.meta.Size {
+		return 0, fmt.Errorf("(%s) changed since it was scanned", obj.meta.Key)
+	}
+	return size, s.replicateFrom(node, obj.id, obj.meta, &rateReader{r: rs, rate: rate, quit: s.quitCh})
+}
+
+// announceState tell every peer the state of this node
+func (s *FileServer) announceState(state string) error {
+	msg := Message{Payload: MessageNodeState{Node: s.Transport.Addr(), State: state}}
+	return s.broadcast(&msg)
+}
+
+// Drain start draining the node, forwarded when it is not this one
+func (s *FileServer) Drain(node string) error {
+	if node == s.Transport.Addr() {
+		return s.Drainer.Start()
+	}
+	peer, ok := s.nodePeer(node)
+	if !ok {
+		return fmt.Errorf("node %s is not connected", node)
+	}
+	return s.send(peer, &Message{Payload: MessageNodeDrain{Node: node}})
+}
+
+// Undrain cancel the drain of the node, forwarded when it is not this one
+func (s *FileServer) Undrain(node string) error {
+	if node == s.Transport.Addr() {
+		return s.Drainer.Cancel()
+	}
+	peer, ok := s.nodePeer(node)
+	if !ok {
+		return fmt.Errorf("node %s is not connected", node)
+	}
+	return s.send(peer, &Message{Payload: MessageNodeDrain{Node: node, Cancel: true}})
+}
+
+// NodeStates state of this node and every node known
+func (s *FileServer) NodeStates() map[string]string {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	states := map[string]string{s.Transport.Addr(): s.Drainer.Status().State}
+	for node := range s.nodes {
+		states[node] = NodeActive
+	}
+	for node, state := range s.nodeStates {
+		if _, ok := s.nodes[node]; ok {
+			states[node] = state
+		}
+	}
+	return states
+}
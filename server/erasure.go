@@ -0,0 +1,813 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/clock"
+	"github.com/roylic/go-distributed-file-storage/crypto"
+	"github.com/roylic/go-distributed-file-storage/erasure"
+	"github.com/roylic/go-distributed-file-storage/storage"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// tags of a shard, enough to rebuild the object from any k of them
+const (
+	tagShardObject   = "ec-object"   // hashed key of the object
+	tagShardIndex    = "ec-index"    // 0..k-1 data, k..k+m-1 parity
+	tagShardData     = "ec-k"        // data shards
+	tagShardParity   = "ec-m"        // parity shards
+	tagShardSize     = "ec-size"     // of the object
+	tagShardChecksum = "ec-checksum" // of the object
+	tagShardNodes    = "ec-nodes"    // the stripe was written on, shard i on the i-th
+)
+
+// stripeChunk bytes of every shard coded at once, the shards are coded
+// column by column through spool files, never held whole
+const stripeChunk = 1 << 20
+
+var (
+	ErrNotEnoughNodes = errors.New("not enough nodes for the shards")
+	// errNoStripe no shard of the object found, it may be replicated
+	errNoStripe = errors.New("no shard of the object")
+)
+
+// SetErasure store the objects of this server's namespace as k data & m
+// parity shards spread across k+m distinct nodes, k <= 0 goes back to
+// full replication. The objects already stored keep their layout
+func (s *FileServer) SetErasure(k, m int) error {
+	if k > 0 {
+		if _, err := erasure.New(k, m); err != nil {
+			return err
+		}
+	}
+	return s.Storage.SetErasure(s.ID, k, m)
+}
+
+// shardKey the shards are objects of their own
+func shardKey(hashedKey string, i int) string {
+	return crypto.HashKey(hashedKey + "/shard/" + strconv.Itoa(i))
+}
+
+// isShard whether the object is a shard of an erasure coded one
+func isShard(meta *storage.Metadata) bool {
+	return len(meta.Tags[tagShardObject]) > 0
+}
+
+// stripe the shards of an object & where they were written, shard i on nodes[i]
+type stripe struct {
+	id     string
+	object string
+	k, m   int
+	nodes  []string
+}
+
+// stripeOf the stripe of a new write, on the nodes of the current ring
+func (s *FileServer) stripeOf(id string, object string, k, m int) stripe {
+	return stripe{id: id, object: object, k: k, m: m, nodes: s.Placement.Locate(object, k+m)}
+}
+
+func (st stripe) sameAs(o stripe) bool {
+	return st.id == o.id && st.object == o.object && st.k == o.k && st.m == o.m && slices.Equal(st.nodes, o.nodes)
+}
+
+// stripeFromShard the stripe a shard belongs to, on the nodes recorded
+// when it was written
+func (s *FileServer) stripeFromShard(id string, meta *storage.Metadata) (stripe, int, bool) {
+	k, err1 := strconv.Atoi(meta.Tags[tagShardData])
+	m, err2 := strconv.Atoi(meta.Tags[tagShardParity])
+	i, err3 := strconv.Atoi(meta.Tags[tagShardIndex])
+	if err1 != nil || err2 != nil || err3 != nil || k < 1 || m < 0 {
+		return stripe{}, 0, false
+	}
+	nodes := meta.Tags[tagShardNodes]
+	if len(nodes) == 0 {
+		// written before the nodes were recorded
+		return s.stripeOf(id, meta.Tags[tagShardObject], k, m), i, true
+	}
+	return stripe{id: id, object: meta.Tags[tagShardObject], k: k, m: m, nodes: strings.Split(nodes, ",")}, i, true
+}
+
+// shardNode the node shard i belongs on: the one it was written on while
+// it is in the ring, the one the ring puts it on once that node left
+func (s *FileServer) shardNode(st stripe, i int) string {
+	if i < len(st.nodes) && contains(s.Placement.Nodes(), st.nodes[i]) {
+		return st.nodes[i]
+	}
+	if ring := s.Placement.Locate(st.object, st.k+st.m); i < len(ring) {
+		return ring[i]
+	}
+	if i < len(st.nodes) {
+		return st.nodes[i]
+	}
+	return ""
+}
+
+// shardNodes the nodes that may hold shard i, the one it was written on &
+// the one the ring puts it on now
+func shardNodes(st stripe, i int, ring []string) []string {
+	var nodes []string
+	if i < len(st.nodes) {
+		nodes = append(nodes, st.nodes[i])
+	}
+	if i < len(ring) && !contains(nodes, ring[i]) {
+		nodes = append(nodes, ring[i])
+	}
+	return nodes
+}
+
+// placeOf the nodes the object belongs on, a shard on the node of its index
+func (s *FileServer) placeOf(id string, meta *storage.Metadata) []string {
+	if st, i, ok := s.stripeFromShard(id, meta); ok {
+		if node := s.shardNode(st, i); len(node) > 0 {
+			return []string{node}
+		}
+	}
+	return s.Placement.Locate(meta.Key, s.ReplicationFactor)
+}
+
+// storeErasure write the object read from content as k+m shards, one per
+// node. It returns once k shards plus the parity required by the
+// consistency level are written, ONE being k shards & ALL every shard.
+// done is called once every shard is sent, content is no longer read then
+func (s *FileServer) storeErasure(id string, key string, meta storage.Metadata, content io.ReaderAt, k, m int, level Consistency, done func()) (*StoreResult, error) {
+	finish := func() {
+		if done != nil {
+			done()
+		}
+	}
+	enc, err := erasure.New(k, m)
+	if err != nil {
+		finish()
+		return nil, err
+	}
+	st := s.stripeOf(id, meta.Key, k, m)
+	res := &StoreResult{Key: meta.Key, CID: meta.CID, Version: meta.Version, Replicas: st.nodes}
+	if len(st.nodes) < k+m {
+		finish()
+		return res, fmt.Errorf("server[%s] store (%s): %w, %d of %d", s.Transport.Addr(), key, ErrNotEnoughNodes, len(st.nodes), k+m)
+	}
+	parity, sums, err := s.encodeStripe(enc, content, meta.Size)
+	if err != nil {
+		finish()
+		return res, err
+	}
+	size := enc.ShardSize(meta.Size)
+	shard := func(i int) io.ReadSeeker {
+		if i < k {
+			return io.NewSectionReader(zeroPadded{r: content, size: meta.Size}, int64(i)*size, size)
+		}
+		return io.NewSectionReader(parity[i-k], 0, size)
+	}
+
+	template := storage.Metadata{
+		Uploader:  meta.Uploader,
+		CreatedAt: meta.CreatedAt,
+		Version:   meta.Version,
+		Node:      meta.Node,
+		Clock:     clock.VClock{s.Transport.Addr(): meta.Version},
+		Tags: map[string]string{
+			tagShardObject:   meta.Key,
+			tagShardData:     strconv.Itoa(k),
+			tagShardParity:   strconv.Itoa(m),
+			tagShardSize:     strconv.FormatInt(meta.Size, 10),
+			tagShardChecksum: meta.Checksum,
+			tagShardNodes:    strings.Join(st.nodes, ","),
+		},
+	}
+	type ack struct {
+		node string
+		err  error
+	}
+	acks := make(chan ack, k+m)
+	var wg sync.WaitGroup
+	for i, node := range st.nodes {
+		wg.Add(1)
+		go func(i int, node string) {
+			defer wg.Done()
+			sm := shardMeta(template, meta.Key, i, size, sums[i])
+			err := s.writeShard(node, id, &sm, shard(i))
+			if err != nil {
+				log.Printf("server[%s] store shard %d of (%s) to %s failed: %s\n", s.Transport.Addr(), i, key, node, err)
+				if node != s.Transport.Addr() {
+					if err := s.Hints.AddFrom(node, id, &sm, shard(i)); err != nil {
+						log.Printf("server[%s] hint (%s) for %s failed: %s\n", s.Transport.Addr(), key, node, err)
+					}
+				}
+			}
+			acks <- ack{node: node, err: err}
+		}(i, node)
+	}
+	go func() {
+		wg.Wait()
+		dropSpools(parity)
+		finish()
+	}()
+
+	need := k - 1 + level.required(m+1)
+	var errs []error
+	for i := 0; i < k+m && len(res.Acked) < need; i++ {
+		a := <-acks
+		if a.err != nil {
+			errs = append(errs, a.err)
+			continue
+		}
+		res.Acked = append(res.Acked, a.node)
+	}
+	if len(res.Acked) < need {
+		return res, fmt.Errorf("server[%s] store (%s): %w, %d of %d shards acknowledged: %w",
+			s.Transport.Addr(), key, ErrConsistency, len(res.Acked), need, errors.Join(errs...))
+	}
+	return res, nil
+}
+
+// writeShard stream the shard to its node, local disk included
+func (s *FileServer) writeShard(node string, id string, meta *storage.Metadata, r io.ReadSeeker) error {
+	if node != s.Transport.Addr() {
+		return s.replicateFrom(node, id, meta, r)
+	}
+	if err := s.applyWriteFrom(id, *meta, r); !errors.Is(err, errSuperseded) {
+		return err
+	}
+	return nil
+}
+
+// encodeStripe compute the parity shards of the content into spool files,
+// returns them with the checksums of every shard
+func (s *FileServer) encodeStripe(enc *erasure.Encoder, content io.ReaderAt, size int64) (parity []*os.File, sums []string, err error) {
+	k, m := enc.DataShards(), enc.ParityShards()
+	shardSize := enc.ShardSize(size)
+	parity = make([]*os.File, m)
+	defer func() {
+		if err != nil {
+			dropSpools(parity)
+		}
+	}()
+	for i := range parity {
+		if parity[i], err = s.Storage.CreateSpool(); err != nil {
+			return nil, nil, err
+		}
+	}
+	data := zeroPadded{r: content, size: size}
+	hashes := make([]hash.Hash, k+m)
+	col := make([][]byte, k+m)
+	for i := range col {
+		hashes[i] = sha256.New()
+		col[i] = make([]byte, min(stripeChunk, shardSize))
+	}
+	for off := int64(0); off < shardSize; off += stripeChunk {
+		n := min(stripeChunk, shardSize-off)
+		for i := range col {
+			col[i] = col[i][:n]
+			if i < k {
+				if _, err := data.ReadAt(col[i], int64(i)*shardSize+off); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		if err := enc.Encode(col); err != nil {
+			return nil, nil, err
+		}
+		for i := range col {
+			hashes[i].Write(col[i])
+			if i < k {
+				continue
+			}
+			if _, err := parity[i-k].Write(col[i]); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return parity, hexSums(hashes), nil
+}
+
+// zeroPadded the content followed by zeros, the last data shards are padded
+type zeroPadded struct {
+	r    io.ReaderAt
+	size int64
+}
+
+func (z zeroPadded) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	if off < z.size {
+		var err error
+		n, err = z.r.ReadAt(p[:min(int64(len(p)), z.size-off)], off)
+		if err != nil && (err != io.EOF || off+int64(n) < z.size) {
+			return n, err
+		}
+	}
+	clear(p[n:])
+	return len(p), nil
+}
+
+func hexSums(hashes []hash.Hash) []string {
+	sums := make([]string, len(hashes))
+	for i, h := range hashes {
+		if h != nil {
+			sums[i] = hex.EncodeToString(h.Sum(nil))
+		}
+	}
+	return sums
+}
+
+// dropSpools close & remove the spool files
+func dropSpools(files []*os.File) {
+	for _, f := range files {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
+}
+
+// shardMeta the metadata of shard i, from the one shared by the stripe
+func shardMeta(template storage.Metadata, object string, i int, size int64, checksum string) storage.Metadata {
+	meta := template
+	meta.Key = shardKey(object, i)
+	meta.Size = size
+	meta.Checksum = checksum
+	meta.Tags = make(map[string]string, len(template.Tags)+1)
+	for k, v := range template.Tags {
+		meta.Tags[k] = v
+	}
+	meta.Tags[tagShardIndex] = strconv.Itoa(i)
+	return meta
+}
+
+// stripeShards the shards of a stripe found on the nodes, by index
+type stripeShards struct {
+	metas   []*storage.Metadata // nil when not found
+	holders []string            // the node each one was found on
+	newest  *storage.Metadata   // of the newest version among them
+}
+
+// getErasure rebuild the object from any k shards of its newest version,
+// missing shards are regenerated in the background
+func (s *FileServer) getErasure(key string, hashedKey string, k, m int) (io.Reader, error) {
+	st, found, err := s.locateStripe(s.ID, hashedKey, k, m)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := erasure.New(st.k, st.m)
+	if err != nil {
+		return nil, err
+	}
+	size, _ := strconv.ParseInt(found.newest.Tags[tagShardSize], 10, 64)
+	shardSize := enc.ShardSize(size)
+	files := s.readShards(st, found, shardSize)
+	defer dropSpools(files)
+	present := 0
+	for _, f := range files {
+		if f != nil {
+			present++
+		}
+	}
+	if _, err := s.rebuildShards(enc, files, shardSize, st.k); err != nil {
+		return nil, fmt.Errorf("server[%s] file (%s): %w", s.Transport.Addr(), key, err)
+	}
+	r, err := s.joinStripe(files[:st.k], shardSize, size, found.newest.Tags[tagShardChecksum])
+	if err != nil {
+		return nil, fmt.Errorf("server[%s] file (%s): %w", s.Transport.Addr(), key, err)
+	}
+	log.Printf("[%s] rebuilt (%s) from %d of %d shards\n", s.Transport.Addr(), key, present, st.k+st.m)
+	if present < st.k+st.m {
+		go func() {
+			if _, err := s.repairStripe(st, false); err != nil {
+				log.Printf("[%s] repair shards of (%s) failed: %s\n", s.Transport.Addr(), key, err)
+			}
+		}()
+	}
+	return r, nil
+}
+
+// locateStripe the stripe of the newest version of the object & its
+// shards. The stripe is known from a local shard, else from the shards on
+// the nodes of the ring, else from any shard a connected node holds
+func (s *FileServer) locateStripe(id string, object string, k, m int) (stripe, stripeShards, error) {
+	st := s.stripeOf(id, object, k, m)
+	if meta := s.localShard(id, object, k+m); meta != nil {
+		if local, _, ok := s.stripeFromShard(id, meta); ok {
+			st = local
+		}
+	}
+	next, found, err := s.newestStripe(st)
+	if !errors.Is(err, errNoStripe) {
+		return next, found, err
+	}
+	if meta := s.findShard(id, object, k+m); meta != nil {
+		if elsewhere, _, ok := s.stripeFromShard(id, meta); ok {
+			return s.newestStripe(elsewhere)
+		}
+	}
+	return next, found, err
+}
+
+// newestStripe the shards of the stripe, followed to the nodes the newest
+// version among them was written on when these differ
+func (s *FileServer) newestStripe(st stripe) (stripe, stripeShards, error) {
+	found := s.statShards(st)
+	if found.newest == nil {
+		return st, found, errNoStripe
+	}
+	if next, _, ok := s.stripeFromShard(st.id, found.newest); ok && !next.sameAs(st) {
+		st, found = next, s.statShards(next)
+		if found.newest == nil {
+			return st, found, errNoStripe
+		}
+	}
+	return st, found, nil
+}
+
+// localShard the metadata of any of the first n shards held locally
+func (s *FileServer) localShard(id string, object string, n int) *storage.Metadata {
+	for i := 0; i < n; i++ {
+		key := shardKey(object, i)
+		if !s.Storage.Has(id, key) {
+			continue
+		}
+		if meta, err := s.Storage.Stat(id, key); err == nil && isShard(meta) {
+			return meta
+		}
+	}
+	return nil
+}
+
+// findShard the newest metadata of the first n shards of the object among
+// the nodes holding them, asked at once, nil when none does
+func (s *FileServer) findShard(id string, object string, n int) *storage.Metadata {
+	var (
+		mu     sync.Mutex
+		newest *storage.Metadata
+		wg     sync.WaitGroup
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			meta := s.newestMeta(s.candidateNodes(id, key), id, key)
+			if meta == nil || !isShard(meta) {
+				return
+			}
+			mu.Lock()
+			if newest == nil || meta.Version > newest.Version {
+				newest = meta
+			}
+			mu.Unlock()
+		}(shardKey(object, i))
+	}
+	wg.Wait()
+	return newest
+}
+
+// statShards ask the metadata of every shard of the stripe, of the node it
+// was written on & of the one the ring puts it on now
+func (s *FileServer) statShards(st stripe) stripeShards {
+	n := st.k + st.m
+	found := stripeShards{metas: make([]*storage.Metadata, n), holders: make([]string, n)}
+	ring := s.Placement.Locate(st.object, n)
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for i := 0; i < n; i++ {
+		for _, node := range shardNodes(st, i, ring) {
+			wg.Add(1)
+			go func(i int, node string) {
+				defer wg.Done()
+				meta, err := s.getShard(node, st.id, shardKey(st.object, i))
+				if err != nil || meta == nil {
+					return
+				}
+				mu.Lock()
+				if cur := found.metas[i]; cur == nil || meta.Version > cur.Version {
+					found.metas[i], found.holders[i] = meta, node
+				}
+				mu.Unlock()
+			}(i, node)
+		}
+	}
+	wg.Wait()
+	for _, meta := range found.metas {
+		if meta != nil && (found.newest == nil || meta.Version > found.newest.Version) {
+			found.newest = meta
+		}
+	}
+	return found
+}
+
+// readShards fetch the shards of the newest version to spool files, the
+// shards failing their size or checksum are left out
+func (s *FileServer) readShards(st stripe, found stripeShards, shardSize int64) []*os.File {
+	files := make([]*os.File, len(found.metas))
+	var wg sync.WaitGroup
+	for i, meta := range found.metas {
+		if meta == nil || meta.Version != found.newest.Version {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, meta *storage.Metadata) {
+			defer wg.Done()
+			node := found.holders[i]
+			if meta.Size != shardSize {
+				log.Printf("[%s] shard %d of (%s) on %s is %d bytes, want %d\n", s.Transport.Addr(), i, st.object, node, meta.Size, shardSize)
+				return
+			}
+			f, err := s.Storage.CreateSpool()
+			if err != nil {
+				log.Printf("[%s] spool shard %d of (%s) failed: %s\n", s.Transport.Addr(), i, st.object, err)
+				return
+			}
+			h := sha256.New()
+			err = s.fetchShard(node, st.id, meta.Key, io.MultiWriter(f, h))
+			if err == nil && hex.EncodeToString(h.Sum(nil)) != meta.Checksum {
+				err = storage.ErrChecksumMismatch
+			}
+			if err != nil {
+				log.Printf("[%s] read shard %d of (%s) from %s failed: %s\n", s.Transport.Addr(), i, st.object, node, err)
+				dropSpools([]*os.File{f})
+				return
+			}
+			files[i] = f
+		}(i, meta)
+	}
+	wg.Wait()
+	return files
+}
+
+// rebuildShards regenerate the shards below n missing from files into
+// spool files, column by column, returns the checksums of the rebuilt ones
+func (s *FileServer) rebuildShards(enc *erasure.Encoder, files []*os.File, shardSize int64, n int) ([]string, error) {
+	present := make([]bool, len(files))
+	count := 0
+	for i, f := range files {
+		if f != nil {
+			present[i] = true
+			count++
+		}
+	}
+	if count < enc.DataShards() {
+		return nil, fmt.Errorf("%w: %d of %d", erasure.ErrTooFewShards, count, enc.DataShards())
+	}
+	hashes := make([]hash.Hash, len(files))
+	var rebuilt []int
+	for i := 0; i < n; i++ {
+		if present[i] {
+			continue
+		}
+		f, err := s.Storage.CreateSpool()
+		if err != nil {
+			return nil, err
+		}
+		files[i], hashes[i] = f, sha256.New()
+		rebuilt = append(rebuilt, i)
+	}
+	if len(rebuilt) == 0 {
+		return hexSums(hashes), nil
+	}
+
+	bufs := make([][]byte, len(files))
+	col := make([][]byte, len(files))
+	for off := int64(0); off < shardSize; off += stripeChunk {
+		c := min(stripeChunk, shardSize-off)
+		for i := range files {
+			col[i] = nil
+			if !present[i] {
+				continue
+			}
+			if bufs[i] == nil {
+				bufs[i] = make([]byte, min(stripeChunk, shardSize))
+			}
+			col[i] = bufs[i][:c]
+			if _, err := io.ReadFull(io.NewSectionReader(files[i], off, c), col[i]); err != nil {
+				return nil, err
+			}
+		}
+		if err := enc.Reconstruct(col); err != nil {
+			return nil, err
+		}
+		for _, i := range rebuilt {
+			hashes[i].Write(col[i])
+			if _, err := files[i].Write(col[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return hexSums(hashes), nil
+}
+
+// joinStripe the content out of the data shards into a spool file checked
+// against its checksum. The spool is unlinked while open, its space is
+// freed once the reader is closed or collected
+func (s *FileServer) joinStripe(data []*os.File, shardSize int64, size int64, checksum string) (io.Reader, error) {
+	out, err := s.Storage.CreateSpool()
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	w := io.MultiWriter(out, h)
+	for _, f := range data {
+		n := min(size, shardSize)
+		if _, err := io.Copy(w, io.NewSectionReader(f, 0, n)); err != nil {
+			dropSpools([]*os.File{out})
+			return nil, err
+		}
+		size -= n
+	}
+	if hex.EncodeToString(h.Sum(nil)) != checksum {
+		dropSpools([]*os.File{out})
+		return nil, errors.New("rebuilt from the shards it does not match its checksum")
+	}
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		dropSpools([]*os.File{out})
+		return nil, err
+	}
+	os.Remove(out.Name())
+	return out, nil
+}
+
+// RepairErasure regenerate the lost shards of the object, returns how many
+func (s *FileServer) RepairErasure(key string) (int, error) {
+	k, m := s.Storage.Erasure(s.ID)
+	if k <= 0 {
+		return 0, fmt.Errorf("namespace %s is not erasure coded", s.ID)
+	}
+	st, _, err := s.locateStripe(s.ID, crypto.HashKey(key), k, m)
+	if err != nil {
+		return 0, err
+	}
+	return s.repairStripe(st, false)
+}
+
+// repairStripe rebuild the shards missing or stale on their nodes & write
+// them back. With onlyFirst only the holder of the lowest shard left
+// repairs, so the holders of a stripe do not all do it
+func (s *FileServer) repairStripe(st stripe, onlyFirst bool) (int, error) {
+	st, found, err := s.newestStripe(st)
+	if err != nil {
+		return 0, err
+	}
+	if len(st.nodes) < st.k+st.m {
+		return 0, fmt.Errorf("%w: %d of %d", ErrNotEnoughNodes, len(st.nodes), st.k+st.m)
+	}
+	var present, missing []int
+	for i, sm := range found.metas {
+		if sm != nil && sm.Version == found.newest.Version {
+			present = append(present, i)
+		} else {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 || (onlyFirst && found.holders[present[0]] != s.Transport.Addr()) {
+		return 0, nil
+	}
+	if len(present) < st.k {
+		return 0, fmt.Errorf("%w of (%s): %d of %d", erasure.ErrTooFewShards, st.object, len(present), st.k)
+	}
+
+	enc, err := erasure.New(st.k, st.m)
+	if err != nil {
+		return 0, err
+	}
+	size, _ := strconv.ParseInt(found.newest.Tags[tagShardSize], 10, 64)
+	shardSize := enc.ShardSize(size)
+	files := s.readShards(st, found, shardSize)
+	defer dropSpools(files)
+	sums, err := s.rebuildShards(enc, files, shardSize, st.k+st.m)
+	if err != nil {
+		return 0, err
+	}
+	repaired := 0
+	for _, i := range missing {
+		node := s.shardNode(st, i)
+		sm := shardMeta(*found.newest, st.object, i, shardSize, sums[i])
+		if err := s.writeShard(node, st.id, &sm, io.NewSectionReader(files[i], 0, shardSize)); err != nil {
+			log.Printf("[%s] repair shard %d of (%s) on %s failed: %s\n", s.Transport.Addr(), i, st.object, node, err)
+			continue
+		}
+		repaired++
+	}
+	log.Printf("[%s] repaired %d of %d shards of (%s)\n", s.Transport.Addr(), repaired, len(missing), st.object)
+	return repaired, nil
+}
+
+// repairStripes check the stripes of the local shards, run by the
+// anti-entropy loop
+func (s *FileServer) repairStripes() {
+	shards, err := s.AntiEntropy.localShards()
+	if err != nil {
+		log.Printf("[%s] list the local shards failed: %s\n", s.Transport.Addr(), err)
+		return
+	}
+	seen := make(map[string]bool)
+	var stripes []stripe
+	for _, e := range shards {
+		meta, err := s.Storage.Stat(e.ID, e.Key)
+		if err != nil {
+			continue
+		}
+		st, _, ok := s.stripeFromShard(e.ID, meta)
+		if ok && !seen[e.ID+"/"+st.object] {
+			seen[e.ID+"/"+st.object] = true
+			stripes = append(stripes, st)
+		}
+	}
+	for _, st := range stripes {
+		if _, err := s.repairStripe(st, true); err != nil {
+			log.Printf("[%s] repair shards of (%s) failed: %s\n", s.Transport.Addr(), st.object, err)
+		}
+	}
+}
+
+// deleteShards tombstone the shards of the object on every node that may
+// hold them
+func (s *FileServer) deleteShards(id string, hashedKey string, version int64, k, m int) {
+	st, found, err := s.locateStripe(id, hashedKey, k, m)
+	ring := s.Placement.Locate(hashedKey, st.k+st.m)
+	for i := 0; i < st.k+st.m; i++ {
+		key := shardKey(hashedKey, i)
+		nodes := shardNodes(st, i, ring)
+		if err == nil && len(found.holders[i]) > 0 && !contains(nodes, found.holders[i]) {
+			nodes = append(nodes, found.holders[i])
+		}
+		for _, node := range nodes {
+			var err error
+			if node == s.Transport.Addr() {
+				err = s.deleteObject(id, key, version)
+			} else {
+				err = s.deleteOn(node, id, key, version)
+			}
+			if err != nil {
+				log.Printf("[%s] delete shard %d of (%s) on %s failed: %s\n", s.Transport.Addr(), i, hashedKey, node, err)
+			}
+		}
+	}
+}
+
+// getShard the metadata of the shard held by the node, local disk included,
+// nil when not held
+func (s *FileServer) getShard(node string, id string, key string) (*storage.Metadata, error) {
+	if node == s.Transport.Addr() {
+		return s.statShard(id, key)
+	}
+	resp, err := s.request(node, func(reqID string) any {
+		return MessageGetShard{RequestID: reqID, ID: id, Key: key}
+	})
+	if err != nil {
+		return nil, err
+	}
+	v := resp.(MessageGetShardResponse)
+	if len(v.Err) > 0 {
+		return nil, fmt.Errorf("node %s: %s", node, v.Err)
+	}
+	return v.Meta, nil
+}
+
+// fetchShard write the content of the shard held by the node to w, read
+// in ranges from a remote node
+func (s *FileServer) fetchShard(node string, id string, key string, w io.Writer) error {
+	if node != s.Transport.Addr() {
+		_, err := s.fetchRangeTo(node, id, key, 0, 0, w)
+		return err
+	}
+	_, r, err := s.Storage.Read(id, key)
+	if err != nil {
+		return err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// statShard the metadata of the local shard, nil when not held
+func (s *FileServer) statShard(id string, key string) (*storage.Metadata, error) {
+	if !s.Storage.Has(id, key) {
+		return nil, nil
+	}
+	meta, err := s.Storage.Stat(id, key)
+	if err != nil || !isShard(meta) {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// handleMessageGetShard answer the metadata of the shard held, the content
+// is read in ranges
+func (s *FileServer) handleMessageGetShard(from string, msg MessageGetShard) error {
+	resp := MessageGetShardResponse{RequestID: msg.RequestID}
+	if meta, err := s.statShard(msg.ID, msg.Key); err != nil {
+		resp.Err = err.Error()
+	} else {
+		resp.Meta = meta
+	}
+	return s.reply(from, &Message{Payload: resp})
+}
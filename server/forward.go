@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/crypto"
+	"github.com/roylic/go-distributed-file-storage/storage"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultForwardTTL  = 3               // hops of a forwarded Get
+	forwardHopTimeout  = 2 * time.Second // waiting per remaining hop
+	forwardSeenTimeout = time.Minute     // duplicates suppressed for this long
+)
+
+// forwardTracker the origins already handled, a request coming back
+// through another route is answered as not found. The route of a found
+// copy is remembered for its ranges, as long as it is used
+type forwardTracker struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time    // origin -> first seen
+	routes map[string]forwardRoute // origin -> next hop towards the copy
+}
+
+type forwardRoute struct {
+	next string // listen address, self at the holder
+	used time.Time
+}
+
+func newForwardTracker() *forwardTracker {
+	return &forwardTracker{seen: make(map[string]time.Time), routes: make(map[string]forwardRoute)}
+}
+
+// first whether the origin is seen for the first time
+func (f *forwardTracker) first(origin string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	for o, at := range f.seen {
+		if now.Sub(at) > forwardSeenTimeout {
+			delete(f.seen, o)
+		}
+	}
+	for o, r := range f.routes {
+		if now.Sub(r.used) > forwardSeenTimeout {
+			delete(f.routes, o)
+		}
+	}
+	if _, ok := f.seen[origin]; ok {
+		return false
+	}
+	f.seen[origin] = now
+	return true
+}
+
+// setRoute the copy of the origin is reached through next
+func (f *forwardTracker) setRoute(origin string, next string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.routes[origin] = forwardRoute{next: next, used: time.Now()}
+}
+
+// route next hop towards the copy of the origin
+func (f *forwardTracker) route(origin string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.routes[origin]
+	if !ok {
+		return "", false
+	}
+	r.used = time.Now()
+	f.routes[origin] = r
+	return r.next, true
+}
+
+// forwardGet ask the connected nodes to look for the object among their
+// own peers, the first copy found is read range by range along the route
+// & written locally
+func (s *FileServer) forwardGet(id string, hashedKey string) (bool, error) {
+	ttl := s.ForwardTTL
+	if ttl == 0 {
+		ttl = DefaultForwardTTL
+	}
+	if ttl < 0 {
+		return false, nil
+	}
+	origin := crypto.GenerateID()[:16]
+	s.forwards.first(origin)
+	resp, err := s.forwardTo("", MessageForwardGet{Origin: origin, ID: id, Key: hashedKey, TTL: ttl})
+	if err != nil || !resp.Found {
+		return false, err
+	}
+	var meta storage.Metadata
+	if resp.Meta != nil {
+		meta = *resp.Meta
+	}
+	next, _ := s.forwards.route(origin)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(s.fetchForwarded(next, origin, id, hashedKey, pw))
+	}()
+	n, err := s.Storage.WriteCopy(s.ID, hashedKey, pr, meta)
+	_ = pr.Close()
+	if err != nil {
+		return false, err
+	}
+	s.Holdings.Add(s.ID, hashedKey)
+	log.Printf("[%s] received (%d) bytes of (%s) from %s over %d hops\n",
+		s.Transport.Addr(), n, hashedKey, resp.Holder, resp.Hops)
+	return true, nil
+}
+
+// forwardTo send the request to every connected node but the one it came
+// from, the first positive answer wins
+func (s *FileServer) forwardTo(from string, msg MessageForwardGet) (MessageForwardGetResponse, error) {
+	s.peerLock.Lock()
+	var nodes []string
+	for node, peer := range s.nodes {
+		if peer.RemoteAddr().String() != from {
+			nodes = append(nodes, node)
+		}
+	}
+	s.peerLock.Unlock()
+	if len(nodes) == 0 {
+		return MessageForwardGetResponse{}, nil
+	}
+
+	type answer struct {
+		node string
+		resp MessageForwardGetResponse
+	}
+	timeout := time.Duration(msg.TTL) * forwardHopTimeout
+	answers := make(chan answer, len(nodes))
+	for _, node := range nodes {
+		go func(node string) {
+			peer, ok := s.nodePeer(node)
+			if !ok {
+				answers <- answer{node: node}
+				return
+			}
+			reqID, ch := s.pendingRequest()
+			hop := msg
+			hop.RequestID = reqID
+			if err := s.send(peer, &Message{Payload: hop}); err != nil {
+				s.cancelRequest(reqID)
+				answers <- answer{node: node}
+				return
+			}
+			resp, err := s.awaitResponse(reqID, ch, timeout)
+			if err != nil {
+				answers <- answer{node: node}
+				return
+			}
+			answers <- answer{node: node, resp: resp.(MessageForwardGetResponse)}
+		}(node)
+	}
+	for range nodes {
+		if a := <-answers; a.resp.Found {
+			s.forwards.setRoute(msg.Origin, a.node)
+			return a.resp, nil
+		}
+	}
+	return MessageForwardGetResponse{}, fmt.Errorf("(%s) not found within %d hops", msg.Key, msg.TTL)
+}
+
+// handleMessageForwardGet serve the object when held, otherwise relay the
+// request to the own peers and the answer back, in the background
+func (s *FileServer) handleMessageForwardGet(from string, msg MessageForwardGet) error {
+	resp := MessageForwardGetResponse{RequestID: msg.RequestID}
+	if !s.forwards.first(msg.Origin) {
+		// already handled, coming back through a loop
+		return s.reply(from, &Message{Payload: resp})
+	}
+	if s.Storage.Has(msg.ID, msg.Key) {
+		meta, err := s.Storage.Stat(msg.ID, msg.Key)
+		if err != nil {
+			return err
+		}
+		s.forwards.setRoute(msg.Origin, s.Transport.Addr())
+		resp.Found, resp.Holder, resp.Hops, resp.Meta = true, s.Transport.Addr(), 1, meta
+		return s.reply(from, &Message{Payload: resp})
+	}
+	if msg.TTL <= 1 {
+		return s.reply(from, &Message{Payload: resp})
+	}
+
+	// the route back is the peer the request came from
+	go func() {
+		next := msg
+		next.TTL--
+		found, err := s.forwardTo(from, next)
+		if err == nil && found.Found {
+			log.Printf("[%s] relaying (%s) from %s\n", s.Transport.Addr(), msg.Key, found.Holder)
+			found.RequestID = msg.RequestID
+			found.Hops++
+			resp = found
+		}
+		if err := s.reply(from, &Message{Payload: resp}); err != nil {
+			log.Printf("[%s] relay of (%s) failed: %s\n", s.Transport.Addr(), msg.Key, err)
+		}
+	}()
+	return nil
+}
+
+// fetchForwarded read the object found by the forwarded Get of the origin
+// range by range from the next hop, each range a single small message
+func (s *FileServer) fetchForwarded(next string, origin string, id string, hashedKey string, w io.Writer) error {
+	var offset int64
+	for {
+		resp, err := s.request(next, func(reqID string) any {
+			return MessageForwardRange{RequestID: reqID, Origin: origin, ID: id, Key: hashedKey, Offset: offset, Length: rangeChunk}
+		})
+		if err != nil {
+			return err
+		}
+		v := resp.(MessageGetRangeResponse)
+		if len(v.Err) > 0 {
+			return errors.New(v.Err)
+		}
+		n, err := crypto.CopyDecryptAt(s.EncKey, v.IV, offset, bytes.NewReader(v.Data), w)
+		if err != nil {
+			return err
+		}
+		offset += int64(n)
+		if len(v.Data) == 0 || offset >= v.Size {
+			return nil
+		}
+	}
+}
+
+// handleMessageForwardRange read the range at the holder, otherwise relay
+// it to the next hop of the route & the answer back, in the background
+func (s *FileServer) handleMessageForwardRange(from string, msg MessageForwardRange) error {
+	next, ok := s.forwards.route(msg.Origin)
+	if !ok {
+		return s.reply(from, &Message{Payload: MessageGetRangeResponse{RequestID: msg.RequestID, Err: "no route of the forwarded get"}})
+	}
+	if next == s.Transport.Addr() {
+		return s.handleMessageGetRange(from, MessageGetRange{RequestID: msg.RequestID, ID: msg.ID, Key: msg.Key, Offset: msg.Offset, Length: msg.Length})
+	}
+	go func() {
+		resp := MessageGetRangeResponse{}
+		v, err := s.request(next, func(reqID string) any {
+			hop := msg
+			hop.RequestID = reqID
+			return hop
+		})
+		if err != nil {
+			resp.Err = err.Error()
+		} else {
+			resp = v.(MessageGetRangeResponse)
+		}
+		resp.RequestID = msg.RequestID
+		if err := s.reply(from, &Message{Payload: resp}); err != nil {
+			log.Printf("[%s] relay range of (%s) failed: %s\n", s.Transport.Addr(), msg.Key, err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/membership"
+	"log"
+)
+
+// gossipTransport carry the membership messages over the node connections
+type gossipTransport struct {
+	s *FileServer
+}
+
+func (t gossipTransport) Send(to string, msg membership.Message) error {
+	peer, ok := t.s.nodePeer(to)
+	if !ok {
+		return fmt.Errorf("node %s is not connected", to)
+	}
+	return t.s.send(peer, &Message{Payload: MessageGossip{Msg: msg}})
+}
+
+// onMemberChange feed the placement & the repair with the membership:
+// dead nodes leave the placement & the DHT, alive ones come back & get their hints
+func (s *FileServer) onMemberChange(mb membership.Member) {
+	log.Printf("[%s] member %s is %s (incarnation %d)\n", s.Transport.Addr(), mb.ID, mb.State, mb.Incarnation)
+	switch mb.State {
+	case membership.StateDead:
+		s.Placement.Remove(mb.ID)
+		s.DHT.RemoveContact(mb.ID)
+		s.Rebalancer.Trigger()
+	case membership.StateAlive:
+		if _, ok := s.nodePeer(mb.ID); !ok {
+			return
+		}
+		s.peerLock.Lock()
+		state, known := s.nodeStates[mb.ID]
+		s.peerLock.Unlock()
+		if known && state != NodeActive {
+			return
+		}
+		s.Placement.Add(mb.ID)
+		s.Rebalancer.Trigger()
+		go func() {
+			if err := s.Hints.Deliver(mb.ID); err != nil {
+				log.Printf("[%s] %s\n", s.Transport.Addr(), err)
+			}
+		}()
+	}
+}
+
+// alive whether the membership does not consider the node down
+func (s *FileServer) alive(node string) bool {
+	state, ok := s.Membership.StateOf(node)
+	return ok && state == membership.StateAlive
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/storage"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hintDir          = "_hints" // under StorageRoot, survive restarts
+	hintDataDir      = "data"   // content of the hinted writes by checksum, shared by their hints
+	DefaultMaxHints  = 1024
+	DefaultHintTTL   = 3 * time.Hour
+	DefaultHintRetry = 10 * time.Second
+)
+
+var ErrHintQueueFull = errors.New("hint queue is full")
+
+// Hint a write missed by an unreachable replica, delivered once it is
+// back, the content is kept once under its checksum
+type Hint struct {
+	Target    string // listen address of the replica
+	ID        string
+	Meta      storage.Metadata
+	CreatedAt time.Time
+}
+
+// hintEntry in memory view of a persisted hint
+type hintEntry struct {
+	target   string
+	checksum string
+	expires  time.Time
+}
+
+// HintedHandoff keep the writes of unreachable replicas on disk,
+// at most one hint per (replica, object), the newest version wins
+type HintedHandoff struct {
+	s *FileServer
+
+	mu         sync.Mutex
+	hints      map[string]hintEntry // file name -> entry
+	delivering map[string]bool      // target -> delivery in flight
+}
+
+func NewHintedHandoff(s *FileServer) *HintedHandoff {
+	return &HintedHandoff{
+		s:          s,
+		hints:      make(map[string]hintEntry),
+		delivering: make(map[string]bool),
+	}
+}
+
+// dir of the persisted hints
+func (h *HintedHandoff) dir() string {
+	return filepath.Join(h.s.Storage.Root, hintDir)
+}
+
+// dataPath of the hinted content
+func (h *HintedHandoff) dataPath(checksum string) string {
+	return filepath.Join(h.dir(), hintDataDir, checksum)
+}
+
+// hintName one file per (replica, object)
+func hintName(target string, id string, key string) string {
+	sum := sha1.Sum([]byte(target + "/" + id + "/" + key))
+	return hex.EncodeToString(sum[:]) + ".hint"
+}
+
+// load the persisted hints, called before the server starts
+func (h *HintedHandoff) load() error {
+	files, err := os.ReadDir(h.dir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".hint") {
+			continue
+		}
+		hint, err := h.read(f.Name())
+		if err != nil {
+			log.Printf("[%s] dropping unreadable hint %s: %s\n", h.s.Transport.Addr(), f.Name(), err)
+			_ = os.Remove(filepath.Join(h.dir(), f.Name()))
+			continue
+		}
+		h.hints[f.Name()] = hintEntry{target: hint.Target, checksum: hint.Meta.Checksum, expires: hint.CreatedAt.Add(h.ttl())}
+	}
+	h.s.Metrics.Set(MetricHintsPending, int64(len(h.hints)))
+	return nil
+}
+
+func (h *HintedHandoff) ttl() time.Duration {
+	if h.s.HintTTL > 0 {
+		return h.s.HintTTL
+	}
+	return DefaultHintTTL
+}
+
+func (h *HintedHandoff) limit() int {
+	if h.s.MaxHints > 0 {
+		return h.s.MaxHints
+	}
+	return DefaultMaxHints
+}
+
+// read a persisted hint
+func (h *HintedHandoff) read(name string) (*Hint, error) {
+	b, err := os.ReadFile(filepath.Join(h.dir(), name))
+	if err != nil {
+		return nil, err
+	}
+	var hint Hint
+	if err := json.Unmarshal(b, &hint); err != nil {
+		return nil, err
+	}
+	return &hint, nil
+}
+
+// Add keep the write for the unreachable replica, replacing an older
+// hint of the same object, ErrHintQueueFull when the queue is full
+func (h *HintedHandoff) Add(target string, id string, meta *storage.Metadata, data []byte) error {
+	m := *meta
+	if len(m.Checksum) == 0 {
+		sum := sha256.Sum256(data)
+		m.Checksum = hex.EncodeToString(sum[:])
+	}
+	return h.AddFrom(target, id, &m, bytes.NewReader(data))
+}
+
+// AddFrom same as Add, the content read from r, meta carries its checksum
+func (h *HintedHandoff) AddFrom(target string, id string, meta *storage.Metadata, r io.Reader) error {
+	name := hintName(target, id, meta.Key)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.hints[name]; !ok && len(h.hints) >= h.limit() {
+		h.s.Metrics.Add(MetricHintsDropped, 1)
+		return ErrHintQueueFull
+	}
+	old, err := h.read(name)
+	if err == nil && old.Meta.Version > meta.Version {
+		return nil // holding a newer write already
+	}
+
+	// the content first, a hint never points to missing content
+	if _, err := os.Stat(h.dataPath(meta.Checksum)); errors.Is(err, os.ErrNotExist) {
+		if err := storage.CopyFileAtomic(h.dataPath(meta.Checksum), r, 0o644); err != nil {
+			return err
+		}
+	}
+	hint := Hint{Target: target, ID: id, Meta: *meta, CreatedAt: time.Now()}
+	b, err := json.Marshal(hint)
+	if err != nil {
+		return err
+	}
+	if err := storage.WriteFileAtomic(filepath.Join(h.dir(), name), b, 0o644); err != nil {
+		return err
+	}
+	h.hints[name] = hintEntry{target: target, checksum: meta.Checksum, expires: hint.CreatedAt.Add(h.ttl())}
+	if old != nil {
+		h.dropData(old.Meta.Checksum)
+	}
+	h.s.Metrics.Add(MetricHintsStored, 1)
+	h.s.Metrics.Set(MetricHintsPending, int64(len(h.hints)))
+	return nil
+}
+
+// Pending hints waiting for the target, every target when empty
+func (h *HintedHandoff) Pending(target string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, e := range h.hints {
+		if len(target) == 0 || e.target == target {
+			n++
+		}
+	}
+	return n
+}
+
+// remove the hint, caller holds the lock
+func (h *HintedHandoff) remove(name string) {
+	_ = os.Remove(filepath.Join(h.dir(), name))
+	e, ok := h.hints[name]
+	delete(h.hints, name)
+	if ok {
+		h.dropData(e.checksum)
+	}
+	h.s.Metrics.Set(MetricHintsPending, int64(len(h.hints)))
+}
+
+// dropData delete the content once no hint refers to it, caller holds the lock
+func (h *HintedHandoff) dropData(checksum string) {
+	for _, e := range h.hints {
+		if e.checksum == checksum {
+			return
+		}
+	}
+	_ = os.Remove(h.dataPath(checksum))
+}
+
+// expire drop the hints older than the TTL, anti-entropy repairs them later
+func (h *HintedHandoff) expire() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	for name, e := range h.hints {
+		if now.After(e.expires) {
+			h.remove(name)
+			h.s.Metrics.Add(MetricHintsExpired, 1)
+		}
+	}
+}
+
+// Deliver replay the hints of the target, stop at the first failure
+// since the target is most likely down again, must not be called in the loop
+func (h *HintedHandoff) Deliver(target string) error {
+	h.mu.Lock()
+	if h.delivering[target] {
+		h.mu.Unlock()
+		return nil
+	}
+	h.delivering[target] = true
+	var names []string
+	for name, e := range h.hints {
+		if e.target == target {
+			names = append(names, name)
+		}
+	}
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		delete(h.delivering, target)
+		h.mu.Unlock()
+	}()
+
+	for _, name := range names {
+		hint, err := h.read(name)
+		if err != nil {
+			h.mu.Lock()
+			h.remove(name)
+			h.mu.Unlock()
+			continue
+		}
+		if err := h.deliver(hint); err != nil {
+			return fmt.Errorf("deliver hint (%s) to %s: %w", hint.Meta.Key, target, err)
+		}
+		h.mu.Lock()
+		// replaced by a newer write meanwhile, keep it for the next round
+		if cur, err := h.read(name); err == nil && cur.Meta.Version == hint.Meta.Version {
+			h.remove(name)
+		}
+		h.mu.Unlock()
+		h.s.Metrics.Add(MetricHintsDelivered, 1)
+	}
+	if len(names) > 0 {
+		log.Printf("[%s] delivered %d hints to %s\n", h.s.Transport.Addr(), len(names), target)
+	}
+	return nil
+}
+
+// deliver a single hint streamed from its content, skipped when the
+// object was deleted since or the content is gone
+func (h *HintedHandoff) deliver(hint *Hint) error {
+	if version, ok := h.s.Storage.TombstoneOf(hint.ID, hint.Meta.Key); ok && version >= hint.Meta.Version {
+		return nil
+	}
+	f, err := os.Open(h.dataPath(hint.Meta.Checksum))
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("[%s] content of the hint (%s) is gone, dropping it\n", h.s.Transport.Addr(), hint.Meta.Key)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return h.s.replicateFrom(hint.Target, hint.ID, &hint.Meta, f)
+}
+
+// loop expire the old hints & retry the connected targets every interval
+func (h *HintedHandoff) loop() {
+	ticker := time.NewTicker(DefaultHintRetry)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.s.quitCh:
+			return
+		}
+		h.expire()
+
+		targets := make(map[string]bool)
+		h.mu.Lock()
+		for _, e := range h.hints {
+			targets[e.target] = true
+		}
+		h.mu.Unlock()
+		for target := range targets {
+			if _, ok := h.s.nodePeer(target); !ok {
+				continue
+			}
+			if err := h.Deliver(target); err != nil {
+				log.Printf("[%s] %s\n", h.s.Transport.Addr(), err)
+			}
+		}
+	}
+}
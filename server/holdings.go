@@ -0,0 +1,248 @@
+package server
+
+import (
+	"github.com/roylic/go-distributed-file-storage/bloom"
+	"github.com/roylic/go-distributed-file-storage/p2p"
+	"github.com/roylic/go-distributed-file-storage/storage"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHoldingsInterval      = 10 * time.Second // between two updates sent to the neighbours
+	DefaultHoldingsKeys          = 10000            // keys the filter is sized for
+	DefaultHoldingsFalsePositive = 0.01
+	holdingsRebuildRounds        = 30 // a full filter every N rounds drops the deleted keys
+)
+
+// remoteHoldings the filter of a neighbour
+type remoteHoldings struct {
+	filter     *bloom.Filter
+	generation uint64
+	seq        uint64
+}
+
+// Holdings summarise the local objects in a Bloom filter sent to the
+// neighbours, and keep theirs, so Get asks the likely holders only
+type Holdings struct {
+	s *FileServer
+
+	mu         sync.Mutex
+	local      *bloom.Filter
+	keys       int // added to the local filter
+	capacity   int // keys the local filter is sized for
+	generation uint64
+	seq        uint64
+	rounds     int
+	remote     map[string]*remoteHoldings // node -> filter
+}
+
+func NewHoldings(s *FileServer) *Holdings {
+	h := &Holdings{s: s, remote: make(map[string]*remoteHoldings)}
+	h.capacity = h.s.HoldingsKeys
+	if h.capacity <= 0 {
+		h.capacity = DefaultHoldingsKeys
+	}
+	h.local = h.newFilter(h.capacity)
+	return h
+}
+
+func (h *Holdings) newFilter(n int) *bloom.Filter {
+	p := h.s.HoldingsFalsePositive
+	if p <= 0 {
+		p = DefaultHoldingsFalsePositive
+	}
+	return bloom.New(n, p)
+}
+
+// holdingKey the object as added to the filters
+func holdingKey(id string, hashedKey string) string {
+	return id + "/" + hashedKey
+}
+
+// rebuild a new generation from the local objects, resized when full
+func (h *Holdings) rebuild() error {
+	var keys []string
+	err := h.s.Storage.Walk(func(id string, meta *storage.Metadata) error {
+		keys = append(keys, holdingKey(id, meta.Key))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for len(keys) > h.capacity {
+		h.capacity *= 2
+	}
+	f := h.newFilter(h.capacity)
+	for _, key := range keys {
+		f.Add(key)
+	}
+	f.Delta()
+	h.local, h.keys = f, len(keys)
+	h.generation++
+	h.seq = 0
+	h.rounds = 0
+	return nil
+}
+
+// Add the object written locally, sent with the next update
+func (h *Holdings) Add(id string, hashedKey string) {
+	h.mu.Lock()
+	h.local.Add(holdingKey(id, hashedKey))
+	h.keys++
+	h.mu.Unlock()
+}
+
+// full the whole filter of the current generation
+func (h *Holdings) full() MessageHoldings {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return MessageHoldings{
+		Node:       h.s.Transport.Addr(),
+		Generation: h.generation,
+		Seq:        h.seq,
+		K:          h.local.K(),
+		Words:      append([]uint64(nil), h.local.Words()...),
+	}
+}
+
+// share send the full filter to the peer
+func (h *Holdings) share(peer p2p.Peer) error {
+	return h.s.send(peer, &Message{Payload: h.full()})
+}
+
+// update the changed words, or a new generation when due, nil when unchanged
+func (h *Holdings) update() *MessageHoldings {
+	h.mu.Lock()
+	h.rounds++
+	rebuild := h.rounds >= holdingsRebuildRounds || h.keys > h.capacity
+	h.mu.Unlock()
+	if rebuild {
+		if err := h.rebuild(); err != nil {
+			log.Printf("[%s] rebuild the holdings filter failed: %s\n", h.s.Transport.Addr(), err)
+			return nil
+		}
+		msg := h.full()
+		return &msg
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delta := h.local.Delta()
+	if delta == nil {
+		return nil
+	}
+	h.seq++
+	return &MessageHoldings{
+		Node:       h.s.Transport.Addr(),
+		Generation: h.generation,
+		Seq:        h.seq,
+		K:          h.local.K(),
+		Delta:      delta,
+	}
+}
+
+// loop send the updates to the neighbours every interval
+func (h *Holdings) loop() {
+	interval := h.s.HoldingsInterval
+	if interval <= 0 {
+		interval = DefaultHoldingsInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.s.quitCh:
+			return
+		}
+		if msg := h.update(); msg != nil {
+			if err := h.s.broadcast(&Message{Payload: *msg}); err != nil {
+				log.Printf("[%s] send the holdings filter failed: %s\n", h.s.Transport.Addr(), err)
+			}
+		}
+	}
+}
+
+// MayHold false only when the filter of the node rules the object out,
+// nodes without a filter may hold anything
+func (h *Holdings) MayHold(node string, id string, hashedKey string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, ok := h.remote[node]
+	if !ok {
+		return true
+	}
+	return r.filter.Test(holdingKey(id, hashedKey))
+}
+
+// split the nodes whose filter matches from the others, kept in case of
+// a filter missing a recent write
+func (h *Holdings) split(nodes []string, id string, hashedKey string) (match []string, rest []string) {
+	for _, node := range nodes {
+		if h.MayHold(node, id, hashedKey) {
+			match = append(match, node)
+		} else {
+			rest = append(rest, node)
+		}
+	}
+	return match, rest
+}
+
+// anyHolder ask the nodes at once whether they hold the object, the
+// first one holding it wins
+func (s *FileServer) anyHolder(nodes []string, id string, hashedKey string) (string, bool) {
+	holders := make(chan string, len(nodes))
+	for _, node := range nodes {
+		go func(node string) {
+			if _, has, err := s.entryOn(node, id, hashedKey); err != nil || !has {
+				node = ""
+			}
+			holders <- node
+		}(node)
+	}
+	for range nodes {
+		if node := <-holders; len(node) > 0 {
+			return node, true
+		}
+	}
+	return "", false
+}
+
+// handleMessageHoldings replace or patch the filter of the node, a gap
+// in the updates drops it & asks the full filter again
+func (s *FileServer) handleMessageHoldings(from string, msg MessageHoldings) error {
+	h := s.Holdings
+	h.mu.Lock()
+	if msg.Words != nil {
+		h.remote[msg.Node] = &remoteHoldings{
+			filter:     bloom.FromWords(msg.K, msg.Words),
+			generation: msg.Generation,
+			seq:        msg.Seq,
+		}
+		h.mu.Unlock()
+		return nil
+	}
+	r, ok := h.remote[msg.Node]
+	if ok && r.generation == msg.Generation && r.seq+1 == msg.Seq {
+		r.filter.Apply(msg.Delta)
+		r.seq = msg.Seq
+		h.mu.Unlock()
+		return nil
+	}
+	delete(h.remote, msg.Node)
+	h.mu.Unlock()
+	return s.reply(from, &Message{Payload: MessageHoldingsRequest{Node: s.Transport.Addr()}})
+}
+
+// handleMessageHoldingsRequest send the full filter back
+func (s *FileServer) handleMessageHoldingsRequest(from string, msg MessageHoldingsRequest) error {
+	peer, ok := s.peerOf(from)
+	if !ok {
+		return nil
+	}
+	return s.Holdings.share(peer)
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// metric names, exposed on the admin API in prometheus text format
+const (
+	MetricAntiEntropyRounds     = "fs_antientropy_rounds_total"
+	MetricAntiEntropyFailures   = "fs_antientropy_failures_total"
+	MetricAntiEntropyDivergent  = "fs_antientropy_divergent_keys_total"
+	MetricAntiEntropyRepaired   = "fs_antientropy_repaired_keys_total"
+	MetricAntiEntropyRepairErrs = "fs_antientropy_repair_errors_total"
+	MetricAntiEntropyLastDiff   = "fs_antientropy_last_divergent_keys"
+	MetricTombstonesPurged      = "fs_tombstones_purged_total"
+	MetricReadRepairs           = "fs_read_repairs_total"
+	MetricReadRepairErrs        = "fs_read_repair_errors_total"
+	MetricHintsStored           = "fs_hints_stored_total"
+	MetricHintsDelivered        = "fs_hints_delivered_total"
+	MetricHintsExpired          = "fs_hints_expired_total"
+	MetricHintsDropped          = "fs_hints_dropped_total"
+	MetricHintsPending          = "fs_hints_pending"
+	MetricConflicts             = "fs_conflicts_total"
+	MetricChunksSent            = "fs_replication_chunks_sent_total"
+	MetricChunksSkipped         = "fs_replication_chunks_skipped_total"
+	MetricDeltaLiteralBytes     = "fs_replication_delta_literal_bytes_total"
+	MetricDeltaMatchedBytes     = "fs_replication_delta_matched_bytes_total"
+)
+
+// Metrics counters & gauges of the server
+type Metrics struct {
+	mu     sync.Mutex
+	values map[string]int64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{values: make(map[string]int64)}
+}
+
+// Add increase the counter
+func (m *Metrics) Add(name string, delta int64) {
+	m.mu.Lock()
+	m.values[name] += delta
+	m.mu.Unlock()
+}
+
+// Set the gauge
+func (m *Metrics) Set(name string, value int64) {
+	m.mu.Lock()
+	m.values[name] = value
+	m.mu.Unlock()
+}
+
+// Get current value, 0 when never set
+func (m *Metrics) Get(name string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[name]
+}
+
+// WriteTo write every metric as `name value` lines, sorted by name
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	names := make([]string, 0, len(m.values))
+	for name := range m.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var total int64
+	for _, name := range names {
+		n, err := fmt.Fprintf(w, "%s %d\n", name, m.values[name])
+		total += int64(n)
+		if err != nil {
+			m.mu.Unlock()
+			return total, err
+		}
+	}
+	m.mu.Unlock()
+	return total, nil
+}
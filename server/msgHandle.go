@@ -1,11 +1,12 @@
 package server
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/roylic/go-distributed-file-storage/crypto"
 	"github.com/roylic/go-distributed-file-storage/p2p"
+	"github.com/roylic/go-distributed-file-storage/storage"
 	"io"
 	"log"
 )
@@ -15,8 +16,128 @@ func (s *FileServer) handleMessage(from string, msg *Message) error {
 	switch v := msg.Payload.(type) {
 	case MessageStoreFile:
 		return s.handleMessageStoreFile(from, v)
+	case MessageStoreAck:
+		return s.resolve(v.RequestID, v)
+	case MessageHasFile:
+		return s.handleMessageHasFile(from, v)
+	case MessageHasFileResponse:
+		return s.resolve(v.RequestID, v)
 	case MessageGetFile:
 		return s.handleMessageGetFile(from, v)
+	case MessageUpdateMeta:
+		return s.handleMessageUpdateMeta(from, v)
+	case MessageDeleteFile:
+		return s.handleMessageDeleteFile(from, v)
+	case MessageDeleteAck:
+		return s.resolve(v.RequestID, v)
+	case MessageMerkleRequest:
+		return s.handleMessageMerkleRequest(from, v)
+	case MessageMerkleResponse:
+		return s.resolve(v.RequestID, v)
+	case MessageMerkleBuckets:
+		return s.handleMessageMerkleBuckets(from, v)
+	case MessageMerkleBucketsResponse:
+		return s.resolve(v.RequestID, v)
+	case MessageRepairPush:
+		return s.handleMessageRepairPush(from, v)
+	case MessageGetVersion:
+		return s.handleMessageGetVersion(from, v)
+	case MessageGetVersionResponse:
+		return s.resolve(v.RequestID, v)
+	case MessageListVersions:
+		return s.handleMessageListVersions(from, v)
+	case MessageListVersionsResponse:
+		return s.resolve(v.RequestID, v)
+	case MessageRestoreVersion:
+		return s.handleMessageRestoreVersion(from, v)
+	case MessageDeleteVersion:
+		return s.handleMessageDeleteVersion(from, v)
+	case MessageHello:
+		return s.handleMessageHello(from, v)
+	case MessageNodeState:
+		return s.handleMessageNodeState(from, v)
+	case MessageNodeDrain:
+		if v.Cancel {
+			return s.Undrain(v.Node)
+		}
+		return s.Drain(v.Node)
+	case MessageGossip:
+		s.Membership.Handle(v.Msg)
+		return nil
+	case MessagePeerExchange:
+		return s.handleMessagePeerExchange(from, v)
+	case MessageDHTRequest:
+		return s.handleMessageDHTRequest(from, v)
+	case MessageDHTResponse:
+		return s.resolve(v.RequestID, v)
+	case MessageHoldings:
+		return s.handleMessageHoldings(from, v)
+	case MessageHoldingsRequest:
+		return s.handleMessageHoldingsRequest(from, v)
+	case MessageForwardGet:
+		return s.handleMessageForwardGet(from, v)
+	case MessageForwardGetResponse:
+		return s.resolve(v.RequestID, v)
+	case MessageForwardRange:
+		return s.handleMessageForwardRange(from, v)
+	case MessagePieceManifest:
+		return s.handleMessagePieceManifest(from, v)
+	case MessagePieceManifestResponse:
+		return s.resolve(v.RequestID, v)
+	case MessageGetPiece:
+		return s.handleMessageGetPiece(from, v)
+	case MessageGetPieceResponse:
+		return s.resolve(v.RequestID, v)
+	case MessageTransferOffset:
+		return s.handleMessageTransferOffset(from, v)
+	case MessageTransferOffsetResponse:
+		return s.resolve(v.RequestID, v)
+	case MessageGetRange:
+		return s.handleMessageGetRange(from, v)
+	case MessageGetRangeResponse:
+		return s.resolve(v.RequestID, v)
+	case MessageUploadPart:
+		return s.handleMessageUploadPart(from, v)
+	case MessageUploadPartResponse:
+		return s.resolve(v.RequestID, v)
+	case MessageCompleteUpload:
+		return s.handleMessageCompleteUpload(from, v)
+	case MessageCompleteUploadResponse:
+		return s.resolve(v.RequestID, v)
+	case MessageAbortUpload:
+		return s.handleMessageAbortUpload(from, v)
+	case MessageAbortUploadResponse:
+		return s.resolve(v.RequestID, v)
+	case MessageChunkHave:
+		return s.handleMessageChunkHave(from, v)
+	case MessageChunkHaveResponse:
+		return s.resolve(v.RequestID, v)
+	case MessageStoreChunks:
+		return s.handleMessageStoreChunks(from, v)
+	case MessageGetBlock:
+		return s.handleMessageGetBlock(from, v)
+	case MessageGetBlockResponse:
+		return s.resolve(v.RequestID, v)
+	case MessageNameRecords:
+		return s.handleMessageNameRecords(from, v)
+	case MessageResolveName:
+		return s.handleMessageResolveName(from, v)
+	case MessageResolveNameResponse:
+		return s.resolve(v.RequestID, v)
+	case MessageGetShard:
+		return s.handleMessageGetShard(from, v)
+	case MessageGetShardResponse:
+		return s.resolve(v.RequestID, v)
+	case MessageDeltaSignature:
+		return s.handleMessageDeltaSignature(from, v)
+	case MessageDeltaSignatureResponse:
+		return s.resolve(v.RequestID, v)
+	case MessageStoreDelta:
+		return s.handleMessageStoreDelta(from, v)
+	case MessageQuery:
+		return s.handleMessageQuery(from, v)
+	case MessageQueryResponse:
+		return s.resolve(v.RequestID, v)
 	}
 	return nil
 }
@@ -26,42 +147,127 @@ func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) e
 	log.Printf("server[%s] recv %+v\n", s.Transport.Addr(), msg)
 
 	// got the peer & let Conn receive the consumption result
-	peer, exist := s.peers[from]
+	peer, exist := s.peerOf(from)
 	if !exist {
 		return fmt.Errorf("peer (%s) not found in Mapping, end handleMessage logic", from)
 	}
 
+	// the content follows as a stream
+	if err := peer.WaitStream(DefaultRequestTimeout); err != nil {
+		return s.ackStore(peer, msg, err)
+	}
+
+	// a leaving node does not accept new writes, drop the stream
+	if s.Drainer.Leaving() {
+		_, err := io.Copy(io.Discard, io.LimitReader(peer, msg.Size))
+		peer.CloseStream()
+		if err == nil {
+			err = fmt.Errorf("[%s] node is leaving, refusing (%s)", s.Transport.Addr(), msg.Key)
+		}
+		return s.ackStore(peer, msg, err)
+	}
+
 	// decrypt first
-	var decryptedBuf bytes.Buffer
 	// 由于TCPPeer包含net.Conn, 并且net.Conn接口实现了Read接口,
 	// 由于网络流并不包含EOF, 使用LimitReader进行封装
 	// 所以可以被当作是io.Reader放入, 可以被读出内容
-	_, err := crypto.CopyDecrypt(s.EncKey, io.LimitReader(peer, msg.Size), &decryptedBuf)
+	data, p, err := s.receiveStore(io.LimitReader(peer, msg.Size), msg)
 	if err != nil {
-		return err
+		peer.CloseStream()
+		return s.ackStore(peer, msg, err)
 	}
 
-	// read decrypted bytes
-	size, err := s.Storage.Write(msg.ID, msg.Key, &decryptedBuf)
+	size := int64(len(data))
+	if p != nil {
+		size = p.Size
+		err = s.commitReplica(msg.ID, msg.Key, msg.Meta, p)
+	} else {
+		err = s.storeReplica(msg.ID, msg.Key, msg.Meta, data)
+	}
+
+	// callback to this Conn's loop
+	//peer.(*p2p.TCPPeer).Wg.Done()
+	peer.CloseStream()
 
 	if err != nil {
-		return err
+		return s.ackStore(peer, msg, err)
 	}
 	log.Printf("server[%s], writtern %d recv bytes to disk\n",
 		s.Transport.Addr(), size)
+	return s.ackStore(peer, msg, nil)
+}
 
-	// callback to this Conn's loop
-	//peer.(*p2p.TCPPeer).Wg.Done()
-	peer.CloseStream()
+// storeReplica write the received content, keeping the origin's metadata
+func (s *FileServer) storeReplica(id string, key string, origin *storage.Metadata, data []byte) error {
+	meta, err := s.replicaMeta(id, key, origin)
+	if err != nil {
+		return err
+	}
+	return s.applyWrite(id, meta, data)
+}
 
-	return nil
+// commitReplica same as storeReplica for content received into a partial
+// transfer, removed when it is not committed
+func (s *FileServer) commitReplica(id string, key string, origin *storage.Metadata, p *storage.PartialTransfer) error {
+	meta, err := s.replicaMeta(id, key, origin)
+	if err != nil {
+		_ = p.Remove()
+		return err
+	}
+	return s.applyCommit(id, meta, p)
+}
+
+// replicaMeta the metadata written with a replica, unless the object was
+// deleted after this version
+func (s *FileServer) replicaMeta(id string, key string, origin *storage.Metadata) (storage.Metadata, error) {
+	var meta storage.Metadata
+	if origin != nil {
+		meta = *origin
+	}
+	meta.Key = key
+	// deleted after this version was written, don't bring it back
+	if version, ok := s.Storage.TombstoneOf(id, key); ok && version >= meta.Version {
+		return meta, fmt.Errorf("[%s] (%s) was deleted at version %d", s.Transport.Addr(), key, version)
+	}
+	return meta, nil
+}
+
+// ackStore reply MessageStoreAck when the sender asked for it
+func (s *FileServer) ackStore(peer p2p.Peer, msg MessageStoreFile, storeErr error) error {
+	superseded := errors.Is(storeErr, errSuperseded)
+	if superseded {
+		storeErr = nil
+	}
+	if len(msg.RequestID) == 0 {
+		return storeErr
+	}
+	ack := MessageStoreAck{RequestID: msg.RequestID, Node: s.Transport.Addr(), Superseded: superseded}
+	if storeErr != nil {
+		ack.Err = storeErr.Error()
+	} else if meta, err := s.Storage.Stat(msg.ID, msg.Key); err == nil {
+		ack.Checksum = meta.Checksum
+	}
+	if err := s.send(peer, &Message{Payload: ack}); err != nil {
+		return err
+	}
+	return storeErr
 }
 
 // handleMessageGetFile handle get file request from other node
 func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
 
-	// 1) 如果本地没有 (通过map确认), 也就返回内容了
+	// 找到该peer的conn连接
+	requestPeer, ok := s.peerOf(from)
+	if !ok {
+		return fmt.Errorf("[%s] found peer %s had not connected", s.Transport.Addr(), from)
+	}
+
+	// 1) 如果本地没有, 回复size为0的stream, 请求方继续询问下一个节点
 	if !s.Storage.Has(msg.ID, msg.Key) {
+		s.sendLock.Lock()
+		defer s.sendLock.Unlock()
+		requestPeer.Send([]byte{p2p.INCOMING_STREAM})
+		binary.Write(requestPeer, binary.LittleEndian, int64(0))
 		return fmt.Errorf("[%s] need to serve file (%s), but it does not exist on disk\n", s.Transport.Addr(), msg.Key)
 	}
 
@@ -80,18 +286,40 @@ func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error
 		defer rc.Close()
 	}
 
-	// 找到该peer的conn连接
-	requestPeer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("[%s] found peer %s had not connected", s.Transport.Addr(), from)
+	// the range asked, from the start when the content changed since
+	header := transferHeader{Total: fSize}
+	meta, err := s.Storage.Stat(msg.ID, msg.Key)
+	if err == nil {
+		copy(header.Checksum[:], meta.Checksum)
+		if msg.Offset > 0 && msg.Offset <= fSize && msg.Checksum == meta.Checksum {
+			header.Offset = msg.Offset
+		}
+	}
+	length := fSize - header.Offset
+	if msg.Length > 0 && msg.Length < length {
+		length = msg.Length
+	}
+	if header.Offset > 0 {
+		rs, ok := r.(io.Seeker)
+		if !ok {
+			return fmt.Errorf("[%s] (%s) is not seekable", s.Transport.Addr(), msg.Key)
+		}
+		if _, err := rs.Seek(header.Offset, io.SeekStart); err != nil {
+			return err
+		}
 	}
 
 	// first send the 'incoming-Stream' byte to the peer
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
 	requestPeer.Send([]byte{p2p.INCOMING_STREAM})
 
-	// then can send the file size as an int64
-	binary.Write(requestPeer, binary.LittleEndian, fSize+16)
-	n, err := crypto.CopyEncrypt(s.EncKey, r, requestPeer)
+	// then can send the file size as an int64, and the range sent
+	binary.Write(requestPeer, binary.LittleEndian, length+16)
+	if err := writeTransferHeader(requestPeer, header, meta); err != nil {
+		return err
+	}
+	n, err := crypto.CopyEncrypt(s.EncKey, io.LimitReader(r, length), requestPeer)
 	if err != nil {
 		return err
 	}
@@ -99,3 +327,109 @@ func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error
 	log.Printf("[%s] written (%d) byets over the network to %s\n", s.Transport.Addr(), n, from)
 	return nil
 }
+
+// handleMessageDeleteFile write the tombstone, reply MessageDeleteAck when asked
+func (s *FileServer) handleMessageDeleteFile(from string, msg MessageDeleteFile) error {
+	err := s.deleteObject(msg.ID, msg.Key, msg.Version)
+	if len(msg.RequestID) == 0 {
+		return err
+	}
+	ack := MessageDeleteAck{RequestID: msg.RequestID, Node: s.Transport.Addr()}
+	if err != nil {
+		ack.Err = err.Error()
+	}
+	if replyErr := s.reply(from, &Message{Payload: ack}); replyErr != nil {
+		return replyErr
+	}
+	return err
+}
+
+// handleMessageUpdateMeta apply the tags editing to the local replica
+func (s *FileServer) handleMessageUpdateMeta(from string, msg MessageUpdateMeta) error {
+	if !s.Storage.Has(msg.ID, msg.Key) {
+		return fmt.Errorf("[%s] recv tags update from %s for (%s), but it does not exist on disk", s.Transport.Addr(), from, msg.Key)
+	}
+	// same version as the origin, so anti-entropy sees no difference
+	if _, err := s.applyTags(msg.ID, msg.Key, msg.Set, msg.Remove, msg.Version, msg.Clock); !errors.Is(err, errSuperseded) {
+		return err
+	}
+	return nil
+}
+
+// handleMessageHello register the remote's listen address as a node of the placement
+func (s *FileServer) handleMessageHello(from string, msg MessageHello) error {
+	s.peerLock.Lock()
+	peer, ok := s.peers[from]
+	if ok {
+		s.nodes[msg.Addr] = peer
+	}
+	s.peerLock.Unlock()
+	if !ok {
+		return fmt.Errorf("[%s] recv hello from unknown peer %s", s.Transport.Addr(), from)
+	}
+	s.Membership.Join(msg.Addr)
+	s.DHT.AddContact(msg.Addr)
+	if s.DHT.Len() == 1 {
+		// first contact, let the overlay learn about this node
+		go s.DHT.Bootstrap()
+	}
+	if err := s.Holdings.share(peer); err != nil {
+		log.Printf("[%s] send the holdings filter to %s failed: %s\n", s.Transport.Addr(), msg.Addr, err)
+	}
+	if err := s.shareNames(peer); err != nil {
+		log.Printf("[%s] send the name records to %s failed: %s\n", s.Transport.Addr(), msg.Addr, err)
+	}
+	// tell the new node about the rest of the cluster
+	s.PeerExchange.connected(msg.Addr)
+	if err := s.PeerExchange.share(msg.Addr); err != nil {
+		log.Printf("[%s] peer exchange with %s failed: %s\n", s.Transport.Addr(), msg.Addr, err)
+	}
+	if len(msg.State) > 0 && msg.State != NodeActive {
+		// leaving node is known, but not part of the placement
+		return s.handleMessageNodeState(from, MessageNodeState{Node: msg.Addr, State: msg.State})
+	}
+	s.Placement.Add(msg.Addr)
+	log.Printf("[%s] node %s joined the placement\n", s.Transport.Addr(), msg.Addr)
+	s.Rebalancer.Trigger()
+	// replay the writes it missed, in the background
+	go func() {
+		if err := s.Hints.Deliver(msg.Addr); err != nil {
+			log.Printf("[%s] %s\n", s.Transport.Addr(), err)
+		}
+	}()
+	return nil
+}
+
+// handleMessageHasFile answer whether the file is held locally
+func (s *FileServer) handleMessageHasFile(from string, msg MessageHasFile) error {
+	peer, ok := s.peerOf(from)
+	if !ok {
+		return fmt.Errorf("[%s] found peer %s had not connected", s.Transport.Addr(), from)
+	}
+	resp := MessageHasFileResponse{RequestID: msg.RequestID}
+	if s.Storage.Has(msg.ID, msg.Key) {
+		if meta, err := s.Storage.Stat(msg.ID, msg.Key); err == nil {
+			resp.Has = true
+			resp.Checksum = meta.Checksum
+			resp.Version = meta.Version
+			resp.Meta = meta
+		}
+	}
+	return s.send(peer, &Message{Payload: resp})
+}
+
+// handleMessageNodeState leaving & drained nodes are taken off the placement
+func (s *FileServer) handleMessageNodeState(from string, msg MessageNodeState) error {
+	s.peerLock.Lock()
+	s.nodeStates[msg.Node] = msg.State
+	s.peerLock.Unlock()
+
+	if msg.State == NodeActive {
+		s.Placement.Add(msg.Node)
+	} else {
+		s.Placement.Remove(msg.Node)
+	}
+	log.Printf("[%s] node %s is %s\n", s.Transport.Addr(), msg.Node, msg.State)
+	s.Rebalancer.Trigger()
+	return nil
+}
@@ -1,16 +1,463 @@
 package server
 
+import (
+	"crypto/ed25519"
+	"github.com/roylic/go-distributed-file-storage/clock"
+	"github.com/roylic/go-distributed-file-storage/dht"
+	"github.com/roylic/go-distributed-file-storage/membership"
+	"github.com/roylic/go-distributed-file-storage/naming"
+	"github.com/roylic/go-distributed-file-storage/rsync"
+	"github.com/roylic/go-distributed-file-storage/storage"
+)
+
 type Message struct {
 	Payload any
 }
 
 type MessageStoreFile struct {
-	ID   string // owner's identifier for finding the file
-	Key  string
-	Size int64
+	ID        string // owner's identifier for finding the file
+	Key       string
+	Size      int64             // bytes of the encrypted stream
+	Offset    int64             // of the first byte sent, resuming a transfer
+	Length    int64             // plain bytes sent
+	Meta      *storage.Metadata // metadata of the origin copy
+	RequestID string            // reply MessageStoreAck when not empty
+}
+
+// MessageStoreAck confirm the replica had been written
+type MessageStoreAck struct {
+	RequestID  string
+	Node       string // listen address of the replica
+	Checksum   string
+	Err        string
+	Superseded bool // the replica kept another version, by causality or conflict resolution
+}
+
+// MessageHasFile ask whether the node holds the file
+type MessageHasFile struct {
+	RequestID string
+	ID        string
+	Key       string
+}
+
+// MessageHasFileResponse answer of MessageHasFile
+type MessageHasFileResponse struct {
+	RequestID string
+	Has       bool
+	Checksum  string
+	Version   int64
+	Meta      *storage.Metadata // of the copy held
 }
 
 type MessageGetFile struct {
-	ID  string // owner's identifier for finding the file
-	Key string
+	ID       string // owner's identifier for finding the file
+	Key      string
+	Offset   int64  // first byte wanted, resuming a transfer
+	Length   int64  // bytes wanted, 0 to the end
+	Checksum string // content the offset refers to, sent from 0 when it changed
+}
+
+// MessageUpdateMeta tags editing, reaching every replica
+type MessageUpdateMeta struct {
+	ID      string // owner's identifier for finding the file
+	Key     string
+	Set     map[string]string
+	Remove  []string
+	Version int64        // version of the edited metadata, same on every replica
+	Clock   clock.VClock // causality of the edit, compared like a write
+}
+
+// MessageDeleteFile delete the file, leaving a tombstone of the version
+type MessageDeleteFile struct {
+	ID        string
+	Key       string
+	Version   int64
+	RequestID string // reply MessageDeleteAck when not empty
+}
+
+// MessageDeleteAck confirm the tombstone had been written
+type MessageDeleteAck struct {
+	RequestID string
+	Node      string
+	Err       string
+}
+
+// MessageMerkleRequest ask the hashes of the tree nodes on the level,
+// the tree is built over the keys shared with Node
+type MessageMerkleRequest struct {
+	RequestID string
+	Node      string
+	Level     int
+	Indexes   []int
+}
+
+type MessageMerkleResponse struct {
+	RequestID string
+	Hashes    [][]byte
+}
+
+// MessageMerkleBuckets ask the entries of the differing leaves
+type MessageMerkleBuckets struct {
+	RequestID string
+	Node      string
+	Leaves    []int
+}
+
+type MessageMerkleBucketsResponse struct {
+	RequestID string
+	Entries   []SyncEntry
+}
+
+// MessageRepairPush ask the node to push its newer entries to Node
+type MessageRepairPush struct {
+	Node    string
+	Entries []SyncEntry
+}
+
+// MessageGetVersion ask the content of an archived version
+type MessageGetVersion struct {
+	RequestID string
+	ID        string
+	Key       string
+	VersionID string
+}
+
+// MessageGetVersionResponse the content is encrypted with the shared key
+type MessageGetVersionResponse struct {
+	RequestID string
+	Meta      *storage.Metadata
+	Data      []byte
+	Err       string
+}
+
+// MessageListVersions ask the version history of the object
+type MessageListVersions struct {
+	RequestID string
+	ID        string
+	Key       string
+}
+
+type MessageListVersionsResponse struct {
+	RequestID string
+	Versions  []storage.ObjectVersion
+	Err       string
+}
+
+// MessageRestoreVersion restore the version as a new one, reaching every replica
+type MessageRestoreVersion struct {
+	ID        string
+	Key       string
+	VersionID string
+	Version   int64 // version of the restored write, same on every replica
+}
+
+// MessageDeleteVersion drop the version from the history of every replica
+type MessageDeleteVersion struct {
+	ID        string
+	Key       string
+	VersionID string
+}
+
+// MessageHello first message on a new connection, telling the
+// advertised listen address used as node identity by the placement
+type MessageHello struct {
+	Addr  string
+	State string // NodeActive / NodeLeaving / NodeDrained
+}
+
+// MessageNodeState broadcast when a node changes its state
+type MessageNodeState struct {
+	Node  string
+	State string
+}
+
+// MessageNodeDrain ask the node to drain itself, or to cancel the drain
+type MessageNodeDrain struct {
+	Node   string
+	Cancel bool // back in service
+}
+
+// MessageGossip SWIM membership protocol message
+type MessageGossip struct {
+	Msg membership.Message
+}
+
+// MessagePeerExchange advertised listen addresses of the nodes known by the sender
+type MessagePeerExchange struct {
+	Addrs []string
+}
+
+// MessageDHTRequest Kademlia request, answered by MessageDHTResponse
+type MessageDHTRequest struct {
+	RequestID string
+	Req       dht.Request
+}
+
+type MessageDHTResponse struct {
+	RequestID string
+	Resp      dht.Response
+}
+
+// MessageHoldings Bloom filter of the objects held by the node, either
+// the full filter of a generation or the words changed since the last Seq
+type MessageHoldings struct {
+	Node       string
+	Generation uint64 // bumped by every full filter
+	Seq        uint64 // incremental updates within the generation
+	K          int
+	Words      []uint64       // full filter
+	Delta      map[int]uint64 // word index -> word
+}
+
+// MessageHoldingsRequest ask the full filter, an update was missed
+type MessageHoldingsRequest struct {
+	Node string // asking
+}
+
+// MessageForwardGet look for the object on the nodes not connected to
+// the requester, relayed hop by hop until TTL runs out
+type MessageForwardGet struct {
+	RequestID string // of this hop
+	Origin    string // same on every hop, for duplicate suppression
+	ID        string
+	Key       string
+	TTL       int
+}
+
+// MessageForwardGetResponse relayed back along the route of the request
+type MessageForwardGetResponse struct {
+	RequestID string
+	Found     bool
+	Holder    string
+	Hops      int
+	Meta      *storage.Metadata // of the holder's copy
+}
+
+// MessageForwardRange ask a range of the object found by the forwarded
+// Get of Origin, relayed along its route, answered by MessageGetRangeResponse
+type MessageForwardRange struct {
+	RequestID string // of this hop
+	Origin    string
+	ID        string
+	Key       string
+	Offset    int64
+	Length    int64
+}
+
+// MessagePieceManifest ask the manifest & the pieces held, the hashes
+// are only sent for objects of at least MinSize
+type MessagePieceManifest struct {
+	RequestID string
+	ID        string
+	Key       string
+	MinSize   int64
+}
+
+type MessagePieceManifestResponse struct {
+	RequestID string
+	Has       bool
+	Version   int64
+	Checksum  string
+	Meta      *storage.Metadata // of the holder's copy, nil while downloading
+	Manifest  PieceManifest
+	Have      []bool // pieces held, all of them unless downloading
+}
+
+// MessageGetPiece ask a single piece
+type MessageGetPiece struct {
+	RequestID string
+	ID        string
+	Key       string
+	PieceSize int64
+	Index     int
+}
+
+type MessageGetPieceResponse struct {
+	RequestID string
+	Data      []byte // encrypted with the shared key
+	Err       string
+}
+
+// MessageTransferOffset ask where to resume the transfer of the object
+type MessageTransferOffset struct {
+	RequestID string
+	ID        string
+	Key       string
+	Size      int64
+	Checksum  string
+}
+
+type MessageTransferOffsetResponse struct {
+	RequestID string
+	Offset    int64
+}
+
+// MessageGetRange ask a range of the object, Length 0 to the end
+type MessageGetRange struct {
+	RequestID string
+	ID        string
+	Key       string
+	Offset    int64
+	Length    int64
+}
+
+// MessageGetRangeResponse the range is encrypted as the bytes at Offset of
+// the CTR stream started with IV, only the range is read & encrypted
+type MessageGetRangeResponse struct {
+	RequestID string
+	Size      int64 // of the whole object
+	IV        []byte
+	Data      []byte
+	Err       string
+}
+
+// MessageUploadPart stage the part on the initiator of the upload, the
+// content follows as a stream
+type MessageUploadPart struct {
+	RequestID string
+	UploadID  string
+	Number    int
+	Size      int64 // of the stream, with 16 bytes of AES IV
+}
+
+type MessageUploadPartResponse struct {
+	RequestID string
+	Part      UploadedPart
+	Missing   bool // the upload is not staged on the node
+	Err       string
+}
+
+// MessageCompleteUpload complete the upload on its initiator
+type MessageCompleteUpload struct {
+	RequestID string
+	UploadID  string
+	Parts     []UploadedPart
+}
+
+type MessageCompleteUploadResponse struct {
+	RequestID string
+	Result    *StoreResult
+	Missing   bool
+	Err       string
+}
+
+// MessageAbortUpload drop the upload staged on its initiator
+type MessageAbortUpload struct {
+	RequestID string
+	UploadID  string
+}
+
+type MessageAbortUploadResponse struct {
+	RequestID string
+	Missing   bool
+	Err       string
+}
+
+// MessageChunkHave ask which chunks the node already holds
+type MessageChunkHave struct {
+	RequestID string
+	Hashes    []string
+}
+
+type MessageChunkHaveResponse struct {
+	RequestID string
+	Have      []bool // same order as the hashes asked
+}
+
+// MessageStoreChunks replicate the object as the manifest of its chunks,
+// carrying the chunks the replica misses, answered by MessageStoreAck
+type MessageStoreChunks struct {
+	RequestID string
+	ID        string
+	Key       string
+	Meta      *storage.Metadata
+	Chunks    storage.Manifest
+	Data      map[string][]byte // hash -> chunk encrypted with the shared key
+}
+
+// MessageGetBlock ask a block of the DAG of Root, a leaf is read from the
+// object at Offset when not held as a block
+type MessageGetBlock struct {
+	RequestID string
+	Root      string
+	CID       string
+	Offset    int64
+	Size      int64 // of a leaf, 0 when unknown
+}
+
+type MessageGetBlockResponse struct {
+	RequestID string
+	Data      []byte // encrypted with the shared key
+	Err       string
+}
+
+// MessageNameRecords gossip of name records, every node keeps the valid
+// ones newer than its own & passes them on
+type MessageNameRecords struct {
+	Records []*naming.Record
+}
+
+// MessageResolveName ask the record of the name held by the node
+type MessageResolveName struct {
+	RequestID string
+	Owner     ed25519.PublicKey
+	Name      string
+}
+
+type MessageResolveNameResponse struct {
+	RequestID string
+	Record    *naming.Record // nil when unknown
+}
+
+// MessageGetShard ask the metadata of the shard held by the node, the
+// content is read with MessageGetRange
+type MessageGetShard struct {
+	RequestID string
+	ID        string
+	Key       string
+}
+
+type MessageGetShardResponse struct {
+	RequestID string
+	Meta      *storage.Metadata // nil when not held
+	Err       string
+}
+
+// MessageDeltaSignature ask the checksums of the blocks of the node's copy
+type MessageDeltaSignature struct {
+	RequestID string
+	ID        string
+	Key       string
+}
+
+type MessageDeltaSignatureResponse struct {
+	RequestID string
+	Checksum  string           // of the copy signed
+	Signature *rsync.Signature // nil when not held
+}
+
+// MessageStoreDelta replicate the object as the instructions rebuilding it
+// from the replica's copy, answered by MessageStoreAck
+type MessageStoreDelta struct {
+	RequestID string
+	ID        string
+	Key       string
+	Meta      *storage.Metadata
+	Base      string // checksum of the copy the delta applies to
+	BlockSize int
+	Ops       []rsync.Op // literal data encrypted with the shared key
+}
+
+// MessageQuery run the query on the node's index of the namespace
+type MessageQuery struct {
+	RequestID string
+	ID        string
+	Query     string
+	Opts      storage.QueryOpts
+}
+
+type MessageQueryResponse struct {
+	RequestID string
+	Result    storage.QueryResult
+	Err       string
 }
@@ -0,0 +1,350 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/crypto"
+	"github.com/roylic/go-distributed-file-storage/storage"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultUploadTTL = 24 * time.Hour // uploads not completed are dropped
+	MaxUploadParts   = 10000
+)
+
+// ErrUploadNotFound the upload is not staged, it was completed, aborted or
+// it expired
+var ErrUploadNotFound = storage.ErrUploadNotFound
+
+// uploadSession staged with the parts on the initiator, out of the index,
+// the other nodes forward UploadPart, CompleteUpload & AbortUpload to it
+type uploadSession struct {
+	Key       string
+	Opts      StoreOpts
+	Initiated time.Time
+}
+
+// UploadedPart returned by UploadPart, the list given to CompleteUpload
+type UploadedPart struct {
+	Number   int
+	Size     int64
+	Checksum string // sha256 hex of the part
+}
+
+// parseUploadID the namespace & the node of the initiator, the upload ID
+// is "<namespace>.<hex of the node address>.<random>"
+func parseUploadID(uploadID string) (id string, node string, err error) {
+	fields := strings.Split(uploadID, ".")
+	if len(fields) != 3 || len(fields[0]) == 0 {
+		return "", "", fmt.Errorf("%w: %s", ErrUploadNotFound, uploadID)
+	}
+	addr, err := hex.DecodeString(fields[1])
+	if err != nil || len(addr) == 0 {
+		return "", "", fmt.Errorf("%w: %s", ErrUploadNotFound, uploadID)
+	}
+	return fields[0], string(addr), nil
+}
+
+func (s *FileServer) uploadTTL() time.Duration {
+	if s.UploadTTL > 0 {
+		return s.UploadTTL
+	}
+	return DefaultUploadTTL
+}
+
+// InitiateUpload start a multipart upload of the key, the options apply to
+// the object once completed. The upload is staged on this node & the
+// object stored in its namespace, whichever node completes it
+func (s *FileServer) InitiateUpload(key string, opts StoreOpts) (string, error) {
+	now := time.Now()
+	info, err := json.Marshal(uploadSession{Key: key, Opts: opts, Initiated: now})
+	if err != nil {
+		return "", err
+	}
+	uploadID := s.ID + "." + hex.EncodeToString([]byte(s.Transport.Addr())) + "." + crypto.GenerateID()[:32]
+	err = s.Storage.CreateUpload(storage.Upload{ID: uploadID, Expires: now.Add(s.uploadTTL()), Info: info})
+	if err != nil {
+		return "", err
+	}
+	return uploadID, nil
+}
+
+// session of the upload staged on this node
+func (s *FileServer) session(uploadID string) (*uploadSession, error) {
+	u, err := s.Storage.Upload(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(u.Expires) {
+		return nil, fmt.Errorf("%w: %s expired", ErrUploadNotFound, uploadID)
+	}
+	session := new(uploadSession)
+	if err := json.Unmarshal(u.Info, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// uploadErr the error answered by the initiator
+func uploadErr(node string, missing bool, msg string) error {
+	if missing {
+		return fmt.Errorf("node %s: %w: %s", node, ErrUploadNotFound, msg)
+	}
+	if len(msg) > 0 {
+		return fmt.Errorf("node %s: %s", node, msg)
+	}
+	return nil
+}
+
+// UploadPart store the part n (1..MaxUploadParts) of the upload, parts are
+// independent & may be sent in parallel through any node, which forwards
+// them to the initiator. Sending the same number again replaces the part
+func (s *FileServer) UploadPart(uploadID string, n int, r io.Reader) (UploadedPart, error) {
+	if n < 1 || n > MaxUploadParts {
+		return UploadedPart{Number: n}, fmt.Errorf("part number %d out of 1..%d", n, MaxUploadParts)
+	}
+	_, node, err := parseUploadID(uploadID)
+	if err != nil {
+		return UploadedPart{Number: n}, err
+	}
+	if node == s.Transport.Addr() {
+		return s.stagePart(uploadID, n, r)
+	}
+	return s.uploadPartOn(node, uploadID, n, r)
+}
+
+// stagePart write the part of an upload initiated on this node
+func (s *FileServer) stagePart(uploadID string, n int, r io.Reader) (UploadedPart, error) {
+	part := UploadedPart{Number: n}
+	if _, err := s.session(uploadID); err != nil {
+		return part, err
+	}
+	h := sha256.New()
+	size, err := s.Storage.WriteUploadPart(uploadID, n, io.TeeReader(r, h))
+	part.Size, part.Checksum = size, hex.EncodeToString(h.Sum(nil))
+	return part, err
+}
+
+// uploadPartOn stream the part to the initiator, spooled first as the
+// size of a stream is sent ahead of it
+func (s *FileServer) uploadPartOn(node string, uploadID string, n int, r io.Reader) (UploadedPart, error) {
+	part := UploadedPart{Number: n}
+	peer, ok := s.nodePeer(node)
+	if !ok {
+		return part, fmt.Errorf("initiator %s of upload %s is not connected", node, uploadID)
+	}
+	f, err := s.Storage.CreateSpool()
+	if err != nil {
+		return part, err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return part, err
+	}
+	part.Size, part.Checksum = size, hex.EncodeToString(h.Sum(nil))
+
+	reqID, ch := s.pendingRequest()
+	msg := Message{Payload: MessageUploadPart{RequestID: reqID, UploadID: uploadID, Number: n, Size: size + 16}}
+	if err := s.sendStream(peer, &msg, io.NewSectionReader(f, 0, size)); err != nil {
+		s.cancelRequest(reqID)
+		return part, err
+	}
+	resp, err := s.awaitResponse(reqID, ch, DefaultRequestTimeout)
+	if err != nil {
+		return part, err
+	}
+	v := resp.(MessageUploadPartResponse)
+	if err := uploadErr(node, v.Missing, v.Err); err != nil {
+		return part, err
+	}
+	if v.Part.Size != part.Size || v.Part.Checksum != part.Checksum {
+		return part, fmt.Errorf("part %d of %s staged on %s: %w", n, uploadID, node, storage.ErrChecksumMismatch)
+	}
+	return part, nil
+}
+
+// handleMessageUploadPart stage the part streamed by another node, the
+// stream is read to its end whatever happens to the part
+func (s *FileServer) handleMessageUploadPart(from string, msg MessageUploadPart) error {
+	peer, ok := s.peerOf(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found in Mapping, end handleMessage logic", from)
+	}
+	resp := MessageUploadPartResponse{RequestID: msg.RequestID}
+	if err := peer.WaitStream(DefaultRequestTimeout); err != nil {
+		resp.Err = err.Error()
+		return s.send(peer, &Message{Payload: resp})
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := crypto.CopyDecrypt(s.EncKey, io.LimitReader(peer, msg.Size), pw)
+		pw.CloseWithError(err)
+	}()
+	part, err := s.stagePart(msg.UploadID, msg.Number, pr)
+	_, _ = io.Copy(io.Discard, pr)
+	peer.CloseStream()
+
+	resp.Part = part
+	if err != nil {
+		resp.Missing = errors.Is(err, ErrUploadNotFound)
+		resp.Err = err.Error()
+	}
+	return s.send(peer, &Message{Payload: resp})
+}
+
+// CompleteUpload stitch the parts, in ascending order, into the object, on
+// the initiator of the upload
+func (s *FileServer) CompleteUpload(uploadID string, parts []UploadedPart) (*StoreResult, error) {
+	_, node, err := parseUploadID(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if node == s.Transport.Addr() {
+		return s.completeUpload(uploadID, parts)
+	}
+	var size int64
+	for _, part := range parts {
+		size += part.Size
+	}
+	resp, err := s.requestWithin(node, completeTimeout(size), func(reqID string) any {
+		return MessageCompleteUpload{RequestID: reqID, UploadID: uploadID, Parts: parts}
+	})
+	if err != nil {
+		return nil, err
+	}
+	v := resp.(MessageCompleteUploadResponse)
+	return v.Result, uploadErr(node, v.Missing, v.Err)
+}
+
+// completeTimeout waiting for the initiator to store the object, a second
+// per MiB of the parts on top of the request timeout
+func completeTimeout(size int64) time.Duration {
+	return DefaultRequestTimeout + time.Duration(size>>20)*time.Second
+}
+
+// completeUpload the parts are streamed & verified one after another into
+// the spool of the object, which is written once every part checked out,
+// so readers never see it half assembled. The upload is dropped
+func (s *FileServer) completeUpload(uploadID string, parts []UploadedPart) (*StoreResult, error) {
+	if len(parts) == 0 {
+		return nil, errors.New("no part to complete the upload")
+	}
+	for i, part := range parts {
+		if i > 0 && part.Number <= parts[i-1].Number {
+			return nil, fmt.Errorf("parts must be in ascending order, %d after %d", part.Number, parts[i-1].Number)
+		}
+	}
+	session, err := s.session(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	id, _, _ := parseUploadID(uploadID)
+	pr, pw := io.Pipe()
+	go func() {
+		for _, part := range parts {
+			if err := s.copyPart(uploadID, part, pw); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+	res, err := s.storeStream(id, session.Key, pr, session.Opts)
+	pr.Close()
+	if err != nil {
+		return res, err
+	}
+	return res, s.Storage.DropUpload(uploadID)
+}
+
+// copyPart write the staged part to w, checked against its checksum
+func (s *FileServer) copyPart(uploadID string, part UploadedPart, w io.Writer) error {
+	r, err := s.Storage.ReadUploadPart(uploadID, part.Number)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), r); err != nil {
+		return fmt.Errorf("part %d of %s: %w", part.Number, uploadID, err)
+	}
+	if hex.EncodeToString(h.Sum(nil)) != part.Checksum {
+		return fmt.Errorf("part %d of %s: %w", part.Number, uploadID, storage.ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// handleMessageCompleteUpload complete off the loop, storing the object
+// waits for the acks of the replicas, which the loop delivers
+func (s *FileServer) handleMessageCompleteUpload(from string, msg MessageCompleteUpload) error {
+	go func() {
+		resp := MessageCompleteUploadResponse{RequestID: msg.RequestID}
+		res, err := s.completeUpload(msg.UploadID, msg.Parts)
+		resp.Result = res
+		if err != nil {
+			resp.Missing = errors.Is(err, ErrUploadNotFound)
+			resp.Err = err.Error()
+		}
+		if err := s.reply(from, &Message{Payload: resp}); err != nil {
+			log.Printf("server[%s] reply completion of %s failed: %s\n", s.Transport.Addr(), msg.UploadID, err)
+		}
+	}()
+	return nil
+}
+
+// AbortUpload drop the session & every part uploaded, on the initiator
+func (s *FileServer) AbortUpload(uploadID string) error {
+	_, node, err := parseUploadID(uploadID)
+	if err != nil {
+		return err
+	}
+	if node == s.Transport.Addr() {
+		return s.abortUpload(uploadID)
+	}
+	resp, err := s.request(node, func(reqID string) any {
+		return MessageAbortUpload{RequestID: reqID, UploadID: uploadID}
+	})
+	if err != nil {
+		return err
+	}
+	v := resp.(MessageAbortUploadResponse)
+	return uploadErr(node, v.Missing, v.Err)
+}
+
+func (s *FileServer) abortUpload(uploadID string) error {
+	if _, err := s.session(uploadID); err != nil {
+		return err
+	}
+	return s.Storage.DropUpload(uploadID)
+}
+
+// handleMessageAbortUpload drop the upload staged on this node
+func (s *FileServer) handleMessageAbortUpload(from string, msg MessageAbortUpload) error {
+	resp := MessageAbortUploadResponse{RequestID: msg.RequestID}
+	if err := s.abortUpload(msg.UploadID); err != nil {
+		resp.Missing = errors.Is(err, ErrUploadNotFound)
+		resp.Err = err.Error()
+	}
+	return s.reply(from, &Message{Payload: resp})
+}
+
+// expireUploads drop the uploads staged on this node expired at the time,
+// found from the staging area alone
+func (s *FileServer) expireUploads(now time.Time) {
+	if _, err := s.Storage.PurgeUploads(now); err != nil {
+		log.Printf("server[%s] expire uploads failed: %s\n", s.Transport.Addr(), err)
+	}
+}
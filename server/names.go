@@ -0,0 +1,151 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/dag"
+	"github.com/roylic/go-distributed-file-storage/naming"
+	"github.com/roylic/go-distributed-file-storage/p2p"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultNameTTL = 24 * time.Hour
+	// namesDir name records kept under the storage root
+	namesDir = "_names"
+)
+
+// NamePublicKey the owner key of the names published by this server
+func (s *FileServer) NamePublicKey() ed25519.PublicKey {
+	return s.NameKey.Public().(ed25519.PublicKey)
+}
+
+// PublishName point the name at the target (a CID, or key@versionID),
+// signed with the server's name key & gossiped to the network
+func (s *FileServer) PublishName(name string, target string) (*naming.Record, error) {
+	ttl := s.NameTTL
+	if ttl <= 0 {
+		ttl = DefaultNameTTL
+	}
+	rec := &naming.Record{Name: name, Target: target, Seq: 1, Expires: time.Now().Add(ttl)}
+	if cur, err := s.ResolveName(s.NamePublicKey(), name); err == nil {
+		rec.Seq = cur.Seq + 1
+	}
+	rec.Sign(s.NameKey)
+	if err := s.Names.Put(rec); err != nil {
+		return nil, err
+	}
+	return rec, s.broadcast(&Message{Payload: MessageNameRecords{Records: []*naming.Record{rec}}})
+}
+
+// ResolveName the record of the name with the highest valid sequence
+// among the local one & the connected nodes' answers, forged or expired
+// records are ignored
+func (s *FileServer) ResolveName(owner ed25519.PublicKey, name string) (*naming.Record, error) {
+	s.peerLock.Lock()
+	nodes := make([]string, 0, len(s.nodes))
+	for node := range s.nodes {
+		nodes = append(nodes, node)
+	}
+	s.peerLock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			resp, err := s.request(node, func(reqID string) any {
+				return MessageResolveName{RequestID: reqID, Owner: owner, Name: name}
+			})
+			if err != nil {
+				return
+			}
+			if rec := resp.(MessageResolveNameResponse).Record; rec != nil {
+				if err := s.Names.Put(rec); err != nil && !errors.Is(err, naming.ErrStale) {
+					log.Printf("[%s] record of %s from %s refused: %s\n", s.Transport.Addr(), name, node, err)
+				}
+			}
+		}(node)
+	}
+	wg.Wait()
+	return s.Names.Get(owner, name)
+}
+
+// GetByName read the content the name points at
+func (s *FileServer) GetByName(owner ed25519.PublicKey, name string) (io.Reader, error) {
+	rec, err := s.ResolveName(owner, name)
+	if err != nil {
+		return nil, err
+	}
+	if c, err := dag.Parse(rec.Target); err == nil {
+		return s.GetByCID(c.String())
+	}
+	if key, version, ok := strings.Cut(rec.Target, "@"); ok {
+		return s.GetWithOpts(key, GetOpts{VersionID: version})
+	}
+	return nil, fmt.Errorf("name %s points at an invalid target (%s)", name, rec.Target)
+}
+
+// shareNames send every record held to the peer
+func (s *FileServer) shareNames(peer p2p.Peer) error {
+	records := s.Names.Records()
+	if len(records) == 0 {
+		return nil
+	}
+	return s.send(peer, &Message{Payload: MessageNameRecords{Records: records}})
+}
+
+// handleMessageNameRecords keep the records accepted & pass them to the
+// other peers, a record already held stops there
+func (s *FileServer) handleMessageNameRecords(from string, msg MessageNameRecords) error {
+	var accepted []*naming.Record
+	for _, rec := range msg.Records {
+		if rec == nil {
+			continue
+		}
+		err := s.Names.Put(rec)
+		if err == nil {
+			accepted = append(accepted, rec)
+			continue
+		}
+		if !errors.Is(err, naming.ErrStale) {
+			log.Printf("[%s] record of %s from %s refused: %s\n", s.Transport.Addr(), rec.Name, from, err)
+		}
+	}
+	if len(accepted) == 0 {
+		return nil
+	}
+	frame := encodeMessage(&Message{Payload: MessageNameRecords{Records: accepted}})
+	s.peerLock.Lock()
+	peers := make(map[string]p2p.Peer, len(s.peers))
+	for addr, peer := range s.peers {
+		peers[addr] = peer
+	}
+	s.peerLock.Unlock()
+
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	for addr, peer := range peers {
+		if addr == from {
+			continue
+		}
+		if err := peer.Send(frame); err != nil {
+			log.Printf("[%s] gossip the name records to %s failed: %s\n", s.Transport.Addr(), addr, err)
+		}
+	}
+	return nil
+}
+
+// handleMessageResolveName answer the record held
+func (s *FileServer) handleMessageResolveName(from string, msg MessageResolveName) error {
+	resp := MessageResolveNameResponse{RequestID: msg.RequestID}
+	if rec, err := s.Names.Get(msg.Owner, msg.Name); err == nil {
+		resp.Record = rec
+	}
+	return s.reply(from, &Message{Payload: resp})
+}
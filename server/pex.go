@@ -0,0 +1,183 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultPeerExchangeInterval time between two address exchanges with a random peer
+const DefaultPeerExchangeInterval = 30 * time.Second
+
+// MaxExchangedAddrs addresses shared in one exchange
+const MaxExchangedAddrs = 64
+
+// ErrPeerLimit the connection is refused, MaxPeers are already connected
+var ErrPeerLimit = errors.New("peer limit reached")
+
+// PeerExchange learn the listen addresses of the cluster from the
+// connected peers, and dial the ones not connected yet
+type PeerExchange struct {
+	s *FileServer
+
+	mu      sync.Mutex
+	known   map[string]time.Time // listen addr -> last learnt
+	dialing map[string]time.Time // listen addr -> dialed at, until its hello
+}
+
+func NewPeerExchange(s *FileServer) *PeerExchange {
+	return &PeerExchange{
+		s:       s,
+		known:   make(map[string]time.Time),
+		dialing: make(map[string]time.Time),
+	}
+}
+
+// Known every listen address learnt, connected or not
+func (p *PeerExchange) Known() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	addrs := make([]string, 0, len(p.known))
+	for addr := range p.known {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// connected the node said hello, it is no longer being dialed
+func (p *PeerExchange) connected(addr string) {
+	p.mu.Lock()
+	p.known[addr] = time.Now()
+	delete(p.dialing, addr)
+	p.mu.Unlock()
+}
+
+// dialed the node is being connected, the peer exchange waits for its hello
+func (p *PeerExchange) dialed(addr string) {
+	p.mu.Lock()
+	p.known[addr] = time.Now()
+	p.dialing[addr] = time.Now()
+	p.mu.Unlock()
+}
+
+// share send the known addresses to the node
+func (p *PeerExchange) share(node string) error {
+	peer, ok := p.s.nodePeer(node)
+	if !ok {
+		return nil
+	}
+	addrs := p.Known()
+	// the receiver knows itself
+	for i, addr := range addrs {
+		if addr == node {
+			addrs = append(addrs[:i], addrs[i+1:]...)
+			break
+		}
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+	if len(addrs) > MaxExchangedAddrs {
+		rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+		addrs = addrs[:MaxExchangedAddrs]
+	}
+	return p.s.send(peer, &Message{Payload: MessagePeerExchange{Addrs: addrs}})
+}
+
+// learn record the addresses, then dial the new ones
+func (p *PeerExchange) learn(addrs []string) {
+	self := p.s.Transport.Addr()
+	p.mu.Lock()
+	for _, addr := range addrs {
+		if len(addr) > 0 && addr != self {
+			p.known[addr] = time.Now()
+		}
+	}
+	p.mu.Unlock()
+	p.connectKnown()
+}
+
+// connectKnown dial the known nodes not connected, within MaxPeers
+func (p *PeerExchange) connectKnown() {
+	if p.s.DiscoverOnly {
+		return
+	}
+	p.s.peerLock.Lock()
+	connected := len(p.s.peers)
+	p.s.peerLock.Unlock()
+
+	p.mu.Lock()
+	var targets []string
+	for addr, at := range p.dialing {
+		if time.Since(at) > DefaultRequestTimeout {
+			delete(p.dialing, addr) // never said hello
+		}
+	}
+	for addr := range p.known {
+		if p.s.MaxPeers > 0 && connected+len(p.dialing) >= p.s.MaxPeers {
+			break
+		}
+		if _, ok := p.dialing[addr]; ok {
+			continue
+		}
+		if _, ok := p.s.nodePeer(addr); ok {
+			continue
+		}
+		p.dialing[addr] = time.Now()
+		targets = append(targets, addr)
+	}
+	p.mu.Unlock()
+
+	for _, addr := range targets {
+		log.Printf("[%s] dialing discovered node %s\n", p.s.Transport.Addr(), addr)
+		go func(addr string) {
+			if err := p.s.Transport.Dial(addr); err != nil {
+				log.Printf("[%s] dial discovered node %s failed: %s\n", p.s.Transport.Addr(), addr, err)
+				p.mu.Lock()
+				delete(p.dialing, addr)
+				p.mu.Unlock()
+			}
+		}(addr)
+	}
+}
+
+// loop exchange the addresses with a random peer every interval,
+// and retry the known nodes not connected
+func (p *PeerExchange) loop() {
+	interval := p.s.PeerExchangeInterval
+	if interval <= 0 {
+		interval = DefaultPeerExchangeInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.s.quitCh:
+			return
+		}
+		p.s.peerLock.Lock()
+		nodes := make([]string, 0, len(p.s.nodes))
+		for node := range p.s.nodes {
+			nodes = append(nodes, node)
+		}
+		p.s.peerLock.Unlock()
+		if len(nodes) > 0 {
+			node := nodes[rand.Intn(len(nodes))]
+			if err := p.share(node); err != nil {
+				log.Printf("[%s] peer exchange with %s failed: %s\n", p.s.Transport.Addr(), node, err)
+			}
+		}
+		p.connectKnown()
+	}
+}
+
+// handleMessagePeerExchange learn the addresses known by the peer
+func (s *FileServer) handleMessagePeerExchange(from string, msg MessagePeerExchange) error {
+	s.PeerExchange.learn(msg.Addrs)
+	return nil
+}
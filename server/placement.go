@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	DefaultReplicationFactor = 3
+	DefaultVirtualNodes      = 64
+)
+
+// Placement decide which nodes should hold a (hashed) key
+type Placement interface {
+	Add(node string)
+	Remove(node string)
+	Nodes() []string
+	// Locate return at most n distinct nodes, ordered by preference
+	Locate(key string, n int) []string
+}
+
+// HashRing consistent hashing with virtual nodes, every node is
+// placed on the ring multiple times to smooth the distribution
+type HashRing struct {
+	mu           sync.RWMutex
+	virtualNodes int
+	hashes       []uint64          // sorted positions on the ring
+	owners       map[uint64]string // position -> node
+	nodes        map[string]bool
+}
+
+func NewHashRing(virtualNodes int) *HashRing {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	return &HashRing{
+		virtualNodes: virtualNodes,
+		owners:       make(map[uint64]string),
+		nodes:        make(map[string]bool),
+	}
+}
+
+// ringHash position of a string on the ring
+func ringHash(s string) uint64 {
+	sum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Add put the node & its virtual nodes on the ring
+func (r *HashRing) Add(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.nodes[node] {
+		return
+	}
+	r.nodes[node] = true
+	for i := 0; i < r.virtualNodes; i++ {
+		h := ringHash(fmt.Sprintf("%s#%d", node, i))
+		r.owners[h] = node
+		r.hashes = append(r.hashes, h)
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+// Remove take the node & its virtual nodes off the ring
+func (r *HashRing) Remove(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+	hashes := r.hashes[:0]
+	for _, h := range r.hashes {
+		if r.owners[h] == node {
+			delete(r.owners, h)
+			continue
+		}
+		hashes = append(hashes, h)
+	}
+	r.hashes = hashes
+}
+
+// Nodes all the nodes on the ring, sorted
+func (r *HashRing) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Locate walk clockwise from the key's position, collecting distinct nodes
+func (r *HashRing) Locate(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	h := ringHash(key)
+	start := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	nodes := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; len(nodes) < n && i < len(r.hashes); i++ {
+		node := r.owners[r.hashes[(start+i)%len(r.hashes)]]
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/storage"
+	"log"
+	"sort"
+	"sync"
+)
+
+// statRemote the newest metadata of the object among the nodes holding
+// it, the replicas by placement are asked before the others
+func (s *FileServer) statRemote(id string, hashedKey string) (*storage.Metadata, error) {
+	likely, rest := s.candidates(id, hashedKey)
+	for _, nodes := range [][]string{likely, rest} {
+		if meta := s.newestMeta(nodes, id, hashedKey); meta != nil {
+			return meta, nil
+		}
+	}
+	return nil, fmt.Errorf("server[%s] file (%s) not found in the network", s.Transport.Addr(), hashedKey)
+}
+
+// newestMeta ask the nodes at once, nil when none of them holds the object
+func (s *FileServer) newestMeta(nodes []string, id string, hashedKey string) *storage.Metadata {
+	var (
+		mu     sync.Mutex
+		newest *storage.Metadata
+		wg     sync.WaitGroup
+	)
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			resp, err := s.request(node, func(reqID string) any {
+				return MessageHasFile{RequestID: reqID, ID: id, Key: hashedKey}
+			})
+			if err != nil {
+				return
+			}
+			has := resp.(MessageHasFileResponse)
+			if !has.Has || has.Meta == nil {
+				return
+			}
+			mu.Lock()
+			if newest == nil || newerMeta(has.Meta, newest) {
+				newest = has.Meta
+			}
+			mu.Unlock()
+		}(node)
+	}
+	wg.Wait()
+	return newest
+}
+
+// newerMeta same order as SyncEntry.newerThan
+func newerMeta(a *storage.Metadata, b *storage.Metadata) bool {
+	return SyncEntry{Version: a.Version, Checksum: a.Checksum}.newerThan(SyncEntry{Version: b.Version, Checksum: b.Checksum})
+}
+
+// queryIn run the query on the local index & on every connected node,
+// the pages are merged by key, the newest version of a key wins
+func (s *FileServer) queryIn(id string, query string, opts storage.QueryOpts) (*storage.QueryResult, error) {
+	local, err := s.Storage.Query(id, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.peerLock.Lock()
+	nodes := make([]string, 0, len(s.nodes))
+	for node := range s.nodes {
+		nodes = append(nodes, node)
+	}
+	s.peerLock.Unlock()
+
+	var (
+		mu    sync.Mutex
+		pages = []*storage.QueryResult{local}
+		wg    sync.WaitGroup
+	)
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			page, err := s.queryOn(node, id, query, opts)
+			if err != nil {
+				log.Printf("[%s] query on %s failed: %s\n", s.Transport.Addr(), node, err)
+				return
+			}
+			mu.Lock()
+			pages = append(pages, page)
+			mu.Unlock()
+		}(node)
+	}
+	wg.Wait()
+	return mergePages(pages, opts.Limit), nil
+}
+
+// queryOn run the query on the node's index
+func (s *FileServer) queryOn(node string, id string, query string, opts storage.QueryOpts) (*storage.QueryResult, error) {
+	resp, err := s.request(node, func(reqID string) any {
+		return MessageQuery{RequestID: reqID, ID: id, Query: query, Opts: opts}
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := resp.(MessageQueryResponse)
+	if len(r.Err) > 0 {
+		return nil, fmt.Errorf("node %s: %s", node, r.Err)
+	}
+	return &r.Result, nil
+}
+
+// mergePages one page out of the pages of every node, each page holds the
+// first matches after the same cursor, so the first limit keys of the
+// union are complete
+func mergePages(pages []*storage.QueryResult, limit int) *storage.QueryResult {
+	if limit <= 0 {
+		limit = storage.DefaultQueryLimit
+	}
+	newest := make(map[string]storage.Metadata)
+	more := false
+	for _, page := range pages {
+		more = more || len(page.NextCursor) > 0
+		for _, meta := range page.Items {
+			cur, ok := newest[meta.Key]
+			if !ok || newerMeta(&meta, &cur) {
+				newest[meta.Key] = meta
+			}
+		}
+	}
+	keys := make([]string, 0, len(newest))
+	for key := range newest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	res := &storage.QueryResult{}
+	for _, key := range keys {
+		if len(res.Items) == limit {
+			more = true
+			break
+		}
+		res.Items = append(res.Items, newest[key])
+	}
+	if more && len(res.Items) == limit {
+		res.NextCursor = res.Items[limit-1].Key
+	}
+	return res
+}
+
+// handleMessageQuery answer from the local index
+func (s *FileServer) handleMessageQuery(from string, msg MessageQuery) error {
+	resp := MessageQueryResponse{RequestID: msg.RequestID}
+	if res, err := s.Storage.Query(msg.ID, msg.Query, msg.Opts); err != nil {
+		resp.Err = err.Error()
+	} else {
+		resp.Result = *res
+	}
+	return s.reply(from, &Message{Payload: resp})
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/crypto"
+	"github.com/roylic/go-distributed-file-storage/storage"
+	"io"
+	"log"
+)
+
+// rangeChunk bytes asked per message, longer ranges take several requests
+const rangeChunk = 1 << 20
+
+// GetRange read length bytes of the file from the offset, 0 to the end.
+// The local copy is read directly, otherwise only the range is fetched
+// from a holder, nothing is stored
+func (s *FileServer) GetRange(key string, offset int64, length int64) (io.Reader, error) {
+	return s.getRange(s.ID, key, offset, length)
+}
+
+// getRange same as GetRange in the namespace id
+func (s *FileServer) getRange(id string, key string, offset int64, length int64) (io.Reader, error) {
+	hashedKey := crypto.HashKey(key)
+	if s.Storage.Has(id, hashedKey) {
+		_, r, err := s.Storage.ReadRange(id, hashedKey, offset, length)
+		return r, err
+	}
+	for _, node := range s.candidateNodes(id, hashedKey) {
+		if node == s.Transport.Addr() {
+			continue
+		}
+		data, err := s.fetchRange(node, id, hashedKey, offset, length)
+		if err != nil {
+			log.Printf("server[%s] fetch range %d+%d of (%s) from %s failed: %s\n", s.Transport.Addr(), offset, length, key, node, err)
+			if errors.Is(err, storage.ErrInvalidRange) {
+				return nil, err
+			}
+			continue
+		}
+		return bytes.NewReader(data), nil
+	}
+	return nil, fmt.Errorf("server[%s] file (%s) not found in the network", s.Transport.Addr(), key)
+}
+
+// fetchRange ask the range from the node, chunk by chunk
+func (s *FileServer) fetchRange(node string, id string, hashedKey string, offset int64, length int64) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := s.fetchRangeTo(node, id, hashedKey, offset, length, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// fetchRangeTo same as fetchRange, each chunk written to w once received,
+// returns the bytes written
+func (s *FileServer) fetchRangeTo(node string, id string, hashedKey string, offset int64, length int64, w io.Writer) (int64, error) {
+	var got int64
+	for {
+		want := int64(rangeChunk)
+		if length > 0 {
+			want = min(want, length-got)
+		}
+		at := offset + got
+		resp, err := s.request(node, func(reqID string) any {
+			return MessageGetRange{RequestID: reqID, ID: id, Key: hashedKey, Offset: at, Length: want}
+		})
+		if err != nil {
+			return got, err
+		}
+		v := resp.(MessageGetRangeResponse)
+		if len(v.Err) > 0 {
+			if v.Size > 0 && at > v.Size {
+				return got, fmt.Errorf("%w: %s", storage.ErrInvalidRange, v.Err)
+			}
+			return got, errors.New(v.Err)
+		}
+		n, err := crypto.CopyDecryptAt(s.EncKey, v.IV, at, bytes.NewReader(v.Data), w)
+		got += int64(n)
+		if err != nil {
+			return got, err
+		}
+		end := v.Size
+		if length > 0 {
+			end = min(end, offset+length)
+		}
+		if len(v.Data) == 0 || offset+got >= end {
+			return got, nil
+		}
+	}
+}
+
+// handleMessageGetRange read & encrypt the range of the local copy
+func (s *FileServer) handleMessageGetRange(from string, msg MessageGetRange) error {
+	resp := MessageGetRangeResponse{RequestID: msg.RequestID}
+	err := s.readRange(msg, &resp)
+	if err != nil {
+		resp.Data = nil
+		resp.Err = err.Error()
+	}
+	return s.reply(from, &Message{Payload: resp})
+}
+
+func (s *FileServer) readRange(msg MessageGetRange, resp *MessageGetRangeResponse) error {
+	meta, err := s.Storage.Stat(msg.ID, msg.Key)
+	if err != nil {
+		return err
+	}
+	resp.Size = meta.Size
+	length := msg.Length
+	if length <= 0 || length > rangeChunk {
+		length = rangeChunk
+	}
+	_, r, err := s.Storage.ReadRange(msg.ID, msg.Key, msg.Offset, length)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	resp.IV = make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, resp.IV); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if _, err := crypto.CopyEncryptAt(s.EncKey, resp.IV, msg.Offset, r, &buf); err != nil {
+		return err
+	}
+	resp.Data = buf.Bytes()
+	return nil
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/storage"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultRebalanceDelay settle time after a membership change,
+// joining & leaving in a row only trigger one pass
+const DefaultRebalanceDelay = time.Second
+
+type RebalanceState string
+
+const (
+	RebalanceIdle    RebalanceState = "idle"
+	RebalanceRunning RebalanceState = "running"
+	RebalancePaused  RebalanceState = "paused"
+)
+
+// RebalanceStatus progress of the current (or last) pass
+type RebalanceStatus struct {
+	State      RebalanceState
+	Passes     int   // finished passes
+	Scanned    int   // objects scanned in this pass
+	Misplaced  int   // objects no longer belong to this node
+	Moved      int   // handed over & deleted locally
+	MovedBytes int64 // bytes streamed to the new owners
+	Failed     int
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// Rebalancer move the locally held objects to their new owners
+// when the membership (and so the placement) changes
+type Rebalancer struct {
+	s *FileServer
+
+	mu       sync.Mutex
+	status   RebalanceStatus
+	paused   bool
+	resumeCh chan struct{} // closed on resume
+
+	triggerCh chan struct{}
+}
+
+func NewRebalancer(s *FileServer) *Rebalancer {
+	return &Rebalancer{
+		s:         s,
+		status:    RebalanceStatus{State: RebalanceIdle},
+		triggerCh: make(chan struct{}, 1),
+	}
+}
+
+// Trigger ask for a new pass, never blocking
+func (r *Rebalancer) Trigger() {
+	select {
+	case r.triggerCh <- struct{}{}:
+	default:
+	}
+}
+
+// Status snapshot of the progress
+func (r *Rebalancer) Status() RebalanceStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := r.status
+	if r.paused {
+		status.State = RebalancePaused
+	}
+	return status
+}
+
+// Pause stop moving objects after the current one
+func (r *Rebalancer) Pause() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.paused {
+		r.paused = true
+		r.resumeCh = make(chan struct{})
+	}
+}
+
+// Resume continue the paused pass
+func (r *Rebalancer) Resume() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.paused {
+		r.paused = false
+		close(r.resumeCh)
+	}
+}
+
+// waitResumed block while paused, false when the server stopped
+func (r *Rebalancer) waitResumed() bool {
+	r.mu.Lock()
+	paused, resumeCh := r.paused, r.resumeCh
+	r.mu.Unlock()
+	if !paused {
+		return true
+	}
+	select {
+	case <-resumeCh:
+		return true
+	case <-r.s.quitCh:
+		return false
+	}
+}
+
+// loop wait for membership changes, running in the background
+func (r *Rebalancer) loop() {
+	delay := r.s.RebalanceDelay
+	if delay <= 0 {
+		delay = DefaultRebalanceDelay
+	}
+	for {
+		select {
+		case <-r.triggerCh:
+		case <-r.s.quitCh:
+			return
+		}
+		// let the membership settle
+		select {
+		case <-time.After(delay):
+		case <-r.s.quitCh:
+			return
+		}
+		// drop the triggers arrived during the delay
+		select {
+		case <-r.triggerCh:
+		default:
+		}
+		r.run()
+	}
+}
+
+// localObject an object held on the local disk
+type localObject struct {
+	id   string
+	meta *storage.Metadata
+}
+
+// run one pass over the local objects
+func (r *Rebalancer) run() {
+	// a leaving node keeps its copies, the drainer takes care of them
+	if r.s.Drainer.Leaving() {
+		return
+	}
+	r.mu.Lock()
+	r.status = RebalanceStatus{
+		State:     RebalanceRunning,
+		Passes:    r.status.Passes,
+		StartedAt: time.Now(),
+	}
+	r.mu.Unlock()
+
+	// collect first, the pass deletes objects
+	var objects []localObject
+	err := r.s.Storage.Walk(func(id string, meta *storage.Metadata) error {
+		objects = append(objects, localObject{id: id, meta: meta})
+		return nil
+	})
+	if err != nil {
+		log.Printf("[%s] rebalance scanning failed: %s\n", r.s.Transport.Addr(), err)
+	}
+
+	self := r.s.Transport.Addr()
+	for _, obj := range objects {
+		if !r.waitResumed() {
+			return
+		}
+		targets := r.s.placeOf(obj.id, obj.meta)
+		r.update(func(st *RebalanceStatus) { st.Scanned++ })
+		if contains(targets, self) || len(targets) == 0 {
+			continue
+		}
+		r.update(func(st *RebalanceStatus) { st.Misplaced++ })
+
+		n, err := r.move(obj, targets)
+		if err != nil {
+			log.Printf("[%s] rebalance (%s) failed: %s\n", self, obj.meta.Key, err)
+			r.update(func(st *RebalanceStatus) { st.Failed++ })
+			continue
+		}
+		r.update(func(st *RebalanceStatus) {
+			st.Moved++
+			st.MovedBytes += n
+		})
+	}
+
+	r.update(func(st *RebalanceStatus) {
+		st.State = RebalanceIdle
+		st.Passes++
+		st.FinishedAt = time.Now()
+	})
+	log.Printf("[%s] rebalance pass finished: %+v\n", self, r.Status())
+}
+
+// move hand the object over to every target, then delete the local copy
+// only when all of them confirmed
+func (r *Rebalancer) move(obj localObject, targets []string) (int64, error) {
+	sent, err := r.s.copyToTargets(obj, targets, r.s.RebalanceRate)
+	if err != nil {
+		return sent, err
+	}
+	return sent, r.s.dropMoved(obj)
+}
+
+// dropMoved delete the local copy once moved, unless a write replaced it
+// meanwhile, the next pass moves the newer one
+func (s *FileServer) dropMoved(obj localObject) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if !s.Storage.Has(obj.id, obj.meta.Key) {
+		return nil
+	}
+	cur, err := s.Storage.Stat(obj.id, obj.meta.Key)
+	if err != nil {
+		return err
+	}
+	if cur.Version != obj.meta.Version || cur.Checksum != obj.meta.Checksum {
+		return fmt.Errorf("(%s) changed while it was moved, the local copy is kept", obj.meta.Key)
+	}
+	return s.Storage.Delete(obj.id, obj.meta.Key)
+}
+
+// rateReader read at most rate bytes per second, unlimited when rate <= 0
+type rateReader struct {
+	r     io.ReadSeeker
+	rate  int64
+	quit  chan struct{}
+	start time.Time
+	n     int64
+}
+
+func (r *rateReader) Read(p []byte) (int, error) {
+	if r.rate <= 0 {
+		return r.r.Read(p)
+	}
+	if r.start.IsZero() {
+		r.start = time.Now()
+	}
+	if int64(len(p)) > r.rate {
+		p = p[:r.rate]
+	}
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	// ahead of the rate, wait until the bytes read are due
+	due := r.start.Add(time.Duration(float64(r.n) / float64(r.rate) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-r.quit:
+		}
+	}
+	return n, err
+}
+
+func (r *rateReader) Seek(offset int64, whence int) (int64, error) {
+	return r.r.Seek(offset, whence)
+}
+
+// update change the status under the lock
+func (r *Rebalancer) update(fn func(*RebalanceStatus)) {
+	r.mu.Lock()
+	fn(&r.status)
+	r.mu.Unlock()
+}
+
+// readLocal read the whole object held locally
+func (s *FileServer) readLocal(id string, key string) ([]byte, error) {
+	_, r, err := s.Storage.Read(id, key)
+	if err != nil {
+		return nil, err
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+	return io.ReadAll(r)
+}
+
+// hasOnNode ask the node whether it holds the same content already
+func (s *FileServer) hasOnNode(node string, id string, key string, checksum string) (bool, error) {
+	resp, err := s.request(node, func(reqID string) any {
+		return MessageHasFile{RequestID: reqID, ID: id, Key: key}
+	})
+	if err != nil {
+		return false, err
+	}
+	has := resp.(MessageHasFileResponse)
+	return has.Has && has.Checksum == checksum, nil
+}
+
+func contains(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
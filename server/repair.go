@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"log"
+)
+
+// entryOn version of the object held by the node, false when missing
+func (s *FileServer) entryOn(node string, id string, key string) (SyncEntry, bool, error) {
+	if node == s.Transport.Addr() {
+		if !s.Storage.Has(id, key) {
+			return SyncEntry{}, false, nil
+		}
+		meta, err := s.Storage.Stat(id, key)
+		if err != nil {
+			return SyncEntry{}, false, err
+		}
+		return SyncEntry{ID: id, Key: key, Version: meta.Version, Checksum: meta.Checksum}, true, nil
+	}
+	resp, err := s.request(node, func(reqID string) any {
+		return MessageHasFile{RequestID: reqID, ID: id, Key: key}
+	})
+	if err != nil {
+		return SyncEntry{}, false, err
+	}
+	has := resp.(MessageHasFileResponse)
+	return SyncEntry{ID: id, Key: key, Version: has.Version, Checksum: has.Checksum}, has.Has, nil
+}
+
+// readRepair compare the replicas of the object after a read, bringing
+// the missing & stale ones up to the newest copy, runs in the background
+func (s *FileServer) readRepair(id string, key string) {
+	// one repair of the object at a time
+	s.repairLock.Lock()
+	if s.repairing[id+"/"+key] {
+		s.repairLock.Unlock()
+		return
+	}
+	s.repairing[id+"/"+key] = true
+	s.repairLock.Unlock()
+	defer func() {
+		s.repairLock.Lock()
+		delete(s.repairing, id+"/"+key)
+		s.repairLock.Unlock()
+	}()
+
+	var (
+		reached  []string
+		holder   string
+		newest   SyncEntry
+		versions = make(map[string]SyncEntry)
+	)
+	for _, node := range s.Placement.Locate(key, s.ReplicationFactor) {
+		e, ok, err := s.entryOn(node, id, key)
+		if err != nil {
+			continue // unreachable, left to the hints & anti-entropy
+		}
+		reached = append(reached, node)
+		if !ok {
+			continue
+		}
+		versions[node] = e
+		if len(holder) == 0 || e.newerThan(newest) {
+			holder, newest = node, e
+		}
+	}
+	if len(holder) == 0 {
+		return
+	}
+
+	for _, node := range reached {
+		if e, ok := versions[node]; ok && !newest.newerThan(e) {
+			continue
+		}
+		if err := s.repairReplica(holder, node, newest); err != nil {
+			log.Printf("[%s] read repair (%s) on %s failed: %s\n", s.Transport.Addr(), key, node, err)
+			s.Metrics.Add(MetricReadRepairErrs, 1)
+			continue
+		}
+		s.Metrics.Add(MetricReadRepairs, 1)
+	}
+}
+
+// repairReplica bring the node up to the entry held by holder, pushed
+// directly when held locally, otherwise the holder is asked to push it
+func (s *FileServer) repairReplica(holder string, node string, e SyncEntry) error {
+	if holder == s.Transport.Addr() {
+		return s.pushEntry(node, e)
+	}
+	peer, ok := s.nodePeer(holder)
+	if !ok {
+		return fmt.Errorf("node %s is not connected", holder)
+	}
+	return s.send(peer, &Message{Payload: MessageRepairPush{Node: node, Entries: []SyncEntry{e}}})
+}
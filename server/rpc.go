@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/crypto"
+	"time"
+)
+
+// DefaultRequestTimeout waiting time for the response of a request
+const DefaultRequestTimeout = 5 * time.Second
+
+// pendingRequest register a request ID, the response is delivered
+// to the returned channel by resolve
+func (s *FileServer) pendingRequest() (string, chan any) {
+	id := crypto.GenerateID()[:16]
+	ch := make(chan any, 1)
+	s.pendingLock.Lock()
+	s.pending[id] = ch
+	s.pendingLock.Unlock()
+	return id, ch
+}
+
+// cancelRequest drop the request, late responses are ignored
+func (s *FileServer) cancelRequest(id string) {
+	s.pendingLock.Lock()
+	delete(s.pending, id)
+	s.pendingLock.Unlock()
+}
+
+// resolve deliver the response to the waiting request, called in the loop
+func (s *FileServer) resolve(id string, resp any) error {
+	s.pendingLock.Lock()
+	ch, ok := s.pending[id]
+	delete(s.pending, id)
+	s.pendingLock.Unlock()
+	if !ok {
+		return fmt.Errorf("[%s] recv response of unknown request %s", s.Transport.Addr(), id)
+	}
+	ch <- resp
+	return nil
+}
+
+// awaitResponse wait for the response, must not be called in the loop
+// (the loop is the one delivering responses)
+func (s *FileServer) awaitResponse(id string, ch chan any, timeout time.Duration) (any, error) {
+	defer s.cancelRequest(id)
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("request %s timeout after %s", id, timeout)
+	case <-s.quitCh:
+		return nil, fmt.Errorf("server stopped")
+	}
+}
+
+// request send the message built with a new request ID to the node,
+// then wait for its response
+func (s *FileServer) request(node string, build func(reqID string) any) (any, error) {
+	return s.requestWithin(node, DefaultRequestTimeout, build)
+}
+
+// requestWithin request waiting up to the timeout, for the requests doing
+// long work on the node
+func (s *FileServer) requestWithin(node string, timeout time.Duration, build func(reqID string) any) (any, error) {
+	peer, ok := s.nodePeer(node)
+	if !ok {
+		return nil, fmt.Errorf("node %s is not connected", node)
+	}
+	reqID, ch := s.pendingRequest()
+	if err := s.send(peer, &Message{Payload: build(reqID)}); err != nil {
+		s.cancelRequest(reqID)
+		return nil, err
+	}
+	return s.awaitResponse(reqID, ch, timeout)
+}
+
+// reply send the response back to the peer the request came from
+func (s *FileServer) reply(from string, msg *Message) error {
+	peer, ok := s.peerOf(from)
+	if !ok {
+		return fmt.Errorf("[%s] found peer %s had not connected", s.Transport.Addr(), from)
+	}
+	return s.send(peer, msg)
+}
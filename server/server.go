@@ -2,12 +2,20 @@ package server
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/roylic/go-distributed-file-storage/crypto"
+	"github.com/roylic/go-distributed-file-storage/dag"
+	"github.com/roylic/go-distributed-file-storage/storage"
 	"io"
 	"log"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/roylic/go-distributed-file-storage/p2p"
@@ -15,6 +23,21 @@ import (
 
 // Start the server
 func (s *FileServer) Start() error {
+	// init the gob, for encode & decoding
+	initTypeRegistration()
+	// a leaving node stays out of the placement after restart
+	if err := s.Drainer.load(); err != nil {
+		return err
+	}
+	if s.Drainer.Leaving() {
+		s.Placement.Remove(s.Transport.Addr())
+	}
+	if err := s.Hints.load(); err != nil {
+		return err
+	}
+	if err := s.Holdings.rebuild(); err != nil {
+		return err
+	}
 	// port listening
 	if err := s.Transport.ListenAndAccept(); err != nil {
 		return err
@@ -26,13 +49,39 @@ func (s *FileServer) Start() error {
 	// -> using another goroutine (in the background)
 	s.errCh = make(chan error, 1)
 	go s.loop()
+	go s.Rebalancer.loop()
+	go s.AntiEntropy.loop()
+	go s.Hints.loop()
+	go s.PeerExchange.loop()
+	go s.Holdings.loop()
+	s.Membership.Start()
+	s.DHT.Start()
+	go s.provideLoop()
+
+	// continue the drain interrupted by the restart
+	if s.Drainer.Status().State == NodeLeaving {
+		if err := s.Drainer.Start(); err != nil {
+			return err
+		}
+	}
 
+	if len(s.AdminAddr) > 0 {
+		return s.startAdmin()
+	}
 	return nil
 }
 
 // Stop will use to close a channel
 func (s *FileServer) Stop() {
 	close(s.quitCh)
+	s.Membership.Stop()
+	s.DHT.Stop()
+	if s.admin != nil {
+		_ = s.admin.Close()
+	}
+	if err := s.Storage.Close(); err != nil {
+		log.Printf("[%s] close the storage failed: %s\n", s.Transport.Addr(), err)
+	}
 }
 
 // OnPeer handle peer connection
@@ -40,113 +89,728 @@ func (s *FileServer) OnPeer(p p2p.Peer) error {
 	// lock for adding & unlock for later
 	s.peerLock.Lock()
 	defer s.peerLock.Unlock()
+	if s.MaxPeers > 0 && len(s.peers) >= s.MaxPeers {
+		return ErrPeerLimit
+	}
 
 	// put into map
 	s.peers[p.RemoteAddr().String()] = p
 	log.Printf("[%s] connected with remote:%s\n", p.LocalAddr(), p.RemoteAddr())
-	return nil
+
+	// tell the remote our listen address, for the placement
+	hello := Message{Payload: MessageHello{Addr: s.Transport.Addr(), State: s.Drainer.Status().State}}
+	return s.send(p, &hello)
+}
+
+// OnPeerClose drop the peer, its node stays in the placement until the
+// membership declares it dead, the writes it misses meanwhile are hinted
+func (s *FileServer) OnPeerClose(p p2p.Peer) {
+	s.peerLock.Lock()
+	delete(s.peers, p.RemoteAddr().String())
+	var left string
+	for node, peer := range s.nodes {
+		if peer == p {
+			left = node
+			delete(s.nodes, node)
+		}
+	}
+	s.peerLock.Unlock()
+
+	if len(left) > 0 {
+		log.Printf("[%s] node %s disconnected\n", s.Transport.Addr(), left)
+	}
 }
 
 // Get file from storage
 func (s *FileServer) Get(key string) (io.Reader, error) {
+	return s.GetWithOpts(key, GetOpts{})
+}
+
+// GetWithOpts read with the consistency level, ONE serves the first copy
+// found (local disk first), QUORUM & ALL consult the replicas & read
+// the newest version among the answers, or read an archived version
+func (s *FileServer) GetWithOpts(key string, opts GetOpts) (io.Reader, error) {
+	hashedKey := crypto.HashKey(key)
+	if len(opts.VersionID) > 0 {
+		return s.getVersion(key, hashedKey, opts.VersionID)
+	}
+	if k, m := s.Storage.Erasure(s.ID); k > 0 {
+		r, err := s.getErasure(key, hashedKey, k, m)
+		if !errors.Is(err, errNoStripe) {
+			return r, err
+		}
+		// stored before the namespace was erasure coded
+	}
+	if opts.Consistency.required(s.ReplicationFactor) > 1 {
+		return s.getConsistent(key, hashedKey, opts.Consistency)
+	}
+
 	// have key, just return
-	if s.Storage.Has(s.ID, key) {
+	if s.Storage.Has(s.ID, hashedKey) {
 		log.Printf("[%s] serving file (%s) from local disk\n", s.Transport.Addr(), key)
-		_, reader, err := s.Storage.Read(s.ID, key)
+		_, reader, err := s.Storage.Read(s.ID, hashedKey)
+		if err == nil {
+			go s.readRepair(s.ID, hashedKey)
+		}
 		return reader, err
 	}
 
-	// do not have key, broadcast for finding
+	// do not have key, ask the likely holders first
 	log.Printf("server[%s] Do not have file %s locally, fetching...",
 		s.Transport.Addr(), key)
 
+	// big objects come in pieces from every holder at once
+	found, err := s.swarmGet(s.ID, hashedKey)
+	if err != nil {
+		log.Printf("server[%s] swarm download of (%s) failed: %s\n", s.Transport.Addr(), key, err)
+	}
+	if found {
+		_, reader, err := s.Storage.Read(s.ID, hashedKey)
+		if err == nil {
+			go s.readRepair(s.ID, hashedKey)
+		}
+		return reader, err
+	}
+
 	msg := Message{
 		Payload: MessageGetFile{
 			ID:  s.ID, // pass the identifier
-			Key: crypto.HashKey(key),
+			Key: hashedKey,
 		},
 	}
-	if err := s.broadcast(&msg); err != nil {
-		return nil, err
+	likely, rest := s.candidates(s.ID, hashedKey)
+	found = s.fetchFirst(likely, hashedKey, &msg)
+	if !found {
+		// none of the matching nodes holds it, the others are asked at once
+		if node, ok := s.anyHolder(rest, s.ID, hashedKey); ok {
+			found = s.fetchFirst([]string{node}, hashedKey, &msg)
+		}
+	}
+	if found {
+		_, reader, err := s.Storage.Read(s.ID, hashedKey)
+		if err == nil {
+			go s.readRepair(s.ID, hashedKey)
+		}
+		return reader, err
 	}
 
-	time.Sleep(time.Millisecond * 500)
+	// held beyond the connected nodes, relayed by the peers
+	found, err = s.forwardGet(s.ID, hashedKey)
+	if err != nil {
+		log.Printf("server[%s] forwarded get of (%s) failed: %s\n", s.Transport.Addr(), key, err)
+	}
+	if found {
+		_, reader, err := s.Storage.Read(s.ID, hashedKey)
+		return reader, err
+	}
+	return nil, fmt.Errorf("server[%s] file (%s) not found in the network", s.Transport.Addr(), key)
+}
 
-	for _, peer := range s.peers {
-		// TODO first bytes to read file size, without hanging
-		var fileSize int64
-		binary.Read(peer, binary.LittleEndian, &fileSize)
+// getConsistent ask the replicas their version, wait for the answers
+// required by the level, then serve the newest copy
+func (s *FileServer) getConsistent(key string, hashedKey string, level Consistency) (io.Reader, error) {
+	type answer struct {
+		node  string
+		entry SyncEntry
+		has   bool
+		err   error
+	}
+	replicas := s.Placement.Locate(hashedKey, s.ReplicationFactor)
+	need := level.required(len(replicas))
+	answers := make(chan answer, len(replicas))
+	for _, node := range replicas {
+		go func(node string) {
+			e, has, err := s.entryOn(node, s.ID, hashedKey)
+			answers <- answer{node: node, entry: e, has: has, err: err}
+		}(node)
+	}
+
+	var (
+		answered int
+		holder   string
+		newest   SyncEntry
+		errs     []error
+	)
+	for i := 0; i < len(replicas) && answered < need; i++ {
+		a := <-answers
+		if a.err != nil {
+			errs = append(errs, a.err)
+			continue
+		}
+		answered++
+		if a.has && (len(holder) == 0 || a.entry.newerThan(newest)) {
+			holder, newest = a.node, a.entry
+		}
+	}
+	if answered < need {
+		return nil, fmt.Errorf("server[%s] get (%s): %w, %d of %d replicas answered: %w",
+			s.Transport.Addr(), key, ErrConsistency, answered, need, errors.Join(errs...))
+	}
+	if len(holder) == 0 {
+		return nil, fmt.Errorf("server[%s] file (%s) not found on the replicas", s.Transport.Addr(), key)
+	}
 
-		// decrypt
-		n, err := s.Storage.WriteDecrypt(s.EncKey, s.ID, key, io.LimitReader(peer, fileSize))
-		//n, err := s.Storage.Write(key, io.LimitReader(peer, fileSize))
+	// fetch unless the local copy is the newest already
+	local, err := s.Storage.Stat(s.ID, hashedKey)
+	if !s.Storage.Has(s.ID, hashedKey) || err != nil || local.Checksum != newest.Checksum {
+		msg := Message{Payload: MessageGetFile{ID: s.ID, Key: hashedKey}}
+		found, err := s.fetchFrom(holder, hashedKey, &msg)
 		if err != nil {
 			return nil, err
 		}
+		if !found {
+			return nil, fmt.Errorf("server[%s] file (%s) vanished from %s", s.Transport.Addr(), key, holder)
+		}
+	}
+	_, reader, err := s.Storage.Read(s.ID, hashedKey)
+	if err == nil {
+		go s.readRepair(s.ID, hashedKey)
+	}
+	return reader, err
+}
+
+// candidateNodes the replicas by placement first, then the holders
+// found through the DHT, then the rest of connected nodes, the nodes
+// whose holdings filter does not match go last
+func (s *FileServer) candidateNodes(id string, hashedKey string) []string {
+	likely, rest := s.candidates(id, hashedKey)
+	return append(likely, rest...)
+}
+
+// candidates same order as candidateNodes, split by the holdings filters
+func (s *FileServer) candidates(id string, hashedKey string) (likely []string, rest []string) {
+	self := s.Transport.Addr()
+	seen := map[string]bool{self: true}
+	var nodes []string
+	for _, node := range s.Placement.Locate(hashedKey, s.ReplicationFactor) {
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	for _, node := range s.providersOf(id, hashedKey) {
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	s.peerLock.Lock()
+	for node := range s.nodes {
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	s.peerLock.Unlock()
+	// the holdings filters rule out most nodes
+	return s.Holdings.split(nodes, id, hashedKey)
+}
 
-		log.Printf("[%s] received (%d) bytes over network from (%s)\n",
-			s.Transport.Addr(), n, peer.RemoteAddr())
+// fetchFirst ask the nodes one after another until one of them holds the file
+func (s *FileServer) fetchFirst(nodes []string, hashedKey string, msg *Message) bool {
+	for _, node := range nodes {
+		found, err := s.fetchFrom(node, hashedKey, msg)
+		if err != nil {
+			log.Printf("server[%s] fetch (%s) from %s failed: %s\n", s.Transport.Addr(), hashedKey, node, err)
+			continue
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
 
-		peer.CloseStream()
+// fetchFrom request the file from a single node, the node answer a zero
+// sized stream when it does not hold the file
+func (s *FileServer) fetchFrom(node string, hashedKey string, msg *Message) (bool, error) {
+	peer, err := s.connect(node)
+	if err != nil {
+		return false, err
+	}
+	// continue an interrupted transfer of the same content
+	if get, ok := msg.Payload.(MessageGetFile); ok {
+		if p, ok := s.Storage.PartialState(s.ID, hashedKey); ok {
+			get.Offset, get.Checksum = p.Offset, p.Checksum
+			msg = &Message{Payload: get}
+		}
+	}
+	if err := s.send(peer, msg); err != nil {
+		return false, err
 	}
 
-	// do not have key
-	_, reader, err := s.Storage.Read(s.ID, key)
-	return reader, err
+	// the answer is a stream, read once the read loop handed it over
+	if err := peer.WaitStream(DefaultRequestTimeout); err != nil {
+		return false, fmt.Errorf("[%s] get from %s: %w", s.Transport.Addr(), node, err)
+	}
+	defer peer.CloseStream()
+	// a holder stalling before the header does not block the Get,
+	// cleared before the read loop takes the connection back
+	_ = peer.SetReadDeadline(time.Now().Add(DefaultRequestTimeout))
+	defer peer.SetReadDeadline(time.Time{})
+
+	// first bytes to read file size
+	var fileSize int64
+	if err := binary.Read(peer, binary.LittleEndian, &fileSize); err != nil {
+		return false, err
+	}
+	if fileSize == 0 {
+		return false, nil
+	}
+	header, meta, err := readTransferHeader(peer)
+	if err != nil {
+		return false, err
+	}
+	_ = peer.SetReadDeadline(time.Time{})
+
+	// decrypt
+	n, err := s.receiveCopy(s.ID, hashedKey, header, meta, io.LimitReader(peer, fileSize))
+	if err != nil {
+		return false, err
+	}
+	log.Printf("[%s] received (%d) bytes over network from (%s)\n",
+		s.Transport.Addr(), n, node)
+	return true, nil
 }
 
 // Store contains below duties
-// 1) *Store* this file to disk
-// 2) *Broadcast* send message to the peers, telling what we got
-// 3)
+// 1) *Store* this file to disk, when this node is one of the replicas
+// 2) *Send* the file to the other replicas picked by the placement
+// 3) a failing replica does not abort the others, a hint is kept for it
 func (s *FileServer) Store(key string, r io.Reader) error {
+	_, err := s.StoreWithOpts(key, r, StoreOpts{})
+	return err
+}
+
+// StoreWithOpts same as Store, with metadata & tags of the object, the
+// replicas are written concurrently & it returns once the acknowledgements
+// required by the consistency level arrived
+func (s *FileServer) StoreWithOpts(key string, r io.Reader, opts StoreOpts) (*StoreResult, error) {
+	// read the whole file, it would be sent to multiple replicas
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := s.newMeta(s.ID, key, opts, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if k, m := s.Storage.Erasure(s.ID); k > 0 {
+		return s.storeErasure(s.ID, key, meta, bytes.NewReader(data), k, m, opts.Consistency, nil)
+	}
+	return s.storeReplicas(key, &meta, opts.Consistency, func(node string) error {
+		return s.storeTo(node, &meta, data)
+	}, func(node string) error {
+		return s.Hints.Add(node, s.ID, &meta, data)
+	}, nil)
+}
 
-	// use teeReader to copy the reader, or else
-	// the read could only be used once, later
-	// broadcast only received empty
+// storeStream same as StoreWithOpts in the namespace id, the content is
+// spooled to disk instead of memory, then streamed to every replica
+func (s *FileServer) storeStream(id string, key string, r io.Reader, opts StoreOpts) (*StoreResult, error) {
+	f, err := s.Storage.CreateSpool()
+	if err != nil {
+		return nil, err
+	}
+	drop := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	meta, err := s.newMeta(id, key, opts, io.TeeReader(r, f))
+	if err != nil {
+		drop()
+		return nil, err
+	}
+	content := func() *io.SectionReader {
+		return io.NewSectionReader(f, 0, meta.Size)
+	}
+	if k, m := s.Storage.Erasure(id); k > 0 {
+		return s.storeErasure(id, key, meta, f, k, m, opts.Consistency, drop)
+	}
+	return s.storeReplicas(key, &meta, opts.Consistency, func(node string) error {
+		if node != s.Transport.Addr() {
+			return s.replicateFrom(node, id, &meta, content())
+		}
+		if err := s.applyWriteFrom(id, meta, content()); !errors.Is(err, errSuperseded) {
+			return err
+		}
+		return nil
+	}, func(node string) error {
+		return s.Hints.AddFrom(node, id, &meta, content())
+	}, drop)
+}
+
+// newMeta the metadata of a new write of the content read from r into
+// the namespace id, its size, checksum & CID computed on the way
+func (s *FileServer) newMeta(id string, key string, opts StoreOpts, r io.Reader) (storage.Metadata, error) {
 	var (
-		fileBuf   = new(bytes.Buffer)
-		teeReader = io.TeeReader(r, fileBuf)
+		h    = sha256.New()
+		size countWriter
+		root dag.CID
+		err  error
 	)
-
-	// 1) Storage, after write, the reader r is empty
-	size, err := s.Storage.Write(s.ID, key, teeReader)
+	r = io.TeeReader(r, io.MultiWriter(h, &size))
+	if s.NoCIDs {
+		_, err = io.Copy(io.Discard, r)
+	} else {
+		root, _, err = s.buildDAG(r)
+	}
 	if err != nil {
+		return storage.Metadata{}, err
+	}
+	uploader := opts.Uploader
+	if len(uploader) == 0 {
+		uploader = id
+	}
+	hashedKey := crypto.HashKey(key)
+	version := s.Clock.Now()
+	vc := s.writeClock(id, hashedKey)
+	vc[s.Transport.Addr()] = version
+	return storage.Metadata{
+		Key:         hashedKey,
+		FileName:    opts.FileName,
+		ContentType: opts.ContentType,
+		Uploader:    uploader,
+		Size:        int64(size),
+		Checksum:    hex.EncodeToString(h.Sum(nil)),
+		CreatedAt:   time.Now(),
+		Version:     version,
+		Tags:        opts.Tags,
+		Versioned:   s.Storage.Versioning(id),
+		Node:        s.Transport.Addr(),
+		Clock:       vc,
+		CID:         root.String(),
+	}, nil
+}
+
+// countWriter count the bytes written
+type countWriter int64
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	*c += countWriter(len(p))
+	return len(p), nil
+}
+
+// storeReplicas write the object to the replicas picked by the placement
+// concurrently, keeping a hint for the failed ones. It returns once the
+// consistency level is met, done runs after every replica finished
+func (s *FileServer) storeReplicas(key string, meta *storage.Metadata, level Consistency, write func(node string) error, hint func(node string) error, done func()) (*StoreResult, error) {
+	type ack struct {
+		node string
+		err  error
+	}
+	res := &StoreResult{
+		Key:      meta.Key,
+		CID:      meta.CID,
+		Version:  meta.Version,
+		Replicas: s.Placement.Locate(meta.Key, s.ReplicationFactor),
+	}
+	need := level.required(len(res.Replicas))
+	acks := make(chan ack, len(res.Replicas))
+	var wg sync.WaitGroup
+	for _, node := range res.Replicas {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			err := write(node)
+			if err != nil {
+				log.Printf("server[%s] store (%s) to %s failed: %s\n", s.Transport.Addr(), key, node, err)
+				// keep a hint, delivered once the replica is back
+				if node != s.Transport.Addr() {
+					if err := hint(node); err != nil {
+						log.Printf("server[%s] hint (%s) for %s failed: %s\n", s.Transport.Addr(), key, node, err)
+					}
+				}
+			}
+			acks <- ack{node: node, err: err}
+		}(node)
+	}
+	if done != nil {
+		go func() {
+			wg.Wait()
+			done()
+		}()
+	}
+
+	var errs []error
+	for i := 0; i < len(res.Replicas) && len(res.Acked) < need; i++ {
+		a := <-acks
+		if a.err != nil {
+			errs = append(errs, a.err)
+			continue
+		}
+		res.Acked = append(res.Acked, a.node)
+	}
+	if need == 0 || len(res.Acked) < need {
+		return res, fmt.Errorf("server[%s] store (%s): %w, %d of %d replicas acknowledged: %w",
+			s.Transport.Addr(), key, ErrConsistency, len(res.Acked), need, errors.Join(errs...))
+	}
+	return res, nil
+}
+
+// storeTo write the file to a single replica, local disk or a remote node
+func (s *FileServer) storeTo(node string, meta *storage.Metadata, data []byte) error {
+	return s.replicate(node, s.ID, meta, data, true)
+}
+
+// replicate write the owner's file to the node, waiting for the
+// replica's MessageStoreAck when wantAck
+func (s *FileServer) replicate(node string, id string, meta *storage.Metadata, data []byte, wantAck bool) error {
+	if node == s.Transport.Addr() {
+		if err := s.applyWrite(id, *meta, data); !errors.Is(err, errSuperseded) {
+			return err
+		}
+		return nil
+	}
+	peer, ok := s.nodePeer(node)
+	if !ok {
+		return fmt.Errorf("node %s is not connected", node)
+	}
+
+	// deduplicated objects send the chunks the replica misses only
+	if s.Storage.Dedup && wantAck && int64(len(data)) == meta.Size {
+		err := s.replicateChunks(node, id, meta, data)
+		if err == nil {
+			return nil
+		}
+		log.Printf("server[%s] chunked replication of (%s) to %s failed, sending it whole: %s\n", s.Transport.Addr(), meta.Key, node, err)
+	}
+
+	// an update of the replica's copy sends the changed bytes only
+	if wantAck && s.deltaThreshold() > 0 && meta.Size >= s.deltaThreshold() && int64(len(data)) == meta.Size &&
+		s.holdsEarlier(node, id, meta) {
+		err := s.replicateDelta(node, id, meta, data)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, errNoBase) && !errors.Is(err, errDeltaTooBig) {
+			log.Printf("server[%s] delta of (%s) to %s failed, sending it whole: %s\n", s.Transport.Addr(), meta.Key, node, err)
+		}
+	}
+
+	// big objects continue from what the replica already received
+	var offset int64
+	if meta.Size >= s.resumeThreshold() && int64(len(data)) == meta.Size {
+		offset = s.transferOffset(node, id, meta)
+	}
+	return s.streamReplica(peer, node, id, meta, bytes.NewReader(data[offset:]), offset, wantAck)
+}
+
+// replicateFrom stream the object from the reader to the node, like
+// replicate without holding the content in memory
+func (s *FileServer) replicateFrom(node string, id string, meta *storage.Metadata, r io.ReadSeeker) error {
+	peer, ok := s.nodePeer(node)
+	if !ok {
+		return fmt.Errorf("node %s is not connected", node)
+	}
+	var offset int64
+	if meta.Size >= s.resumeThreshold() {
+		offset = s.transferOffset(node, id, meta)
+	}
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
 		return err
 	}
+	return s.streamReplica(peer, node, id, meta, r, offset, true)
+}
+
+// streamReplica send MessageStoreFile & the content from offset
+func (s *FileServer) streamReplica(peer p2p.Peer, node string, id string, meta *storage.Metadata, r io.Reader, offset int64, wantAck bool) error {
+	var (
+		reqID string
+		ch    chan any
+	)
+	if wantAck {
+		reqID, ch = s.pendingRequest()
+	}
 	msg := Message{
 		Payload: MessageStoreFile{
-			ID:   s.ID,
-			Key:  crypto.HashKey(key), // hash the key
-			Size: size + 16,           // with 16 bytes of AES key
+			ID:        id,
+			Key:       meta.Key,
+			Size:      meta.Size - offset + 16, // with 16 bytes of AES IV
+			Offset:    offset,
+			Length:    meta.Size - offset,
+			Meta:      meta,
+			RequestID: reqID,
 		},
 	}
+	if err := s.sendStream(peer, &msg, io.LimitReader(r, meta.Size-offset)); err != nil {
+		if wantAck {
+			s.cancelRequest(reqID)
+		}
+		return err
+	}
+	if !wantAck {
+		return nil
+	}
 
-	// 2) broadcast message (message type)
-	if err := s.broadcast(&msg); err != nil {
+	resp, err := s.awaitResponse(reqID, ch, DefaultRequestTimeout)
+	if err != nil {
 		return err
 	}
+	return checkStoreAck(node, meta, resp.(MessageStoreAck))
+}
 
-	// 3) broadcast file stream concurrently
-	time.Sleep(time.Millisecond * 5)
+// checkStoreAck the replica stored the content sent, or a newer one
+func checkStoreAck(node string, meta *storage.Metadata, ack MessageStoreAck) error {
+	if len(ack.Err) > 0 {
+		return fmt.Errorf("node %s: %s", node, ack.Err)
+	}
+	if ack.Superseded {
+		return nil
+	}
+	if ack.Checksum != meta.Checksum {
+		return fmt.Errorf("node %s stored checksum %s, want %s", node, ack.Checksum, meta.Checksum)
+	}
+	return nil
+}
 
-	// writing to peers concurrently (by multi-writer)
-	var peers []io.Writer
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
+// sendStream send the message followed by the encrypted data,
+// message & stream together must not interleave with others
+func (s *FileServer) sendStream(peer p2p.Peer, msg *Message, r io.Reader) error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	if err := peer.Send(encodeMessage(msg)); err != nil {
+		return err
+	}
+	time.Sleep(time.Millisecond * 5)
+	if err := peer.Send([]byte{p2p.INCOMING_STREAM}); err != nil {
+		return err
 	}
-	mw := io.MultiWriter(peers...)
-	mw.Write([]byte{p2p.INCOMING_STREAM})
-	n, err := crypto.CopyEncrypt(s.EncKey, fileBuf, mw)
+	n, err := crypto.CopyEncrypt(s.EncKey, r, peer)
 	if err != nil {
 		return err
 	}
+	log.Printf("server[%s] sent %d bytes to %s\n", s.Transport.Addr(), n, peer.RemoteAddr())
+	return nil
+}
+
+// Stat return the metadata of the file, the local copy when held,
+// otherwise the newest copy among the nodes holding it
+func (s *FileServer) Stat(key string) (*storage.Metadata, error) {
+	hashedKey := crypto.HashKey(key)
+	if s.Storage.Has(s.ID, hashedKey) {
+		return s.Storage.Stat(s.ID, hashedKey)
+	}
+	return s.statRemote(s.ID, hashedKey)
+}
+
+// UpdateTags edit the tags locally when held, then broadcast to the
+// replicas, the edit is a write of a new version following the local copy
+func (s *FileServer) UpdateTags(key string, set map[string]string, remove []string) (*storage.Metadata, error) {
+	hashedKey := crypto.HashKey(key)
+	version := s.Clock.Now()
+	vc := s.writeClock(s.ID, hashedKey)
+	vc[s.Transport.Addr()] = version
+	var meta *storage.Metadata
+	if s.Storage.Has(s.ID, hashedKey) {
+		var err error
+		if meta, err = s.applyTags(s.ID, hashedKey, set, remove, version, vc); err != nil && !errors.Is(err, errSuperseded) {
+			return nil, err
+		}
+	}
+	msg := Message{
+		Payload: MessageUpdateMeta{
+			ID:      s.ID,
+			Key:     hashedKey,
+			Set:     set,
+			Remove:  remove,
+			Version: version,
+			Clock:   vc,
+		},
+	}
+	if err := s.broadcast(&msg); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Delete the file locally & on every peer, the tombstones keep
+// replicas missing the delete from bringing the file back
+func (s *FileServer) Delete(key string) error {
+	return s.DeleteWithOpts(key, DeleteOpts{})
+}
+
+// DeleteWithOpts same as Delete, returning once the replicas required by
+// the consistency level acknowledged the tombstone
+func (s *FileServer) DeleteWithOpts(key string, opts DeleteOpts) error {
+	return s.deleteIn(s.ID, key, opts)
+}
+
+// deleteIn same as DeleteWithOpts in the namespace id
+func (s *FileServer) deleteIn(id string, key string, opts DeleteOpts) error {
+	hashedKey := crypto.HashKey(key)
+	version := s.Clock.Now()
+	if err := s.deleteObject(id, hashedKey, version); err != nil {
+		return err
+	}
+	if k, m := s.Storage.Erasure(id); k > 0 {
+		s.deleteShards(id, hashedKey, version, k, m)
+	}
 
-	log.Printf("server[%s] recv & writtern %d bytes to disk\n",
-		s.Transport.Addr(), n)
+	self := s.Transport.Addr()
+	replicas := s.Placement.Locate(hashedKey, s.ReplicationFactor)
+	need := opts.Consistency.required(len(replicas))
+	acks := make(chan error, len(replicas))
+	for _, node := range replicas {
+		if node == self {
+			acks <- nil
+			continue
+		}
+		go func(node string) {
+			acks <- s.deleteOn(node, id, hashedKey, version)
+		}(node)
+	}
+	// the other nodes may hold a fetched copy, no need to wait for them
+	s.peerLock.Lock()
+	var others []p2p.Peer
+	for node, peer := range s.nodes {
+		if !contains(replicas, node) {
+			others = append(others, peer)
+		}
+	}
+	s.peerLock.Unlock()
+	for _, peer := range others {
+		_ = s.send(peer, &Message{Payload: MessageDeleteFile{ID: id, Key: hashedKey, Version: version}})
+	}
+
+	var (
+		acked int
+		errs  []error
+	)
+	for i := 0; i < len(replicas) && acked < need; i++ {
+		if err := <-acks; err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		acked++
+	}
+	if acked < need {
+		return fmt.Errorf("server[%s] delete (%s): %w, %d of %d replicas acknowledged: %w",
+			s.Transport.Addr(), key, ErrConsistency, acked, need, errors.Join(errs...))
+	}
+	return nil
+}
+
+// deleteOn write the tombstone on the node, waiting for its MessageDeleteAck
+func (s *FileServer) deleteOn(node string, id string, hashedKey string, version int64) error {
+	resp, err := s.request(node, func(reqID string) any {
+		return MessageDeleteFile{ID: id, Key: hashedKey, Version: version, RequestID: reqID}
+	})
+	if err != nil {
+		return err
+	}
+	if ack := resp.(MessageDeleteAck); len(ack.Err) > 0 {
+		return fmt.Errorf("node %s: %s", node, ack.Err)
+	}
 	return nil
 }
 
+// Query search the metadata index of the files owned by this server,
+// on every node as the replicas are spread over the cluster
+func (s *FileServer) Query(query string, opts storage.QueryOpts) (*storage.QueryResult, error) {
+	return s.queryIn(s.ID, query, opts)
+}
+
 func (s *FileServer) Err() <-chan error {
 	return s.errCh
 }
@@ -185,30 +849,68 @@ func (s *FileServer) loop() {
 
 // broadcast will send message to all peers
 func (s *FileServer) broadcast(m *Message) error {
-	// form msg
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(m); err != nil {
-		log.Fatal("Error during encoding message", err)
-	}
-	// send
-	for _, peer := range s.peers {
-		// First byte to indicate the msg type
-		peer.Send([]byte{p2p.INCOMING_MESSAGE})
-		// Second then send the rest (file-buffer)
-		if err := peer.Send(buf.Bytes()); err != nil {
+	frame := encodeMessage(m)
+	peers := s.connectedPeers()
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	for _, peer := range peers {
+		if err := peer.Send(frame); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// send a single message to the peer
+func (s *FileServer) send(p p2p.Peer, m *Message) error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	return p.Send(encodeMessage(m))
+}
+
+// connectedPeers copy of the connections, safe to use after peerLock is released
+func (s *FileServer) connectedPeers() []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// peerOf find the connection by its remote address
+func (s *FileServer) peerOf(from string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	peer, ok := s.peers[from]
+	return peer, ok
+}
+
+// nodePeer find the connection by the node's listen address
+func (s *FileServer) nodePeer(node string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	peer, ok := s.nodes[node]
+	return peer, ok
+}
+
+// encodeMessage form msg, first byte to indicate the msg type, then length & payload
+func encodeMessage(m *Message) []byte {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(m); err != nil {
+		log.Fatal("Error during encoding message", err)
+	}
+	return p2p.EncodeMessage(buf.Bytes())
+}
+
 // stream all coding msg to cur node's peer
 // Deprecated: use  broadcast instead
 func (s *FileServer) stream(m *Message) error {
 
 	// append to temp slice
 	var peers []io.Writer
-	for _, peer := range s.peers {
+	for _, peer := range s.connectedPeers() {
 		peers = append(peers, peer)
 	}
 
@@ -227,8 +929,6 @@ func (s *FileServer) stream(m *Message) error {
 
 // bootstrapNetwork is for dialing to other port
 func (s *FileServer) bootstrapNetwork() error {
-	// init the gob, for encode & decoding
-	initTypeRegistration()
 	// for each node, make a new goroutine for dialing it
 	for _, addr := range s.BootstrapNodes {
 		if len(strings.TrimSpace(addr)) == 0 {
@@ -237,6 +937,8 @@ func (s *FileServer) bootstrapNetwork() error {
 		// only when addr is not empty
 		log.Printf("server[%s] is attempting to connect with remote:%s\n",
 			s.Transport.Addr(), addr)
+		// not dialed again when the peer exchange tells about it
+		s.PeerExchange.dialed(addr)
 		go func(addr string) {
 			if err := s.Transport.Dial(addr); err != nil {
 				log.Println("Dial error during BootstrapNetwork(): ", err)
@@ -250,5 +952,63 @@ func (s *FileServer) bootstrapNetwork() error {
 func initTypeRegistration() {
 	gob.Register(Message{})
 	gob.Register(MessageStoreFile{})
+	gob.Register(MessageStoreAck{})
+	gob.Register(MessageHasFile{})
+	gob.Register(MessageHasFileResponse{})
 	gob.Register(MessageGetFile{})
+	gob.Register(MessageUpdateMeta{})
+	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageDeleteAck{})
+	gob.Register(MessageMerkleRequest{})
+	gob.Register(MessageMerkleResponse{})
+	gob.Register(MessageMerkleBuckets{})
+	gob.Register(MessageMerkleBucketsResponse{})
+	gob.Register(MessageRepairPush{})
+	gob.Register(MessageGetVersion{})
+	gob.Register(MessageGetVersionResponse{})
+	gob.Register(MessageListVersions{})
+	gob.Register(MessageListVersionsResponse{})
+	gob.Register(MessageRestoreVersion{})
+	gob.Register(MessageDeleteVersion{})
+	gob.Register(MessageHello{})
+	gob.Register(MessageNodeState{})
+	gob.Register(MessageNodeDrain{})
+	gob.Register(MessageGossip{})
+	gob.Register(MessagePeerExchange{})
+	gob.Register(MessageDHTRequest{})
+	gob.Register(MessageDHTResponse{})
+	gob.Register(MessageHoldings{})
+	gob.Register(MessageHoldingsRequest{})
+	gob.Register(MessageForwardGet{})
+	gob.Register(MessageForwardGetResponse{})
+	gob.Register(MessageForwardRange{})
+	gob.Register(MessagePieceManifest{})
+	gob.Register(MessagePieceManifestResponse{})
+	gob.Register(MessageGetPiece{})
+	gob.Register(MessageGetPieceResponse{})
+	gob.Register(MessageTransferOffset{})
+	gob.Register(MessageTransferOffsetResponse{})
+	gob.Register(MessageGetRange{})
+	gob.Register(MessageGetRangeResponse{})
+	gob.Register(MessageUploadPart{})
+	gob.Register(MessageUploadPartResponse{})
+	gob.Register(MessageCompleteUpload{})
+	gob.Register(MessageCompleteUploadResponse{})
+	gob.Register(MessageAbortUpload{})
+	gob.Register(MessageAbortUploadResponse{})
+	gob.Register(MessageChunkHave{})
+	gob.Register(MessageChunkHaveResponse{})
+	gob.Register(MessageStoreChunks{})
+	gob.Register(MessageGetBlock{})
+	gob.Register(MessageGetBlockResponse{})
+	gob.Register(MessageNameRecords{})
+	gob.Register(MessageResolveName{})
+	gob.Register(MessageResolveNameResponse{})
+	gob.Register(MessageGetShard{})
+	gob.Register(MessageGetShardResponse{})
+	gob.Register(MessageDeltaSignature{})
+	gob.Register(MessageDeltaSignatureResponse{})
+	gob.Register(MessageStoreDelta{})
+	gob.Register(MessageQuery{})
+	gob.Register(MessageQueryResponse{})
 }
@@ -1,46 +1,190 @@
 package server
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/roylic/go-distributed-file-storage/clock"
 	"github.com/roylic/go-distributed-file-storage/crypto"
+	"github.com/roylic/go-distributed-file-storage/dht"
+	"github.com/roylic/go-distributed-file-storage/membership"
+	"github.com/roylic/go-distributed-file-storage/naming"
 	"github.com/roylic/go-distributed-file-storage/p2p"
 	"github.com/roylic/go-distributed-file-storage/storage"
+	"log"
+	"net/http"
+	"path/filepath"
 	"sync"
+	"time"
 )
 
 // FileServerOpts inner Transport is for accepting the p2p communication
 type FileServerOpts struct {
-	ID                string // server identifier
-	EncKey            []byte
-	StorageRoot       string
-	PathTransformFunc storage.PathTransformFunc
-	Transport         p2p.Transport
-	BootstrapNodes    []string
+	ID                    string // server identifier
+	EncKey                []byte
+	StorageRoot           string
+	PathTransformFunc     storage.PathTransformFunc
+	Dedup                 bool               // store objects as deduplicated chunks, replicas receive the chunks they miss, forced on unless NoCIDs
+	NoCIDs                bool               // Store returns no CID, otherwise keys point to the chunks of the content, stored once (erasure coded shards excepted)
+	Durability            storage.Durability // fsync every write (default) or batched, flushed by the anti-entropy loop
+	NameKey               ed25519.PrivateKey // signs the name records published, loaded from or saved under StorageRoot when empty
+	NameTTL               time.Duration      // validity of a published name record, default 24h
+	Transport             p2p.Transport
+	BootstrapNodes        []string
+	ReplicationFactor     int       // copies of each file, default 3
+	VirtualNodes          int       // virtual nodes per node on the hash ring
+	Placement             Placement // default consistent hashing ring
+	AdminAddr             string    // http admin API, disabled when empty
+	RebalanceRate         int64     // bytes per second moved by the rebalancer, 0 unlimited
+	RebalanceDelay        time.Duration
+	AntiEntropyInterval   time.Duration    // between two replica repair rounds
+	MaxHints              int              // hints kept for unreachable replicas, default 1024
+	HintTTL               time.Duration    // hints older than this are dropped
+	ConflictStrategy      ConflictStrategy // concurrent writes handling, default last writer wins
+	ConflictResolver      ConflictResolver // used by ConflictCustom
+	MembershipConfig      membership.Config
+	DHTConfig             dht.Config
+	HoldingsKeys          int           // keys the holdings filter is sized for, default 10000
+	HoldingsFalsePositive float64       // of the holdings filter, default 0.01
+	HoldingsInterval      time.Duration // between two holdings updates sent to the neighbours
+	SwarmThreshold        int64         // objects from this size are downloaded in pieces from every holder, default 4MiB
+	UploadTTL             time.Duration // multipart uploads not completed expire, default 24h
+	ResumeThreshold       int64         // transfers from this size are resumed after an interruption, default 1MiB
+	DeltaThreshold        int64         // updates of replicas from this size send the changed bytes only, default 64KiB, negative disables
+	ForwardTTL            int           // hops of a Get forwarded beyond the connected nodes, default 3, negative disables
+	MaxPeers              int           // connections kept, beyond it discovered nodes are not dialed & new ones refused, 0 unlimited
+	DiscoverOnly          bool          // learn the nodes from the peer exchange without dialing them
+	PeerExchangeInterval  time.Duration // between two address exchanges with a random peer
 }
 
 type FileServer struct {
 	FileServerOpts
 
-	peerLock sync.Mutex
-	peers    map[string]p2p.Peer
+	peerLock   sync.Mutex
+	peers      map[string]p2p.Peer // remote addr -> peer
+	nodes      map[string]p2p.Peer // advertised listen addr -> peer
+	nodeStates map[string]string   // advertised listen addr -> NodeActive...
 
-	Storage *storage.Storage
+	sendLock sync.Mutex // message & its stream must not interleave
+
+	writeLock sync.Mutex // the clock comparison & the write of a replica are one step
+
+	pendingLock sync.Mutex
+	pending     map[string]chan any // request ID -> response
+
+	repairLock sync.Mutex
+	repairing  map[string]bool // objects under read repair
+
+	forwards *forwardTracker
+
+	swarmLock sync.Mutex
+	swarms    map[string]*swarm // objects being downloaded in pieces
+
+	Storage      *storage.Storage
+	Clock        *clock.HLC // versions of the writes from this node
+	Rebalancer   *Rebalancer
+	Drainer      *Drainer
+	AntiEntropy  *AntiEntropy
+	Hints        *HintedHandoff
+	Membership   *membership.Memberlist
+	PeerExchange *PeerExchange
+	DHT          *dht.DHT
+	Holdings     *Holdings
+	Names        *naming.Registry
+	Metrics      *Metrics
+
+	admin *http.Server // admin API
 
 	errCh  chan error    // 出错时的停止
 	quitCh chan struct{} // 退出时的停止
 }
 
 func NewFileServer(opts FileServerOpts) *FileServer {
+	if !opts.NoCIDs {
+		opts.Dedup = true
+	}
 	storageOpts := storage.StorageOpt{
 		Root:              opts.StorageRoot,
 		PathTransformFunc: opts.PathTransformFunc,
+		Dedup:             opts.Dedup,
+		Durability:        opts.Durability,
 	}
 	if len(opts.ID) == 0 {
 		opts.ID = crypto.GenerateID()
 	}
-	return &FileServer{
+	if opts.ReplicationFactor <= 0 {
+		opts.ReplicationFactor = DefaultReplicationFactor
+	}
+	if len(opts.ConflictStrategy) == 0 {
+		opts.ConflictStrategy = ConflictLastWriterWins
+	}
+	if opts.Placement == nil {
+		opts.Placement = NewHashRing(opts.VirtualNodes)
+	}
+	// self is always part of the placement
+	opts.Placement.Add(opts.Transport.Addr())
+	s := &FileServer{
 		FileServerOpts: opts,
 		peers:          make(map[string]p2p.Peer),
+		nodes:          make(map[string]p2p.Peer),
+		nodeStates:     make(map[string]string),
+		pending:        make(map[string]chan any),
+		repairing:      make(map[string]bool),
+		forwards:       newForwardTracker(),
+		swarms:         make(map[string]*swarm),
 		Storage:        storage.NewStore(storageOpts),
+		Clock:          clock.NewHLC(),
 		quitCh:         make(chan struct{}),
 	}
+	s.Rebalancer = NewRebalancer(s)
+	s.Drainer = NewDrainer(s)
+	s.AntiEntropy = NewAntiEntropy(s)
+	s.Hints = NewHintedHandoff(s)
+	s.PeerExchange = NewPeerExchange(s)
+	s.Holdings = NewHoldings(s)
+	names, err := naming.NewRegistry(filepath.Join(s.Storage.Root, namesDir))
+	if err != nil {
+		log.Printf("load the name records failed: %s\n", err)
+	}
+	s.Names = names
+	if s.NameKey == nil {
+		if s.NameKey, err = naming.LoadKey(filepath.Join(s.Storage.Root, namesDir)); err != nil {
+			log.Printf("load the name key failed, names published won't survive a restart: %s\n", err)
+			_, s.NameKey, _ = ed25519.GenerateKey(rand.Reader)
+		}
+	}
+	memberCfg := opts.MembershipConfig
+	memberCfg.OnChange = s.onMemberChange
+	s.Membership = membership.New(opts.Transport.Addr(), gossipTransport{s: s}, memberCfg)
+	s.DHT = dht.New(opts.Transport.Addr(), dhtTransport{s: s}, opts.DHTConfig)
+	s.Metrics = NewMetrics()
+	return s
+}
+
+// StoreOpts optional metadata attached when storing a file
+type StoreOpts struct {
+	FileName    string
+	ContentType string
+	Uploader    string // default to the server ID
+	Tags        map[string]string
+	Consistency Consistency // acknowledgements to wait for, default ONE
+}
+
+// StoreResult replicas picked for the object & the ones acknowledged
+type StoreResult struct {
+	Key      string // hashed key
+	CID      string // content identifier, same for the same content under any key & stored once, empty with NoCIDs
+	Version  int64
+	Replicas []string
+	Acked    []string // acknowledged before returning, the others may still follow
+}
+
+// GetOpts options of reading a file
+type GetOpts struct {
+	Consistency Consistency // replicas consulted, the newest version wins
+	VersionID   string      // read an archived version instead of the latest
+}
+
+// DeleteOpts options of deleting a file
+type DeleteOpts struct {
+	Consistency Consistency // acknowledgements to wait for, default ONE
 }
@@ -2,11 +2,25 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/clock"
+	"github.com/roylic/go-distributed-file-storage/crypto"
+	"github.com/roylic/go-distributed-file-storage/dag"
+	"github.com/roylic/go-distributed-file-storage/erasure"
+	"github.com/roylic/go-distributed-file-storage/membership"
+	"github.com/roylic/go-distributed-file-storage/naming"
 	"github.com/roylic/go-distributed-file-storage/p2p"
 	"github.com/roylic/go-distributed-file-storage/storage"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"io/fs"
 	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -19,14 +33,14 @@ func Test_FilePassing(t *testing.T) {
 	// S1 监听3999端口
 	s1 := makeServer(":3999", "")
 
-	go func() {
-		log.Fatal(s1.Start())
-	}()
+	if err := s1.Start(); err != nil {
+		log.Fatal(err)
+	}
 	time.Sleep(time.Millisecond * 500)
 
-	go func() {
-		log.Fatal(s2.Start())
-	}()
+	if err := s2.Start(); err != nil {
+		log.Fatal(err)
+	}
 	time.Sleep(time.Second * 1)
 
 	key := "MyPrivateData"
@@ -50,6 +64,1692 @@ func Test_FilePassing(t *testing.T) {
 	assert.Equal(t, data, storedFileBytes)
 }
 
+// Test_MetadataReplication 确认元数据与tags更新到达replica
+func Test_MetadataReplication(t *testing.T) {
+	s1 := makeServer(":3998", "")
+	s2 := makeServer(":4998", ":3998")
+	startCluster(t, s1, s2)
+
+	key := "report.pdf"
+	opts := StoreOpts{
+		FileName:    key,
+		ContentType: "application/pdf",
+		Tags:        map[string]string{"project": "alpha"},
+	}
+	_, err := s2.StoreWithOpts(key, bytes.NewReader([]byte("quarterly report")), opts)
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond * 500)
+
+	origin, err := s2.Stat(key)
+	assert.Nil(t, err)
+	replica, err := s1.Storage.Stat(s2.ID, crypto.HashKey(key))
+	assert.Nil(t, err)
+	assert.Equal(t, origin.Checksum, replica.Checksum)
+	assert.Equal(t, "application/pdf", replica.ContentType)
+	assert.Equal(t, "alpha", replica.Tags["project"])
+
+	// editing tags reach the replica, as a write following the content
+	edited, err := s2.UpdateTags(key, map[string]string{"project": "beta"}, nil)
+	assert.Nil(t, err)
+	assert.Greater(t, edited.Version, origin.Version)
+	assert.Equal(t, clock.After, edited.Clock.Compare(origin.Clock))
+	time.Sleep(time.Millisecond * 200)
+	replica, err = s1.Storage.Stat(s2.ID, crypto.HashKey(key))
+	assert.Nil(t, err)
+	assert.Equal(t, "beta", replica.Tags["project"])
+	assert.Equal(t, edited.Version, replica.Version)
+	assert.Equal(t, clock.Equal, edited.Clock.Compare(replica.Clock))
+
+	// an edit the replica already follows is not applied again
+	_, err = s1.applyTags(s2.ID, crypto.HashKey(key), map[string]string{"project": "stale"}, nil, origin.Version, origin.Clock)
+	assert.ErrorIs(t, err, errSuperseded)
+
+	// a copy fetched back from the replica keeps the origin's metadata
+	assert.Nil(t, s2.Storage.Delete(s2.ID, crypto.HashKey(key)))
+	r, err := s2.Get(key)
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, []byte("quarterly report"), b)
+	fetched, err := s2.Stat(key)
+	assert.Nil(t, err)
+	assert.Equal(t, key, fetched.FileName)
+	assert.Equal(t, "application/pdf", fetched.ContentType)
+	assert.Equal(t, "beta", fetched.Tags["project"])
+}
+
+// Test_QueryOwner 写入节点不是replica时, Stat & Query仍能找到它的文件
+func Test_QueryOwner(t *testing.T) {
+	s1 := makeServer(":3972", "")
+	s2 := makeServer(":4972", ":3972")
+	servers := []*FileServer{s1, s2}
+	for _, s := range servers {
+		s.ReplicationFactor = 1
+		s.Placement = staticPlacement{":4972"}
+	}
+	startCluster(t, servers...)
+
+	for _, key := range []string{"q1", "q2", "q3"} {
+		_, err := s1.StoreWithOpts(key, bytes.NewReader([]byte(key)), StoreOpts{Tags: map[string]string{"project": "alpha"}})
+		assert.Nil(t, err)
+		assert.False(t, s1.Storage.Has(s1.ID, crypto.HashKey(key)))
+	}
+
+	meta, err := s1.Stat("q1")
+	assert.Nil(t, err)
+	assert.Equal(t, "alpha", meta.Tags["project"])
+	_, err = s1.Stat("missing")
+	assert.NotNil(t, err)
+
+	page, err := s1.Query("tag:project=alpha", storage.QueryOpts{Limit: 2})
+	assert.Nil(t, err)
+	assert.Len(t, page.Items, 2)
+	assert.NotEmpty(t, page.NextCursor)
+	next, err := s1.Query("tag:project=alpha", storage.QueryOpts{Limit: 2, Cursor: page.NextCursor})
+	assert.Nil(t, err)
+	assert.Len(t, next.Items, 1)
+	assert.Empty(t, next.NextCursor)
+}
+
+// TestHashRing 确认placement的确定性与分布
+func TestHashRing(t *testing.T) {
+	ring := NewHashRing(DefaultVirtualNodes)
+	for _, node := range []string{":3000", ":3001", ":3002", ":3003"} {
+		ring.Add(node)
+	}
+
+	// exactly R distinct nodes, same answer every time
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		key := crypto.HashKey(fmt.Sprintf("key_%d", i))
+		nodes := ring.Locate(key, 3)
+		assert.Equal(t, 3, len(nodes))
+		assert.NotEqual(t, nodes[0], nodes[1])
+		assert.NotEqual(t, nodes[1], nodes[2])
+		assert.Equal(t, nodes, ring.Locate(key, 3))
+		counts[nodes[0]]++
+	}
+	for node, n := range counts {
+		assert.Greater(t, n, 100, "node %s owns too few keys", node)
+	}
+
+	// removing a node only moves the keys it owned
+	key := crypto.HashKey("key_1")
+	before := ring.Locate(key, 1)[0]
+	other := ":3000"
+	if other == before {
+		other = ":3001"
+	}
+	ring.Remove(other)
+	assert.Equal(t, before, ring.Locate(key, 1)[0])
+	assert.Equal(t, 3, len(ring.Nodes()))
+	assert.Equal(t, 3, len(ring.Locate(key, 5)))
+}
+
+// Test_ReplicationFactor 3个节点, R=2, 只有placement选中的节点保存文件
+func Test_ReplicationFactor(t *testing.T) {
+	s1 := makeServer(":3997", "")
+	s2 := makeServer(":4997", ":3997")
+	s3 := makeServer(":5997", ":3997", ":4997")
+	servers := []*FileServer{s1, s2, s3}
+	for _, s := range servers {
+		s.ReplicationFactor = 2
+	}
+	startCluster(t, servers...)
+
+	key := "placement-data"
+	data := []byte("only two copies of me")
+	assert.Nil(t, s1.Store(key, bytes.NewReader(data)))
+	time.Sleep(time.Millisecond * 500)
+
+	hashedKey := crypto.HashKey(key)
+	targets := s1.Placement.Locate(hashedKey, 2)
+	assert.Equal(t, targets, s3.Placement.Locate(hashedKey, 2))
+	holders := 0
+	for _, s := range servers {
+		if s.Storage.Has(s1.ID, hashedKey) {
+			holders++
+			assert.Contains(t, targets, s.Transport.Addr())
+		}
+	}
+	assert.Equal(t, 2, holders)
+
+	// get from the node not holding the file, by the same owner
+	for _, s := range servers {
+		if !s.Storage.Has(s1.ID, hashedKey) {
+			s.ID = s1.ID
+			r, err := s.Get(key)
+			assert.Nil(t, err)
+			b, _ := io.ReadAll(r)
+			assert.Equal(t, data, b)
+		}
+	}
+}
+
+// Test_Rebalance 新节点加入后, 不再属于本节点的文件被移动到新的owner
+func Test_Rebalance(t *testing.T) {
+	s1 := makeServer(":3996", "")
+	s2 := makeServer(":4996", ":3996")
+	for _, s := range []*FileServer{s1, s2} {
+		s.ReplicationFactor = 1
+		s.RebalanceDelay = time.Millisecond * 100
+	}
+	startCluster(t, s1, s2)
+
+	var keys []string
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("rebalance_%d", i)
+		keys = append(keys, key)
+		assert.Nil(t, s1.Store(key, bytes.NewReader([]byte(key))))
+	}
+	time.Sleep(time.Millisecond * 300)
+
+	// pausing before the join, nothing moves
+	s1.Rebalancer.Pause()
+	s2.Rebalancer.Pause()
+	s3 := makeServer(":5996", ":3996", ":4996")
+	s3.ReplicationFactor = 1
+	assert.Nil(t, s3.Start())
+	time.Sleep(time.Millisecond * 800)
+	assert.Equal(t, RebalancePaused, s1.Rebalancer.Status().State)
+
+	s1.Rebalancer.Resume()
+	s2.Rebalancer.Resume()
+	time.Sleep(time.Second * 2)
+
+	servers := []*FileServer{s1, s2, s3}
+	moved := 0
+	for _, key := range keys {
+		hashedKey := crypto.HashKey(key)
+		owner := s3.Placement.Locate(hashedKey, 1)[0]
+		for _, s := range servers {
+			assert.Equal(t, s.Transport.Addr() == owner, s.Storage.Has(s1.ID, hashedKey),
+				"key %s owner %s server %s", key, owner, s.Transport.Addr())
+		}
+		if owner == s3.Transport.Addr() {
+			moved++
+		}
+	}
+	assert.Equal(t, moved, s1.Rebalancer.Status().Moved+s2.Rebalancer.Status().Moved)
+}
+
+// TestRateReader 确认rebalance的流按速率读取
+func TestRateReader(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 2000)
+	r := &rateReader{r: bytes.NewReader(data), rate: 4000, quit: make(chan struct{})}
+	start := time.Now()
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+// Test_Drain 节点下线, 所有文件复制到其他节点后才报告drained
+func Test_Drain(t *testing.T) {
+	s1 := makeServer(":3995", "")
+	s2 := makeServer(":4995", ":3995")
+	s3 := makeServer(":5995", ":3995", ":4995")
+	servers := []*FileServer{s1, s2, s3}
+	for _, s := range servers {
+		s.ReplicationFactor = 1
+	}
+	startCluster(t, servers...)
+
+	var keys []string
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("drain_%d", i)
+		keys = append(keys, key)
+		assert.Nil(t, s1.Store(key, bytes.NewReader([]byte(key))))
+	}
+	time.Sleep(time.Millisecond * 300)
+
+	// forwarded from s1 to s3
+	assert.Nil(t, s1.Drain(s3.Transport.Addr()))
+	deadline := time.Now().Add(time.Second * 10)
+	for s3.Drainer.Status().State != NodeDrained && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 100)
+	}
+	assert.Equal(t, NodeDrained, s3.Drainer.Status().State)
+	assert.Equal(t, NodeDrained, s1.NodeStates()[s3.Transport.Addr()])
+	assert.NotContains(t, s1.Placement.Nodes(), s3.Transport.Addr())
+
+	// every object held by s3 is on its new owner, s3 still keeps its copy
+	for _, key := range keys {
+		hashedKey := crypto.HashKey(key)
+		if !s3.Storage.Has(s1.ID, hashedKey) {
+			continue
+		}
+		owner := s1.Placement.Locate(hashedKey, 1)[0]
+		assert.NotEqual(t, s3.Transport.Addr(), owner)
+		for _, s := range servers[:2] {
+			if s.Transport.Addr() == owner {
+				assert.True(t, s.Storage.Has(s1.ID, hashedKey))
+			}
+		}
+	}
+
+	// new writes skip the drained node
+	assert.Nil(t, s1.Store("after-drain", bytes.NewReader([]byte("x"))))
+	time.Sleep(time.Millisecond * 200)
+	assert.False(t, s3.Storage.Has(s1.ID, crypto.HashKey("after-drain")))
+
+	// the state survives restarts
+	restarted := NewFileServer(FileServerOpts{
+		StorageRoot: s3.StorageRoot,
+		Transport:   p2p.NewTCPTransport(p2p.TCPTransportOpt{ListenAddr: ":5995"}),
+	})
+	assert.Nil(t, restarted.Drainer.load())
+	assert.Equal(t, NodeDrained, restarted.Drainer.Status().State)
+
+	// undrained through s1, back in the placement & persisted
+	assert.Nil(t, s1.Undrain(s3.Transport.Addr()))
+	assert.Eventually(t, func() bool {
+		return s1.NodeStates()[s3.Transport.Addr()] == NodeActive
+	}, time.Second*2, time.Millisecond*50)
+	assert.Equal(t, NodeActive, s3.Drainer.Status().State)
+	assert.Contains(t, s1.Placement.Nodes(), s3.Transport.Addr())
+	assert.Nil(t, restarted.Drainer.load())
+	assert.Equal(t, NodeActive, restarted.Drainer.Status().State)
+}
+
+// Test_AntiEntropy 副本错过Store/Delete后, 通过Merkle树比对修复
+func Test_AntiEntropy(t *testing.T) {
+	s1 := makeServer(":3994", "")
+	s2 := makeServer(":4994", ":3994")
+	for _, s := range []*FileServer{s1, s2} {
+		s.ReplicationFactor = 2
+	}
+	startCluster(t, s1, s2)
+
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, s1.Store(fmt.Sprintf("ae_%d", i), bytes.NewReader([]byte("v1"))))
+	}
+	time.Sleep(time.Millisecond * 500)
+
+	// nothing differs yet
+	res, err := s1.AntiEntropy.SyncWith(s2.Transport.Addr())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Divergent)
+
+	missed := crypto.HashKey("ae_1")  // s2 missed the store
+	deleted := crypto.HashKey("ae_2") // s2 missed the delete
+	stale := crypto.HashKey("ae_3")   // s1 holds an old version
+	assert.Nil(t, s2.Storage.Delete(s1.ID, missed))
+	assert.Nil(t, s1.Storage.Tombstone(s1.ID, deleted, time.Now().UnixNano()))
+	meta, _ := s2.Storage.Stat(s1.ID, stale)
+	meta.Version = time.Now().UnixNano()
+	_, err = s2.Storage.WriteWithMeta(s1.ID, stale, bytes.NewReader([]byte("v2")), *meta)
+	assert.Nil(t, err)
+
+	res, err = s1.AntiEntropy.SyncWith(s2.Transport.Addr())
+	assert.Nil(t, err)
+	assert.Equal(t, 3, res.Divergent)
+	assert.Equal(t, 3, res.Repaired)
+	time.Sleep(time.Millisecond * 500)
+
+	assert.True(t, s2.Storage.Has(s1.ID, missed))
+	assert.False(t, s2.Storage.Has(s1.ID, deleted))
+	b, err := s1.readLocal(s1.ID, stale)
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", string(b))
+	assert.Equal(t, int64(3), s1.Metrics.Get(MetricAntiEntropyDivergent))
+
+	// converged
+	res, err = s1.AntiEntropy.SyncWith(s2.Transport.Addr())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Divergent)
+}
+
+// Test_AntiEntropyTree Merkle树随写入删除增量更新, 与重新遍历的结果一致
+func Test_AntiEntropyTree(t *testing.T) {
+	s := makeServer(":3970", "")
+	s.Placement = staticPlacement{":3970", ":4970"}
+	defer s.Storage.Close()
+
+	_, err := s.Storage.Write(s.ID, "k1", bytes.NewReader([]byte("v1")))
+	assert.Nil(t, err)
+	tree, err := s.AntiEntropy.treeFor(":4970")
+	if !assert.Nil(t, err) {
+		return
+	}
+	walked := func() []byte {
+		fresh := &AntiEntropy{s: s}
+		assert.Nil(t, fresh.build(fresh.ringOf()))
+		ft, _ := fresh.treeFor(":4970")
+		return ft.Root()
+	}
+	assert.Equal(t, walked(), tree.Root())
+
+	// followed without walking the store again
+	_, err = s.Storage.Write(s.ID, "k2", bytes.NewReader([]byte("v1")))
+	assert.Nil(t, err)
+	_, err = s.Storage.Write(s.ID, "k3", bytes.NewReader([]byte("v1")))
+	assert.Nil(t, err)
+	assert.Nil(t, s.Storage.Tombstone(s.ID, "k1", time.Now().UnixNano()))
+	assert.Nil(t, s.Storage.Delete(s.ID, "k3"))
+	assert.Equal(t, walked(), tree.Root())
+	e, ok := s.AntiEntropy.entry(SyncEntry{ID: s.ID, Key: "k1"}.merkleKey())
+	assert.True(t, ok)
+	assert.True(t, e.Deleted)
+	_, ok = s.AntiEntropy.entry(SyncEntry{ID: s.ID, Key: "k3"}.merkleKey())
+	assert.False(t, ok)
+}
+
+// Test_ReadRepair Get之后, 缺失或过期的副本在后台修复
+func Test_ReadRepair(t *testing.T) {
+	s1 := makeServer(":3993", "")
+	s2 := makeServer(":4993", ":3993")
+	for _, s := range []*FileServer{s1, s2} {
+		s.ReplicationFactor = 2
+	}
+	startCluster(t, s1, s2)
+
+	missed, stale := crypto.HashKey("rr_missed"), crypto.HashKey("rr_stale")
+	assert.Nil(t, s1.Store("rr_missed", bytes.NewReader([]byte("v1"))))
+	assert.Nil(t, s1.Store("rr_stale", bytes.NewReader([]byte("v1"))))
+	time.Sleep(time.Millisecond * 500)
+
+	// s2 lost one object & holds an old version of the other
+	assert.Nil(t, s2.Storage.Delete(s1.ID, missed))
+	meta, err := s1.Storage.Stat(s1.ID, stale)
+	assert.Nil(t, err)
+	meta.Version = time.Now().UnixNano()
+	_, err = s1.Storage.WriteWithMeta(s1.ID, stale, bytes.NewReader([]byte("v2")), *meta)
+	assert.Nil(t, err)
+
+	for _, key := range []string{"rr_missed", "rr_stale"} {
+		_, err := s1.Get(key)
+		assert.Nil(t, err)
+	}
+	time.Sleep(time.Second)
+
+	assert.True(t, s2.Storage.Has(s1.ID, missed))
+	b, err := s2.readLocal(s1.ID, stale)
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", string(b))
+	assert.Equal(t, int64(2), s1.Metrics.Get(MetricReadRepairs))
+}
+
+// Test_StaleFetch 从过期副本取回的拷贝保留其版本, anti-entropy不会用它覆盖新版本
+func Test_StaleFetch(t *testing.T) {
+	s1 := makeServer(":3973", "")
+	s2 := makeServer(":4973", ":3973")
+	s3 := makeServer(":5973", ":3973", ":4973")
+	for _, s := range []*FileServer{s1, s2, s3} {
+		s.ReplicationFactor = 3
+	}
+	startCluster(t, s1, s2, s3)
+
+	key := "stale_fetch"
+	hashedKey := crypto.HashKey(key)
+	assert.Nil(t, s1.Store(key, bytes.NewReader([]byte("v1"))))
+	time.Sleep(time.Millisecond * 500)
+	old, err := s2.Storage.Stat(s1.ID, hashedKey)
+	assert.Nil(t, err)
+
+	// s3 holds a newer version s2 missed, s1 lost its copy
+	meta, err := s3.Storage.Stat(s1.ID, hashedKey)
+	assert.Nil(t, err)
+	meta.Version = time.Now().UnixNano()
+	_, err = s3.Storage.WriteWithMeta(s1.ID, hashedKey, bytes.NewReader([]byte("v2")), *meta)
+	assert.Nil(t, err)
+	assert.Nil(t, s1.Storage.Delete(s1.ID, hashedKey))
+
+	// fetched from the stale replica, it keeps the version it was copied from
+	found, err := s1.fetchFrom(s2.Transport.Addr(), hashedKey, &Message{Payload: MessageGetFile{ID: s1.ID, Key: hashedKey}})
+	assert.Nil(t, err)
+	assert.True(t, found)
+	fetched, err := s1.Storage.Stat(s1.ID, hashedKey)
+	assert.Nil(t, err)
+	assert.Equal(t, old.Version, fetched.Version)
+	assert.Equal(t, old.Clock, fetched.Clock)
+
+	// anti-entropy brings the newest version everywhere, never the old one back
+	_, err = s1.AntiEntropy.SyncWith(s3.Transport.Addr())
+	assert.Nil(t, err)
+	_, err = s2.AntiEntropy.SyncWith(s3.Transport.Addr())
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		for _, s := range []*FileServer{s1, s2, s3} {
+			if b, err := s.readLocal(s1.ID, hashedKey); err != nil || string(b) != "v2" {
+				return false
+			}
+		}
+		return true
+	}, time.Second*2, time.Millisecond*50)
+}
+
+// staticPlacement fixed replicas, unreachable nodes are not taken off
+type staticPlacement []string
+
+func (p staticPlacement) Add(node string)    {}
+func (p staticPlacement) Remove(node string) {}
+func (p staticPlacement) Nodes() []string    { return p }
+func (p staticPlacement) Locate(key string, n int) []string {
+	if n > len(p) {
+		n = len(p)
+	}
+	return p[:n]
+}
+
+// Test_HintedHandoff 副本不可达时保留hint, 重新连接后投递
+func Test_HintedHandoff(t *testing.T) {
+	s1 := makeServer(":3992", "")
+	s2 := makeServer(":4992", ":3992")
+	for _, s := range []*FileServer{s1, s2} {
+		s.ReplicationFactor = 2
+	}
+	startCluster(t, s1, s2)
+
+	// :4992 drops off while storing, it stays a replica in the ring
+	peer, _ := s1.nodePeer(":4992")
+	assert.Nil(t, peer.Close())
+	assert.Eventually(t, func() bool {
+		_, ok := s1.nodePeer(":4992")
+		return !ok
+	}, time.Second, time.Millisecond*10)
+	assert.Contains(t, s1.Placement.Nodes(), ":4992")
+
+	key := "hinted"
+	assert.Nil(t, s1.Store(key, bytes.NewReader([]byte("missed write"))))
+	assert.Eventually(t, func() bool {
+		return s1.Metrics.Get(MetricHintsStored) == 1
+	}, time.Second, time.Millisecond*10)
+
+	// back, the hint is delivered & its content dropped
+	_, err := s1.connect(":4992")
+	assert.Nil(t, err)
+	assert.Nil(t, s1.Hints.Deliver(":4992"))
+	assert.Eventually(t, func() bool {
+		b, err := s2.readLocal(s1.ID, crypto.HashKey(key))
+		return err == nil && string(b) == "missed write"
+	}, time.Second*2, time.Millisecond*50)
+	assert.Eventually(t, func() bool {
+		return s1.Hints.Pending("") == 0
+	}, time.Second, time.Millisecond*20)
+	assert.Equal(t, int64(1), s1.Metrics.Get(MetricHintsDelivered))
+	spooled, _ := os.ReadDir(filepath.Join(s1.Storage.Root, hintDir, hintDataDir))
+	assert.Empty(t, spooled)
+
+	// bounded queue, expiry
+	s1.MaxHints, s1.HintTTL = 1, time.Millisecond
+	meta := &storage.Metadata{Key: "k1", Version: 1}
+	assert.Nil(t, s1.Hints.Add(":5992", s1.ID, meta, []byte("a")))
+	// the hint survives a restart of the holder
+	reloaded := NewHintedHandoff(s1)
+	assert.Nil(t, reloaded.load())
+	assert.Equal(t, 1, reloaded.Pending(""))
+	meta = &storage.Metadata{Key: "k2", Version: 1}
+	assert.ErrorIs(t, s1.Hints.Add(":5992", s1.ID, meta, []byte("b")), ErrHintQueueFull)
+	time.Sleep(time.Millisecond * 5)
+	s1.Hints.expire()
+	assert.Equal(t, 0, s1.Hints.Pending(""))
+}
+
+// Test_Consistency 按一致性级别等待副本确认, 读取时最新版本胜出
+func Test_Consistency(t *testing.T) {
+	s1 := makeServer(":3991", "")
+	s2 := makeServer(":4991", ":3991")
+	s3 := makeServer(":5991", ":3991", ":4991")
+	servers := []*FileServer{s1, s2, s3}
+	startCluster(t, servers...)
+
+	key := "consistent"
+	res, err := s1.StoreWithOpts(key, bytes.NewReader([]byte("v1")), StoreOpts{Consistency: ConsistencyAll})
+	assert.Nil(t, err)
+	assert.Len(t, res.Replicas, 3)
+	assert.ElementsMatch(t, res.Replicas, res.Acked)
+
+	// two replicas hold a newer version, any quorum sees it
+	meta, err := s1.Storage.Stat(s1.ID, res.Key)
+	assert.Nil(t, err)
+	meta.Version = time.Now().UnixNano()
+	for _, s := range []*FileServer{s2, s3} {
+		_, err = s.Storage.WriteWithMeta(s1.ID, res.Key, bytes.NewReader([]byte("v2")), *meta)
+		assert.Nil(t, err)
+	}
+	r, err := s1.GetWithOpts(key, GetOpts{Consistency: ConsistencyQuorum})
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, "v2", string(b))
+	local, err := s1.Stat(key)
+	assert.Nil(t, err)
+	assert.Equal(t, meta.Version, local.Version)
+
+	// an unreachable replica fails ALL, not QUORUM, the placement is
+	// fixed before the server starts
+	s4 := makeServer(":7991", ":3991", ":4991")
+	s4.Placement = staticPlacement{":7991", ":3991", ":6991"}
+	assert.Nil(t, s4.Start())
+	assert.Eventually(t, func() bool {
+		_, ok := s4.nodePeer(":3991")
+		return ok
+	}, 2*time.Second, 10*time.Millisecond)
+	res, err = s4.StoreWithOpts("partial", bytes.NewReader([]byte("x")), StoreOpts{Consistency: ConsistencyAll})
+	assert.ErrorIs(t, err, ErrConsistency)
+	assert.Len(t, res.Acked, 2)
+	_, err = s4.StoreWithOpts("partial", bytes.NewReader([]byte("x")), StoreOpts{Consistency: ConsistencyQuorum})
+	assert.Nil(t, err)
+	_, err = s4.GetWithOpts("partial", GetOpts{Consistency: ConsistencyAll})
+	assert.ErrorIs(t, err, ErrConsistency)
+	assert.ErrorIs(t, s4.DeleteWithOpts("partial", DeleteOpts{Consistency: ConsistencyAll}), ErrConsistency)
+	assert.Nil(t, s1.DeleteWithOpts(key, DeleteOpts{Consistency: ConsistencyQuorum}))
+	held := 0
+	for _, s := range servers {
+		if s.Storage.Has(s1.ID, crypto.HashKey(key)) {
+			held++
+		}
+	}
+	assert.LessOrEqual(t, held, 1)
+}
+
+func TestParseConsistency(t *testing.T) {
+	for in, want := range map[string]Consistency{"": ConsistencyOne, "quorum": ConsistencyQuorum, " ALL ": ConsistencyAll} {
+		c, err := ParseConsistency(in)
+		assert.Nil(t, err)
+		assert.Equal(t, want, c)
+	}
+	_, err := ParseConsistency("TWO")
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, ConsistencyQuorum.required(3))
+	assert.Equal(t, 1, Consistency("").required(3))
+}
+
+// Test_Versioning 每次写入保留版本, 副本的版本历史一致
+func Test_Versioning(t *testing.T) {
+	s1 := makeServer(":3990", "")
+	s2 := makeServer(":4990", ":3990")
+	for _, s := range []*FileServer{s1, s2} {
+		s.ReplicationFactor = 2
+	}
+	startCluster(t, s1, s2)
+	assert.Nil(t, s1.SetVersioning(true))
+
+	key := "versioned"
+	hashedKey := crypto.HashKey(key)
+	for _, content := range []string{"v1", "v2"} {
+		_, err := s1.StoreWithOpts(key, bytes.NewReader([]byte(content)), StoreOpts{Consistency: ConsistencyAll})
+		assert.Nil(t, err)
+	}
+	versions, err := s1.ListVersions(key)
+	assert.Nil(t, err)
+	assert.Len(t, versions, 2)
+	first := versions[1].VersionID
+
+	r, err := s1.GetWithOpts(key, GetOpts{VersionID: first})
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, "v1", string(b))
+
+	// replicas converge on the same history
+	_, err = s1.RestoreVersion(key, first)
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond * 300)
+	for _, s := range []*FileServer{s1, s2} {
+		b, err := s.readLocal(s1.ID, hashedKey)
+		assert.Nil(t, err)
+		assert.Equal(t, "v1", string(b))
+		history, err := s.Storage.ListVersions(s1.ID, hashedKey)
+		assert.Nil(t, err)
+		assert.Len(t, history, 3)
+		assert.Equal(t, versions[0].VersionID, history[1].VersionID)
+	}
+
+	assert.Nil(t, s1.DeleteVersion(key, first))
+	time.Sleep(time.Millisecond * 300)
+	history, err := s2.Storage.ListVersions(s1.ID, hashedKey)
+	assert.Nil(t, err)
+	assert.Len(t, history, 2)
+
+	// history kept by the replica only
+	_ = os.RemoveAll(s1.StorageRoot + "/_versions")
+	r, err = s1.GetWithOpts(key, GetOpts{VersionID: history[1].VersionID})
+	assert.Nil(t, err)
+	b, _ = io.ReadAll(r)
+	assert.Equal(t, "v2", string(b))
+}
+
+// Test_ConcurrentWrites 两个节点同时写入同一个key, 副本最终一致
+func Test_ConcurrentWrites(t *testing.T) {
+	s1 := makeServer(":3989", "")
+	s2 := makeServer(":4989", ":3989")
+	// the same owner writing through both nodes
+	s2.ID = s1.ID
+	for _, s := range []*FileServer{s1, s2} {
+		s.ReplicationFactor = 2
+	}
+	startCluster(t, s1, s2)
+
+	key := "contended"
+	done := make(chan error, 2)
+	for _, s := range []*FileServer{s1, s2} {
+		go func(s *FileServer) {
+			_, err := s.StoreWithOpts(key, bytes.NewReader([]byte("from "+s.Transport.Addr())), StoreOpts{Consistency: ConsistencyAll})
+			done <- err
+		}(s)
+	}
+	assert.Nil(t, <-done)
+	assert.Nil(t, <-done)
+	time.Sleep(time.Millisecond * 300)
+
+	m1, err := s1.Stat(key)
+	assert.Nil(t, err)
+	m2, err := s2.Stat(key)
+	assert.Nil(t, err)
+	assert.Equal(t, m1.Checksum, m2.Checksum)
+	assert.Contains(t, m1.Clock, m1.Node)
+}
+
+// TestDropMoved 搬移期间被新写入替换的本地副本不会被删除
+func TestDropMoved(t *testing.T) {
+	s := makeServer(":3971", "")
+	defer s.Storage.Close()
+	write := func(version int64, content string) *storage.Metadata {
+		meta := storage.Metadata{
+			Key:     crypto.HashKey("moved"),
+			Version: version,
+			Node:    "a",
+			Clock:   clock.VClock{"a": version},
+		}
+		assert.Nil(t, s.applyWrite(s.ID, meta, []byte(content)))
+		got, err := s.Storage.Stat(s.ID, meta.Key)
+		assert.Nil(t, err)
+		return got
+	}
+	sent := write(1, "sent")
+	write(2, "newer")
+	assert.NotNil(t, s.dropMoved(localObject{id: s.ID, meta: sent}))
+	assert.True(t, s.Storage.Has(s.ID, sent.Key))
+
+	current, err := s.Storage.Stat(s.ID, sent.Key)
+	assert.Nil(t, err)
+	assert.Nil(t, s.dropMoved(localObject{id: s.ID, meta: current}))
+	assert.False(t, s.Storage.Has(s.ID, sent.Key))
+}
+
+func TestConflictStrategies(t *testing.T) {
+	s := makeServer(":3988", "")
+	write := func(key string, node string, version int64, content string) error {
+		meta := storage.Metadata{
+			Key:     crypto.HashKey(key),
+			Version: version,
+			Node:    node,
+			Clock:   clock.VClock{node: version},
+		}
+		return s.applyWrite(s.ID, meta, []byte(content))
+	}
+	read := func(key string) string {
+		b, err := s.readLocal(s.ID, crypto.HashKey(key))
+		assert.Nil(t, err)
+		return string(b)
+	}
+
+	// last writer wins, the older concurrent write is superseded
+	assert.Nil(t, write("lww", "a", 2, "a"))
+	assert.ErrorIs(t, write("lww", "b", 1, "b"), errSuperseded)
+	assert.Equal(t, "a", read("lww"))
+	assert.Equal(t, int64(1), s.Metrics.Get(MetricConflicts))
+	meta, _ := s.Stat("lww")
+	assert.Equal(t, clock.VClock{"a": 2, "b": 1}, meta.Clock)
+	// seen by the merged clock now
+	assert.ErrorIs(t, write("lww", "b", 1, "b"), errSuperseded)
+	assert.Equal(t, int64(1), s.Metrics.Get(MetricConflicts))
+
+	// siblings, superseded by a later write from this node
+	s.ConflictStrategy = ConflictKeepSiblings
+	assert.Nil(t, write("sib", "a", 1, "a"))
+	assert.Nil(t, write("sib", "b", 2, "b"))
+	assert.Equal(t, "b", read("sib"))
+	siblings, err := s.Siblings("sib")
+	assert.Nil(t, err)
+	assert.Len(t, siblings, 1)
+	assert.Equal(t, "a", siblings[0].Node)
+	_, err = s.StoreWithOpts("sib", bytes.NewReader([]byte("merged")), StoreOpts{})
+	assert.Nil(t, err)
+	siblings, _ = s.Siblings("sib")
+	assert.Empty(t, siblings)
+
+	// custom resolver
+	s.ConflictStrategy = ConflictCustom
+	s.ConflictResolver = func(local Sibling, remote Sibling) ([]byte, error) {
+		parts := []string{string(local.Data), string(remote.Data)}
+		sort.Strings(parts)
+		return []byte(strings.Join(parts, "+")), nil
+	}
+	assert.Nil(t, write("custom", "b", 1, "b"))
+	assert.ErrorIs(t, write("custom", "a", 2, "a"), errSuperseded)
+	assert.Equal(t, "a+b", read("custom"))
+	meta, _ = s.Stat("custom")
+	assert.Equal(t, int64(3), meta.Version)
+}
+
+// Test_Membership 节点通过SWIM互相发现, 停止的节点被判定为dead
+func Test_Membership(t *testing.T) {
+	cfg := membership.Config{
+		ProbeInterval:    50 * time.Millisecond,
+		ProbeTimeout:     10 * time.Millisecond,
+		SuspicionTimeout: 200 * time.Millisecond,
+	}
+	s1 := makeServer(":3987", "")
+	s2 := makeServer(":4987", ":3987")
+	s3 := makeServer(":5987", ":3987")
+	servers := []*FileServer{s1, s2, s3}
+	for _, s := range servers {
+		// faster probing than the defaults
+		cfg.OnChange = s.onMemberChange
+		s.Membership = membership.New(s.Transport.Addr(), gossipTransport{s: s}, cfg)
+	}
+	startCluster(t, servers...)
+
+	// s2 & s3 only dialed s1, they learn each other by gossip
+	assert.Eventually(t, func() bool {
+		state, ok := s2.Membership.StateOf(":5987")
+		return ok && state == membership.StateAlive
+	}, 2*time.Second, 20*time.Millisecond)
+
+	s3.Stop()
+	assert.Eventually(t, func() bool {
+		state, _ := s1.Membership.StateOf(":5987")
+		return state == membership.StateDead
+	}, 3*time.Second, 20*time.Millisecond)
+	assert.NotContains(t, s1.Placement.Nodes(), ":5987")
+}
+
+// Test_PeerExchange nodes knowing a single seed connect to the whole cluster
+func Test_PeerExchange(t *testing.T) {
+	s1 := makeServer(":3986", "")
+	s2 := makeServer(":4986", ":3986")
+	s3 := makeServer(":5986", ":3986")
+	s4 := makeServer(":6986", ":3986")
+	s4.MaxPeers = 2
+	servers := []*FileServer{s1, s2, s3, s4}
+	startCluster(t, servers...)
+	defer func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+	}()
+
+	connected := func(s *FileServer, node string) bool {
+		_, ok := s.nodePeer(node)
+		return ok
+	}
+	assert.Eventually(t, func() bool {
+		return connected(s2, ":5986") && connected(s3, ":4986")
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// s4 learns the whole cluster but keeps 2 connections
+	assert.Eventually(t, func() bool {
+		return len(s4.PeerExchange.Known()) == 3
+	}, 2*time.Second, 20*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	s4.peerLock.Lock()
+	assert.Len(t, s4.peers, 2)
+	s4.peerLock.Unlock()
+}
+
+// Test_DHT the holder of an object is located through the provider records
+func Test_DHT(t *testing.T) {
+	s1 := makeServer(":3985", "")
+	s2 := makeServer(":4985", ":3985")
+	s3 := makeServer(":5985", ":3985")
+	// s2 & s3 share the namespace & place nothing on the others
+	s3.ID = s2.ID
+	s2.Placement = staticPlacement{":4985"}
+	s3.Placement = staticPlacement{":5985"}
+	servers := []*FileServer{s1, s2, s3}
+	for _, s := range servers {
+		s.DiscoverOnly = true
+	}
+	startCluster(t, servers...)
+	defer func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+	}()
+	key := "located-by-dht"
+	assert.Nil(t, s2.Store(key, bytes.NewReader([]byte("held by s2 only"))))
+	hashedKey := crypto.HashKey(key)
+	assert.Eventually(t, func() bool {
+		return len(s1.DHT.Providers(providerKey(s2.ID, hashedKey))) > 0
+	}, 2*time.Second, 20*time.Millisecond)
+	assert.Equal(t, []string{":4985"}, s3.providersOf(s3.ID, hashedKey))
+
+	r, err := s3.Get(key)
+	if assert.Nil(t, err) {
+		b, _ := io.ReadAll(r)
+		assert.Equal(t, "held by s2 only", string(b))
+	}
+
+	// deleted, the holders withdraw their records
+	assert.Nil(t, s2.Delete(key))
+	assert.Eventually(t, func() bool {
+		return len(s1.DHT.Providers(providerKey(s2.ID, hashedKey))) == 0
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+// Test_Forwarding a node connected to a single peer reaches the holder through it
+func Test_Forwarding(t *testing.T) {
+	s1 := makeServer(":3984", "")
+	s2 := makeServer(":4984", ":3984")
+	s3 := makeServer(":5984", ":4984")
+	// s1 & s3 share the namespace, s1 keeps its only connection to s2
+	s3.ID = s1.ID
+	s1.MaxPeers = 1
+	s1.Placement = staticPlacement{":3984"}
+	s3.Placement = staticPlacement{":5984"}
+	servers := []*FileServer{s1, s2, s3}
+	for _, s := range servers {
+		s.DiscoverOnly = true
+	}
+	startCluster(t, servers...)
+	defer func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+	}()
+
+	key := "two-hops-away"
+	assert.Nil(t, s3.Store(key, bytes.NewReader([]byte("relayed by s2"))))
+	time.Sleep(200 * time.Millisecond)
+	_, connected := s1.nodePeer(":5984")
+	assert.False(t, connected)
+
+	r, err := s1.Get(key)
+	if assert.Nil(t, err) {
+		b, _ := io.ReadAll(r)
+		assert.Equal(t, "relayed by s2", string(b))
+	}
+
+	// a big object is relayed range by range, never as a single message
+	big := bytes.Repeat([]byte("0123456789abcdef"), rangeChunk/8+7)
+	assert.Nil(t, s3.Store("big-two-hops-away", bytes.NewReader(big)))
+	r, err = s1.Get("big-two-hops-away")
+	if assert.Nil(t, err) {
+		b, _ := io.ReadAll(r)
+		assert.Equal(t, big, b)
+	}
+
+	// duplicates are suppressed, a looping request is not served twice
+	assert.True(t, s2.forwards.first("origin"))
+	assert.False(t, s2.forwards.first("origin"))
+}
+
+// Test_Holdings Get asks first the nodes whose holdings filter matches
+func Test_Holdings(t *testing.T) {
+	s1 := makeServer(":3983", "")
+	s2 := makeServer(":4983", ":3983")
+	s3 := makeServer(":5983", ":3983", ":4983")
+	// s2 & s3 share the namespace, each places the objects on itself only
+	s3.ID = s2.ID
+	s2.Placement = staticPlacement{":4983"}
+	s3.Placement = staticPlacement{":5983"}
+	servers := []*FileServer{s1, s2, s3}
+	for _, s := range servers {
+		s.HoldingsInterval = 50 * time.Millisecond
+	}
+	startCluster(t, servers...)
+	defer func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+	}()
+
+	key := "summarised"
+	hashedKey := crypto.HashKey(key)
+	assert.Nil(t, s2.Store(key, bytes.NewReader([]byte("held by s2"))))
+	// the update reaches s3 incrementally
+	assert.Eventually(t, func() bool {
+		return s3.Holdings.MayHold(":4983", s2.ID, hashedKey)
+	}, time.Second, 20*time.Millisecond)
+	assert.False(t, s3.Holdings.MayHold(":3983", s2.ID, hashedKey))
+	assert.Equal(t, ":4983", s3.candidateNodes(s3.ID, hashedKey)[0])
+
+	r, err := s3.Get(key)
+	if assert.Nil(t, err) {
+		b, _ := io.ReadAll(r)
+		assert.Equal(t, "held by s2", string(b))
+	}
+	// the fetched copy reaches the filters too
+	assert.Eventually(t, func() bool {
+		return s1.Holdings.MayHold(":5983", s2.ID, hashedKey)
+	}, time.Second, 20*time.Millisecond)
+
+	// no filter matching, the nodes are asked at once
+	holder, ok := s1.anyHolder([]string{":4983", ":5983"}, s2.ID, hashedKey)
+	assert.True(t, ok)
+	assert.Contains(t, []string{":4983", ":5983"}, holder)
+	_, ok = s1.anyHolder([]string{":4983", ":5983"}, s2.ID, crypto.HashKey("nowhere"))
+	assert.False(t, ok)
+
+	// a missed update drops the filter until the full one comes back
+	s3.Holdings.mu.Lock()
+	generation := s3.Holdings.remote[":3983"].generation
+	s3.Holdings.mu.Unlock()
+	s3.peerLock.Lock()
+	var from string
+	for addr, peer := range s3.peers {
+		if peer == s3.nodes[":3983"] {
+			from = addr
+		}
+	}
+	s3.peerLock.Unlock()
+	assert.Nil(t, s3.handleMessageHoldings(from, MessageHoldings{Node: ":3983", Generation: generation, Seq: 100, Delta: map[int]uint64{0: 1}}))
+	assert.True(t, s3.Holdings.MayHold(":3983", s2.ID, hashedKey))
+	assert.Eventually(t, func() bool {
+		return !s3.Holdings.MayHold(":3983", s2.ID, hashedKey)
+	}, time.Second, 20*time.Millisecond)
+}
+
+func TestSwarm(t *testing.T) {
+	content := make([]byte, 30*100+37)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	pieces, err := storage.HashPieces(bytes.NewReader(content), 100)
+	assert.Nil(t, err)
+	manifest := manifestOf(pieces)
+	assert.Len(t, manifest.Hashes, 31)
+	assert.True(t, manifest.valid())
+
+	all := make([]bool, 31)
+	for i := range all {
+		all[i] = true
+	}
+	rare := make([]bool, 31)
+	rare[30] = true
+	have := map[string][]bool{"a": all, "b": all, "bad": all, "rare": rare}
+
+	var mu sync.Mutex
+	var order []int
+	out := make(memPieces, len(content))
+	w := newSwarm(manifest, have, out, func(peer string, i int) ([]byte, error) {
+		off, n := manifest.pieceRange(i)
+		data := append([]byte(nil), content[off:off+n]...)
+		mu.Lock()
+		order = append(order, i)
+		mu.Unlock()
+		time.Sleep(time.Millisecond) // network
+		if peer == "bad" {
+			data[0]++ // corrupted, rejected by the hash
+		}
+		return data, nil
+	})
+	assert.Nil(t, w.run())
+	assert.Equal(t, content, []byte(out))
+	piece, ok := w.readPiece(30)
+	assert.True(t, ok)
+	assert.Equal(t, content[3000:], piece)
+	assert.Equal(t, 0, w.from["bad"])
+	assert.Equal(t, swarmPeerFailures, w.failures["bad"])
+	assert.Greater(t, w.from["a"], 0)
+	assert.Greater(t, w.from["b"], 0)
+	// rarest first: the piece held by every peer comes after the rare one
+	assert.Contains(t, order[:4], 30)
+
+	// a piece nobody holds
+	w = newSwarm(manifest, map[string][]bool{"rare": rare}, out, nil)
+	assert.ErrorIs(t, w.run(), ErrPiecesUnavailable)
+}
+
+// memPieces in memory pieceFile
+type memPieces []byte
+
+func (m memPieces) WriteAt(b []byte, off int64) (int, error) {
+	return copy(m[off:], b), nil
+}
+
+func (m memPieces) ReadAt(b []byte, off int64) (int, error) {
+	return copy(b, m[off:]), nil
+}
+
+// Test_SwarmDownload a big object comes in pieces from every replica
+func Test_SwarmDownload(t *testing.T) {
+	s1 := makeServer(":3982", "")
+	s2 := makeServer(":4982", ":3982")
+	s3 := makeServer(":5982", ":3982", ":4982")
+	s4 := makeServer(":6982", ":3982", ":4982", ":5982")
+	// s1..s3 hold the object in the namespace of s4, s4 holds nothing
+	for _, s := range []*FileServer{s1, s2, s3} {
+		s.ID = s4.ID
+		s.Placement = staticPlacement{":3982", ":4982", ":5982"}
+		s.Storage.PieceSize = 1 << 10
+	}
+	s4.Placement = staticPlacement{":6982"}
+	s4.SwarmThreshold = 16 << 10
+	servers := []*FileServer{s1, s2, s3, s4}
+	startCluster(t, servers...)
+	defer func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+	}()
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4<<10) // 64KiB
+	key := "big-object"
+	assert.Nil(t, s1.Store(key, bytes.NewReader(content)))
+	time.Sleep(300 * time.Millisecond)
+
+	found, err := s4.swarmGet(s4.ID, crypto.HashKey(key))
+	assert.Nil(t, err)
+	assert.True(t, found)
+	r, err := s4.Get(key)
+	if assert.Nil(t, err) {
+		b, _ := io.ReadAll(r)
+		assert.Equal(t, content, b)
+	}
+
+	// a holder answering another manifest is outvoted
+	assert.Nil(t, filepath.WalkDir(filepath.Join(s3.Storage.Root, s4.ID), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !strings.HasSuffix(path, ".pieces") {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var pieces storage.Pieces
+		if err := json.Unmarshal(b, &pieces); err != nil {
+			return err
+		}
+		pieces.Hashes[0] = make([]byte, len(pieces.Hashes[0]))
+		b, _ = json.Marshal(pieces)
+		return os.WriteFile(path, b, 0o644)
+	}))
+	assert.Nil(t, s4.Storage.Delete(s4.ID, crypto.HashKey(key)))
+	found, err = s4.swarmGet(s4.ID, crypto.HashKey(key))
+	assert.Nil(t, err)
+	assert.True(t, found)
+	r, err = s4.Get(key)
+	if assert.Nil(t, err) {
+		b, _ := io.ReadAll(r)
+		assert.Equal(t, content, b)
+	}
+
+	// small objects are not split
+	assert.Nil(t, s1.Store("small", bytes.NewReader([]byte("tiny"))))
+	time.Sleep(300 * time.Millisecond)
+	found, err = s4.swarmGet(s4.ID, crypto.HashKey("small"))
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
+
+// Test_ResumableTransfer 中断的传输从已校验的offset继续, get & store 两个方向
+func Test_ResumableTransfer(t *testing.T) {
+	s1 := makeServer(":3981", "")
+	s2 := makeServer(":4981", ":3981")
+	s3 := makeServer(":5981", ":3981")
+	// only s1 holds the object, s2 & s3 share its namespace
+	for _, s := range []*FileServer{s2, s3} {
+		s.ID = s1.ID
+	}
+	servers := []*FileServer{s1, s2, s3}
+	for _, s := range servers {
+		s.Placement = staticPlacement{":3981"}
+		s.Storage.Dedup = false // deduplicated objects resend the missing chunks instead
+		s.ResumeThreshold = 4 << 10
+		s.SwarmThreshold = 1 << 30
+	}
+	startCluster(t, servers...)
+	defer func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+	}()
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4<<10) // 64KiB
+	key := "resumed-object"
+	hashedKey := crypto.HashKey(key)
+	assert.Nil(t, s1.Store(key, bytes.NewReader(content)))
+	meta, err := s1.Storage.Stat(s1.ID, hashedKey)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// interrupted half way
+	half := int64(len(content) / 2)
+	interrupt := func(s *FileServer) {
+		p, err := s.Storage.OpenPartial(s.ID, hashedKey, meta.Size, meta.Checksum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = p.Write(content[:half])
+		assert.Nil(t, p.Close())
+	}
+
+	// get: s2 asks the rest from s1
+	interrupt(s2)
+	r, err := s2.Get(key)
+	if assert.Nil(t, err) {
+		b, _ := io.ReadAll(r)
+		assert.Equal(t, content, b)
+	}
+	_, ok := s2.Storage.PartialState(s2.ID, hashedKey)
+	assert.False(t, ok)
+
+	// store: s1 sends the rest to s3
+	interrupt(s3)
+	assert.Equal(t, half, s1.transferOffset(":5981", s1.ID, meta))
+	assert.Nil(t, s1.replicate(":5981", s1.ID, meta, content, true))
+	_, r, err = s3.Storage.Read(s3.ID, hashedKey)
+	if assert.Nil(t, err) {
+		b, _ := io.ReadAll(r)
+		r.(io.Closer).Close()
+		assert.Equal(t, content, b)
+	}
+	_, ok = s3.Storage.PartialState(s3.ID, hashedKey)
+	assert.False(t, ok)
+	// committed in place as a write of the origin's version
+	if got, err := s3.Storage.Stat(s3.ID, hashedKey); assert.Nil(t, err) {
+		assert.Equal(t, meta.Version, got.Version)
+		assert.Equal(t, meta.Clock, got.Clock)
+	}
+
+	// another content starts over
+	assert.Equal(t, int64(0), s1.transferOffset(":5981", s1.ID, &storage.Metadata{Key: hashedKey, Size: meta.Size, Checksum: "other"}))
+}
+
+// Test_RangedRead 读取远端对象的一段, 只传输这一段
+func Test_RangedRead(t *testing.T) {
+	s1 := makeServer(":3980", "")
+	s2 := makeServer(":4980", ":3980")
+	// s2 reads the objects of s1's owner
+	s2.ID = s1.ID
+	servers := []*FileServer{s1, s2}
+	for _, s := range servers {
+		s.Placement = staticPlacement{":3980"}
+	}
+	startCluster(t, servers...)
+	defer func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+	}()
+
+	content := make([]byte, 2*rangeChunk+1234)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	key := "ranged-object"
+	assert.Nil(t, s1.Store(key, bytes.NewReader(content)))
+
+	for _, c := range [][2]int64{{0, 100}, {12345, 777}, {rangeChunk - 10, rangeChunk + 20}, {2 * rangeChunk, 0}} {
+		for _, s := range servers {
+			r, err := s.GetRange(key, c[0], c[1])
+			if !assert.Nil(t, err) {
+				continue
+			}
+			b, _ := io.ReadAll(r)
+			end := int64(len(content))
+			if c[1] > 0 {
+				end = c[0] + c[1]
+			}
+			assert.Equal(t, content[c[0]:end], b, "range %v from %s", c, s.Transport.Addr())
+		}
+	}
+	// the range is not stored
+	assert.False(t, s2.Storage.Has(s2.ID, crypto.HashKey(key)))
+
+	_, err := s2.GetRange(key, int64(len(content))+1, 10)
+	assert.ErrorIs(t, err, storage.ErrInvalidRange)
+}
+
+// Test_MultipartUpload 分段并行上传到不同节点, 合并 / 取消 / 过期
+func Test_MultipartUpload(t *testing.T) {
+	s1 := makeServer(":3979", "")
+	s2 := makeServer(":4979", ":3979")
+	servers := []*FileServer{s1, s2}
+	startCluster(t, servers...)
+	defer func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+	}()
+
+	key := "multipart-object"
+	uploadID, err := s1.InitiateUpload(key, StoreOpts{FileName: "big.bin"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	// parts in parallel, through both nodes, out of order
+	chunks := [][]byte{[]byte("first part, "), []byte("second part, "), []byte("third part")}
+	parts := make([]UploadedPart, len(chunks))
+	var wg sync.WaitGroup
+	for i := len(chunks) - 1; i >= 0; i-- {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			part, err := servers[i%2].UploadPart(uploadID, i+1, bytes.NewReader(chunks[i]))
+			assert.Nil(t, err)
+			parts[i] = part
+		}(i)
+	}
+	wg.Wait()
+	// unordered list refused
+	_, err = s2.CompleteUpload(uploadID, []UploadedPart{parts[1], parts[0]})
+	assert.NotNil(t, err)
+	_, err = s2.CompleteUpload(uploadID, parts)
+	assert.Nil(t, err)
+	time.Sleep(300 * time.Millisecond)
+
+	r, err := s1.Get(key)
+	if assert.Nil(t, err) {
+		b, _ := io.ReadAll(r)
+		assert.Equal(t, "first part, second part, third part", string(b))
+	}
+	meta, err := s1.Stat(key)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "big.bin", meta.FileName)
+	}
+	// the upload was staged on the initiator only, out of the index
+	for _, s := range servers {
+		uploads, err := s.Storage.Uploads()
+		assert.Nil(t, err)
+		assert.Empty(t, uploads)
+		res, err := s.Storage.Query(s1.ID, "", storage.QueryOpts{})
+		if assert.Nil(t, err) {
+			for _, meta := range res.Items {
+				assert.Equal(t, crypto.HashKey(key), meta.Key)
+			}
+		}
+	}
+	assert.False(t, s2.Storage.Has(s2.ID, crypto.HashKey(key)))
+	// the spooled content is dropped once every replica has it
+	assert.Eventually(t, func() bool {
+		entries, _ := os.ReadDir(filepath.Join(s2.Storage.Root, "_spool"))
+		return len(entries) == 0
+	}, time.Second, 10*time.Millisecond)
+	_, err = s1.UploadPart(uploadID, 4, bytes.NewReader([]byte("late")))
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+
+	// abort drops the parts, through any node
+	uploadID, err = s2.InitiateUpload("aborted-object", StoreOpts{})
+	assert.Nil(t, err)
+	_, err = s1.UploadPart(uploadID, 1, bytes.NewReader([]byte("dropped")))
+	assert.Nil(t, err)
+	uploads, _ := s2.Storage.Uploads()
+	assert.Len(t, uploads, 1)
+	assert.Nil(t, s1.AbortUpload(uploadID))
+	uploads, _ = s2.Storage.Uploads()
+	assert.Empty(t, uploads)
+	_, err = s1.CompleteUpload(uploadID, []UploadedPart{{Number: 1}})
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+
+	// uploads never completed expire
+	uploadID, err = s1.InitiateUpload("expired-object", StoreOpts{})
+	assert.Nil(t, err)
+	_, err = s2.UploadPart(uploadID, 1, bytes.NewReader([]byte("expired")))
+	assert.Nil(t, err)
+	s1.expireUploads(time.Now())
+	uploads, _ = s1.Storage.Uploads()
+	assert.Len(t, uploads, 1)
+	s1.expireUploads(time.Now().Add(DefaultUploadTTL + time.Minute))
+	uploads, _ = s1.Storage.Uploads()
+	assert.Empty(t, uploads)
+	_, err = s2.UploadPart(uploadID, 2, bytes.NewReader([]byte("late")))
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+}
+
+// Test_Dedup 分块去重存储, 副本只接收缺少的块
+func Test_Dedup(t *testing.T) {
+	s1 := makeServer(":3978", "")
+	s2 := makeServer(":4978", ":3978")
+	servers := []*FileServer{s1, s2}
+	for _, s := range servers {
+		s.Storage.Dedup = true
+		s.Placement = staticPlacement{":3978", ":4978"}
+	}
+	startCluster(t, servers...)
+	defer func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+	}()
+
+	content := make([]byte, 512<<10)
+	for i := range content {
+		content[i] = byte(i*131 + i/251)
+	}
+	for i := 0; i < len(content); i += 1000 {
+		copy(content[i:], fmt.Sprintf("line %d", i))
+	}
+	_, err := s1.StoreWithOpts("original", bytes.NewReader(content), StoreOpts{Consistency: ConsistencyAll})
+	assert.Nil(t, err)
+	sent := s1.Metrics.Get(MetricChunksSent)
+	chunks, _, _ := s2.Storage.ChunkUsage()
+	assert.Equal(t, int64(chunks), sent)
+	assert.Zero(t, s1.Metrics.Get(MetricChunksSkipped))
+
+	// a small edit sends the chunks around it only
+	edited := append([]byte("edited "), content...)
+	_, err = s1.StoreWithOpts("edited", bytes.NewReader(edited), StoreOpts{Consistency: ConsistencyAll})
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, s1.Metrics.Get(MetricChunksSent)-sent, int64(3))
+	assert.Greater(t, s1.Metrics.Get(MetricChunksSkipped), int64(chunks-3))
+	n, _, _ := s2.Storage.ChunkUsage()
+	assert.LessOrEqual(t, n, chunks+3)
+
+	_, r, err := s2.Storage.Read(s1.ID, crypto.HashKey("edited"))
+	if assert.Nil(t, err) {
+		b, _ := io.ReadAll(r)
+		r.(io.Closer).Close()
+		assert.Equal(t, edited, b)
+	}
+}
+
+// Test_CID 内容寻址, 与key无关的CID, 逐块校验不可信节点返回的数据
+func Test_CID(t *testing.T) {
+	s1 := makeServer(":3977", "")
+	s2 := makeServer(":4977", ":3977")
+	s3 := makeServer(":5977", ":3977", ":4977")
+	servers := []*FileServer{s1, s2, s3}
+	for _, s := range servers {
+		s.Placement = staticPlacement{":3977"}
+	}
+	startCluster(t, servers...)
+	defer func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+	}()
+
+	content := make([]byte, 300<<10)
+	for i := range content {
+		content[i] = byte(i*17 + i/509)
+	}
+	res, err := s1.StoreWithOpts("by-key", bytes.NewReader(content), StoreOpts{})
+	if !assert.Nil(t, err) {
+		return
+	}
+	cid := res.CID
+	assert.True(t, strings.HasPrefix(cid, "dag:"))
+	// the key points to the CID, the same content has the same CID
+	meta, err := s1.Stat("by-key")
+	if assert.Nil(t, err) {
+		assert.Equal(t, cid, meta.CID)
+	}
+	// stored once, the second key points to the same chunks
+	chunks, size, _ := s1.Storage.ChunkUsage()
+	again, err := s1.StoreWithOpts("other-key", bytes.NewReader(content), StoreOpts{})
+	if assert.Nil(t, err) {
+		assert.Equal(t, cid, again.CID)
+	}
+	againChunks, againSize, _ := s1.Storage.ChunkUsage()
+	assert.Equal(t, chunks, againChunks)
+	assert.Equal(t, size, againSize)
+
+	// fetched & verified block by block, from a node holding no key
+	r, err := s3.GetByCID(cid)
+	if assert.Nil(t, err) {
+		b, _ := io.ReadAll(r)
+		assert.Equal(t, content, b)
+	}
+
+	// a node serving a tampered root is skipped
+	root := dag.CID(cid)
+	tampered := filepath.Join(s2.Storage.Root, "_blocks", root.Hash()[:2], root.Hash())
+	assert.Nil(t, os.MkdirAll(filepath.Dir(tampered), os.ModePerm))
+	assert.Nil(t, os.WriteFile(tampered, []byte(`{"Links":[]}`), 0o644))
+	f := &cidFetch{s: s3, root: root, nodes: []string{":4977", ":3977"}}
+	var buf bytes.Buffer
+	assert.Nil(t, f.walk(root, 0, 0, &buf))
+	assert.Equal(t, content, buf.Bytes())
+
+	_, err = s3.GetByCID(dag.NewCID(dag.CodecRaw, []byte("unknown")).String())
+	assert.ErrorIs(t, err, storage.ErrBlockNotFound)
+	_, err = s3.GetByCID("not-a-cid")
+	assert.NotNil(t, err)
+
+	// the local copy is verified too, a damaged chunk is never served
+	m, err := s1.Storage.Manifest(s1.ID, crypto.HashKey("by-key"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	chunk := filepath.Join(s1.Storage.Root, "_chunks", m[0].Hash[:2], m[0].Hash)
+	assert.Nil(t, os.Chmod(chunk, 0o644))
+	damaged, _ := os.ReadFile(chunk)
+	damaged[0] ^= 0xff
+	assert.Nil(t, os.WriteFile(chunk, damaged, 0o644))
+	r, err = s1.GetByCID(cid)
+	if assert.Nil(t, err) {
+		b, err := io.ReadAll(r)
+		assert.ErrorIs(t, err, storage.ErrBlockNotFound)
+		assert.NotEqual(t, content, b)
+	}
+}
+
+// Test_Names 签名的可变名字记录, gossip传播, 选择最高的有效序号
+func Test_Names(t *testing.T) {
+	s1 := makeServer(":3976", "")
+	s2 := makeServer(":4976", ":3976")
+	s3 := makeServer(":5976", ":4976")
+	servers := []*FileServer{s1, s2, s3}
+	startCluster(t, servers...)
+	defer func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+	}()
+
+	owner := s1.NamePublicKey()
+	v1, err := s1.StoreWithOpts("site-v1", bytes.NewReader([]byte("first version")), StoreOpts{})
+	assert.Nil(t, err)
+	rec, err := s1.PublishName("site", v1.CID)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, uint64(1), rec.Seq)
+	time.Sleep(300 * time.Millisecond)
+	r, err := s3.GetByName(owner, "site")
+	if assert.Nil(t, err) {
+		b, _ := io.ReadAll(r)
+		assert.Equal(t, "first version", string(b))
+	}
+
+	// updated, the higher sequence wins everywhere
+	v2, err := s1.StoreWithOpts("site-v2", bytes.NewReader([]byte("second version")), StoreOpts{})
+	assert.Nil(t, err)
+	rec, err = s1.PublishName("site", v2.CID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), rec.Seq)
+	time.Sleep(300 * time.Millisecond)
+	for _, s := range servers {
+		got, err := s.Names.Get(owner, "site")
+		if assert.Nil(t, err) {
+			assert.Equal(t, v2.CID, got.Target)
+		}
+	}
+
+	// forged updates are dropped
+	forged := *rec
+	forged.Seq, forged.Target = 3, v1.CID
+	other := naming.Record{Name: "site", Target: v1.CID, Seq: 4, Expires: rec.Expires}
+	other.Sign(s2.NameKey)
+	other.Owner = owner
+	assert.Nil(t, s2.broadcast(&Message{Payload: MessageNameRecords{Records: []*naming.Record{&forged, &other}}}))
+	time.Sleep(300 * time.Millisecond)
+	got, err := s3.ResolveName(owner, "site")
+	if assert.Nil(t, err) {
+		assert.Equal(t, uint64(2), got.Seq)
+		assert.Equal(t, v2.CID, got.Target)
+	}
+
+	// a node missing the gossip resolves from the others
+	s3.Names, _ = naming.NewRegistry("")
+	got, err = s3.ResolveName(owner, "site")
+	if assert.Nil(t, err) {
+		assert.Equal(t, uint64(2), got.Seq)
+	}
+	_, err = s3.ResolveName(owner, "unknown")
+	assert.ErrorIs(t, err, naming.ErrNotFound)
+}
+
+// Test_Erasure 纠删码, k+m个分片分布在不同节点, 任意k个即可重建, 丢失的分片可修复
+func Test_Erasure(t *testing.T) {
+	s1 := makeServer(":3975", "")
+	s2 := makeServer(":4975", ":3975")
+	s3 := makeServer(":5975", ":3975", ":4975")
+	s4 := makeServer(":6975", ":3975", ":4975", ":5975")
+	servers := []*FileServer{s1, s2, s3, s4}
+	for _, s := range servers {
+		s.Placement = staticPlacement{":3975", ":4975", ":5975", ":6975"}
+	}
+	// a node whose ring has changed since the object was written
+	s5 := makeServer(":7975", ":3975")
+	s5.Placement = staticPlacement{":6975", ":5975", ":4975", ":3975"}
+	startCluster(t, append(servers, s5)...)
+	defer func() {
+		for _, s := range append(servers, s5) {
+			s.Stop()
+		}
+	}()
+	assert.Nil(t, s1.SetErasure(2, 2))
+
+	// shards of several coding columns & ranged reads
+	content := make([]byte, 3<<20+7)
+	for i := range content {
+		content[i] = byte(i*29 + i/311)
+	}
+	key := "coded"
+	hashedKey := crypto.HashKey(key)
+	res, err := s1.StoreWithOpts(key, bytes.NewReader(content), StoreOpts{Consistency: ConsistencyAll})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Len(t, res.Acked, 4)
+	// one shard per node, a quarter of a full replica each
+	for i, s := range servers {
+		meta, err := s.Storage.Stat(s1.ID, shardKey(hashedKey, i))
+		if assert.Nil(t, err) {
+			assert.Equal(t, int64(len(content)+1)/2, meta.Size)
+			assert.Equal(t, ":3975,:4975,:5975,:6975", meta.Tags[tagShardNodes])
+		}
+		assert.False(t, s.Storage.Has(s1.ID, hashedKey))
+	}
+	// found on the nodes recorded in the shards, not where the ring puts them now
+	st, found, err := s5.locateStripe(s1.ID, hashedKey, 2, 2)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{":3975", ":4975", ":5975", ":6975"}, st.nodes)
+		assert.Equal(t, st.nodes, found.holders)
+	}
+
+	read := func() ([]byte, error) {
+		r, err := s1.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	}
+	b, err := read()
+	assert.Nil(t, err)
+	assert.Equal(t, content, b)
+
+	// any two shards rebuild it, a data shard & a parity shard lost here
+	assert.Nil(t, s2.Storage.Delete(s1.ID, shardKey(hashedKey, 1)))
+	assert.Nil(t, s4.Storage.Delete(s1.ID, shardKey(hashedKey, 3)))
+	b, err = read()
+	assert.Nil(t, err)
+	assert.Equal(t, content, b)
+
+	// repair regenerates the lost ones on their nodes
+	time.Sleep(time.Millisecond * 500)
+	n, err := s1.RepairErasure(key)
+	assert.Nil(t, err)
+	assert.Zero(t, n, "repaired by the read already")
+	assert.True(t, s2.Storage.Has(s1.ID, shardKey(hashedKey, 1)))
+	assert.True(t, s4.Storage.Has(s1.ID, shardKey(hashedKey, 3)))
+
+	assert.Nil(t, s3.Storage.Delete(s1.ID, shardKey(hashedKey, 2)))
+	n, err = s1.RepairErasure(key)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	// three lost shards are too many
+	for _, i := range []int{0, 1, 2} {
+		assert.Nil(t, servers[i].Storage.Delete(s1.ID, shardKey(hashedKey, i)))
+	}
+	_, err = read()
+	assert.ErrorIs(t, err, erasure.ErrTooFewShards)
+
+	// distinct nodes for every shard
+	assert.Nil(t, s1.SetErasure(3, 2))
+	err = s1.Store("wide", bytes.NewReader(content))
+	assert.ErrorIs(t, err, ErrNotEnoughNodes)
+}
+
+// Test_Delta 更新已有副本时只发送变化的字节 (rsync)
+func Test_Delta(t *testing.T) {
+	s1 := makeServer(":3974", "")
+	s2 := makeServer(":4974", ":3974")
+	servers := []*FileServer{s1, s2}
+	for _, s := range servers {
+		s.Placement = staticPlacement{":3974", ":4974"}
+		s.Storage.Dedup = false // deduplicated objects send the missing chunks instead
+	}
+	startCluster(t, servers...)
+	defer func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+	}()
+
+	content := make([]byte, 512<<10)
+	for i := range content {
+		content[i] = byte(i*37 + i/263)
+	}
+	key := "large"
+	later := &storage.Metadata{Key: crypto.HashKey(key), Version: s1.Clock.Now() + 1<<40, Checksum: "later"}
+	// no copy on the replica yet, its copy is not signed & it is sent whole
+	assert.False(t, s1.holdsEarlier(":4974", s1.ID, later))
+	_, err := s1.StoreWithOpts(key, bytes.NewReader(content), StoreOpts{Consistency: ConsistencyAll})
+	assert.Nil(t, err)
+	assert.Zero(t, s1.Metrics.Get(MetricDeltaMatchedBytes))
+	assert.True(t, s1.holdsEarlier(":4974", s1.ID, later))
+
+	edited := append([]byte(nil), content[:200<<10]...)
+	edited = append(edited, "a few changed bytes"...)
+	edited = append(edited, content[200<<10+5:]...)
+	_, err = s1.StoreWithOpts(key, bytes.NewReader(edited), StoreOpts{Consistency: ConsistencyAll})
+	assert.Nil(t, err)
+	assert.Less(t, s1.Metrics.Get(MetricDeltaLiteralBytes), int64(4<<10))
+	assert.Greater(t, s1.Metrics.Get(MetricDeltaMatchedBytes), int64(500<<10))
+
+	_, r, err := s2.Storage.Read(s1.ID, crypto.HashKey(key))
+	if assert.Nil(t, err) {
+		b, _ := io.ReadAll(r)
+		r.(io.Closer).Close()
+		assert.Equal(t, edited, b)
+	}
+}
+
+// sharedKey the AES key shared by all test servers
+var sharedKey = crypto.NewAesKey()
+
+// startCluster start the servers in order, then wait until every server &
+// each of its bootstrap nodes said hello to each other
+func startCluster(t *testing.T, servers ...*FileServer) {
+	t.Helper()
+	byAddr := make(map[string]*FileServer)
+	for _, s := range servers {
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		byAddr[s.Transport.Addr()] = s
+	}
+	for _, s := range servers {
+		for _, addr := range s.BootstrapNodes {
+			seed, ok := byAddr[addr]
+			if !ok {
+				continue
+			}
+			assert.Eventually(t, func() bool {
+				_, dialed := s.nodePeer(addr)
+				_, accepted := seed.nodePeer(s.Transport.Addr())
+				return dialed && accepted
+			}, 2*time.Second, 10*time.Millisecond, "%s not connected to %s", s.Transport.Addr(), addr)
+		}
+	}
+}
+
 // makeServer extract the server opts
 func makeServer(listenAddr string, nodes ...string) *FileServer {
 	// 1. tcp options
@@ -59,8 +1759,10 @@ func makeServer(listenAddr string, nodes ...string) *FileServer {
 		Decoder:       p2p.DefaultDecoder{},
 	}
 	transport := p2p.NewTCPTransport(tcpOpts)
-	// 2. file server options
+	// 2. file server options, start from an empty storage
+	_ = os.RemoveAll(listenAddr + "_network")
 	fileServerOpts := FileServerOpts{
+		EncKey:            sharedKey,
 		StorageRoot:       listenAddr + "_network",
 		PathTransformFunc: storage.CASPathTransformFunc,
 		Transport:         transport,
@@ -69,5 +1771,6 @@ func makeServer(listenAddr string, nodes ...string) *FileServer {
 	// 3. construct server
 	s := NewFileServer(fileServerOpts)
 	transport.OnPeer = s.OnPeer
+	transport.OnPeerClose = s.OnPeerClose
 	return s
 }
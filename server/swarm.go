@@ -0,0 +1,514 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/crypto"
+	"github.com/roylic/go-distributed-file-storage/storage"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+)
+
+const (
+	DefaultSwarmThreshold = 4 << 20 // objects from this size are downloaded in pieces
+	swarmPeerFailures     = 3       // a peer failing this many pieces is dropped
+)
+
+// ErrPiecesUnavailable no peer left holds some of the pieces
+var ErrPiecesUnavailable = errors.New("pieces unavailable")
+
+// PieceManifest hashes of the fixed size pieces of an object, recorded by
+// the holders when the object was written
+type PieceManifest struct {
+	Size      int64
+	PieceSize int64
+	Hashes    [][]byte // sha256 of each piece
+}
+
+func manifestOf(p storage.Pieces) PieceManifest {
+	return PieceManifest{Size: p.Size, PieceSize: p.PieceSize, Hashes: p.Hashes}
+}
+
+// valid the hashes cover the size, piece by piece
+func (m PieceManifest) valid() bool {
+	if m.Size <= 0 || m.PieceSize <= 0 || int64(len(m.Hashes)) != (m.Size+m.PieceSize-1)/m.PieceSize {
+		return false
+	}
+	for _, sum := range m.Hashes {
+		if len(sum) != sha256.Size {
+			return false
+		}
+	}
+	return true
+}
+
+// digest the holders of the same content with the same piece size answer
+// the same manifest
+func (m PieceManifest) digest() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d %d\n", m.Size, m.PieceSize)
+	for _, sum := range m.Hashes {
+		h.Write(sum)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// pieceRange offset & length of the piece
+func (m PieceManifest) pieceRange(i int) (int64, int64) {
+	off := int64(i) * m.PieceSize
+	return off, min(m.PieceSize, m.Size-off)
+}
+
+// verify the piece against its hash
+func (m PieceManifest) verify(i int, data []byte) bool {
+	if _, n := m.pieceRange(i); int64(len(data)) != n {
+		return false
+	}
+	sum := sha256.Sum256(data)
+	return bytes.Equal(sum[:], m.Hashes[i])
+}
+
+// pieceFile the verified pieces are written at their offsets, and read
+// back for the peers asking them during the download
+type pieceFile interface {
+	io.WriterAt
+	io.ReaderAt
+}
+
+// swarm download of the pieces from several peers in parallel: every peer
+// gets the rarest piece it holds not requested yet, and once nothing new
+// is left the pieces still in flight are requested again (endgame)
+type swarm struct {
+	manifest PieceManifest
+	version  int64 // of the content downloaded
+	checksum string
+	out      pieceFile
+	fetch    func(peer string, index int) ([]byte, error)
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	have     map[string][]bool // peer -> pieces held
+	got      []bool            // pieces verified & written
+	writing  []bool            // pieces claimed by the worker writing them
+	done     int
+	inflight map[int]map[string]bool // piece -> peers asked
+	failures map[string]int
+	from     map[string]int // pieces received per peer
+	err      error
+}
+
+func newSwarm(manifest PieceManifest, have map[string][]bool, out pieceFile, fetch func(peer string, index int) ([]byte, error)) *swarm {
+	w := &swarm{
+		manifest: manifest,
+		out:      out,
+		fetch:    fetch,
+		have:     have,
+		got:      make([]bool, len(manifest.Hashes)),
+		writing:  make([]bool, len(manifest.Hashes)),
+		inflight: make(map[int]map[string]bool),
+		failures: make(map[string]int),
+		from:     make(map[string]int),
+	}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// live the peer was not dropped
+func (w *swarm) live(peer string) bool {
+	return w.failures[peer] < swarmPeerFailures
+}
+
+// next piece for the peer, -1 when none, called with the lock
+func (w *swarm) next(peer string) int {
+	best, bestAvail := -1, 0
+	for i, held := range w.have[peer] {
+		if !held || w.got[i] || len(w.inflight[i]) > 0 {
+			continue
+		}
+		avail := 0
+		for p, have := range w.have {
+			if w.live(p) && have[i] {
+				avail++
+			}
+		}
+		// rarest first, ties broken randomly so peers spread
+		if best < 0 || avail < bestAvail || (avail == bestAvail && rand.Intn(2) == 0) {
+			best, bestAvail = i, avail
+		}
+	}
+	if best < 0 {
+		// endgame, help with the pieces requested from the others
+		for i, held := range w.have[peer] {
+			if held && !w.got[i] && !w.inflight[i][peer] {
+				best = i
+				break
+			}
+		}
+	}
+	if best >= 0 {
+		if w.inflight[best] == nil {
+			w.inflight[best] = make(map[string]bool)
+		}
+		w.inflight[best][peer] = true
+	}
+	return best
+}
+
+// unavailable a missing piece no live peer holds, called with the lock
+func (w *swarm) unavailable() bool {
+	for i, got := range w.got {
+		if got {
+			continue
+		}
+		held := false
+		for p, have := range w.have {
+			if w.live(p) && have[i] {
+				held = true
+				break
+			}
+		}
+		if !held {
+			return true
+		}
+	}
+	return false
+}
+
+// worker download pieces from the peer until the swarm is over
+func (w *swarm) worker(peer string) {
+	for {
+		w.mu.Lock()
+		i := -1
+		for {
+			if w.err != nil || w.done == len(w.got) || !w.live(peer) {
+				w.mu.Unlock()
+				return
+			}
+			if i = w.next(peer); i >= 0 {
+				break
+			}
+			w.cond.Wait()
+		}
+		w.mu.Unlock()
+
+		data, err := w.fetch(peer, i)
+		if err == nil && !w.manifest.verify(i, data) {
+			err = fmt.Errorf("piece %d from %s does not match its hash", i, peer)
+		}
+		// the endgame may get the piece twice, only the first one is written
+		w.mu.Lock()
+		commit := err == nil && !w.writing[i]
+		if commit {
+			w.writing[i] = true
+		}
+		w.mu.Unlock()
+		var writeErr error
+		if commit {
+			off, _ := w.manifest.pieceRange(i)
+			_, writeErr = w.out.WriteAt(data, off)
+		}
+
+		w.mu.Lock()
+		delete(w.inflight[i], peer)
+		switch {
+		case err != nil:
+			log.Printf("swarm: %s\n", err)
+			w.failures[peer]++
+			if w.unavailable() {
+				w.err = ErrPiecesUnavailable
+			}
+		case writeErr != nil:
+			w.err = writeErr
+		case commit:
+			w.got[i] = true
+			w.done++
+			w.from[peer]++
+		}
+		w.cond.Broadcast()
+		w.mu.Unlock()
+	}
+}
+
+// run download every piece into the file
+func (w *swarm) run() error {
+	w.mu.Lock()
+	if w.unavailable() {
+		w.mu.Unlock()
+		return ErrPiecesUnavailable
+	}
+	w.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for peer := range w.have {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			w.worker(peer)
+		}(peer)
+	}
+	wg.Wait()
+
+	if w.err != nil {
+		return w.err
+	}
+	if w.done != len(w.got) {
+		return ErrPiecesUnavailable
+	}
+	return nil
+}
+
+// readPiece a piece already downloaded
+func (w *swarm) readPiece(i int) ([]byte, bool) {
+	w.mu.Lock()
+	got := i >= 0 && i < len(w.got) && w.got[i]
+	w.mu.Unlock()
+	if !got {
+		return nil, false
+	}
+	off, n := w.manifest.pieceRange(i)
+	data := make([]byte, n)
+	if _, err := w.out.ReadAt(data, off); err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// swarmGet download a big object in pieces from every holder, false when
+// the object is small or not found, Get falls back to a single holder
+func (s *FileServer) swarmGet(id string, hashedKey string) (bool, error) {
+	threshold := s.SwarmThreshold
+	if threshold <= 0 {
+		threshold = DefaultSwarmThreshold
+	}
+
+	// the manifests & the pieces held by every candidate
+	type answer struct {
+		node string
+		resp MessagePieceManifestResponse
+	}
+	var nodes []string
+	for _, node := range s.candidateNodes(id, hashedKey) {
+		if _, ok := s.nodePeer(node); ok {
+			nodes = append(nodes, node)
+		}
+	}
+	answers := make(chan answer, len(nodes))
+	for _, node := range nodes {
+		go func(node string) {
+			resp, err := s.request(node, func(reqID string) any {
+				return MessagePieceManifest{RequestID: reqID, ID: id, Key: hashedKey, MinSize: threshold}
+			})
+			if err != nil {
+				answers <- answer{node: node}
+				return
+			}
+			answers <- answer{node: node, resp: resp.(MessagePieceManifestResponse)}
+		}(node)
+	}
+	var (
+		newest SyncEntry
+		meta   storage.Metadata // of a copy holding the newest content
+		holder []answer
+	)
+	for range nodes {
+		a := <-answers
+		if !a.resp.Has {
+			continue
+		}
+		e := SyncEntry{Version: a.resp.Version, Checksum: a.resp.Checksum}
+		if len(holder) == 0 || e.newerThan(newest) {
+			newest = e
+			meta = storage.Metadata{}
+		}
+		if a.resp.Meta != nil && a.resp.Checksum == newest.Checksum && meta.Version == 0 {
+			meta = *a.resp.Meta
+		}
+		holder = append(holder, a)
+	}
+	if len(holder) == 0 {
+		return false, nil
+	}
+
+	// only the peers holding the newest content take part, with the
+	// manifest answered by most of them
+	digests := make(map[string]string) // node -> digest of its manifest
+	votes := make(map[string]int)
+	var best string
+	for _, a := range holder {
+		m := a.resp.Manifest
+		if a.resp.Checksum != newest.Checksum || m.Size < threshold || !m.valid() || len(a.resp.Have) != len(m.Hashes) ||
+			(a.resp.Meta != nil && a.resp.Meta.Size != m.Size) {
+			continue
+		}
+		d := m.digest()
+		digests[a.node] = d
+		votes[d]++
+		if len(best) == 0 || votes[d] > votes[best] || (votes[d] == votes[best] && d < best) {
+			best = d
+		}
+	}
+	if len(best) == 0 {
+		return false, nil
+	}
+	have := make(map[string][]bool)
+	var manifest PieceManifest
+	for _, a := range holder {
+		if d, ok := digests[a.node]; ok && d == best {
+			manifest = a.resp.Manifest
+			have[a.node] = a.resp.Have
+		}
+	}
+	pieceSize := manifest.PieceSize
+
+	// the pieces go straight to disk, verified as a whole on commit
+	p, err := s.Storage.OpenPartial(id, hashedKey, manifest.Size, newest.Checksum)
+	if err != nil {
+		return false, err
+	}
+	w := newSwarm(manifest, have, p, func(peer string, index int) ([]byte, error) {
+		return s.getPiece(peer, id, hashedKey, pieceSize, index)
+	})
+	w.version, w.checksum = newest.Version, newest.Checksum
+	skey := holdingKey(id, hashedKey)
+	s.swarmLock.Lock()
+	s.swarms[skey] = w
+	s.swarmLock.Unlock()
+	defer func() {
+		s.swarmLock.Lock()
+		delete(s.swarms, skey)
+		s.swarmLock.Unlock()
+	}()
+
+	err = w.run()
+	if err == nil {
+		err = p.Rehash()
+	}
+	if err == nil {
+		err = p.Commit(meta)
+	}
+	if err != nil {
+		_ = p.Remove()
+		return false, err
+	}
+	s.Holdings.Add(id, hashedKey)
+	log.Printf("[%s] downloaded (%s) in %d pieces from %v\n", s.Transport.Addr(), hashedKey, len(w.got), w.from)
+	return true, nil
+}
+
+// getPiece download & decrypt a single piece
+func (s *FileServer) getPiece(node string, id string, hashedKey string, pieceSize int64, index int) ([]byte, error) {
+	resp, err := s.request(node, func(reqID string) any {
+		return MessageGetPiece{RequestID: reqID, ID: id, Key: hashedKey, PieceSize: pieceSize, Index: index}
+	})
+	if err != nil {
+		return nil, err
+	}
+	piece := resp.(MessageGetPieceResponse)
+	if len(piece.Err) > 0 {
+		return nil, errors.New(piece.Err)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := crypto.CopyDecrypt(s.EncKey, bytes.NewReader(piece.Data), buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// downloading the swarm in progress for the object, its pieces are served too
+func (s *FileServer) downloading(id string, hashedKey string) (*swarm, bool) {
+	s.swarmLock.Lock()
+	defer s.swarmLock.Unlock()
+	w, ok := s.swarms[holdingKey(id, hashedKey)]
+	return w, ok
+}
+
+// handleMessagePieceManifest answer off the loop
+func (s *FileServer) handleMessagePieceManifest(from string, msg MessagePieceManifest) error {
+	go func() {
+		if err := s.reply(from, &Message{Payload: s.pieceManifest(msg)}); err != nil {
+			log.Printf("[%s] reply manifest of (%s) failed: %s\n", s.Transport.Addr(), msg.Key, err)
+		}
+	}()
+	return nil
+}
+
+// pieceManifest the manifest recorded with the local copy, or the pieces
+// already downloaded. A copy without manifest is not served in pieces
+func (s *FileServer) pieceManifest(msg MessagePieceManifest) MessagePieceManifestResponse {
+	resp := MessagePieceManifestResponse{RequestID: msg.RequestID}
+	if s.Storage.Has(msg.ID, msg.Key) {
+		meta, err := s.Storage.Stat(msg.ID, msg.Key)
+		if err != nil {
+			log.Printf("[%s] stat (%s) failed: %s\n", s.Transport.Addr(), msg.Key, err)
+			return resp
+		}
+		resp.Has, resp.Version, resp.Checksum, resp.Meta = true, meta.Version, meta.Checksum, meta
+		if meta.Size < msg.MinSize {
+			return resp
+		}
+		pieces, err := s.Storage.Pieces(msg.ID, msg.Key)
+		if err != nil || pieces.Checksum != meta.Checksum {
+			return resp
+		}
+		resp.Manifest = manifestOf(*pieces)
+		resp.Have = make([]bool, len(resp.Manifest.Hashes))
+		for i := range resp.Have {
+			resp.Have[i] = true
+		}
+	} else if w, ok := s.downloading(msg.ID, msg.Key); ok {
+		w.mu.Lock()
+		resp.Has, resp.Version, resp.Checksum, resp.Manifest = true, w.version, w.checksum, w.manifest
+		resp.Have = append([]bool(nil), w.got...)
+		w.mu.Unlock()
+	}
+	return resp
+}
+
+// handleMessageGetPiece read the piece from the local copy or the download
+func (s *FileServer) handleMessageGetPiece(from string, msg MessageGetPiece) error {
+	resp := MessageGetPieceResponse{RequestID: msg.RequestID}
+	data, err := s.readPiece(msg)
+	if err == nil {
+		buf := new(bytes.Buffer)
+		if _, err = crypto.CopyEncrypt(s.EncKey, bytes.NewReader(data), buf); err == nil {
+			resp.Data = buf.Bytes()
+		}
+	}
+	if err != nil {
+		resp.Err = err.Error()
+	}
+	return s.reply(from, &Message{Payload: resp})
+}
+
+func (s *FileServer) readPiece(msg MessageGetPiece) ([]byte, error) {
+	if !s.Storage.Has(msg.ID, msg.Key) {
+		if w, ok := s.downloading(msg.ID, msg.Key); ok && w.manifest.PieceSize == msg.PieceSize {
+			if data, ok := w.readPiece(msg.Index); ok {
+				return data, nil
+			}
+		}
+		return nil, fmt.Errorf("[%s] piece %d of (%s) not held", s.Transport.Addr(), msg.Index, msg.Key)
+	}
+	meta, err := s.Storage.Stat(msg.ID, msg.Key)
+	if err != nil {
+		return nil, err
+	}
+	m := PieceManifest{Size: meta.Size, PieceSize: msg.PieceSize}
+	off, n := m.pieceRange(msg.Index)
+	if msg.Index < 0 || n <= 0 {
+		return nil, fmt.Errorf("piece %d out of range", msg.Index)
+	}
+	_, r, err := s.Storage.ReadRange(msg.ID, msg.Key, off, n)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data := make([]byte, n)
+	_, err = io.ReadFull(r, data)
+	return data, err
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/crypto"
+	"github.com/roylic/go-distributed-file-storage/p2p"
+	"github.com/roylic/go-distributed-file-storage/storage"
+	"io"
+	"strings"
+)
+
+// DefaultResumeThreshold transfers from this size are checkpointed on disk
+// & resumed after an interruption, smaller ones are simply sent again
+const DefaultResumeThreshold = 1 << 20
+
+// transferHeader follows the size of a get stream, the range sent
+// & the object it belongs to, then MetaSize bytes of the holder's metadata
+type transferHeader struct {
+	Offset   int64
+	Total    int64
+	Checksum [64]byte // hex sha256 of the whole object
+	MetaSize uint32
+}
+
+func (h transferHeader) checksum() string {
+	return strings.TrimRight(string(h.Checksum[:]), "\x00")
+}
+
+// writeTransferHeader send the header & the metadata following it
+func writeTransferHeader(w io.Writer, header transferHeader, meta *storage.Metadata) error {
+	var b []byte
+	if meta != nil {
+		var err error
+		if b, err = json.Marshal(meta); err != nil {
+			return err
+		}
+	}
+	header.MetaSize = uint32(len(b))
+	if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readTransferHeader read the header & the holder's metadata
+func readTransferHeader(r io.Reader) (transferHeader, storage.Metadata, error) {
+	var (
+		header transferHeader
+		meta   storage.Metadata
+	)
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return header, meta, err
+	}
+	if header.MetaSize > p2p.DefaultMaxMessageSize {
+		return header, meta, fmt.Errorf("transfer metadata: %w", p2p.ErrMessageTooLarge)
+	}
+	if header.MetaSize == 0 {
+		return header, meta, nil
+	}
+	b := make([]byte, header.MetaSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return header, meta, err
+	}
+	return header, meta, json.Unmarshal(b, &meta)
+}
+
+func (s *FileServer) resumeThreshold() int64 {
+	if s.ResumeThreshold > 0 {
+		return s.ResumeThreshold
+	}
+	return DefaultResumeThreshold
+}
+
+// receiveCopy write a fetched copy from the encrypted stream with the
+// holder's metadata, big objects go through a partial transfer continuing
+// the previous attempt
+func (s *FileServer) receiveCopy(id string, key string, header transferHeader, meta storage.Metadata, r io.Reader) (int64, error) {
+	checksum := header.checksum()
+	if header.Total < s.resumeThreshold() || len(checksum) == 0 {
+		// small, written once complete
+		buf := new(bytes.Buffer)
+		if _, err := crypto.CopyDecrypt(s.EncKey, r, buf); err != nil {
+			return 0, err
+		}
+		n, err := s.Storage.WriteCopy(id, key, buf, meta)
+		if err != nil {
+			return n, err
+		}
+		s.Holdings.Add(id, key)
+		return n, nil
+	}
+	p, err := s.receivePartial(id, key, header.Total, checksum, header.Offset, r)
+	if err != nil {
+		return 0, err
+	}
+	if err := p.Commit(meta); err != nil {
+		_ = p.Remove()
+		return 0, err
+	}
+	s.Holdings.Add(id, key)
+	return p.Size - header.Offset, nil
+}
+
+// receivePartial append the stream to the partial transfer starting at
+// offset, it is kept for the next attempt unless complete
+func (s *FileServer) receivePartial(id string, key string, size int64, checksum string, offset int64, r io.Reader) (*storage.PartialTransfer, error) {
+	p, err := s.Storage.OpenPartial(id, key, size, checksum)
+	if err != nil {
+		_, _ = io.Copy(io.Discard, r)
+		return nil, err
+	}
+	if p.Offset != offset {
+		if offset != 0 {
+			_ = p.Close()
+			_, _ = io.Copy(io.Discard, r)
+			return nil, fmt.Errorf("transfer of (%s) resumed at %d, but %d bytes were received", key, offset, p.Offset)
+		}
+		if err := p.Reset(); err != nil {
+			_ = p.Close()
+			_, _ = io.Copy(io.Discard, r)
+			return nil, err
+		}
+	}
+	if _, err := crypto.CopyDecrypt(s.EncKey, r, p); err != nil {
+		_ = p.Close()
+		_, _ = io.Copy(io.Discard, r)
+		return nil, fmt.Errorf("transfer of (%s) interrupted at %d of %d bytes: %w", key, p.Offset, p.Size, err)
+	}
+	if !p.Complete() {
+		_ = p.Close()
+		return nil, fmt.Errorf("transfer of (%s) interrupted at %d of %d bytes", key, p.Offset, p.Size)
+	}
+	return p, nil
+}
+
+// receiveStore the content of a replicated object, big objects go through
+// a partial transfer so the sender can resume it, and stay on disk
+// verified until committed
+func (s *FileServer) receiveStore(r io.Reader, msg MessageStoreFile) ([]byte, *storage.PartialTransfer, error) {
+	if msg.Meta == nil || (msg.Offset == 0 && msg.Meta.Size < s.resumeThreshold()) {
+		var buf bytes.Buffer
+		if _, err := crypto.CopyDecrypt(s.EncKey, r, &buf); err != nil {
+			return nil, nil, err
+		}
+		return buf.Bytes(), nil, nil
+	}
+	p, err := s.receivePartial(msg.ID, msg.Key, msg.Meta.Size, msg.Meta.Checksum, msg.Offset, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := p.Verify(); err != nil {
+		_ = p.Remove()
+		return nil, nil, err
+	}
+	return nil, p, nil
+}
+
+// transferOffset where the node resumes receiving the object, 0 when unknown
+func (s *FileServer) transferOffset(node string, id string, meta *storage.Metadata) int64 {
+	resp, err := s.request(node, func(reqID string) any {
+		return MessageTransferOffset{RequestID: reqID, ID: id, Key: meta.Key, Size: meta.Size, Checksum: meta.Checksum}
+	})
+	if err != nil {
+		return 0
+	}
+	offset := resp.(MessageTransferOffsetResponse).Offset
+	if offset < 0 || offset > meta.Size {
+		return 0
+	}
+	return offset
+}
+
+// handleMessageTransferOffset answer the offset of the partial transfer
+func (s *FileServer) handleMessageTransferOffset(from string, msg MessageTransferOffset) error {
+	resp := MessageTransferOffsetResponse{RequestID: msg.RequestID}
+	if p, ok := s.Storage.PartialState(msg.ID, msg.Key); ok && p.Size == msg.Size && p.Checksum == msg.Checksum {
+		resp.Offset = p.Offset
+	}
+	return s.reply(from, &Message{Payload: resp})
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/crypto"
+	"github.com/roylic/go-distributed-file-storage/storage"
+	"io"
+	"log"
+)
+
+// SetVersioning enable or disable the version history of the files owned
+// by this server, the flag travels with the metadata to the replicas
+func (s *FileServer) SetVersioning(enabled bool) error {
+	return s.Storage.SetVersioning(s.ID, enabled)
+}
+
+// getVersion read the archived version, from the local history first
+func (s *FileServer) getVersion(key string, hashedKey string, versionID string) (io.Reader, error) {
+	_, r, err := s.Storage.ReadVersion(s.ID, hashedKey, versionID)
+	if err == nil {
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		return bytes.NewReader(data), err
+	}
+	if !errors.Is(err, storage.ErrVersionNotFound) {
+		return nil, err
+	}
+
+	for _, node := range s.candidateNodes(s.ID, hashedKey) {
+		resp, err := s.request(node, func(reqID string) any {
+			return MessageGetVersion{RequestID: reqID, ID: s.ID, Key: hashedKey, VersionID: versionID}
+		})
+		if err != nil {
+			log.Printf("server[%s] get version (%s@%s) from %s failed: %s\n", s.Transport.Addr(), key, versionID, node, err)
+			continue
+		}
+		v := resp.(MessageGetVersionResponse)
+		if len(v.Err) > 0 {
+			continue
+		}
+		var data bytes.Buffer
+		if _, err := crypto.CopyDecrypt(s.EncKey, bytes.NewReader(v.Data), &data); err != nil {
+			return nil, err
+		}
+		return &data, nil
+	}
+	return nil, fmt.Errorf("server[%s] %w: (%s@%s) in the network", s.Transport.Addr(), storage.ErrVersionNotFound, key, versionID)
+}
+
+// ListVersions version history of the file, newest first, asking the
+// replicas when it is not kept locally
+func (s *FileServer) ListVersions(key string) ([]storage.ObjectVersion, error) {
+	hashedKey := crypto.HashKey(key)
+	versions, err := s.Storage.ListVersions(s.ID, hashedKey)
+	if err != nil || len(versions) > 0 {
+		return versions, err
+	}
+	for _, node := range s.Placement.Locate(hashedKey, s.ReplicationFactor) {
+		if node == s.Transport.Addr() {
+			continue
+		}
+		resp, err := s.request(node, func(reqID string) any {
+			return MessageListVersions{RequestID: reqID, ID: s.ID, Key: hashedKey}
+		})
+		if err != nil {
+			continue
+		}
+		if v := resp.(MessageListVersionsResponse); len(v.Err) == 0 && len(v.Versions) > 0 {
+			return v.Versions, nil
+		}
+	}
+	return nil, nil
+}
+
+// RestoreVersion write the archived version again as the latest one,
+// locally when held, then broadcast to the replicas
+func (s *FileServer) RestoreVersion(key string, versionID string) (*storage.Metadata, error) {
+	hashedKey := crypto.HashKey(key)
+	version := s.Clock.Now()
+	meta, err := s.Storage.RestoreVersion(s.ID, hashedKey, versionID, version)
+	if err != nil && !errors.Is(err, storage.ErrVersionNotFound) {
+		return nil, err
+	}
+	msg := Message{
+		Payload: MessageRestoreVersion{ID: s.ID, Key: hashedKey, VersionID: versionID, Version: version},
+	}
+	if err := s.broadcast(&msg); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// DeleteVersion drop the version from the history, locally & on the replicas
+func (s *FileServer) DeleteVersion(key string, versionID string) error {
+	hashedKey := crypto.HashKey(key)
+	err := s.Storage.DeleteVersion(s.ID, hashedKey, versionID)
+	if err != nil && !errors.Is(err, storage.ErrVersionNotFound) {
+		return err
+	}
+	return s.broadcast(&Message{Payload: MessageDeleteVersion{ID: s.ID, Key: hashedKey, VersionID: versionID}})
+}
+
+// handleMessageGetVersion answer the encrypted content of the version
+func (s *FileServer) handleMessageGetVersion(from string, msg MessageGetVersion) error {
+	resp := MessageGetVersionResponse{RequestID: msg.RequestID}
+	meta, r, err := s.Storage.ReadVersion(msg.ID, msg.Key, msg.VersionID)
+	if err == nil {
+		defer r.Close()
+		var data bytes.Buffer
+		if _, err = crypto.CopyEncrypt(s.EncKey, r, &data); err == nil {
+			resp.Meta, resp.Data = meta, data.Bytes()
+		}
+	}
+	if err != nil {
+		resp.Err = err.Error()
+	}
+	return s.reply(from, &Message{Payload: resp})
+}
+
+// handleMessageListVersions answer the local version history
+func (s *FileServer) handleMessageListVersions(from string, msg MessageListVersions) error {
+	resp := MessageListVersionsResponse{RequestID: msg.RequestID}
+	versions, err := s.Storage.ListVersions(msg.ID, msg.Key)
+	if err != nil {
+		resp.Err = err.Error()
+	}
+	resp.Versions = versions
+	return s.reply(from, &Message{Payload: resp})
+}
+
+// handleMessageRestoreVersion restore the version when held locally
+func (s *FileServer) handleMessageRestoreVersion(from string, msg MessageRestoreVersion) error {
+	_, err := s.Storage.RestoreVersion(msg.ID, msg.Key, msg.VersionID, msg.Version)
+	if errors.Is(err, storage.ErrVersionNotFound) {
+		return nil
+	}
+	return err
+}
+
+// handleMessageDeleteVersion drop the version when held locally
+func (s *FileServer) handleMessageDeleteVersion(from string, msg MessageDeleteVersion) error {
+	err := s.Storage.DeleteVersion(msg.ID, msg.Key, msg.VersionID)
+	if errors.Is(err, storage.ErrVersionNotFound) {
+		return nil
+	}
+	return err
+}
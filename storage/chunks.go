@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/chunker"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// chunkDir content of the deduplicated objects, once per chunk
+	// (root/_chunks/ab/hash), dropped by PurgeBlocks once no manifest
+	// lists it, so a crash never leaves a count out of step with the
+	// manifests
+	chunkDir = "_chunks"
+	// manifestSuffix a deduplicated object is a manifest of its chunks,
+	// stored instead of the object file
+	manifestSuffix = ".chunks"
+)
+
+// ErrChunkNotFound the chunk is not in the local chunk store
+var ErrChunkNotFound = errors.New("chunk not found")
+
+// ChunkRef a chunk of an object, Hash is the sha256 hex of its content
+type ChunkRef struct {
+	Hash string
+	Size int64
+}
+
+// Manifest chunks of an object in order
+type Manifest []ChunkRef
+
+// Size of the object
+func (m Manifest) Size() int64 {
+	var n int64
+	for _, c := range m {
+		n += c.Size
+	}
+	return n
+}
+
+// ChunkHash content address of the chunk
+func ChunkHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// SplitChunks cut the content like the storage does when deduplicating
+func (s *Storage) SplitChunks(data []byte) ([][]byte, Manifest) {
+	chunks := s.ChunkConfig.Split(data)
+	m := make(Manifest, len(chunks))
+	for i, c := range chunks {
+		m[i] = ChunkRef{Hash: ChunkHash(c), Size: int64(len(c))}
+	}
+	return chunks, m
+}
+
+func (s *Storage) chunkPath(hash string) string {
+	return filepath.Join(s.Root, chunkDir, hash[:2], hash)
+}
+
+func (s *Storage) manifestPath(id string, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return fmt.Sprintf("%s/%s/%s%s", s.Root, id, pathKey.FullPath(), manifestSuffix)
+}
+
+// HasChunk whether the chunk is in the local chunk store
+func (s *Storage) HasChunk(hash string) bool {
+	if len(hash) < 2 {
+		return false
+	}
+	_, err := os.Stat(s.chunkPath(hash))
+	return err == nil
+}
+
+// ReadChunk content of the chunk
+func (s *Storage) ReadChunk(hash string) ([]byte, error) {
+	if len(hash) < 2 {
+		return nil, fmt.Errorf("%w: %q", ErrChunkNotFound, hash)
+	}
+	b, err := os.ReadFile(s.chunkPath(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrChunkNotFound, hash)
+	}
+	return b, err
+}
+
+// putChunk store the chunk unless already held, a chunk reused is
+// touched, PurgeBlocks keeps it until the manifest listing it is written
+func (s *Storage) putChunk(data []byte) (ChunkRef, error) {
+	ref := ChunkRef{Hash: ChunkHash(data), Size: int64(len(data))}
+	path := s.chunkPath(ref.Hash)
+
+	s.chunkLock.Lock()
+	defer s.chunkLock.Unlock()
+	if _, err := os.Stat(path); err == nil {
+		now := time.Now()
+		return ref, os.Chtimes(path, now, now)
+	}
+	return ref, s.writeFileAtomic(path, data, 0o444)
+}
+
+// sweepChunks remove the chunks no manifest lists, last written before
+// the time, returns how many
+func (s *Storage) sweepChunks(before time.Time, live map[string]bool) (int, error) {
+	purged := 0
+	err := filepath.WalkDir(filepath.Join(s.Root, chunkDir), func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return filepath.SkipDir
+		}
+		if err != nil || d.IsDir() || live[d.Name()] {
+			return err
+		}
+		// checked again under the lock, putChunk may reuse it meanwhile
+		s.chunkLock.Lock()
+		defer s.chunkLock.Unlock()
+		info, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil || info.ModTime().After(before) {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		purged++
+		return nil
+	})
+	return purged, err
+}
+
+// writeChunked store the content as chunks & the manifest of the object,
+// replacing the previous one
+func (s *Storage) writeChunked(id string, key string, r io.Reader) (int64, error) {
+	var (
+		m   Manifest
+		c   = chunker.New(r, s.ChunkConfig)
+		err error
+	)
+	for {
+		var chunk []byte
+		chunk, err = c.Next()
+		if err != nil {
+			break
+		}
+		var ref ChunkRef
+		if ref, err = s.putChunk(chunk); err != nil {
+			break
+		}
+		m = append(m, ref)
+	}
+	if !errors.Is(err, io.EOF) {
+		return m.Size(), err
+	}
+
+	pathKey := s.PathTransformFunc(key)
+	if err := os.MkdirAll(fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName), os.ModePerm); err != nil {
+		return 0, err
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.writeFileAtomic(s.manifestPath(id, key), b, 0o644); err != nil {
+		return 0, err
+	}
+	// a plain copy written before is replaced too
+	if err := os.Remove(fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return m.Size(), err
+	}
+	return m.Size(), nil
+}
+
+// Manifest chunks of the object, empty when it is not deduplicated
+func (s *Storage) Manifest(id string, key string) (Manifest, error) {
+	b, err := os.ReadFile(s.manifestPath(id, key))
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	return m, json.Unmarshal(b, &m)
+}
+
+// dropManifest remove the manifest of the object, before it is replaced
+// by a plain file or deleted, its chunks go with the next PurgeBlocks
+func (s *Storage) dropManifest(id string, key string) error {
+	if err := os.Remove(s.manifestPath(id, key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// ChunkUsage chunks in the chunk store & their bytes on disk
+func (s *Storage) ChunkUsage() (int, int64, error) {
+	var (
+		n    int
+		size int64
+	)
+	err := filepath.WalkDir(filepath.Join(s.Root, chunkDir), func(path string, d os.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return filepath.SkipDir
+		}
+		if err != nil || d.IsDir() || filepath.Ext(path) != "" {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		n++
+		size += fi.Size()
+		return nil
+	})
+	return n, size, err
+}
+
+// chunkReader read & seek the object through its manifest, loading one
+// chunk at a time
+type chunkReader struct {
+	s       *Storage
+	m       Manifest
+	offsets []int64 // of every chunk in the object
+	size    int64
+	pos     int64
+
+	cur  int // chunk loaded, -1 for none
+	data []byte
+}
+
+func (s *Storage) newChunkReader(m Manifest) *chunkReader {
+	r := &chunkReader{s: s, m: m, offsets: make([]int64, len(m)), cur: -1}
+	for i, c := range m {
+		r.offsets[i] = r.size
+		r.size += c.Size
+	}
+	return r
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	// chunk holding pos
+	i := r.cur
+	if i < 0 || r.pos < r.offsets[i] || r.pos >= r.offsets[i]+r.m[i].Size {
+		i = sort.Search(len(r.offsets), func(j int) bool { return r.offsets[j] > r.pos }) - 1
+		data, err := r.s.ReadChunk(r.m[i].Hash)
+		if err != nil {
+			return 0, err
+		}
+		r.cur, r.data = i, data
+	}
+	n := copy(p, r.data[r.pos-r.offsets[i]:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *chunkReader) Close() error {
+	r.data = nil
+	return nil
+}
@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/dag"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// blockDir inner nodes of the DAGs (root/_blocks/ab/hash), the leaves
+	// are the content of the objects
+	blockDir = "_blocks"
+	// cidDir objects holding the content of a CID (root/_cids/codec/hash,
+	// one `id/key` per line)
+	cidDir = "_cids"
+
+	// DefaultBlockGrace blocks & CID records written since are kept by
+	// PurgeBlocks, the object linking them may not be written yet
+	DefaultBlockGrace = time.Hour
+)
+
+// ErrBlockNotFound the block is not held locally
+var ErrBlockNotFound = errors.New("block not found")
+
+func (s *Storage) blockPath(c dag.CID) string {
+	hash := c.Hash()
+	return filepath.Join(s.Root, blockDir, hash[:2], hash)
+}
+
+// PutBlock store the node of a DAG, already held blocks are left untouched
+func (s *Storage) PutBlock(c dag.CID, block []byte) error {
+	if err := c.Verify(block); err != nil {
+		return err
+	}
+	path := s.blockPath(c)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	return s.writeFileAtomic(path, block, 0o444)
+}
+
+// GetBlock a node of a DAG, or a leaf held in the chunk store
+func (s *Storage) GetBlock(c dag.CID) ([]byte, error) {
+	if _, err := dag.Parse(string(c)); err != nil {
+		return nil, err
+	}
+	if c.Codec() == dag.CodecRaw {
+		b, err := s.ReadChunk(c.Hash())
+		if errors.Is(err, ErrChunkNotFound) {
+			return nil, fmt.Errorf("%w: %s", ErrBlockNotFound, c)
+		}
+		return b, err
+	}
+	b, err := os.ReadFile(s.blockPath(c))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrBlockNotFound, c)
+	}
+	return b, err
+}
+
+func (s *Storage) cidPath(c dag.CID) string {
+	return filepath.Join(s.Root, cidDir, c.Codec(), c.Hash())
+}
+
+// AddCID record the object holds the content of the CID
+func (s *Storage) AddCID(c dag.CID, id string, key string) error {
+	if _, err := dag.Parse(string(c)); err != nil {
+		return err
+	}
+	entry := id + "/" + key
+	path := s.cidPath(c)
+	s.cidLock.Lock()
+	defer s.cidLock.Unlock()
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line == entry {
+			return nil
+		}
+	}
+	return s.writeFileAtomic(path, append(b, entry+"\n"...), 0o644)
+}
+
+// LookupCID an object currently holding the content of the CID, the
+// records of objects deleted or overwritten since are skipped
+func (s *Storage) LookupCID(c dag.CID) (string, string, bool) {
+	if _, err := dag.Parse(string(c)); err != nil {
+		return "", "", false
+	}
+	b, err := os.ReadFile(s.cidPath(c))
+	if err != nil {
+		return "", "", false
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		id, key, ok := strings.Cut(line, "/")
+		if !ok || !s.Has(id, key) {
+			continue
+		}
+		if meta, err := s.Stat(id, key); err == nil && meta.CID == string(c) {
+			return id, key, true
+		}
+	}
+	return "", "", false
+}
+
+// PurgeBlocks drop the blocks & chunks no object held links to anymore,
+// and the CID records of contents no object holds, the ones written after
+// before are kept. Returns the blocks & chunks dropped
+func (s *Storage) PurgeBlocks(before time.Time) (int, error) {
+	roots := make(map[dag.CID]bool)
+	live := make(map[dag.CID]bool)
+	chunks := make(map[string]bool)
+	err := s.Walk(func(id string, meta *Metadata) error {
+		if c, err := dag.Parse(meta.CID); err == nil {
+			roots[c] = true
+			s.markBlocks(c, live)
+		}
+		if m, err := s.Manifest(id, meta.Key); err == nil {
+			for _, ref := range m {
+				chunks[ref.Hash] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	purged, err := s.sweepChunks(before, chunks)
+	if err != nil {
+		return purged, err
+	}
+	err = s.sweepOld(filepath.Join(s.Root, blockDir), before, func(path string, name string) bool {
+		if live[dag.CID(dag.CodecDAG+":"+name)] {
+			return false
+		}
+		purged++
+		return true
+	})
+	if err != nil {
+		return purged, err
+	}
+	err = s.sweepOld(filepath.Join(s.Root, cidDir), before, func(path string, name string) bool {
+		codec := filepath.Base(filepath.Dir(path))
+		return !roots[dag.CID(codec+":"+name)]
+	})
+	return purged, err
+}
+
+// markBlocks the node & the nodes below it, the leaves are not in the
+// block store
+func (s *Storage) markBlocks(c dag.CID, live map[dag.CID]bool) {
+	if c.Codec() != dag.CodecDAG || live[c] {
+		return
+	}
+	live[c] = true
+	b, err := os.ReadFile(s.blockPath(c))
+	if err != nil {
+		return
+	}
+	n, err := dag.Decode(c, b)
+	if err != nil {
+		return
+	}
+	for _, l := range n.Links {
+		s.markBlocks(l.CID, live)
+	}
+}
+
+// sweepOld remove the files under dir last written before the time, that
+// drop selects
+func (s *Storage) sweepOld(dir string, before time.Time, drop func(path string, name string) bool) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return filepath.SkipDir
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(before) || !drop(path, d.Name()) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	})
+}
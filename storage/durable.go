@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Durability when the writes reach the disk
+type Durability string
+
+const (
+	// DurabilityAlways every write is fsynced before it becomes visible, the default
+	DurabilityAlways Durability = "always"
+	// DurabilityBatched writes become visible at once, atomically, and are
+	// fsynced together by Flush or once DefaultSyncBatch are pending
+	DurabilityBatched Durability = "batched"
+
+	DefaultSyncBatch = 128
+
+	// tmpMarker the temp files of the writes in progress, swept at startup
+	tmpMarker = ".tmp"
+	spoolDir  = "_spool"
+)
+
+// atomicFile written beside its final path, the final path holds either
+// the previous content or the whole new one
+type atomicFile struct {
+	*os.File
+	s    *Storage
+	path string
+}
+
+// createAtomic a temp file in the directory of the path, created if needed
+func (s *Storage) createAtomic(path string, perm os.FileMode) (*atomicFile, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(path)+tmpMarker+"-*")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &atomicFile{File: f, s: s, path: path}, nil
+}
+
+// Commit fsync, close & rename over the final path, then fsync the
+// directory so the rename survives a crash too
+func (f *atomicFile) Commit() error {
+	if f.s.Durability != DurabilityBatched {
+		if err := f.Sync(); err != nil {
+			f.Abort()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.s.commitRename(f.Name(), f.path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// Abort drop the temp file, the final path is untouched
+func (f *atomicFile) Abort() {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// writeFileAtomic os.WriteFile through a temp file
+func (s *Storage) writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return s.copyFileAtomic(path, bytes.NewReader(data), perm)
+}
+
+// copyFileAtomic same as writeFileAtomic, the content read from r
+func (s *Storage) copyFileAtomic(path string, r io.Reader, perm os.FileMode) error {
+	f, err := s.createAtomic(path, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Commit()
+}
+
+// WriteFileAtomic os.WriteFile through a temp file, always fsynced, for
+// the state files kept outside of a Storage
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return CopyFileAtomic(path, bytes.NewReader(data), perm)
+}
+
+// CopyFileAtomic same as WriteFileAtomic, the content read from r
+func CopyFileAtomic(path string, r io.Reader, perm os.FileMode) error {
+	s := &Storage{StorageOpt: StorageOpt{Durability: DurabilityAlways}}
+	return s.copyFileAtomic(path, r, perm)
+}
+
+// CreateSpool a temp file under the root for content on its way to the
+// replicas, swept at startup like the other temp files
+func (s *Storage) CreateSpool() (*os.File, error) {
+	dir := filepath.Join(s.Root, spoolDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(dir, "spool"+tmpMarker+"-*")
+}
+
+// commitRename move the written file in place, the source already synced
+// when always durable
+func (s *Storage) commitRename(src string, dst string) error {
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	if s.Durability == DurabilityBatched {
+		return s.markUnsynced(dst, filepath.Dir(dst))
+	}
+	return syncPath(filepath.Dir(dst))
+}
+
+// markUnsynced remember the paths for the next Flush, flushing once the batch is full
+func (s *Storage) markUnsynced(paths ...string) error {
+	s.syncLock.Lock()
+	if s.unsynced == nil {
+		s.unsynced = make(map[string]bool)
+	}
+	for _, p := range paths {
+		s.unsynced[p] = true
+	}
+	full := len(s.unsynced) >= DefaultSyncBatch
+	s.syncLock.Unlock()
+	if full {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Flush fsync the files & directories written since the last flush, a
+// no-op when always durable
+func (s *Storage) Flush() error {
+	s.syncLock.Lock()
+	paths := s.unsynced
+	s.unsynced = nil
+	s.syncLock.Unlock()
+
+	var errs []error
+	for p := range paths {
+		if err := syncPath(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// syncPath fsync the file or directory
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// sweepTemp delete the temp files left under the root by writes a crash
+// interrupted, returns how many
+func sweepTemp(root string) (int, error) {
+	n := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !isTemp(d.Name()) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// isTemp the temp files of createAtomic & the older name.tmp ones
+func isTemp(name string) bool {
+	return strings.HasSuffix(name, tmpMarker) || strings.Contains(name, tmpMarker+"-")
+}
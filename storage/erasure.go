@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// erasureDir code of the erasure coded namespaces (root/_erasure/id)
+const erasureDir = "_erasure"
+
+// SetErasure store the objects of the namespace (owner ID) as k data &
+// m parity shards instead of full replicas, k <= 0 goes back to replication
+func (s *Storage) SetErasure(id string, k, m int) error {
+	path := filepath.Join(s.Root, erasureDir, id)
+	if k <= 0 {
+		err := os.Remove(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if m < 0 || k+m > 256 {
+		return fmt.Errorf("invalid erasure code of %d data & %d parity shards", k, m)
+	}
+	return s.writeFileAtomic(path, []byte(fmt.Sprintf("%d %d", k, m)), 0o644)
+}
+
+// Erasure the code of the namespace, k is 0 when replicated
+func (s *Storage) Erasure(id string) (k, m int) {
+	b, err := os.ReadFile(filepath.Join(s.Root, erasureDir, id))
+	if err != nil {
+		return 0, 0
+	}
+	if _, err := fmt.Sscanf(string(b), "%d %d", &k, &m); err != nil {
+		return 0, 0
+	}
+	return k, m
+}
@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	indexDir     = "_index"    // 系统目录以"_"开头, 与ownerID目录区分
+	indexLogName = "index.log" // append-only log of index changes
+)
+
+// indexEntry one line of the index log
+type indexEntry struct {
+	Op   string // put / del
+	ID   string
+	Key  string
+	Meta *Metadata `json:",omitempty"`
+}
+
+// Index is the embedded secondary index over the metadata sidecars,
+// kept in memory and persisted as an append-only log under Root/_index
+type Index struct {
+	mu      sync.RWMutex
+	s       *Storage // durability of the log
+	path    string
+	logFile *os.File
+	entries int // lines in the log, for compaction
+
+	owners map[string]map[string]*Metadata       // id -> key -> meta
+	tags   map[string]map[string]map[string]bool // id -> "k=v" -> keys
+}
+
+// openIndex load the log into memory, create it if it does not exist
+func openIndex(s *Storage) (*Index, error) {
+	dir := filepath.Join(s.Root, indexDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	idx := &Index{s: s, path: filepath.Join(dir, indexLogName)}
+	idx.reset()
+
+	// replay the log
+	f, err := os.Open(idx.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if f != nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var e indexEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("corrupted index log %s: %w", idx.path, err)
+			}
+			idx.apply(e)
+			idx.entries++
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	idx.logFile, err = os.OpenFile(idx.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// close the log, the index keeps serving from memory only
+func (idx *Index) close() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.logFile == nil {
+		return nil
+	}
+	err := idx.logFile.Close()
+	idx.logFile = nil
+	return err
+}
+
+// newMemoryIndex index without persistence, fallback when the log can not be opened
+func newMemoryIndex() *Index {
+	idx := &Index{}
+	idx.reset()
+	return idx
+}
+
+// reset clear the in-memory maps
+func (idx *Index) reset() {
+	idx.owners = make(map[string]map[string]*Metadata)
+	idx.tags = make(map[string]map[string]map[string]bool)
+}
+
+// apply change the in-memory maps only
+func (idx *Index) apply(e indexEntry) {
+	// drop the old tags of the key first
+	if old, ok := idx.owners[e.ID][e.Key]; ok {
+		for k, v := range old.Tags {
+			delete(idx.tags[e.ID][tagTerm(k, v)], e.Key)
+		}
+		delete(idx.owners[e.ID], e.Key)
+	}
+	if e.Op != "put" || e.Meta == nil {
+		return
+	}
+
+	if idx.owners[e.ID] == nil {
+		idx.owners[e.ID] = make(map[string]*Metadata)
+		idx.tags[e.ID] = make(map[string]map[string]bool)
+	}
+	meta := e.Meta.Clone()
+	idx.owners[e.ID][e.Key] = &meta
+	for k, v := range meta.Tags {
+		term := tagTerm(k, v)
+		if idx.tags[e.ID][term] == nil {
+			idx.tags[e.ID][term] = make(map[string]bool)
+		}
+		idx.tags[e.ID][term][e.Key] = true
+	}
+}
+
+// append apply & persist the change
+func (idx *Index) append(e indexEntry) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.apply(e)
+	if idx.logFile == nil {
+		return nil // memory only
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := idx.logFile.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	idx.entries++
+	if idx.s.Durability == DurabilityBatched {
+		if err := idx.s.markUnsynced(idx.path); err != nil {
+			return err
+		}
+	} else if err := idx.logFile.Sync(); err != nil {
+		return err
+	}
+
+	// log grows much larger than the live set -> compact
+	if idx.entries > 1024 && idx.entries > 2*idx.size() {
+		return idx.compact()
+	}
+	return nil
+}
+
+// put index the metadata of (id, key)
+func (idx *Index) put(id string, meta *Metadata) error {
+	return idx.append(indexEntry{Op: "put", ID: id, Key: meta.Key, Meta: meta})
+}
+
+// remove drop (id, key) from the index
+func (idx *Index) remove(id string, key string) error {
+	return idx.append(indexEntry{Op: "del", ID: id, Key: key})
+}
+
+// size live entries, caller holds the lock
+func (idx *Index) size() int {
+	n := 0
+	for _, keys := range idx.owners {
+		n += len(keys)
+	}
+	return n
+}
+
+// compact rewrite the log with only the live entries, caller holds the lock
+func (idx *Index) compact() error {
+	if idx.logFile == nil {
+		return nil
+	}
+	tmp, err := idx.s.createAtomic(idx.path, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	n := 0
+	for id, keys := range idx.owners {
+		for key, meta := range keys {
+			b, err := json.Marshal(indexEntry{Op: "put", ID: id, Key: key, Meta: meta})
+			if err != nil {
+				tmp.Abort()
+				return err
+			}
+			w.Write(append(b, '\n'))
+			n++
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Abort()
+		return err
+	}
+	idx.logFile.Close()
+	if err := tmp.Commit(); err != nil {
+		// keep appending to the previous log
+		idx.logFile, _ = os.OpenFile(idx.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		return err
+	}
+	idx.logFile, err = os.OpenFile(idx.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	idx.entries = n
+	return err
+}
+
+// candidates keys of the owner that could match, narrowed by the
+// first tag equality condition when there is one
+func (idx *Index) candidates(id string, q Query) []string {
+	var keys []string
+	narrowed := false
+	for _, c := range q {
+		if c.Op == OpEq && strings.HasPrefix(c.Field, tagPrefix) {
+			for key := range idx.tags[id][tagTerm(strings.TrimPrefix(c.Field, tagPrefix), c.Value)] {
+				keys = append(keys, key)
+			}
+			narrowed = true
+			break
+		}
+	}
+	if !narrowed {
+		for key := range idx.owners[id] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// search run the query for one owner, ordered by key, starting after cursor
+func (idx *Index) search(id string, q Query, opts QueryOpts) *QueryResult {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultQueryLimit
+	}
+	res := &QueryResult{}
+	for _, key := range idx.candidates(id, q) {
+		if len(opts.Cursor) > 0 && key <= opts.Cursor {
+			continue
+		}
+		meta := idx.owners[id][key]
+		if !q.Match(meta) {
+			continue
+		}
+		// one more match after the page is full -> there is a next page
+		if len(res.Items) == limit {
+			res.NextCursor = res.Items[limit-1].Key
+			break
+		}
+		res.Items = append(res.Items, meta.Clone())
+	}
+	return res
+}
+
+// Walk visit the metadata sidecar of every object under the root
+func (s *Storage) Walk(fn func(id string, meta *Metadata) error) error {
+	owners, err := os.ReadDir(s.Root)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, owner := range owners {
+		// skip the system directories
+		if !owner.IsDir() || strings.HasPrefix(owner.Name(), "_") {
+			continue
+		}
+		id := owner.Name()
+		err := filepath.WalkDir(filepath.Join(s.Root, id), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !strings.HasSuffix(path, metaSuffix) {
+				return nil
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			meta := new(Metadata)
+			if err := json.Unmarshal(b, meta); err != nil {
+				log.Printf("skip corrupted metadata %s: %s\n", path, err)
+				return nil
+			}
+			return fn(id, meta)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RebuildIndex drop the index and rebuild it from the sidecars on disk
+func (s *Storage) RebuildIndex() (int, error) {
+	idx := s.index
+	idx.mu.Lock()
+	idx.reset()
+	idx.mu.Unlock()
+
+	n := 0
+	err := s.Walk(func(id string, meta *Metadata) error {
+		idx.mu.Lock()
+		idx.apply(indexEntry{Op: "put", ID: id, Key: meta.Key, Meta: meta})
+		idx.mu.Unlock()
+		n++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return n, idx.compact()
+}
+
+// Query search the objects of the owner, e.g.
+// `tag:project=alpha AND size>10MB AND created<2026-01-01`
+func (s *Storage) Query(id string, query string, opts QueryOpts) (*QueryResult, error) {
+	q, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return s.index.search(id, q, opts), nil
+}
+
+// tagTerm inverted index term of a tag
+func tagTerm(k, v string) string {
+	return k + "=" + v
+}
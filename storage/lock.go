@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockFile held by the process serving the root for as long as it runs,
+// tools opening the root meanwhile are refused
+const lockFile = "_lock"
+
+// ErrRootLocked another process serves the storage root
+var ErrRootLocked = errors.New("storage root is locked by a running node")
+
+// lockRoot take the lock of the root, released when the file is closed
+func lockRoot(root string) (*os.File, error) {
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(root, lockFile), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := flock(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", root, err)
+	}
+	// the pid of the holder, for the operator
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+	return f, nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package storage
+
+import "os"
+
+// flock not supported, the root is never seen as locked
+func flock(f *os.File) error {
+	return nil
+}
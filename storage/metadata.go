@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/roylic/go-distributed-file-storage/clock"
+	"os"
+	"time"
+)
+
+// metaSuffix sidecar文件后缀, 与对象文件放在同一目录下
+const metaSuffix = ".meta"
+
+// Metadata is the record kept next to every object, it travels
+// with MessageStoreFile when replicating and is returned by Stat
+type Metadata struct {
+	Key         string // key the object is stored under
+	FileName    string // original filename given by the uploader
+	ContentType string
+	Uploader    string
+	Size        int64
+	Checksum    string // sha256 of the plain content, hex encoded
+	CreatedAt   time.Time
+	ModifiedAt  time.Time
+	Version     int64             // unix nano of the write, newest wins between replicas
+	Tags        map[string]string // user-defined key/value tags
+	Versioned   bool              // every write is kept in the version history
+	VersionID   string            // immutable version of the content, set when versioned
+	Node        string            // node which wrote the content
+	Clock       clock.VClock      // causality of the write, detects concurrent writes
+	CID         string            // root of the Merkle DAG over the content
+}
+
+// Clone deep copy, so tags map is not shared between records
+func (m Metadata) Clone() Metadata {
+	if m.Tags != nil {
+		tags := make(map[string]string, len(m.Tags))
+		for k, v := range m.Tags {
+			tags[k] = v
+		}
+		m.Tags = tags
+	}
+	if m.Clock != nil {
+		m.Clock = m.Clock.Copy()
+	}
+	return m
+}
+
+// metaPath sidecar全路径 (root/id/path/filename.meta)
+func (s *Storage) metaPath(id string, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return fmt.Sprintf("%s/%s/%s%s", s.Root, id, pathKey.FullPath(), metaSuffix)
+}
+
+// Stat return the metadata of the object, objects written before
+// metadata existed get a record built from the file info
+func (s *Storage) Stat(id string, key string) (*Metadata, error) {
+	b, err := os.ReadFile(s.metaPath(id, key))
+	if err == nil {
+		meta := new(Metadata)
+		if err := json.Unmarshal(b, meta); err != nil {
+			return nil, err
+		}
+		return meta, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// no sidecar, fallback to the file itself
+	pathKey := s.PathTransformFunc(key)
+	fi, err := os.Stat(fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath()))
+	if err != nil {
+		return nil, err
+	}
+	return &Metadata{
+		Key:        key,
+		Size:       fi.Size(),
+		CreatedAt:  fi.ModTime(),
+		ModifiedAt: fi.ModTime(),
+	}, nil
+}
+
+// WriteMeta 写入sidecar文件, 对象本身需已存在
+func (s *Storage) WriteMeta(id string, key string, meta *Metadata) error {
+	if !s.Has(id, key) {
+		return fmt.Errorf("object (%s) does not exist for owner (%s)", key, id)
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := s.writeFileAtomic(s.metaPath(id, key), b, 0o644); err != nil {
+		return err
+	}
+	if err := s.index.put(id, meta); err != nil {
+		return err
+	}
+	s.changed(id, key)
+	return nil
+}
+
+// UpdateTags set & remove tags of an existing object, the edit is a write
+// of version with the clock vc, return the updated record
+func (s *Storage) UpdateTags(id string, key string, set map[string]string, remove []string, version int64, vc clock.VClock) (*Metadata, error) {
+	meta, err := s.Stat(id, key)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Tags == nil {
+		meta.Tags = make(map[string]string, len(set))
+	}
+	for k, v := range set {
+		meta.Tags[k] = v
+	}
+	for _, k := range remove {
+		delete(meta.Tags, k)
+	}
+	meta.ModifiedAt = time.Now()
+	meta.Version = version
+	meta.Clock = vc
+	if err := s.WriteMeta(id, key, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
@@ -0,0 +1,314 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// partialDir transfers in progress (root/_partial/id/key.part & .state),
+// the object only gets its final name once complete & verified
+const partialDir = "_partial"
+
+const (
+	DefaultCheckpointBytes = 1 << 20        // written between two checkpoints of a transfer
+	DefaultPartialTTL      = 24 * time.Hour // transfers not resumed are dropped
+)
+
+// ErrChecksumMismatch the content transferred is not the one expected
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// PartialTransfer an object being received, its state is persisted at
+// every checkpoint so a restarted transfer continues from Offset
+type PartialTransfer struct {
+	ID        string
+	Key       string
+	Size      int64  // of the whole object
+	Checksum  string // expected sha256 of the whole object
+	Offset    int64  // bytes synced to disk & hashed
+	HashState []byte // sha256 state at Offset
+	UpdatedAt time.Time
+
+	s        *Storage
+	f        *os.File
+	h        hash.Hash
+	unsynced int64
+}
+
+// partialPath of the content, the state sits next to it
+func (s *Storage) partialPath(id string, key string) string {
+	return filepath.Join(s.Root, partialDir, id, key)
+}
+
+// PartialState the recorded state of the transfer of the object
+func (s *Storage) PartialState(id string, key string) (PartialTransfer, bool) {
+	var p PartialTransfer
+	b, err := os.ReadFile(s.partialPath(id, key) + ".state")
+	if err != nil || json.Unmarshal(b, &p) != nil {
+		return p, false
+	}
+	return p, true
+}
+
+// OpenPartial resume the transfer of the object, from scratch when none is
+// recorded or it was of another content. What was written after the last
+// checkpoint is dropped
+func (s *Storage) OpenPartial(id string, key string, size int64, checksum string) (*PartialTransfer, error) {
+	path := s.partialPath(id, key)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path+".part", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	p := &PartialTransfer{ID: id, Key: key, Size: size, Checksum: checksum, s: s, f: f, h: sha256.New()}
+
+	if prev, ok := s.PartialState(id, key); ok && prev.Size == size && prev.Checksum == checksum {
+		fi, err := f.Stat()
+		if err == nil && fi.Size() >= prev.Offset &&
+			p.h.(encoding.BinaryUnmarshaler).UnmarshalBinary(prev.HashState) == nil {
+			p.Offset, p.HashState, p.UpdatedAt = prev.Offset, prev.HashState, prev.UpdatedAt
+		} else {
+			p.h.Reset()
+		}
+	}
+	if err := f.Truncate(p.Offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(p.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return p, p.Checkpoint()
+}
+
+// Write append the content, checkpointing every DefaultCheckpointBytes
+func (p *PartialTransfer) Write(b []byte) (int, error) {
+	if p.Offset+int64(len(b)) > p.Size {
+		return 0, fmt.Errorf("transfer of (%s) exceeds its size %d", p.Key, p.Size)
+	}
+	n, err := p.f.Write(b)
+	p.h.Write(b[:n])
+	p.Offset += int64(n)
+	p.unsynced += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if p.unsynced >= DefaultCheckpointBytes {
+		return n, p.Checkpoint()
+	}
+	return n, nil
+}
+
+// WriteAt write a piece of the content at its offset, for transfers
+// received out of order, hashed by Rehash once every piece is written
+func (p *PartialTransfer) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(b)) > p.Size {
+		return 0, fmt.Errorf("piece at %d of (%s) exceeds its size %d", off, p.Key, p.Size)
+	}
+	return p.f.WriteAt(b, off)
+}
+
+// ReadAt read back the content written
+func (p *PartialTransfer) ReadAt(b []byte, off int64) (int, error) {
+	return p.f.ReadAt(b, off)
+}
+
+// Rehash hash the whole content from the file, once written with WriteAt
+func (p *PartialTransfer) Rehash() error {
+	p.h.Reset()
+	if _, err := io.Copy(p.h, io.NewSectionReader(p.f, 0, p.Size)); err != nil {
+		return err
+	}
+	p.Offset = p.Size
+	return nil
+}
+
+// Checkpoint sync the content & persist the state at the current offset
+func (p *PartialTransfer) Checkpoint() error {
+	if err := p.f.Sync(); err != nil {
+		return err
+	}
+	state, err := p.h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	p.HashState = state
+	p.UpdatedAt = time.Now()
+	p.unsynced = 0
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return p.s.writeFileAtomic(p.s.partialPath(p.ID, p.Key)+".state", b, 0o644)
+}
+
+// Reset start the transfer over
+func (p *PartialTransfer) Reset() error {
+	if err := p.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := p.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	p.h.Reset()
+	p.Offset = 0
+	return p.Checkpoint()
+}
+
+// Complete every byte was received
+func (p *PartialTransfer) Complete() bool {
+	return p.Offset == p.Size
+}
+
+// Verify the received content against the expected checksum
+func (p *PartialTransfer) Verify() error {
+	if !p.Complete() {
+		return fmt.Errorf("transfer of (%s) incomplete, %d of %d bytes", p.Key, p.Offset, p.Size)
+	}
+	if sum := hex.EncodeToString(p.h.Sum(nil)); sum != p.Checksum {
+		return fmt.Errorf("transfer of (%s): %w, got %s", p.Key, ErrChecksumMismatch, sum)
+	}
+	return nil
+}
+
+// Close checkpoint the transfer, to be resumed later
+func (p *PartialTransfer) Close() error {
+	err := p.Checkpoint()
+	if closeErr := p.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Bytes the whole content received
+func (p *PartialTransfer) Bytes() ([]byte, error) {
+	return os.ReadFile(p.s.partialPath(p.ID, p.Key) + ".part")
+}
+
+// Remove drop the transfer & its state
+func (p *PartialTransfer) Remove() error {
+	p.f.Close()
+	path := p.s.partialPath(p.ID, p.Key)
+	if err := os.Remove(path + ".part"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(path + ".state"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Commit verify the content, then move it under the final name of the
+// object, as a copy fetched from another node with the holder's metadata
+func (p *PartialTransfer) Commit(meta Metadata) error {
+	return p.commit(meta, false)
+}
+
+// CommitWrite same as Commit, as a write of the object like WriteWithMeta
+func (p *PartialTransfer) CommitWrite(meta Metadata) error {
+	return p.commit(meta, true)
+}
+
+func (p *PartialTransfer) commit(meta Metadata, archive bool) error {
+	if err := p.Verify(); err != nil {
+		return err
+	}
+	if p.s.Durability != DurabilityBatched {
+		if err := p.f.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := p.f.Close(); err != nil {
+		return err
+	}
+	pathKey := p.s.PathTransformFunc(p.Key)
+	if err := os.MkdirAll(fmt.Sprintf("%s/%s/%s", p.s.Root, p.ID, pathKey.PathName), os.ModePerm); err != nil {
+		return err
+	}
+	path := p.s.partialPath(p.ID, p.Key)
+	if p.s.Dedup {
+		// chunked from the received file
+		f, err := os.Open(path + ".part")
+		if err != nil {
+			return err
+		}
+		_, err = p.s.writeChunked(p.ID, p.Key, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if err := p.Remove(); err != nil {
+			return err
+		}
+		return p.s.writeMetaFor(p.ID, p.Key, p.Size, p.h, meta, archive)
+	}
+	if err := p.s.dropManifest(p.ID, p.Key); err != nil {
+		return err
+	}
+	if err := p.s.commitRename(path+".part", fmt.Sprintf("%s/%s/%s", p.s.Root, p.ID, pathKey.FullPath())); err != nil {
+		return err
+	}
+	if err := os.Remove(path + ".state"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return p.s.writeMetaFor(p.ID, p.Key, p.Size, p.h, meta, archive)
+}
+
+// Partials every transfer in progress
+func (s *Storage) Partials() ([]PartialTransfer, error) {
+	var partials []PartialTransfer
+	root := filepath.Join(s.Root, partialDir)
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return filepath.SkipDir
+		}
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".state") {
+			return err
+		}
+		rel, err := filepath.Rel(root, strings.TrimSuffix(path, ".state"))
+		if err != nil {
+			return err
+		}
+		id, key := filepath.Split(rel)
+		if p, ok := s.PartialState(filepath.Clean(id), key); ok {
+			partials = append(partials, p)
+		}
+		return nil
+	})
+	return partials, err
+}
+
+// PurgePartials drop the transfers not resumed since the time
+func (s *Storage) PurgePartials(before time.Time) (int, error) {
+	partials, err := s.Partials()
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, p := range partials {
+		if p.UpdatedAt.After(before) {
+			continue
+		}
+		path := s.partialPath(p.ID, p.Key)
+		if err := os.Remove(path + ".part"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return purged, err
+		}
+		if err := os.Remove(path + ".state"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
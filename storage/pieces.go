@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// piecesSuffix hashes of the fixed size pieces of the object, next to it,
+// written with the object so peers download it in verified pieces
+const piecesSuffix = ".pieces"
+
+// DefaultPieceSize bytes of a piece when PieceSize is not set
+const DefaultPieceSize = 256 << 10
+
+// Pieces hashes of the fixed size pieces of an object
+type Pieces struct {
+	Checksum  string // of the whole object the pieces are of
+	Size      int64
+	PieceSize int64
+	Hashes    [][]byte // sha256 of each piece
+}
+
+func (s *Storage) pieceSize() int64 {
+	if s.PieceSize > 0 {
+		return s.PieceSize
+	}
+	return DefaultPieceSize
+}
+
+func (s *Storage) piecesPath(id string, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return fmt.Sprintf("%s/%s/%s%s", s.Root, id, pathKey.FullPath(), piecesSuffix)
+}
+
+// pieceHasher hash the content written piece by piece
+type pieceHasher struct {
+	pieceSize int64
+	h         hash.Hash // of the current piece
+	n         int64     // written to the current piece
+	size      int64
+	hashes    [][]byte
+}
+
+func newPieceHasher(pieceSize int64) *pieceHasher {
+	return &pieceHasher{pieceSize: pieceSize, h: sha256.New()}
+}
+
+func (p *pieceHasher) Write(b []byte) (int, error) {
+	written := len(b)
+	for len(b) > 0 {
+		k := min(int64(len(b)), p.pieceSize-p.n)
+		p.h.Write(b[:k])
+		p.n += k
+		p.size += k
+		b = b[k:]
+		if p.n == p.pieceSize {
+			p.hashes = append(p.hashes, p.h.Sum(nil))
+			p.h.Reset()
+			p.n = 0
+		}
+	}
+	return written, nil
+}
+
+// pieces hashed so far, the last one may be short
+func (p *pieceHasher) pieces() Pieces {
+	hashes := p.hashes[:len(p.hashes):len(p.hashes)]
+	if p.n > 0 {
+		hashes = append(hashes, p.h.Sum(nil))
+	}
+	return Pieces{Size: p.size, PieceSize: p.pieceSize, Hashes: hashes}
+}
+
+// HashPieces hash the content read to its end in pieces of pieceSize
+func HashPieces(r io.Reader, pieceSize int64) (Pieces, error) {
+	p := newPieceHasher(pieceSize)
+	if _, err := io.Copy(p, r); err != nil {
+		return Pieces{}, err
+	}
+	return p.pieces(), nil
+}
+
+// contentHash sha256 of the whole content & of its pieces, both fed by
+// the single pass of the write
+type contentHash struct {
+	hash.Hash
+	pieces *pieceHasher
+}
+
+func (s *Storage) newContentHash() *contentHash {
+	return &contentHash{Hash: sha256.New(), pieces: newPieceHasher(s.pieceSize())}
+}
+
+func (h *contentHash) Write(b []byte) (int, error) {
+	h.pieces.Write(b)
+	return h.Hash.Write(b)
+}
+
+// writePieces persist the piece hashes of the object just written, hashed
+// again from the stored content when the write did not hash its pieces.
+// An object of a single piece needs none
+func (s *Storage) writePieces(id string, key string, checksum string, h hash.Hash) error {
+	ch, ok := h.(*contentHash)
+	if !ok {
+		_, r, err := s.Read(id, key)
+		if err != nil {
+			return err
+		}
+		ch = s.newContentHash()
+		_, err = io.Copy(ch, r)
+		if rc, ok := r.(io.Closer); ok {
+			rc.Close()
+		}
+		if err != nil {
+			return err
+		}
+		if hex.EncodeToString(ch.Sum(nil)) != checksum {
+			return nil // replaced meanwhile, the newer write has its own
+		}
+	}
+	p := ch.pieces.pieces()
+	path := s.piecesPath(id, key)
+	if len(p.Hashes) <= 1 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	p.Checksum = checksum
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return s.writeFileAtomic(path, b, 0o644)
+}
+
+// Pieces the piece hashes of the current content of the object,
+// os.ErrNotExist when none was recorded for it
+func (s *Storage) Pieces(id string, key string) (*Pieces, error) {
+	meta, err := s.Stat(id, key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(s.piecesPath(id, key))
+	if err != nil {
+		return nil, err
+	}
+	p := new(Pieces)
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, err
+	}
+	if p.Checksum != meta.Checksum {
+		return nil, fmt.Errorf("pieces of (%s) out of date: %w", key, os.ErrNotExist)
+	}
+	return p, nil
+}
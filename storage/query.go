@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultQueryLimit = 100
+	tagPrefix         = "tag:"
+)
+
+// Op comparison operator of a condition
+type Op string
+
+const (
+	OpEq     Op = "="
+	OpNe     Op = "!="
+	OpGt     Op = ">"
+	OpGe     Op = ">="
+	OpLt     Op = "<"
+	OpLe     Op = "<="
+	OpExists Op = "" // `tag:name` without operator
+)
+
+// Condition single `field op value` of a query
+type Condition struct {
+	Field string
+	Op    Op
+	Value string
+
+	num  int64     // parsed value of size
+	when time.Time // parsed value of created / modified
+}
+
+// Query conditions joined by AND
+type Query []Condition
+
+// QueryOpts pagination, Cursor is the NextCursor of the previous page
+type QueryOpts struct {
+	Limit  int
+	Cursor string
+}
+
+// QueryResult one page of matched metadata, ordered by key
+type QueryResult struct {
+	Items      []Metadata
+	NextCursor string // empty when there is no more page
+}
+
+var (
+	conditionRegex = regexp.MustCompile(`^([A-Za-z_]+(?::[^=!<>]+)?)\s*(!=|>=|<=|=|>|<)?\s*(.*)$`)
+	sizeRegex      = regexp.MustCompile(`^(\d+)\s*([A-Za-z]*)$`)
+	andRegex       = regexp.MustCompile(`\s+(?i:and)\s+`)
+	sizeUnits      = map[string]int64{
+		"": 1, "B": 1,
+		"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30, "TB": 1 << 40,
+	}
+)
+
+// ParseQuery parse the conditions joined by `AND`, supported fields are
+// tag:<name>, size, created, modified, name, type, uploader & key
+func ParseQuery(s string) (Query, error) {
+	var q Query
+	if len(strings.TrimSpace(s)) == 0 {
+		return q, nil
+	}
+	for _, part := range andRegex.Split(strings.TrimSpace(s), -1) {
+		m := conditionRegex.FindStringSubmatch(strings.TrimSpace(part))
+		if m == nil {
+			return nil, fmt.Errorf("invalid condition (%s)", part)
+		}
+		field := strings.TrimSpace(m[1])
+		c := Condition{Field: strings.ToLower(field), Op: Op(m[2]), Value: strings.TrimSpace(m[3])}
+		if strings.HasPrefix(c.Field, tagPrefix) {
+			// tag name keep the original case
+			c.Field = tagPrefix + field[len(tagPrefix):]
+		}
+		if err := c.parseValue(); err != nil {
+			return nil, err
+		}
+		q = append(q, c)
+	}
+	return q, nil
+}
+
+// parseValue validate the operator & convert the value by field
+func (c *Condition) parseValue() error {
+	if c.Op == OpExists {
+		if !strings.HasPrefix(c.Field, tagPrefix) || len(c.Value) > 0 {
+			return fmt.Errorf("missing operator in condition (%s)", c.Field)
+		}
+		return nil
+	}
+	switch c.Field {
+	case "size":
+		m := sizeRegex.FindStringSubmatch(c.Value)
+		if m == nil {
+			return fmt.Errorf("invalid size (%s)", c.Value)
+		}
+		unit, ok := sizeUnits[strings.ToUpper(m[2])]
+		if !ok {
+			return fmt.Errorf("invalid size unit (%s)", m[2])
+		}
+		n, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		c.num = n * unit
+	case "created", "modified":
+		when, err := parseTime(c.Value)
+		if err != nil {
+			return err
+		}
+		c.when = when
+	case "name", "type", "uploader", "key":
+		if c.Op != OpEq && c.Op != OpNe {
+			return fmt.Errorf("field (%s) only support = and !=", c.Field)
+		}
+	default:
+		if !strings.HasPrefix(c.Field, tagPrefix) {
+			return fmt.Errorf("unknown field (%s)", c.Field)
+		}
+		if c.Op != OpEq && c.Op != OpNe {
+			return fmt.Errorf("tag only support = and !=")
+		}
+	}
+	return nil
+}
+
+// parseTime accept date or RFC3339 time
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time (%s), want YYYY-MM-DD or RFC3339", s)
+	}
+	return t, nil
+}
+
+// Match all the conditions are true for the metadata
+func (q Query) Match(meta *Metadata) bool {
+	for _, c := range q {
+		if !c.match(meta) {
+			return false
+		}
+	}
+	return true
+}
+
+// match single condition
+func (c Condition) match(meta *Metadata) bool {
+	switch c.Field {
+	case "size":
+		return compare(c.Op, cmpInt(meta.Size, c.num))
+	case "created":
+		return compare(c.Op, meta.CreatedAt.Compare(c.when))
+	case "modified":
+		return compare(c.Op, meta.ModifiedAt.Compare(c.when))
+	case "name":
+		return compare(c.Op, strings.Compare(meta.FileName, c.Value))
+	case "type":
+		return compare(c.Op, strings.Compare(meta.ContentType, c.Value))
+	case "uploader":
+		return compare(c.Op, strings.Compare(meta.Uploader, c.Value))
+	case "key":
+		return compare(c.Op, strings.Compare(meta.Key, c.Value))
+	}
+	v, ok := meta.Tags[strings.TrimPrefix(c.Field, tagPrefix)]
+	if c.Op == OpExists {
+		return ok
+	}
+	if !ok {
+		return c.Op == OpNe
+	}
+	return compare(c.Op, strings.Compare(v, c.Value))
+}
+
+// compare apply the operator on the result of a 3-way comparison
+func compare(op Op, r int) bool {
+	switch op {
+	case OpEq:
+		return r == 0
+	case OpNe:
+		return r != 0
+	case OpGt:
+		return r > 0
+	case OpGe:
+		return r >= 0
+	case OpLt:
+		return r < 0
+	case OpLe:
+		return r <= 0
+	}
+	return false
+}
+
+func cmpInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
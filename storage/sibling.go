@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/roylic/go-distributed-file-storage/clock"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// siblingDir concurrent versions kept next to the served one
+// (root/_siblings/id/key/checksum), until a later write resolves them
+const siblingDir = "_siblings"
+
+// siblingPath content of the sibling, the metadata sits next to it
+func (s *Storage) siblingPath(id string, key string, checksum string) string {
+	return filepath.Join(s.Root, siblingDir, id, key, checksum)
+}
+
+// AddSibling keep a concurrent version of the object, identical
+// contents are kept once
+func (s *Storage) AddSibling(id string, key string, r io.Reader, meta Metadata) error {
+	path := s.siblingPath(id, key, meta.Checksum)
+	f, err := s.createAtomic(path, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Abort()
+		return err
+	}
+	if err := f.Commit(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return s.writeFileAtomic(path+metaSuffix, b, 0o644)
+}
+
+// Siblings concurrent versions of the object, newest first
+func (s *Storage) Siblings(id string, key string) ([]Metadata, error) {
+	entries, err := os.ReadDir(filepath.Join(s.Root, siblingDir, id, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var siblings []Metadata
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), metaSuffix) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(s.Root, siblingDir, id, key, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var meta Metadata
+		if err := json.Unmarshal(b, &meta); err != nil {
+			return nil, err
+		}
+		siblings = append(siblings, meta)
+	}
+	sort.Slice(siblings, func(i, j int) bool { return siblings[i].Version > siblings[j].Version })
+	return siblings, nil
+}
+
+// ReadSibling content of the sibling, the caller closes it
+func (s *Storage) ReadSibling(id string, key string, checksum string) (io.ReadCloser, error) {
+	return os.Open(s.siblingPath(id, key, checksum))
+}
+
+// ClearSiblings drop the siblings seen by the clock, return how many left
+func (s *Storage) ClearSiblings(id string, key string, seen clock.VClock) (int, error) {
+	siblings, err := s.Siblings(id, key)
+	if err != nil {
+		return 0, err
+	}
+	left := 0
+	for _, sib := range siblings {
+		if !seen.Descends(sib.Clock) {
+			left++
+			continue
+		}
+		path := s.siblingPath(id, key, sib.Checksum)
+		if err := os.Remove(path + metaSuffix); err != nil {
+			return left, err
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return left, err
+		}
+	}
+	return left, nil
+}
@@ -5,11 +5,15 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/roylic/go-distributed-file-storage/chunker"
 	"github.com/roylic/go-distributed-file-storage/crypto"
+	"hash"
 	"io"
 	"log"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 const DefaultRoot = "../NetworkFiles/"
@@ -60,31 +64,153 @@ type StorageOpt struct {
 	// Root 是保存的根路径
 	Root              string
 	PathTransformFunc PathTransformFunc
+	// Dedup 内容分块存储, 相同的块只保存一次
+	Dedup       bool
+	ChunkConfig chunker.Config
+	// Durability 写入落盘方式, 默认每次写入都fsync
+	Durability Durability
+	// PieceSize 写入时按固定大小分片哈希, 供多节点分片下载, 默认256KiB
+	PieceSize int64
 }
 
 type Storage struct {
 	StorageOpt
+
+	index      *Index // metadata secondary index
+	chunkLock  sync.Mutex
+	cidLock    sync.Mutex // the records of a CID are rewritten whole
+	uploadLock sync.Mutex // parts are committed while their upload exists
+	syncLock   sync.Mutex
+	unsynced   map[string]bool // written but not fsynced yet, batched durability
+	lock       *os.File        // of the root, nil when held by another process
+	watch      func(id string, key string)
 }
 
+// NewStore open the storage under the root, still served when another
+// process holds the root lock
 func NewStore(opts StorageOpt) *Storage {
+	s, _ := openStore(opts, false)
+	return s
+}
+
+// OpenStore same as NewStore, but fails with ErrRootLocked when a running
+// node serves the root
+func OpenStore(opts StorageOpt) (*Storage, error) {
+	return openStore(opts, true)
+}
+
+func openStore(opts StorageOpt, exclusive bool) (*Storage, error) {
 	if nil == opts.PathTransformFunc {
 		opts.PathTransformFunc = DefaultPathTransformFunc
 	}
 	if len(opts.Root) == 0 {
 		opts.Root = DefaultRoot
 	}
-	return &Storage{
+	if len(opts.Durability) == 0 {
+		opts.Durability = DurabilityAlways
+	}
+	lock, err := lockRoot(opts.Root)
+	if err != nil {
+		if exclusive {
+			return nil, err
+		}
+		log.Printf("lock storage root %s failed: %s\n", opts.Root, err)
+	}
+	// writes interrupted by a crash left their temp files behind, unless
+	// another process holds the root & is still writing them
+	if lock != nil {
+		if n, err := sweepTemp(opts.Root); err != nil {
+			log.Printf("sweep temp files under %s failed: %s\n", opts.Root, err)
+		} else if n > 0 {
+			log.Printf("swept %d orphaned temp files under %s\n", n, opts.Root)
+		}
+	}
+	s := &Storage{
 		StorageOpt: opts,
+		lock:       lock,
+	}
+	index, err := openIndex(s)
+	if err != nil {
+		// still serve queries, rebuilt from the sidecars
+		log.Printf("open index under %s failed, rebuilding in memory: %s\n", opts.Root, err)
+		index = newMemoryIndex()
+	}
+	s.index = index
+	// an empty log may be a compaction a crash cut short, the sidecars tell
+	if err != nil || index.entries == 0 {
+		if _, err := s.RebuildIndex(); err != nil {
+			log.Printf("rebuild index under %s failed: %s\n", opts.Root, err)
+		}
+	}
+	return s, nil
+}
+
+// Close flush the pending writes, close the index log & release the root
+func (s *Storage) Close() error {
+	err := errors.Join(s.Flush(), s.index.close())
+	if s.lock != nil {
+		err = errors.Join(err, s.lock.Close())
+		s.lock = nil
+	}
+	return err
+}
+
+// Watch call fn after every write & delete of an object or of its
+// tombstone, set before the storage is used
+func (s *Storage) Watch(fn func(id string, key string)) {
+	s.watch = fn
+}
+
+// changed report the change of the object to the watcher
+func (s *Storage) changed(id string, key string) {
+	if s.watch != nil {
+		s.watch(id, key)
 	}
 }
 
 // Write 添加一个Write允许外部访问
 func (s *Storage) Write(id string, key string, r io.Reader) (int64, error) {
-	return s.writeStream(id, key, r)
+	return s.WriteWithMeta(id, key, r, Metadata{})
 }
 
-// WriteDecrypt encKey:AES-Key, key: fileKey, r: io.Reader
-func (s *Storage) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
+// WriteWithMeta write the object together with its metadata sidecar,
+// Size & Checksum are always computed from the content written
+func (s *Storage) WriteWithMeta(id string, key string, r io.Reader, meta Metadata) (int64, error) {
+	h := s.newContentHash()
+	n, err := s.writeStream(id, key, io.TeeReader(r, h))
+	if err != nil {
+		return n, err
+	}
+	return n, s.writeMetaFor(id, key, n, h, meta, true)
+}
+
+// WriteCopy write a copy of the object fetched from another node in
+// plain, like WriteDecrypt it is not a new version of the object: meta
+// is the holder's, Size & Checksum are computed from the content
+func (s *Storage) WriteCopy(id string, key string, r io.Reader, meta Metadata) (int64, error) {
+	h := s.newContentHash()
+	n, err := s.writeStream(id, key, io.TeeReader(r, h))
+	if err != nil {
+		return n, err
+	}
+	return n, s.writeMetaFor(id, key, n, h, meta, false)
+}
+
+// WriteDecrypt encKey:AES-Key, key: fileKey, r: io.Reader, meta: the holder's metadata
+func (s *Storage) WriteDecrypt(encKey []byte, id string, key string, r io.Reader, meta Metadata) (int64, error) {
+	if s.Dedup {
+		// decrypted on its way to the chunker
+		pr, pw := io.Pipe()
+		decrypted := make(chan int, 1)
+		go func() {
+			n, err := crypto.CopyDecrypt(encKey, r, pw)
+			pw.CloseWithError(err)
+			decrypted <- n
+		}()
+		_, err := s.WriteCopy(id, key, pr, meta)
+		pr.CloseWithError(err) // stops the decryption when the write failed
+		return int64(<-decrypted), err
+	}
 	// 打开文件
 	f, err := s.openFileForWriting(id, key)
 	if err != nil {
@@ -93,12 +219,72 @@ func (s *Storage) WriteDecrypt(encKey []byte, id string, key string, r io.Reader
 	// 写入文件 (连接时由于每次传入的是Stream, 没有EOF, 会导致Blocking)
 	// 可以使用 CopyN 指定拷贝大小 / 使用limitReader
 	// copy with decrypt
-	n, err := crypto.CopyDecrypt(encKey, r, f)
-	return int64(n), err
+	h := s.newContentHash()
+	n, err := crypto.CopyDecrypt(encKey, r, io.MultiWriter(f, h))
+	if err != nil {
+		f.Abort()
+		return int64(n), err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Abort()
+		return int64(n), err
+	}
+	if err := f.Commit(); err != nil {
+		return int64(n), err
+	}
+	// a fetched copy is not a new version of the object
+	return int64(n), s.writeMetaFor(id, key, fi.Size(), h, meta, false)
+}
+
+// writeMetaFor fill the computed fields and persist the sidecar,
+// archiving the content when the object or its namespace is versioned.
+// A copy (archive false) keeps the holder's version & times, it never
+// gets a newer version than the one it was copied from
+func (s *Storage) writeMetaFor(id string, key string, size int64, h hash.Hash, meta Metadata, archive bool) error {
+	now := time.Now()
+	meta = meta.Clone()
+	meta.Key = key
+	meta.Size = size
+	meta.Checksum = hex.EncodeToString(h.Sum(nil))
+	if meta.CreatedAt.IsZero() {
+		meta.CreatedAt = now
+	}
+	if archive || meta.ModifiedAt.IsZero() {
+		meta.ModifiedAt = now
+	}
+	if meta.Version == 0 && archive {
+		meta.Version = now.UnixNano()
+	}
+	if archive && (meta.Versioned || s.Versioning(id)) {
+		meta.Versioned = true
+		if len(meta.VersionID) == 0 {
+			meta.VersionID = VersionIDOf(meta.Version)
+		}
+	} else {
+		meta.Versioned, meta.VersionID = false, ""
+	}
+	// the object is alive again
+	if err := s.clearTombstone(id, key); err != nil {
+		return err
+	}
+	if err := s.WriteMeta(id, key, &meta); err != nil {
+		return err
+	}
+	if err := s.writePieces(id, key, meta.Checksum, h); err != nil {
+		return err
+	}
+	if meta.Versioned {
+		return s.archiveVersion(id, key, &meta)
+	}
+	return nil
 }
 
 // writeStream 从reader写入文件
 func (s *Storage) writeStream(id string, key string, r io.Reader) (int64, error) {
+	if s.Dedup {
+		return s.writeChunked(id, key, r)
+	}
 	// 打开文件
 	f, err := s.openFileForWriting(id, key)
 	if err != nil {
@@ -106,35 +292,76 @@ func (s *Storage) writeStream(id string, key string, r io.Reader) (int64, error)
 	}
 	// 写入文件 (连接时由于每次传入的是Stream, 没有EOF, 会导致Blocking)
 	// 可以使用 CopyN 指定拷贝大小 / 使用limitReader
-	return io.Copy(f, r)
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Abort()
+		return n, err
+	}
+	return n, f.Commit()
 }
 
-// openFileForWriting 打开文件 (附带路径转换)
-func (s *Storage) openFileForWriting(id string, key string) (*os.File, error) {
+// openFileForWriting 打开文件 (附带路径转换), 写入临时文件, Commit后原子替换
+func (s *Storage) openFileForWriting(id string, key string) (*atomicFile, error) {
 	// 转换路径 + 创建路径 (path = root/id/path)
 	pathKey := s.PathTransformFunc(key)
 	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName)
 	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
 		return nil, err
 	}
+	// a deduplicated object is replaced by the plain file
+	if err := s.dropManifest(id, key); err != nil {
+		return nil, err
+	}
 	// 创建文件 (由于pkg是在storage, 创建的也会在此之下)
 	fullPathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
-	return os.Create(fullPathNameWithRoot)
+	return s.createAtomic(fullPathNameWithRoot, 0o644)
 }
 
+// ErrInvalidRange the range starts beyond the end of the object
+var ErrInvalidRange = errors.New("invalid range")
+
 // Read 从文件读取
 func (s *Storage) Read(id string, key string) (int64, io.Reader, error) {
 	// 不需要额外buffer, 直接返回文件流 (disk->network)
 	return s.readStream(id, key)
 }
 
+// ReadRange 读取文件的一段, length <= 0 读到结尾, 返回实际的长度
+func (s *Storage) ReadRange(id string, key string, offset int64, length int64) (int64, io.ReadCloser, error) {
+	size, rc, err := s.readStream(id, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	if offset < 0 || offset > size {
+		rc.Close()
+		return 0, nil, fmt.Errorf("%w: offset %d of (%s) sized %d", ErrInvalidRange, offset, key, size)
+	}
+	if length <= 0 || offset+length > size {
+		length = size - offset
+	}
+	if _, err := rc.(io.Seeker).Seek(offset, io.SeekStart); err != nil {
+		rc.Close()
+		return 0, nil, err
+	}
+	return length, struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rc, length), rc}, nil
+}
+
 // readStream 读取字节流, 注意返回的应该使用ReadCloser可以关闭
 func (s *Storage) readStream(id string, key string) (int64, io.ReadCloser, error) {
 	// 转换路径
 	pathKey := s.PathTransformFunc(key)
 	fullPathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
-	// 打开文件
+	// 打开文件, 分块存储的对象通过manifest读取
 	fio, err := os.Open(fullPathNameWithRoot)
+	if errors.Is(err, os.ErrNotExist) {
+		if m, mErr := s.Manifest(id, key); mErr == nil {
+			r := s.newChunkReader(m)
+			return r.size, r, nil
+		}
+	}
 	if err != nil {
 		return 0, nil, err
 	}
@@ -146,11 +373,14 @@ func (s *Storage) readStream(id string, key string) (int64, io.ReadCloser, error
 	return fi.Size(), fio, nil
 }
 
-// Has 判断是否存在
+// Has 判断是否存在, 文件本身或分块的manifest (目录中可能只有未完成的临时文件)
 func (s *Storage) Has(id string, key string) bool {
 	pathKey := s.PathTransformFunc(key)
-	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName)
-	_, err := os.Stat(pathNameWithRoot)
+	fullPathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+	if _, err := os.Stat(fullPathNameWithRoot); !errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	_, err := os.Stat(s.manifestPath(id, key))
 	return !errors.Is(err, os.ErrNotExist)
 }
 
@@ -161,6 +391,16 @@ func (s *Storage) Delete(id string, key string) error {
 	defer func() {
 		log.Printf("deleted [%s] from disk\n", pathKey.FileName)
 	}()
+	if err := s.dropManifest(id, key); err != nil {
+		return err
+	}
 	// TODO 暂时不做递归删除无用文件夹, 避免hash碰撞导致删除另外文件
-	return os.RemoveAll(pathNameWithRoot)
+	if err := os.RemoveAll(pathNameWithRoot); err != nil {
+		return err
+	}
+	if err := s.index.remove(id, key); err != nil {
+		return err
+	}
+	s.changed(id, key)
+	return nil
 }
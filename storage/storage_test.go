@@ -2,10 +2,19 @@ package storage
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/roylic/go-distributed-file-storage/clock"
 	"github.com/roylic/go-distributed-file-storage/crypto"
+	"github.com/roylic/go-distributed-file-storage/dag"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestPathTransformFunc(t *testing.T) {
@@ -65,3 +74,655 @@ func storeFile(key string, t *testing.T) (*Storage, string, []byte) {
 	}
 	return store, id, data
 }
+
+func TestStorage_StatAndTags(t *testing.T) {
+	key := "SydneyHoliday"
+	store := NewStore(StorageOpt{PathTransformFunc: CASPathTransformFunc})
+	id := crypto.GenerateID()
+	data := []byte("some jpg file byes")
+	meta := Metadata{
+		FileName:    "holiday.jpg",
+		ContentType: "image/jpeg",
+		Tags:        map[string]string{"trip": "sydney"},
+	}
+	if _, err := store.WriteWithMeta(id, key, bytes.NewReader(data), meta); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Delete(id, key)
+
+	// computed fields & user fields
+	got, err := store.Stat(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if got.Size != int64(len(data)) || got.Checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("Want size %d checksum %x but got %d %s", len(data), sum, got.Size, got.Checksum)
+	}
+	if got.FileName != "holiday.jpg" || got.Tags["trip"] != "sydney" || got.CreatedAt.IsZero() {
+		t.Errorf("Unexpected metadata %+v", got)
+	}
+
+	// editing tags later
+	vc := clock.VClock{"a": got.Version + 1}
+	if _, err := store.UpdateTags(id, key, map[string]string{"year": "2025"}, []string{"trip"}, got.Version+1, vc); err != nil {
+		t.Fatal(err)
+	}
+	edited, _ := store.Stat(id, key)
+	if _, ok := edited.Tags["trip"]; ok || edited.Tags["year"] != "2025" {
+		t.Errorf("Unexpected tags %+v", edited.Tags)
+	}
+	if edited.Version != got.Version+1 || edited.Clock.Compare(vc) != clock.Equal {
+		t.Errorf("Want version %d clock %v but got %d %v", got.Version+1, vc, edited.Version, edited.Clock)
+	}
+}
+
+func TestStorage_Query(t *testing.T) {
+	root := t.TempDir()
+	store := NewStore(StorageOpt{Root: root, PathTransformFunc: CASPathTransformFunc})
+	id := crypto.GenerateID()
+
+	write := func(key string, size int, tags map[string]string) {
+		data := bytes.Repeat([]byte("x"), size)
+		if _, err := store.WriteWithMeta(id, key, bytes.NewReader(data), Metadata{Tags: tags}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a", 2<<10, map[string]string{"project": "alpha"})
+	write("b", 20<<10, map[string]string{"project": "alpha"})
+	write("c", 30<<10, map[string]string{"project": "alpha"})
+	write("d", 40<<10, map[string]string{"project": "beta"})
+
+	keysOf := func(res *QueryResult) []string {
+		var keys []string
+		for _, m := range res.Items {
+			keys = append(keys, m.Key)
+		}
+		return keys
+	}
+
+	// tag + size + created, with pagination
+	query := "tag:project=alpha AND size>10KB AND created<2100-01-01"
+	res, err := store.Query(id, query, QueryOpts{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(keysOf(res)) != "[b]" || res.NextCursor != "b" {
+		t.Errorf("Unexpected first page %v cursor %s", keysOf(res), res.NextCursor)
+	}
+	res, _ = store.Query(id, query, QueryOpts{Limit: 1, Cursor: res.NextCursor})
+	if fmt.Sprint(keysOf(res)) != "[c]" || len(res.NextCursor) != 0 {
+		t.Errorf("Unexpected second page %v cursor %s", keysOf(res), res.NextCursor)
+	}
+
+	// consistent with delete
+	if err := store.Delete(id, "c"); err != nil {
+		t.Fatal(err)
+	}
+	res, _ = store.Query(id, "tag:project=alpha", QueryOpts{})
+	if fmt.Sprint(keysOf(res)) != "[a b]" {
+		t.Errorf("Unexpected result after delete %v", keysOf(res))
+	}
+
+	// persisted & rebuildable from disk
+	reopened := NewStore(StorageOpt{Root: root, PathTransformFunc: CASPathTransformFunc})
+	res, _ = reopened.Query(id, "size>=20KB", QueryOpts{})
+	if fmt.Sprint(keysOf(res)) != "[b d]" {
+		t.Errorf("Unexpected result after reopen %v", keysOf(res))
+	}
+	if n, err := reopened.RebuildIndex(); err != nil || n != 3 {
+		t.Errorf("Want 3 objects rebuilt but got %d, err: %v", n, err)
+	}
+
+	// a log a crash left empty is rebuilt from the sidecars
+	if err := os.Truncate(filepath.Join(root, indexDir, indexLogName), 0); err != nil {
+		t.Fatal(err)
+	}
+	emptied := NewStore(StorageOpt{Root: root, PathTransformFunc: CASPathTransformFunc})
+	res, _ = emptied.Query(id, "size>=20KB", QueryOpts{})
+	if fmt.Sprint(keysOf(res)) != "[b d]" {
+		t.Errorf("Unexpected result after reopening an empty log %v", keysOf(res))
+	}
+
+	if _, err := ParseQuery("size>10XB"); err == nil {
+		t.Error("Want error for invalid size unit")
+	}
+}
+
+func TestStorage_Versions(t *testing.T) {
+	store := NewStore(StorageOpt{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	id, key := crypto.GenerateID(), "notes.txt"
+	if err := store.SetVersioning(id, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// every write is kept
+	for i, content := range []string{"v1", "v2", "v3"} {
+		meta := Metadata{Version: int64(i + 1)}
+		if _, err := store.WriteWithMeta(id, key, bytes.NewReader([]byte(content)), meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions, err := store.ListVersions(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || versions[0].VersionID != "3" || !versions[0].Latest || versions[1].Latest {
+		t.Fatalf("Unexpected versions %+v", versions)
+	}
+	_, r, err := store.ReadVersion(id, key, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.Close()
+	if string(b) != "v1" {
+		t.Errorf("Want v1 but got %s", b)
+	}
+
+	// restoring makes a new version
+	meta, err := store.RestoreVersion(id, key, "1", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.VersionID != "4" {
+		t.Errorf("Want version 4 but got %s", meta.VersionID)
+	}
+
+	// deleting the current version serves the previous one
+	if err := store.DeleteVersion(id, key, "4"); err != nil {
+		t.Fatal(err)
+	}
+	_, cur, _ := store.Read(id, key)
+	b, _ = io.ReadAll(cur)
+	cur.(io.Closer).Close()
+	if string(b) != "v3" {
+		t.Errorf("Want v3 but got %s", b)
+	}
+	if _, _, err := store.ReadVersion(id, key, "4"); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("Want ErrVersionNotFound but got %v", err)
+	}
+
+	// the last version gone, the object goes too
+	for _, v := range []string{"1", "2", "3"} {
+		if err := store.DeleteVersion(id, key, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if store.Has(id, key) {
+		t.Errorf("Object still exists after deleting every version")
+	}
+}
+
+func TestStorage_Partial(t *testing.T) {
+	store := NewStore(StorageOpt{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	id, key := crypto.GenerateID(), "big.bin"
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+
+	// interrupted after the first half
+	p, err := store.OpenPartial(id, key, int64(len(data)), checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Write(data[:500]); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// not synced past the checkpoint, dropped when resuming
+	p, _ = store.OpenPartial(id, key, int64(len(data)), checksum)
+	p.Write(data[500:600])
+	p.f.Close()
+	if store.Has(id, key) {
+		t.Fatal("Partial object under its final name")
+	}
+	if partials, _ := store.Partials(); len(partials) != 1 || partials[0].Offset != 500 {
+		t.Fatalf("Unexpected partials %+v", partials)
+	}
+
+	// resumed from the last checkpoint
+	p, err = store.OpenPartial(id, key, int64(len(data)), checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Offset != 500 {
+		t.Fatalf("Want to resume at 500 but got %d", p.Offset)
+	}
+	p.Write(data[500:])
+	if err := p.Commit(Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	_, r, err := store.Read(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	if !bytes.Equal(b, data) {
+		t.Error("Committed content differs")
+	}
+	if meta, err := store.Stat(id, key); err != nil || meta.Checksum != checksum {
+		t.Errorf("Unexpected metadata %+v %v", meta, err)
+	}
+	if partials, _ := store.Partials(); len(partials) != 0 {
+		t.Errorf("Transfer state left %+v", partials)
+	}
+
+	// another content does not match the checksum
+	p, _ = store.OpenPartial(id, "other", int64(len(data)), checksum)
+	p.Write(bytes.Repeat([]byte("x"), len(data)))
+	if err := p.Commit(Metadata{}); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Want checksum mismatch but got %v", err)
+	}
+	p.Remove()
+
+	// written out of order, hashed once complete
+	p, _ = store.OpenPartial(id, "pieces", int64(len(data)), checksum)
+	for _, off := range []int{600, 0, 900, 300} {
+		if _, err := p.WriteAt(data[off:min(off+300, len(data))], int64(off)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := p.WriteAt(data, 1); err == nil {
+		t.Error("Want an error writing past the size")
+	}
+	if err := p.Rehash(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Commit(Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// committed as a write, versioned like WriteWithMeta
+	store.SetVersioning(id, true)
+	p, _ = store.OpenPartial(id, "written", int64(len(data)), checksum)
+	p.Write(data)
+	if err := p.CommitWrite(Metadata{Version: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := store.Stat(id, "written"); err != nil || !meta.Versioned || meta.ModifiedAt.IsZero() {
+		t.Errorf("Unexpected metadata %+v %v", meta, err)
+	}
+}
+
+// TestStorage_Pieces 写入时记录分片哈希, 内容改变后随之更新
+func TestStorage_Pieces(t *testing.T) {
+	store := NewStore(StorageOpt{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc, PieceSize: 100})
+	id := crypto.GenerateID()
+	data := bytes.Repeat([]byte("0123456789"), 25)
+	if _, err := store.Write(id, "big", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	p, err := store.Pieces(id, "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := HashPieces(bytes.NewReader(data), 100)
+	if p.Size != 250 || p.PieceSize != 100 || len(p.Hashes) != 3 {
+		t.Fatalf("pieces %+v", p)
+	}
+	for i := range want.Hashes {
+		if !bytes.Equal(p.Hashes[i], want.Hashes[i]) {
+			t.Errorf("piece %d hashed %x, want %x", i, p.Hashes[i], want.Hashes[i])
+		}
+	}
+	// a single piece needs no manifest, the old one is dropped
+	if _, err := store.Write(id, "big", bytes.NewReader(data[:50])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Pieces(id, "big"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("pieces of a single piece object, got %v", err)
+	}
+}
+
+// TestStorage_Uploads 分段上传暂存在索引之外, 过期清理
+func TestStorage_Uploads(t *testing.T) {
+	store := NewStore(StorageOpt{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	now := time.Now()
+	if _, err := store.WriteUploadPart("u1", 1, strings.NewReader("early")); !errors.Is(err, ErrUploadNotFound) {
+		t.Fatalf("part before the upload, got %v", err)
+	}
+	if err := store.CreateUpload(Upload{ID: "u1", Expires: now.Add(time.Hour), Info: []byte("info")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateUpload(Upload{ID: "u2", Expires: now.Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateUpload(Upload{ID: "../escape"}); err == nil {
+		t.Fatal("upload ID out of the staging area accepted")
+	}
+	if _, err := store.WriteUploadPart("u1", 1, strings.NewReader("first")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.WriteUploadPart("u1", 1, strings.NewReader("replaced")); err != nil {
+		t.Fatal(err)
+	}
+	r, err := store.ReadUploadPart("u1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.Close()
+	if string(b) != "replaced" {
+		t.Errorf("part %q, want %q", b, "replaced")
+	}
+	// staged out of the index
+	objects := 0
+	store.Walk(func(id string, meta *Metadata) error {
+		objects++
+		return nil
+	})
+	if objects != 0 {
+		t.Errorf("%d staged objects walked", objects)
+	}
+
+	if n, err := store.PurgeUploads(now); err != nil || n != 1 {
+		t.Fatalf("purged %d (%v), want the expired one", n, err)
+	}
+	uploads, _ := store.Uploads()
+	if len(uploads) != 1 || uploads[0].ID != "u1" || string(uploads[0].Info) != "info" {
+		t.Fatalf("uploads left %+v", uploads)
+	}
+	if err := store.DropUpload("u1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ReadUploadPart("u1", 1); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("part of a dropped upload, got %v", err)
+	}
+}
+
+func TestStorage_ReadRange(t *testing.T) {
+	store := NewStore(StorageOpt{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	id, key := crypto.GenerateID(), "range.bin"
+	data := []byte("0123456789abcdefghij")
+	if _, err := store.Write(id, key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, 5, "01234"},
+		{10, 6, "abcdef"},
+		{15, 0, "fghij"},
+		{18, 10, "ij"},
+		{20, 0, ""},
+	} {
+		n, r, err := store.ReadRange(id, key, c.offset, c.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		r.Close()
+		if string(b) != c.want || n != int64(len(c.want)) {
+			t.Errorf("range %d+%d: want %q got %q (%d)", c.offset, c.length, c.want, b, n)
+		}
+	}
+	if _, _, err := store.ReadRange(id, key, 21, 1); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("want ErrInvalidRange, got %v", err)
+	}
+}
+
+func TestStorage_Dedup(t *testing.T) {
+	store := NewStore(StorageOpt{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc, Dedup: true})
+	id := crypto.GenerateID()
+	data := make([]byte, 512<<10)
+	for i := range data {
+		data[i] = byte(i*31 + i/7)
+	}
+	for i := 0; i < len(data); i += 4096 {
+		copy(data[i:], []byte(fmt.Sprintf("block %d", i)))
+	}
+	if _, err := store.Write(id, "a", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	chunks, size, err := store.ChunkUsage()
+	if err != nil || chunks < 2 {
+		t.Fatalf("want several chunks, got %d (%v)", chunks, err)
+	}
+	// identical content under another key takes no space
+	if _, err := store.Write(id, "b", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if n, sz, _ := store.ChunkUsage(); n != chunks || sz != size {
+		t.Errorf("duplicate stored again: %d chunks (%d bytes), want %d (%d)", n, sz, chunks, size)
+	}
+	// a small edit adds a few chunks only
+	edited := append([]byte("prefix"), data...)
+	if _, err := store.Write(id, "c", bytes.NewReader(edited)); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, _ := store.ChunkUsage(); n > chunks+3 {
+		t.Errorf("edit added %d chunks", n-chunks)
+	}
+
+	// read whole & ranged through the manifest
+	_, r, err := store.Read(id, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	if !bytes.Equal(b, edited) {
+		t.Error("chunked read differs")
+	}
+	_, rc, err := store.ReadRange(id, "b", 100000, 50000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = io.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(b, data[100000:150000]) {
+		t.Error("chunked range differs")
+	}
+	if meta, err := store.Stat(id, "a"); err != nil || meta.Size != int64(len(data)) {
+		t.Errorf("stat of chunked object: %+v %v", meta, err)
+	}
+
+	// chunks go with the last manifest listing them, once purged
+	for _, key := range []string{"a", "c"} {
+		if err := store.Delete(id, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.PurgeBlocks(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, _ := store.ChunkUsage(); n != chunks {
+		t.Errorf("chunks of b dropped: %d left, want %d", n, chunks)
+	}
+	// replaced by a plain copy, the chunks written within the grace stay
+	store.Dedup = false
+	if _, err := store.Write(id, "b", bytes.NewReader([]byte("plain"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.PurgeBlocks(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, _ := store.ChunkUsage(); n != chunks {
+		t.Errorf("chunks dropped within the grace: %d left, want %d", n, chunks)
+	}
+	if _, err := store.PurgeBlocks(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, _ := store.ChunkUsage(); n != 0 {
+		t.Errorf("%d chunks left without reference", n)
+	}
+}
+
+func TestStorage_CID(t *testing.T) {
+	store := NewStore(StorageOpt{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	id := crypto.GenerateID()
+	root, nodes := dag.Build([][]byte{[]byte("first chunk"), []byte("second chunk")}, 0)
+	for c, block := range nodes {
+		if err := store.PutBlock(c, block); err != nil {
+			t.Fatal(err)
+		}
+		b, err := store.GetBlock(c)
+		if err != nil || !bytes.Equal(b, block) {
+			t.Errorf("block %s: %v", c, err)
+		}
+	}
+	if err := store.PutBlock(root, []byte("tampered")); !errors.Is(err, dag.ErrHashMismatch) {
+		t.Errorf("want ErrHashMismatch, got %v", err)
+	}
+	if _, err := store.GetBlock(dag.NewCID(dag.CodecRaw, []byte("missing"))); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("want ErrBlockNotFound, got %v", err)
+	}
+
+	// the CID points to the objects holding the content
+	if _, err := store.WriteWithMeta(id, "a", bytes.NewReader([]byte("first chunksecond chunk")), Metadata{CID: root.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddCID(root, id, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if gotID, key, ok := store.LookupCID(root); !ok || gotID != id || key != "a" {
+		t.Errorf("lookup %s: %s/%s %t", root, gotID, key, ok)
+	}
+	// overwritten with other content
+	if _, err := store.Write(id, "a", bytes.NewReader([]byte("other"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := store.LookupCID(root); ok {
+		t.Error("lookup found an overwritten object")
+	}
+
+	// no object links to the DAG anymore
+	if n, err := store.PurgeBlocks(time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Errorf("purged %d recent blocks: %v", n, err)
+	}
+	other, otherNodes := dag.Build([][]byte{[]byte("kept"), []byte("content")}, 0)
+	for c, block := range otherNodes {
+		store.PutBlock(c, block)
+	}
+	store.WriteWithMeta(id, "b", bytes.NewReader([]byte("keptcontent")), Metadata{CID: other.String()})
+	store.AddCID(other, id, "b")
+	if n, err := store.PurgeBlocks(time.Now().Add(time.Second)); err != nil || n != len(nodes) {
+		t.Errorf("purged %d blocks, want %d: %v", n, len(nodes), err)
+	}
+	if _, err := store.GetBlock(root); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("want ErrBlockNotFound, got %v", err)
+	}
+	if _, err := store.GetBlock(other); err != nil {
+		t.Errorf("block of a held object purged: %v", err)
+	}
+	if _, err := os.Stat(store.cidPath(root)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("CID record left: %v", err)
+	}
+	if _, _, ok := store.LookupCID(other); !ok {
+		t.Error("CID record of a held object purged")
+	}
+}
+
+// failingReader fails after the first bytes, like a dropped transfer
+type failingReader struct{ n int }
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := min(len(p), r.n)
+	r.n -= n
+	return n, nil
+}
+
+func TestStorage_AtomicWrite(t *testing.T) {
+	root := t.TempDir()
+	store := NewStore(StorageOpt{Root: root, PathTransformFunc: CASPathTransformFunc})
+	id, key := crypto.GenerateID(), "atomic.txt"
+	if _, err := store.Write(id, key, bytes.NewReader([]byte("complete"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed write leaves the previous content & no temp file
+	if _, err := store.Write(id, key, &failingReader{n: 3}); err == nil {
+		t.Fatal("failed write reported success")
+	}
+	_, r, err := store.Read(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	if string(b) != "complete" {
+		t.Errorf("content after a failed write: %q", b)
+	}
+
+	// a crash before the rename leaves a temp file only, not an object
+	other := "crashed.txt"
+	dir := filepath.Join(root, id, CASPathTransformFunc(other).PathName)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	orphan := filepath.Join(dir, CASPathTransformFunc(other).FileName+tmpMarker+"-123")
+	if err := os.WriteFile(orphan, []byte("trunc"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if store.Has(id, other) {
+		t.Error("temp file reported as an object")
+	}
+
+	// the writes in progress of the node holding the root are not swept
+	second := NewStore(StorageOpt{Root: root, PathTransformFunc: CASPathTransformFunc})
+	if _, err := os.Stat(orphan); err != nil {
+		t.Errorf("temp file of the running node swept: %v", err)
+	}
+	second.Close()
+
+	// swept on startup, the objects stay
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store = NewStore(StorageOpt{Root: root, PathTransformFunc: CASPathTransformFunc})
+	defer store.Close()
+	if _, err := os.Stat(orphan); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("orphaned temp file not swept: %v", err)
+	}
+	if !store.Has(id, key) {
+		t.Error("object lost by the sweep")
+	}
+}
+
+func TestStorage_BatchedDurability(t *testing.T) {
+	store := NewStore(StorageOpt{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc, Durability: DurabilityBatched})
+	id := crypto.GenerateID()
+	for i := 0; i < 3; i++ {
+		if _, err := store.Write(id, fmt.Sprintf("batched-%d", i), bytes.NewReader([]byte("data"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(store.unsynced) == 0 {
+		t.Fatal("batched writes synced at once")
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.unsynced) != 0 {
+		t.Errorf("%d paths left after the flush", len(store.unsynced))
+	}
+	if !store.Has(id, "batched-0") {
+		t.Error("batched write not visible")
+	}
+}
+
+func TestStorage_Lock(t *testing.T) {
+	root := t.TempDir()
+	store := NewStore(StorageOpt{Root: root, PathTransformFunc: CASPathTransformFunc})
+
+	// a tool opening the root of the running node is refused
+	if _, err := OpenStore(StorageOpt{Root: root}); !errors.Is(err, ErrRootLocked) {
+		t.Fatalf("open of a locked root: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	other, err := OpenStore(StorageOpt{Root: root})
+	if err != nil {
+		t.Fatalf("open after close: %v", err)
+	}
+	other.Close()
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tombstoneDir deleted objects are remembered here (root/_tombstones/id/key),
+// so a replica missing the delete does not bring the object back
+const tombstoneDir = "_tombstones"
+
+// DefaultTombstoneTTL tombstones older than this are purged
+const DefaultTombstoneTTL = 7 * 24 * time.Hour
+
+// tombstonePath 墓碑文件路径, key已经是hash之后的值
+func (s *Storage) tombstonePath(id string, key string) string {
+	return filepath.Join(s.Root, tombstoneDir, id, key)
+}
+
+// Tombstone delete the object and record the version of the deletion,
+// an object newer than the deletion is kept
+func (s *Storage) Tombstone(id string, key string, version int64) error {
+	if old, ok := s.TombstoneOf(id, key); ok && old >= version {
+		return nil
+	}
+	if s.Has(id, key) {
+		meta, err := s.Stat(id, key)
+		if err != nil {
+			return err
+		}
+		if meta.Version > version {
+			return nil
+		}
+		if err := s.Delete(id, key); err != nil {
+			return err
+		}
+	}
+	path := s.tombstonePath(id, key)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	if err := s.writeFileAtomic(path, []byte(strconv.FormatInt(version, 10)), 0o644); err != nil {
+		return err
+	}
+	s.changed(id, key)
+	return nil
+}
+
+// TombstoneOf version of the deletion, false when not deleted
+func (s *Storage) TombstoneOf(id string, key string) (int64, bool) {
+	b, err := os.ReadFile(s.tombstonePath(id, key))
+	if err != nil {
+		return 0, false
+	}
+	version, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return version, true
+}
+
+// clearTombstone the object is written again
+func (s *Storage) clearTombstone(id string, key string) error {
+	err := os.Remove(s.tombstonePath(id, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// WalkTombstones visit every tombstone
+func (s *Storage) WalkTombstones(fn func(id string, key string, version int64) error) error {
+	owners, err := os.ReadDir(filepath.Join(s.Root, tombstoneDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, owner := range owners {
+		keys, err := os.ReadDir(filepath.Join(s.Root, tombstoneDir, owner.Name()))
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			version, ok := s.TombstoneOf(owner.Name(), key.Name())
+			if !ok {
+				continue
+			}
+			if err := fn(owner.Name(), key.Name(), version); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PurgeTombstones drop the tombstones of deletions before the time
+func (s *Storage) PurgeTombstones(before time.Time) (int, error) {
+	n := 0
+	err := s.WalkTombstones(func(id string, key string, version int64) error {
+		if version >= before.UnixNano() {
+			return nil
+		}
+		n++
+		if err := os.Remove(s.tombstonePath(id, key)); err != nil {
+			return err
+		}
+		s.changed(id, key)
+		return nil
+	})
+	return n, err
+}
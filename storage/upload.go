@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uploadDir multipart uploads staged on this node (root/_uploads/uploadID/
+// session & the parts by number), out of the index, never replicated
+const uploadDir = "_uploads"
+
+// ErrUploadNotFound no upload staged under the ID
+var ErrUploadNotFound = errors.New("upload not found")
+
+// Upload a multipart upload staged until completed, aborted or expired
+type Upload struct {
+	ID      string
+	Expires time.Time
+	Info    []byte // of the caller, the session of the upload
+}
+
+func (s *Storage) uploadPath(uploadID string) (string, error) {
+	if len(uploadID) == 0 || strings.ContainsAny(uploadID, `/\`) || strings.HasPrefix(uploadID, ".") {
+		return "", fmt.Errorf("%w: invalid ID %q", ErrUploadNotFound, uploadID)
+	}
+	return filepath.Join(s.Root, uploadDir, uploadID), nil
+}
+
+// CreateUpload stage a new upload, its parts are written once it exists
+func (s *Storage) CreateUpload(u Upload) error {
+	dir, err := s.uploadPath(u.ID)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	s.uploadLock.Lock()
+	defer s.uploadLock.Unlock()
+	return s.writeFileAtomic(filepath.Join(dir, "session"), b, 0o644)
+}
+
+// Upload the staged upload, expired or not
+func (s *Storage) Upload(uploadID string) (*Upload, error) {
+	dir, err := s.uploadPath(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "session"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrUploadNotFound, uploadID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	u := new(Upload)
+	if err := json.Unmarshal(b, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// WriteUploadPart write the part n of the upload, replacing the one sent
+// before. The part is dropped when the upload went away meanwhile
+func (s *Storage) WriteUploadPart(uploadID string, n int, r io.Reader) (int64, error) {
+	dir, err := s.uploadPath(uploadID)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.Upload(uploadID); err != nil {
+		return 0, err
+	}
+	f, err := s.createAtomic(filepath.Join(dir, strconv.Itoa(n)), 0o644)
+	if err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(f, r)
+	if err != nil {
+		f.Abort()
+		return written, err
+	}
+	s.uploadLock.Lock()
+	defer s.uploadLock.Unlock()
+	if _, err := s.Upload(uploadID); err != nil {
+		f.Abort()
+		return written, err
+	}
+	return written, f.Commit()
+}
+
+// ReadUploadPart the part n of the upload
+func (s *Storage) ReadUploadPart(uploadID string, n int) (io.ReadCloser, error) {
+	dir, err := s.uploadPath(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(dir, strconv.Itoa(n)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: part %d of %s", ErrUploadNotFound, n, uploadID)
+	}
+	return f, err
+}
+
+// DropUpload remove the upload & its parts
+func (s *Storage) DropUpload(uploadID string) error {
+	dir, err := s.uploadPath(uploadID)
+	if err != nil {
+		return err
+	}
+	s.uploadLock.Lock()
+	defer s.uploadLock.Unlock()
+	return os.RemoveAll(dir)
+}
+
+// Uploads every upload staged on this node
+func (s *Storage) Uploads() ([]Upload, error) {
+	entries, err := os.ReadDir(filepath.Join(s.Root, uploadDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var uploads []Upload
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if u, err := s.Upload(e.Name()); err == nil {
+			uploads = append(uploads, *u)
+		}
+	}
+	return uploads, nil
+}
+
+// PurgeUploads drop the uploads expired before the time
+func (s *Storage) PurgeUploads(before time.Time) (int, error) {
+	uploads, err := s.Uploads()
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, u := range uploads {
+		if u.Expires.After(before) {
+			continue
+		}
+		if err := s.DropUpload(u.ID); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
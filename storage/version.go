@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// versionDir immutable copies of every version (root/_versions/id/key/versionID)
+	versionDir = "_versions"
+	// versioningDir namespaces with versioning enabled (root/_versioning/id)
+	versioningDir = "_versioning"
+)
+
+// ErrVersionNotFound the version is not in the history
+var ErrVersionNotFound = errors.New("version not found")
+
+// ObjectVersion single entry of the version history
+type ObjectVersion struct {
+	Metadata
+	Latest bool // the version currently served
+}
+
+// SetVersioning enable or disable versioning of the namespace (owner ID),
+// disabling keeps the existing history
+func (s *Storage) SetVersioning(id string, enabled bool) error {
+	path := filepath.Join(s.Root, versioningDir, id)
+	if !enabled {
+		err := os.Remove(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return s.writeFileAtomic(path, nil, 0o644)
+}
+
+// Versioning whether the namespace keeps a version history
+func (s *Storage) Versioning(id string) bool {
+	_, err := os.Stat(filepath.Join(s.Root, versioningDir, id))
+	return err == nil
+}
+
+// versionPath archived content of the version, the metadata sits next to it
+func (s *Storage) versionPath(id string, key string, versionID string) string {
+	return filepath.Join(s.Root, versionDir, id, key, versionID)
+}
+
+// archiveVersion copy the current content into the history, a version
+// already archived is immutable and left untouched
+func (s *Storage) archiveVersion(id string, key string, meta *Metadata) error {
+	path := s.versionPath(id, key, meta.VersionID)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	_, r, err := s.readStream(id, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// content first, the metadata marks the version as complete
+	f, err := s.createAtomic(path, 0o444)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Abort()
+		return err
+	}
+	if err := f.Commit(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return s.writeFileAtomic(path+metaSuffix, b, 0o444)
+}
+
+// ListVersions history of the object, newest first
+func (s *Storage) ListVersions(id string, key string) ([]ObjectVersion, error) {
+	entries, err := os.ReadDir(filepath.Join(s.Root, versionDir, id, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var latest string
+	if s.Has(id, key) {
+		if meta, err := s.Stat(id, key); err == nil {
+			latest = meta.VersionID
+		}
+	}
+	var versions []ObjectVersion
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), metaSuffix) {
+			continue
+		}
+		meta, err := s.statVersion(id, key, strings.TrimSuffix(e.Name(), metaSuffix))
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, ObjectVersion{Metadata: *meta, Latest: meta.VersionID == latest})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version > versions[j].Version })
+	return versions, nil
+}
+
+// statVersion metadata of the archived version
+func (s *Storage) statVersion(id string, key string, versionID string) (*Metadata, error) {
+	b, err := os.ReadFile(s.versionPath(id, key, versionID) + metaSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: (%s) of (%s)", ErrVersionNotFound, versionID, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta := new(Metadata)
+	if err := json.Unmarshal(b, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// ReadVersion content of the archived version, the caller closes it
+func (s *Storage) ReadVersion(id string, key string, versionID string) (*Metadata, io.ReadCloser, error) {
+	meta, err := s.statVersion(id, key, versionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(s.versionPath(id, key, versionID))
+	if err != nil {
+		return nil, nil, err
+	}
+	return meta, f, nil
+}
+
+// RestoreVersion write the archived content again as a new version,
+// version is given by the caller so every replica gets the same one
+func (s *Storage) RestoreVersion(id string, key string, versionID string, version int64) (*Metadata, error) {
+	meta, r, err := s.ReadVersion(id, key, versionID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	restored := meta.Clone()
+	restored.Version = version
+	restored.VersionID = ""
+	restored.Versioned = true
+	if _, err := s.WriteWithMeta(id, key, r, restored); err != nil {
+		return nil, err
+	}
+	return s.Stat(id, key)
+}
+
+// DeleteVersion drop the version from the history, deleting the current
+// version serves the newest remaining one, or deletes the object
+func (s *Storage) DeleteVersion(id string, key string, versionID string) error {
+	deleted, err := s.statVersion(id, key, versionID)
+	if err != nil {
+		return err
+	}
+	path := s.versionPath(id, key, versionID)
+	if err := os.Remove(path + metaSuffix); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if !s.Has(id, key) {
+		return nil
+	}
+	current, err := s.Stat(id, key)
+	if err != nil || current.VersionID != versionID {
+		return err
+	}
+	versions, err := s.ListVersions(id, key)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return s.Tombstone(id, key, max(deleted.Version, current.Version))
+	}
+
+	// the newest remaining version is already archived, no new version
+	prev := versions[0].Metadata
+	r, err := os.Open(s.versionPath(id, key, prev.VersionID))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := s.writeStream(id, key, r); err != nil {
+		return err
+	}
+	return s.WriteMeta(id, key, &prev)
+}
+
+// VersionIDOf the version ID given to the write of the version
+func VersionIDOf(version int64) string {
+	return strconv.FormatInt(version, 10)
+}